@@ -0,0 +1,12 @@
+// The jpegger command line. Everything but starting it lives in the
+// jpegger package.
+package main
+
+import (
+	"github.com/netguy204/jpegger/pkg/jpegger"
+	"os"
+)
+
+func main() {
+	jpegger.Main(os.Args)
+}
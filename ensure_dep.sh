@@ -1,4 +1,11 @@
 #!/bin/bash
 
 go get github.com/coreos/bbolt
-go get github.com/xiam/exif
\ No newline at end of file
+go get github.com/xiam/exif
+go get github.com/fsnotify/fsnotify
+go get github.com/BurntSushi/toml
+go get github.com/mattn/go-sqlite3
+go get github.com/zeebo/xxh3
+go get lukechampine.com/blake3
+go get golang.org/x/sys
+go get golang.org/x/text
\ No newline at end of file
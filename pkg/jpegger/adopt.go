@@ -0,0 +1,154 @@
+package jpegger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var (
+	AdoptCommand = &Command{
+		Name:    "adopt",
+		Args:    "archive_dir",
+		Summary: "record an already organized directory as imported, without moving anything, so imports skip what it holds",
+		Flags:   adoptFlags,
+		Run:     RunAdopt,
+	}
+
+	adoptFlags = NewFlagSet("adopt", "archive_dir")
+)
+
+func init() {
+	// content must be keyed the way the imports that follow key it
+	adoptFlags.StringVar(HashName, "hash", DefaultHash, "how content is keyed: sha256, blake3 or xxh3. use what the imports that follow will")
+	adoptFlags.BoolVar(Prefilter, "prefilter", false, "key content by its size and first and last 64KB, for imports with -prefilter")
+	adoptFlags.StringVar(ExifBackend, "exif", "", "exif backend: libexif (cgo builds only) or native. defaults to libexif when available")
+	adoptFlags.Var(Excludes, "exclude", "skip files matching a glob. repeatable")
+	adoptFlags.Var(Includes, "include", "only adopt files matching a glob. repeatable")
+	adoptFlags.Var(Extensions, "extensions", "comma separated extensions of the files to adopt, replacing the defaults")
+}
+
+// Record a file in root as placed where it is, dated the way an import
+// would date it. Content the database already knows keeps its state and
+// isn't adopted. No run placed it, so undo leaves it be.
+func AdoptFile(db Store, root, rel string, key []byte, algorithm string, readExif ExifReader) (bool, error) {
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	stamp, _, _ := DateFile(path, path, info, DateOptions{ReadExif: readExif, Clock: FlagClock()})
+
+	adopted, err := CommitState(db, path, key, NoFile, CopiedFile)
+	if err != nil || !adopted {
+		return false, err
+	}
+	if algorithm == PrefilterHash {
+		// the file stands in for the first source of its prefilter key
+		err = db.Update(func(tx Tx) error {
+			if lookup(tx, Prefilters, key) != nil {
+				return nil
+			}
+			return tx.Bucket([]byte(Prefilters)).Put(key, []byte(path))
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, RecordExisting(db, rel, key, algorithm, stamp.Time)
+}
+
+func RunAdopt(args []string) error {
+	if len(args) != 1 {
+		return UsageError(adoptFlags, "expected the directory to adopt")
+	}
+	root := args[0]
+	if IsRemote(root) {
+		return UsageError(adoptFlags, "only local directories can be adopted")
+	}
+	if err := CheckHashAlgorithm(*HashName); err != nil {
+		return UsageError(adoptFlags, "%v", err)
+	}
+	readExif, err := SelectExifReader(*ExifBackend)
+	if err != nil {
+		return UsageError(adoptFlags, "invalid exif backend: %v", err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		return err
+	}
+
+	lock, err := LockRun(*Database, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	db, err := OpenStore(*Database, StoreOptions{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = CreateBuckets(db); err != nil {
+		return err
+	}
+	if err = CheckDatabaseAlgorithm(db, *HashName, *Prefilter); err != nil {
+		return err
+	}
+	algorithm := *HashName
+	if *Prefilter {
+		algorithm = PrefilterHash
+	}
+
+	// files adopted before, say by an interrupted adopt, aren't read again
+	recorded := map[string]bool{}
+	err = db.View(func(tx Tx) error {
+		return tx.Bucket([]byte(DestinationPath)).ForEach(func(rel, _ []byte) error {
+			recorded[string(rel)] = true
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	adopted, known, unreadable := 0, 0, 0
+	want := func(rel string) bool {
+		return !recorded[rel] && ValidName(rel)
+	}
+	err = hashTreeEach(root, want, func(string) string { return algorithm }, func(file verifiedFile) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if file.Err != nil {
+			unreadable += 1
+			fmt.Printf("unreadable %s: %v\n", file.RelPath, file.Err)
+			return nil
+		}
+		ok, err := AdoptFile(db, root, file.RelPath, file.Key, algorithm, readExif)
+		if err != nil {
+			return fmt.Errorf("while adopting %s: %v", file.RelPath, err)
+		}
+		if ok {
+			adopted += 1
+		} else {
+			known += 1
+		}
+		return nil
+	})
+
+	fmt.Printf("adopted %d files, %d held content already recorded", adopted, known)
+	if unreadable > 0 {
+		fmt.Printf(", %d couldn't be read", unreadable)
+	}
+	fmt.Println()
+	if err == context.Canceled {
+		return fmt.Errorf("interrupted. adopt again to carry on")
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package jpegger
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+var (
+	ExportCommand = &Command{
+		Name:    "export",
+		Args:    "share_dir",
+		Summary: "hard link the placed files matching a search into a folder for sharing",
+		Flags:   exportFlags,
+		Run:     RunExport,
+	}
+
+	exportFlags = NewFlagSet("export", "share_dir")
+
+	exportQuery  = NewQueryFlags(exportFlags)
+	exportOutput = exportFlags.String("output", "", "the output directory the files were placed in. by default the one the last import placed into")
+	exportDated  = exportFlags.Bool("dated", false, "keep the folders the files are in under the output rather than putting them all in one folder")
+)
+
+// The output directory the last import placed into
+func lastOutput(tx Tx) (string, error) {
+	runs, err := ListRuns(tx)
+	if err != nil {
+		return "", err
+	}
+	if len(runs) == 0 {
+		return "", fmt.Errorf("no imports recorded, give -output")
+	}
+	return runs[len(runs)-1].Output, nil
+}
+
+// Hard link a file placed in the output at rel into share, in one folder
+// or under the same folders. A name taken by another file is numbered.
+// Returns where it was linked, and false if it was already there.
+func ExportFile(output, share, rel string, dated bool) (string, bool, error) {
+	src := OutputPath(output, rel)
+	name := path.Base(rel)
+	dir := share
+	if dated {
+		dir = filepath.Join(share, filepath.FromSlash(path.Dir(rel)))
+	}
+	if err := EnsureDir(dir); err != nil {
+		return "", false, err
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", false, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		dest := filepath.Join(dir, name)
+		err := LinkFile(src, dest)
+		if err == nil {
+			return dest, true, nil
+		}
+		if !os.IsExist(err) {
+			return "", false, err
+		}
+		if info, err := os.Stat(dest); err == nil && os.SameFile(srcInfo, info) {
+			return dest, false, nil
+		}
+		name, _ = CollisionName(CollisionSequence, path.Base(rel), FileStamp{}, attempt)
+	}
+}
+
+func RunExport(args []string) error {
+	if len(args) != 1 {
+		return UsageError(exportFlags, "expected a folder to export into")
+	}
+	share := args[0]
+	q, err := exportQuery.Query()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(*Database); err != nil {
+		return err
+	}
+	db, err := OpenReadOnlyDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	output := *exportOutput
+	var found []string
+	err = db.View(func(tx Tx) error {
+		if output == "" {
+			if output, err = lastOutput(tx); err != nil {
+				return err
+			}
+		}
+		found = Search(tx, q)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if IsRemote(output) {
+		return fmt.Errorf("can't link files out of %s", output)
+	}
+
+	linked, present, failed := 0, 0, 0
+	for _, rel := range found {
+		_, isNew, err := ExportFile(output, share, rel, *exportDated)
+		switch {
+		case err != nil:
+			log.Printf("%s: %v", rel, err)
+			failed += 1
+		case isNew:
+			linked += 1
+		default:
+			present += 1
+		}
+	}
+	fmt.Printf("%d linked into %s, %d already there, %d failed\n", linked, share, present, failed)
+	if failed > 0 {
+		return &ExitStatus{Code: ExitFileErrors, Err: fmt.Errorf("%d files could not be exported", failed)}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package jpegger
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A piece of content as the API describes it
+type CatalogEntry struct {
+	Hash        string     `json:"hash"`
+	State       string     `json:"state"`
+	Algorithm   string     `json:"algorithm"`
+	Date        *time.Time `json:"date,omitempty"`
+	Destination string     `json:"destination,omitempty"`
+	Sources     []string   `json:"sources"`
+	Pair        string     `json:"pair,omitempty"`
+	DuplicateOf string     `json:"duplicate_of,omitempty"`
+	Camera      string     `json:"camera,omitempty"`
+	Position    []float64  `json:"position,omitempty"`
+}
+
+// What the database holds, in counts
+type CatalogStats struct {
+	Content      map[string]int `json:"content"`
+	Sources      int            `json:"sources"`
+	Destinations int            `json:"destinations"`
+	Dated        int            `json:"dated"`
+	Runs         int            `json:"runs"`
+	LastRun      *time.Time     `json:"last_run,omitempty"`
+	Unreadable   int            `json:"unreadable"`
+	Failed       int            `json:"failed"`
+	KeyedBy      map[string]int `json:"keyed_by"`
+}
+
+// Describe a piece of content. sources is from sourcesByKey.
+func NewCatalogEntry(tx Tx, key []byte, sources map[string][]string) CatalogEntry {
+	entry := CatalogEntry{
+		Hash:        hex.EncodeToString(key),
+		State:       StateName(stateOf(tx, key)),
+		Algorithm:   KeyAlgorithm(tx, key),
+		Destination: string(lookup(tx, ContentDestination, key)),
+		Sources:     sources[string(key)],
+	}
+	if taken, ok := ContentDate(tx, key); ok {
+		entry.Date = &taken
+	}
+	if partner := lookup(tx, Pairs, key); partner != nil {
+		entry.Pair = hex.EncodeToString(partner)
+	}
+	if kept := lookup(tx, Duplicates, key); kept != nil {
+		entry.DuplicateOf = hex.EncodeToString(kept)
+	}
+	if shot, ok := ContentShotInfo(tx, key); ok {
+		entry.Camera, entry.Position = shot.Camera, shot.Position
+	}
+	if entry.Sources == nil {
+		entry.Sources = []string{}
+	}
+	sort.Strings(entry.Sources)
+	return entry
+}
+
+// The content taken in a month, as dated where it was taken, oldest first
+func CatalogMonth(tx Tx, month time.Time) []CatalogEntry {
+	entries := []CatalogEntry{}
+	b := tx.Bucket([]byte(ContentDates))
+	if b == nil {
+		return entries
+	}
+	want := month.Format("2006-01")
+	sources := sourcesByKey(tx)
+	b.ForEach(func(key, v []byte) error {
+		taken, err := time.Parse(time.RFC3339, string(v))
+		if err != nil || taken.Format("2006-01") != want {
+			return nil
+		}
+		entries = append(entries, NewCatalogEntry(tx, key, sources))
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Date.Before(*entries[j].Date)
+	})
+	return entries
+}
+
+func LoadCatalogStats(tx Tx) (CatalogStats, error) {
+	stats := CatalogStats{Content: map[string]int{}, KeyedBy: ContentAlgorithms(tx)}
+	if b := tx.Bucket([]byte(ContentHash)); b != nil {
+		b.ForEach(func(k, v []byte) error {
+			stats.Content[StateName(v)] += 1
+			return nil
+		})
+	}
+	counts := []struct {
+		bucket string
+		n      *int
+	}{
+		{SourcePath, &stats.Sources},
+		{DestinationPath, &stats.Destinations},
+		{ContentDates, &stats.Dated},
+		{Quarantined, &stats.Unreadable},
+		{FileErrors, &stats.Failed},
+	}
+	for _, c := range counts {
+		if b := tx.Bucket([]byte(c.bucket)); b != nil {
+			*c.n = b.KeyN()
+		}
+	}
+
+	runs, err := ListRuns(tx)
+	if err != nil {
+		return stats, err
+	}
+	stats.Runs = len(runs)
+	if len(runs) > 0 {
+		stats.LastRun = &runs[len(runs)-1].Started
+	}
+	return stats, nil
+}
+
+// Answer with JSON from a fresh look at the database, or with
+// {"error": ...}. view returns the status and the value to send.
+func (s *statusServer) serveJSON(w http.ResponseWriter, view func(tx Tx) (int, interface{})) {
+	status, body := http.StatusOK, interface{}(nil)
+	err := s.db.View(func(tx Tx) error {
+		status, body = view(tx)
+		return nil
+	})
+	if err != nil {
+		status, body = http.StatusInternalServerError, apiError(err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(body); err != nil {
+		log.Printf("while answering: %v", err)
+	}
+}
+
+func apiError(message string) map[string]string {
+	return map[string]string{"error": message}
+}
+
+// GET /files?month=2019-07
+func (s *statusServer) serveFiles(w http.ResponseWriter, r *http.Request) {
+	month, err := time.Parse("2006-01", r.URL.Query().Get("month"))
+	if err != nil {
+		serveError(w, http.StatusBadRequest, "expected a month like ?month=2019-07")
+		return
+	}
+	s.serveJSON(w, func(tx Tx) (int, interface{}) {
+		return http.StatusOK, CatalogMonth(tx, month)
+	})
+}
+
+// GET /hash/<hash or a prefix of one>
+func (s *statusServer) serveHash(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/hash/"))
+	if prefix == "" {
+		serveError(w, http.StatusBadRequest, "expected a hash like /hash/1a2b3c4d")
+		return
+	}
+	s.serveJSON(w, func(tx Tx) (int, interface{}) {
+		key, err := findKey(tx, prefix)
+		if err != nil {
+			return http.StatusNotFound, apiError(err.Error())
+		}
+		return http.StatusOK, NewCatalogEntry(tx, key, sourcesByKey(tx))
+	})
+}
+
+// GET /stats
+func (s *statusServer) serveStats(w http.ResponseWriter, r *http.Request) {
+	s.serveJSON(w, func(tx Tx) (int, interface{}) {
+		stats, err := LoadCatalogStats(tx)
+		if err != nil {
+			return http.StatusInternalServerError, apiError(err.Error())
+		}
+		return http.StatusOK, stats
+	})
+}
+
+func serveError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError(message))
+}
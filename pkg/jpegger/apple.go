@@ -0,0 +1,138 @@
+package jpegger
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var Apple = importFlags.Bool("apple", false, "the input is an Apple Photos or iCloud Photos export: leave out IMG_E edits of originals that are there, and take dates from Photo Details.csv for photos without EXIF dates")
+
+var (
+	NoAppleDate = fmt.Errorf("no apple date")
+
+	// an edit like IMG_E1234.JPG, saved beside IMG_1234.HEIC
+	appleEdit = regexp.MustCompile(`^(.*_)E(\d+\.[^.]*)$`)
+
+	// originalCreationDate in Photo Details.csv, e.g.
+	// Tuesday September 24,2019 4:10 PM GMT
+	appleDateFormats = []string{
+		"Monday January 2,2006 3:04 PM MST",
+		"Monday January 2, 2006 3:04 PM MST",
+		"Monday January 2,2006 15:04 MST",
+	}
+
+	// Photo Details.csv of each directory read so far, by directory
+	appleDetails   = map[string]map[string]string{}
+	appleDetailsMu sync.Mutex
+)
+
+// The original beside an edit Photos saved as a copy, if the path is one
+// and the original is there
+func AppleEditOriginal(name string) string {
+	dir, base := filepath.Split(name)
+	m := appleEdit.FindStringSubmatch(base)
+	if m == nil {
+		return ""
+	}
+	stem := strings.TrimSuffix(m[1]+m[2], filepath.Ext(m[2]))
+	// the edit of a HEIC is often a JPEG
+	for _, ext := range *Extensions {
+		for _, candidate := range []string{stem + ext, stem + strings.ToUpper(ext)} {
+			info, err := os.Stat(dir + candidate)
+			if err == nil && !info.IsDir() {
+				return dir + candidate
+			}
+		}
+	}
+	return ""
+}
+
+// Read a Photo Details.csv, mapping each file name to when it was taken
+func readAppleDetails(r io.Reader) (map[string]string, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	name, date := -1, -1
+	for i, column := range records[0] {
+		switch strings.Trim(column, " \ufeff") {
+		case "imgName":
+			name = i
+		case "originalCreationDate":
+			date = i
+		}
+	}
+	details := map[string]string{}
+	if name < 0 || date < 0 {
+		return details, nil
+	}
+	for _, record := range records[1:] {
+		if name < len(record) && date < len(record) {
+			details[record[name]] = record[date]
+		}
+	}
+	return details, nil
+}
+
+// The dates in every Photo Details.csv of a directory. An export split in
+// parts has one per part, numbered.
+func appleDirDetails(dir string) (map[string]string, error) {
+	appleDetailsMu.Lock()
+	defer appleDetailsMu.Unlock()
+	if details, ok := appleDetails[dir]; ok {
+		return details, nil
+	}
+
+	// remote inputs have no directory to look in
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	details := map[string]string{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "Photo Details") || !strings.HasSuffix(entry.Name(), ".csv") {
+			continue
+		}
+		name := filepath.Join(dir, entry.Name())
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		read, err := readAppleDetails(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("while reading %s: %v", name, err)
+		}
+		for k, v := range read {
+			details[k] = v
+		}
+	}
+	appleDetails[dir] = details
+	return details, nil
+}
+
+// When the photo was taken according to the Photo Details.csv beside it
+func ReadAppleDate(name string) (time.Time, error) {
+	details, err := appleDirDetails(filepath.Dir(name))
+	if err != nil {
+		return time.Time{}, err
+	}
+	value, ok := details[filepath.Base(name)]
+	if !ok || value == "" {
+		return time.Time{}, NoAppleDate
+	}
+	for _, format := range appleDateFormats {
+		date, err := time.Parse(format, value)
+		if err == nil {
+			return date.In(time.Local), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid originalCreationDate %q for %s", value, name)
+}
@@ -0,0 +1,340 @@
+package jpegger
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ApplyCommand = &Command{
+		Name:    "apply",
+		Args:    "plan.json",
+		Summary: "carry out the plan an import -dry-run -plan wrote, after reviewing it",
+		Flags:   applyFlags,
+		Run:     RunApply,
+	}
+
+	applyFlags = NewFlagSet("apply", "plan.json")
+)
+
+func init() {
+	applyFlags.StringVar(S3Endpoint, "s3-endpoint", *S3Endpoint, "endpoint for plans with s3:// outputs on S3-compatible stores")
+	applyFlags.BoolVar(Wait, "wait", false, "wait for another import or undo of the database to finish rather than stopping")
+}
+
+// Hash a source as the plan did and check that it still holds what was
+// planned, recording its key like an import would
+func applyKey(db Store, entry PlanEntry, algorithm string) ([]byte, error) {
+	planned, err := hex.DecodeString(entry.Hash)
+	if err != nil || len(planned) == 0 {
+		return nil, fmt.Errorf("no hash for %s in the plan", entry.Source)
+	}
+	info, err := os.Stat(entry.Source)
+	if err != nil {
+		return nil, err
+	}
+	key, err := HashFile(entry.Source, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(key, planned) {
+		return nil, fmt.Errorf("%s has changed since the plan was made", entry.Source)
+	}
+	return key, db.Update(func(tx Tx) error {
+		err := putSourceKey(tx, entry.Source, key, FileStat(info))
+		if err != nil {
+			return err
+		}
+		return RecordKeyAlgorithm(tx, key, algorithm)
+	})
+}
+
+func RunApply(args []string) error {
+	if len(args) != 1 {
+		return UsageError(applyFlags, "expected the plan to apply")
+	}
+	plan, err := LoadPlan(args[0])
+	if err != nil {
+		return err
+	}
+	for _, entry := range plan.Entries {
+		if IsRemote(entry.Source) {
+			return fmt.Errorf("%s: plans of remote inputs can't be applied, import them instead", args[0])
+		}
+	}
+	if err = CheckHashAlgorithm(plan.Hash); err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+
+	lock, err := LockRun(*Database, *Wait)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	f, err := OpenLog()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	db, err := OpenStore(*Database, StoreOptions{})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = CreateBuckets(db)
+	if err != nil {
+		return err
+	}
+	err = CheckDatabaseAlgorithm(db, plan.Hash, false)
+	if err != nil {
+		return err
+	}
+
+	output := plan.Output
+	transfer := Transfer
+	if IsRemote(output) {
+		dest, err := OpenDestination(output)
+		if err != nil {
+			return err
+		}
+		transfer = dest.Transfer
+	} else {
+		transfer = NewCaseFolder().Transfer(transfer)
+	}
+	outputRel := func(path string) (string, error) {
+		rel, err := filepath.Rel(output, path)
+		return filepath.ToSlash(rel), err
+	}
+
+	// a plan that moves anything is recorded as a move, so undo won't
+	// delete what may be the only copies
+	runMode := TransferLink
+	for i, entry := range plan.Entries {
+		if mode, err := ParseTransferMode(entry.Action); err == nil && (i == 0 || mode == TransferMove) {
+			runMode = mode
+		}
+		if runMode == TransferMove {
+			break
+		}
+	}
+	run, err := StartRun(db, plan.Inputs, output, runMode)
+	if err != nil {
+		return err
+	}
+	Emit(Event{Event: "run-started", Run: run, Source: args[0], Destination: output})
+
+	report := NewRunReport()
+	reporting = report
+	defer func() { reporting = nil }()
+
+	// the destinations of the main files placed, which their sidecars and
+	// companions follow
+	placed := map[string]bool{}
+
+	// place a main file where the plan says, or record it where the
+	// output already holds it. a taken destination fails the file rather
+	// than being renamed, as the plan is carried out exactly
+	place := func(entry PlanEntry, mode TransferMode, existing bool) error {
+		key, err := applyKey(db, entry, plan.Hash)
+		if err != nil {
+			return err
+		}
+		transitioned, err := CommitState(db, entry.Source, key, NoFile, DiscoveredFile)
+		if err != nil {
+			return &FatalError{"recording file", entry.Source, err}
+		}
+		if !transitioned {
+			Emit(Event{Event: "skipped", Source: entry.Source})
+			return nil
+		}
+		err = applyPlaced(db, run, entry, mode, existing, key, plan.Hash, transfer, outputRel)
+		if err != nil {
+			if rErr := ReleaseClaim(db, key); rErr != nil {
+				return &FatalError{"recording file", entry.Source, rErr}
+			}
+			return err
+		}
+		placed[entry.Destination] = true
+		return nil
+	}
+
+	failures := NewFileFailures(db, ErrorSkip)
+	// the database failing stops the run after the file in hand
+	var stopped error
+	for _, entry := range plan.Entries {
+		entry := entry
+		start := time.Now()
+		if mode, err := ParseTransferMode(entry.Action); err == nil {
+			stopped = failures.Attempt(entry.Source, func() error {
+				if entry.Of != "" && !placed[entry.Of] {
+					return nil
+				}
+				if entry.Of != "" {
+					return applySidecar(db, run, entry, mode, plan.Hash, transfer, outputRel)
+				}
+				return place(entry, mode, false)
+			})
+		} else if entry.Action == PlanExisting {
+			stopped = failures.Attempt(entry.Source, func() error {
+				return place(entry, TransferLink, true)
+			})
+		} else if entry.Action == PlanDuplicate {
+			stopped = failures.Attempt(entry.Source, func() error {
+				key, err := applyKey(db, entry, plan.Hash)
+				if err != nil {
+					return err
+				}
+				preferred, err := hex.DecodeString(entry.OfHash)
+				if err != nil {
+					return fmt.Errorf("no hash for %s in the plan", entry.Of)
+				}
+				recorded, err := RecordDuplicate(db, entry.Source, key, preferred)
+				if err != nil {
+					return &FatalError{"recording file", entry.Source, err}
+				}
+				if recorded {
+					Emit(Event{Event: "duplicate", Source: entry.Source, Partner: entry.Of, Hash: entry.Hash})
+				} else {
+					Emit(Event{Event: "skipped", Source: entry.Source})
+				}
+				return nil
+			})
+		}
+		// the rest change nothing
+		report.Time("placing", start)
+		if stopped != nil {
+			break
+		}
+	}
+
+	failed := failures.Failed()
+	Emit(Event{Event: "summary", Run: run, Message: report.Line(len(failed))})
+	if Verbosity() != VerbosityQuiet {
+		report.Write(os.Stderr, len(failed))
+	}
+	if stopped != nil {
+		Emit(Event{Event: "stopped", Message: stopped.Error()})
+		return stopped
+	}
+	if len(failed) > 0 {
+		SummarizeFailures(os.Stderr, failed)
+		return &ExitStatus{ExitFileErrors, fmt.Errorf("%d files failed to apply", len(failed))}
+	}
+	if report.Handled() == 0 {
+		return &ExitStatus{ExitNothingToDo, nil}
+	}
+	return nil
+}
+
+// Carry out the transfer of a claimed main file and record it as placed,
+// or as found already in the output
+func applyPlaced(db Store, run uint64, entry PlanEntry, mode TransferMode, existing bool, key []byte, algorithm string, transfer func(TransferMode, string, string) error, outputRel func(string) (string, error)) error {
+	var taken time.Time
+	if entry.Date != nil {
+		taken = *entry.Date
+	}
+	relPath, err := outputRel(entry.Destination)
+	if err != nil {
+		return fmt.Errorf("while recording destination of %s: %w", entry.Source, err)
+	}
+
+	if existing {
+		found, err := HashFile(entry.Destination, algorithm)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(found, key) {
+			return fmt.Errorf("%s has changed since the plan was made", entry.Destination)
+		}
+		err = RecordExisting(db, relPath, key, algorithm, taken)
+		if err == nil {
+			_, err = CommitState(db, entry.Source, key, DiscoveredFile, CopiedFile)
+		}
+		if err != nil {
+			return &FatalError{"recording destination of", entry.Source, err}
+		}
+		Emit(Event{Event: "existing", Source: entry.Source, Destination: entry.Destination, Hash: entry.Hash})
+		Emit(Event{Event: "linked", Source: entry.Source, Destination: entry.Destination, Hash: entry.Hash, Date: entry.Date, DateSource: entry.DateSource})
+		return nil
+	}
+
+	if !IsRemote(entry.Destination) {
+		if err = EnsureDir(filepath.Dir(entry.Destination)); err != nil {
+			return fmt.Errorf("while creating directory %s: %w", filepath.Dir(entry.Destination), err)
+		}
+	}
+	if err = transfer(mode, entry.Source, entry.Destination); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s has been taken since the plan was made", entry.Destination)
+		}
+		return fmt.Errorf("while placing %s: %w", entry.Source, err)
+	}
+	if mode == TransferMove {
+		err = VerifyCopy(entry.Source, entry.Destination, key, algorithm, algorithm)
+		if err != nil {
+			os.Remove(entry.Destination)
+			return fmt.Errorf("while moving %s: %w", entry.Source, err)
+		}
+	}
+
+	err = RecordDestination(db, run, relPath, key, algorithm, taken)
+	if err == nil {
+		_, err = CommitState(db, entry.Source, key, DiscoveredFile, CopiedFile)
+	}
+	if err == nil && mode == TransferMove {
+		_, err = MarkVerified(db, key)
+	}
+	if err == nil {
+		err = ReleaseQuarantine(db, entry.Source)
+	}
+	if err != nil {
+		return &FatalError{"recording destination of", entry.Source, err}
+	}
+	Emit(Event{Event: "linked", Source: entry.Source, Destination: entry.Destination, Hash: entry.Hash, Date: entry.Date, DateSource: entry.DateSource})
+
+	if mode == TransferMove {
+		if err = os.Remove(entry.Source); err != nil {
+			return fmt.Errorf("while removing moved file %s: %w", entry.Source, err)
+		}
+		Emit(Event{Event: "source-removed", Source: entry.Source})
+	}
+	return nil
+}
+
+// Place a sidecar or companion beside the file it goes with
+func applySidecar(db Store, run uint64, entry PlanEntry, mode TransferMode, algorithm string, transfer func(TransferMode, string, string) error, outputRel func(string) (string, error)) error {
+	err := transfer(mode, entry.Source, entry.Destination)
+	if os.IsExist(err) {
+		return nil // shared with the other half of a pair
+	}
+	if err != nil {
+		return fmt.Errorf("while placing %s: %w", entry.Source, err)
+	}
+	Emit(Event{Event: "sidecar", Source: entry.Source, Destination: entry.Destination})
+
+	key, err := HashFile(entry.Source, algorithm)
+	if err != nil {
+		return fmt.Errorf("while hashing %s: %w", entry.Source, err)
+	}
+	relPath, err := outputRel(entry.Destination)
+	if err != nil {
+		return fmt.Errorf("while recording destination of %s: %w", entry.Source, err)
+	}
+	mainRel, err := outputRel(entry.Of)
+	if err == nil {
+		err = RecordDestination(db, run, relPath, key, algorithm, time.Time{})
+	}
+	if err == nil {
+		err = RecordCompanion(db, relPath, mainRel)
+	}
+	if err != nil {
+		return &FatalError{"recording destination of", entry.Source, err}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package jpegger
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The burst directory each piece of content placed with -bursts went
+	// in, relative to the output
+	Bursts = "Bursts"
+
+	// Shots of a burst are at most this far apart. EXIF dates are to the
+	// second, so shots a second apart may be much closer.
+	BurstGap = time.Second
+	// Fewer shots than this in quick succession aren't a burst
+	MinBurst = 3
+)
+
+var (
+	GroupBursts = importFlags.Bool("bursts", false, "place bursts, three or more shots from one camera under a second apart with sequential names, in a burst_<time> directory of their own. the whole input is read before anything is placed")
+
+	// the number a camera counts shots with, e.g. 0042 in IMG_0042
+	shotNumber = regexp.MustCompile(`^(.*?)(\d+)$`)
+)
+
+// Split a file's name into its prefix and shot number
+func parseShotNumber(name string) (string, int, bool) {
+	base := filepath.Base(name)
+	m := shotNumber.FindStringSubmatch(strings.TrimSuffix(base, filepath.Ext(base)))
+	if m == nil {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(m[2])
+	if err != nil {
+		return "", 0, false
+	}
+	return strings.ToLower(m[1]), n, true
+}
+
+// Could b be the shot after a in a burst? The halves of a RAW+JPEG pair
+// share a number, so the number may also stay the same.
+func burstNext(a, b FileStamp) bool {
+	if a.Camera == "" || a.Camera != b.Camera || b.Time.Sub(a.Time) > BurstGap {
+		return false
+	}
+	prefixA, numberA, okA := parseShotNumber(a.Path)
+	prefixB, numberB, okB := parseShotNumber(b.Path)
+	return okA && okB && prefixA == prefixB && (numberB == numberA || numberB == numberA+1)
+}
+
+// Find the bursts among files and give each shot in one the name of the
+// burst's directory, after when it started. Returns the files in the order
+// they were taken.
+func FindBursts(stamps []FileStamp) []FileStamp {
+	sort.SliceStable(stamps, func(i, j int) bool {
+		if !stamps[i].Time.Equal(stamps[j].Time) {
+			return stamps[i].Time.Before(stamps[j].Time)
+		}
+		return stamps[i].Path < stamps[j].Path
+	})
+
+	start := 0
+	for i := 1; i <= len(stamps); i++ {
+		if i < len(stamps) && burstNext(stamps[i-1], stamps[i]) {
+			continue
+		}
+		shots := map[int]bool{}
+		for _, stamp := range stamps[start:i] {
+			_, n, _ := parseShotNumber(stamp.Path)
+			shots[n] = true
+		}
+		if len(shots) >= MinBurst {
+			name := "burst_" + stamps[start].Time.Format("20060102-150405")
+			for j := start; j < i; j++ {
+				stamps[j].Burst = name
+			}
+		}
+		start = i
+	}
+	return stamps
+}
+
+// Remember which burst content was placed in
+func RecordBurst(db Store, key []byte, dir string) error {
+	return db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte(Bursts)).Put(key, []byte(dir))
+	})
+}
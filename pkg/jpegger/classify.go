@@ -0,0 +1,122 @@
+package jpegger
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// What kind of file something is, for routing each kind to its own layout
+const (
+	ClassCamera     = "camera"
+	ClassScreenshot = "screenshot"
+	ClassMessenger  = "messenger"
+	ClassOther      = "other"
+)
+
+var (
+	Classes = []string{ClassCamera, ClassScreenshot, ClassMessenger, ClassOther}
+
+	// class=layout pairs, repeatable
+	ClassLayouts = &StringList{}
+
+	// Names and directories screenshots are saved under, on phones and
+	// desktops in a few languages
+	screenshotNames = regexp.MustCompile(`(?i)(^|/)(screenshots?|screen shot|screen recording|bildschirmfoto|capture d.écran|captura de pantalla|schermafbeelding)`)
+	// WhatsApp's IMG-20190714-WA0001.jpg, Telegram Desktop's
+	// photo_2019-07-14_18-30-22.jpg and Signal's signal-2019-07-14-183022.jpg,
+	// and the folders the apps save to
+	messengerNames = regexp.MustCompile(`(?i)(-WA\d{4}|^photo_\d{4}-\d{2}-\d{2}_|^signal-\d{4}-\d{2}-\d{2}|(^|/)(whatsapp|telegram|signal)[^/]*/)`)
+
+	// The short sides of common phone, tablet and desktop screens
+	screenSizes = map[int]bool{
+		640: true, 720: true, 750: true, 768: true, 800: true, 828: true, 900: true, 1050: true, 1080: true,
+		1125: true, 1170: true, 1179: true, 1200: true, 1242: true, 1284: true, 1290: true, 1440: true,
+		1536: true, 1600: true, 1640: true, 1668: true, 1800: true, 2048: true, 2160: true,
+	}
+	// The longest side messengers scale photos down to
+	messengerSizes = map[int]bool{1280: true, 1600: true, 2048: true, 2560: true}
+)
+
+func init() {
+	importFlags.Var(ClassLayouts, "class-layout", "place one kind of file by its own layout, e.g. screenshot=screenshots/%Y/%m. the kinds are camera, screenshot, messenger and other. repeatable")
+}
+
+// Parse a class=layout flag
+func ParseClassLayout(value string) (string, *Layout, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("expected class=layout, got %q", value)
+	}
+	known := false
+	for _, class := range Classes {
+		known = known || class == parts[0]
+	}
+	if !known {
+		return "", nil, fmt.Errorf("unknown class %q, expected one of %s", parts[0], strings.Join(Classes, ", "))
+	}
+	layout, err := ParseLayout(parts[1])
+	return parts[0], layout, err
+}
+
+// The width and height of an image, from its EXIF or failing that its
+// header. Zero if neither says.
+func imageSize(local string, tags map[string]string) (int, int) {
+	width, _ := strconv.Atoi(tags["Pixel X Dimension"])
+	height, _ := strconv.Atoi(tags["Pixel Y Dimension"])
+	if width > 0 && height > 0 {
+		return width, height
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+// Work out what kind of file a stamp is: a screenshot or messenger save by
+// its name or folder, a camera original by its EXIF or container, and
+// otherwise by its format and size. local is where its content is.
+func Classify(stamp FileStamp, local string, tags map[string]string) string {
+	name := filepath.ToSlash(stamp.Path)
+	base := filepath.Base(name)
+	switch {
+	case screenshotNames.MatchString(name):
+		return ClassScreenshot
+	case messengerNames.MatchString(name) || messengerNames.MatchString(base):
+		return ClassMessenger
+	case stamp.Camera != "" || IsRaw(name) || stamp.Source == DateSourceContainer:
+		return ClassCamera
+	}
+
+	// what's left has no camera EXIF
+	if IsQuickTime(name) || !hasExtension(name, []string{".png", ".webp", ".jpg", ".jpeg"}) {
+		return ClassOther
+	}
+	width, height := imageSize(local, tags)
+	short, long := width, height
+	if short > long {
+		short, long = long, short
+	}
+	switch {
+	case hasExtension(name, []string{".png", ".webp"}) && screenSizes[short] && long*10 >= short*13 && long*10 <= short*23:
+		return ClassScreenshot
+	case IsJPEG(name) && messengerSizes[long]:
+		// messengers strip EXIF and scale photos down
+		return ClassMessenger
+	}
+	return ClassOther
+}
@@ -0,0 +1,77 @@
+package jpegger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Corrections for cameras whose clocks were set wrong, by EXIF model.
+	// Set from the camera_offsets table of the config file.
+	CameraOffsets = map[string]time.Duration{}
+
+	// The tag holding the UTC offset for each date tag
+	exifOffsetKeys = map[string]string{
+		"Date and Time (Original)":  "Offset Time Original",
+		"Date and Time (Digitized)": "Offset Time Digitized",
+		"Date and Time":             "Offset Time",
+	}
+)
+
+// Parse an EXIF UTC offset like +02:00
+func parseExifOffset(offset string) (*time.Location, error) {
+	offset = strings.TrimSpace(offset)
+	if len(offset) != 6 || (offset[0] != '+' && offset[0] != '-') || offset[3] != ':' {
+		return nil, fmt.Errorf("invalid offset %q", offset)
+	}
+	hours, err := strconv.Atoi(offset[1:3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid offset %q", offset)
+	}
+	minutes, err := strconv.Atoi(offset[4:6])
+	if err != nil {
+		return nil, fmt.Errorf("invalid offset %q", offset)
+	}
+
+	seconds := hours*3600 + minutes*60
+	if offset[0] == '-' {
+		seconds = -seconds
+	}
+	return time.FixedZone(offset, seconds), nil
+}
+
+// EXIF dates are the time on the camera's clock. Put one in the time zone
+// the camera recorded alongside it, if it did. The clock time, and so the
+// directory it lands in, stays the same.
+func ExifZone(date time.Time, tags map[string]string, key string) time.Time {
+	offset, ok := tags[exifOffsetKeys[key]]
+	if !ok {
+		return date
+	}
+	zone, err := parseExifOffset(offset)
+	if err != nil {
+		return date // cameras write all sorts of things here
+	}
+	return time.Date(date.Year(), date.Month(), date.Day(),
+		date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), zone)
+}
+
+// Corrections for clocks that were set wrong
+type Clock struct {
+	// Added to every date
+	Offset time.Duration
+	// Added to the dates of each camera, by EXIF model
+	Cameras map[string]time.Duration
+}
+
+// The corrections of -time-offset and the config file's camera_offsets
+func FlagClock() Clock {
+	return Clock{*TimeOffset, CameraOffsets}
+}
+
+// Shift a date taken by a camera model by the corrections for it
+func (c Clock) Correct(date time.Time, model string) time.Time {
+	return date.Add(c.Offset + c.Cameras[strings.TrimSpace(model)])
+}
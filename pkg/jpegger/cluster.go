@@ -0,0 +1,95 @@
+package jpegger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Event directories are named for their first day and numbered within the
+// layout directory, e.g. 2019-07-14_event-03
+var eventDirPattern = regexp.MustCompile(`_event-(\d+)$`)
+
+// The highest event number already used in a directory of the output
+func lastEventNumber(dir string) int {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	last := 0
+	for _, file := range files {
+		m := eventDirPattern.FindStringSubmatch(file.Name())
+		if m == nil || !file.IsDir() {
+			continue
+		}
+		if n, err := strconv.Atoi(m[1]); err == nil && n > last {
+			last = n
+		}
+	}
+	return last
+}
+
+// Would an import place this content, or has it been placed before?
+func NewContent(db Store, key []byte) (bool, error) {
+	isNew := true
+	err := db.View(func(tx Tx) error {
+		if b := tx.Bucket([]byte(ContentHash)); b != nil {
+			isNew = b.Get(key) == nil
+		}
+		return nil
+	})
+	return isNew, err
+}
+
+// Group files taken within gap of each other into events and give each one
+// the directory of its event. An event goes in the layout directory of its
+// first file, numbered after any events an earlier import left there.
+// Returns the files in the order they were taken.
+func ClusterEvents(stamps []FileStamp, gap time.Duration, layout *Layout, output string) ([]FileStamp, error) {
+	sort.SliceStable(stamps, func(i, j int) bool {
+		return stamps[i].Time.Before(stamps[j].Time)
+	})
+
+	numbers := map[string]int{}
+	eventDir := ""
+	for i := range stamps {
+		if i == 0 || stamps[i].Time.Sub(stamps[i-1].Time) > gap {
+			dir, err := layout.Path(stamps[i])
+			if err != nil {
+				return nil, fmt.Errorf("while forming path for %s: %v", stamps[i].Path, err)
+			}
+
+			n, seen := numbers[dir]
+			if !seen && !IsRemote(output) {
+				n = lastEventNumber(filepath.Join(output, dir))
+			}
+			n += 1
+			numbers[dir] = n
+			eventDir = fmt.Sprintf("%s/%s_event-%02d", dir, stamps[i].Time.Format("2006-01-02"), n)
+		}
+		stamps[i].EventDir = eventDir
+	}
+	return stamps, nil
+}
+
+// Hold back every file until all have arrived, then pass them on in the
+// order arrange puts them in
+func clusterAll(in <-chan FileStamp, arrange func([]FileStamp) []FileStamp) <-chan FileStamp {
+	out := make(chan FileStamp)
+	go func() {
+		defer close(out)
+		var stamps []FileStamp
+		for stamp := range in {
+			stamps = append(stamps, stamp)
+		}
+		for _, stamp := range arrange(stamps) {
+			out <- stamp
+		}
+	}()
+	return out
+}
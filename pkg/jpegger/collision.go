@@ -0,0 +1,146 @@
+package jpegger
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// How a file is renamed when its name is taken by different content
+type CollisionStrategy int
+
+const (
+	// The first 8 hex digits of the key in front, e.g. 1a2b3c4d_IMG_0001.JPG
+	CollisionHash = CollisionStrategy(iota)
+	// A number after, e.g. IMG_0001_001.JPG
+	CollisionSequence
+	// The whole key in place of the name
+	CollisionFullHash
+	// The capture time in place of the name, e.g. 20190704_153012.JPG,
+	// numbered if that is taken too
+	CollisionTime
+)
+
+var collisionStrategyNames = map[string]CollisionStrategy{
+	"hash":      CollisionHash,
+	"sequence":  CollisionSequence,
+	"full-hash": CollisionFullHash,
+	"time":      CollisionTime,
+}
+
+func ParseCollisionStrategy(name string) (CollisionStrategy, error) {
+	strategy, ok := collisionStrategyNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown collision strategy %q (expected hash, sequence, full-hash or time)", name)
+	}
+	return strategy, nil
+}
+
+// The name to try in place of name for the nth attempt at placing a file
+// whose name was taken, counting from 1. ok is false once the strategy has
+// nothing left to try. The transfer fails if the name is taken, so each
+// name is claimed by exactly one file however many are placed at once.
+func CollisionName(strategy CollisionStrategy, name string, stamp FileStamp, attempt int) (string, bool) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	switch strategy {
+	case CollisionSequence:
+		return fmt.Sprintf("%s_%03d%s", stem, attempt, ext), true
+	case CollisionFullHash:
+		return fmt.Sprintf("%x%s", stamp.Key, ext), attempt == 1
+	case CollisionTime:
+		if stamp.Time.IsZero() {
+			return "", false
+		}
+		taken := stamp.Time.Format("20060102_150405")
+		if attempt == 1 {
+			return taken + ext, true
+		}
+		return fmt.Sprintf("%s_%03d%s", taken, attempt, ext), true
+	default:
+		return fmt.Sprintf("%x", stamp.Key)[:8] + "_" + name, attempt == 1
+	}
+}
+
+// The form names are placed under. macOS writes names decomposed (NFD)
+// while most everything else composes them (NFC), and the two look the
+// same.
+func NormalizeName(name string) string {
+	return norm.NFC.String(name)
+}
+
+// A name as a case-insensitive filesystem compares it
+func foldName(name string) string {
+	return strings.ToLower(NormalizeName(name))
+}
+
+// Finds names in the output that differ from another only in case or
+// Unicode normalization, like IMG_0001.JPG and img_0001.jpg. A
+// case-insensitive filesystem, or a copy of the output on one, would hold
+// only one of them.
+type CaseFolder struct {
+	Events EventSink
+
+	lock sync.Mutex
+	// each directory seen, from folded names to the names in it
+	dirs map[string]map[string]string
+}
+
+func NewCaseFolder() *CaseFolder {
+	return &CaseFolder{dirs: map[string]map[string]string{}}
+}
+
+// The name in dir that dest would be the same file as on a
+// case-insensitive filesystem, if it isn't dest's own name
+func (c *CaseFolder) Match(dest string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	dir, name := filepath.Split(dest)
+	names := c.names(dir)
+	other, ok := names[foldName(name)]
+	return other, ok && other != name
+}
+
+// Remember a name placed in its directory
+func (c *CaseFolder) Add(dest string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	dir, name := filepath.Split(dest)
+	c.names(dir)[foldName(name)] = name
+}
+
+func (c *CaseFolder) names(dir string) map[string]string {
+	names, ok := c.dirs[dir]
+	if ok {
+		return names
+	}
+	names = map[string]string{}
+	// a directory that isn't there yet holds nothing
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		names[foldName(entry.Name())] = entry.Name()
+	}
+	c.dirs[dir] = names
+	return names
+}
+
+// Wrap a transfer so that a name differing from one already in its
+// directory only in case or normalization is taken, like an identical
+// name, rather than one file clobbering or hiding the other
+func (c *CaseFolder) Transfer(transfer func(TransferMode, string, string) error) func(TransferMode, string, string) error {
+	return func(mode TransferMode, src, dest string) error {
+		if other, ok := c.Match(dest); ok {
+			c.Events.Emit(Event{Event: "case-collision", Source: src, Destination: dest, Message: other})
+			return &os.LinkError{Op: transferModeVerbs[mode], Old: src, New: dest, Err: os.ErrExist}
+		}
+		err := transfer(mode, src, dest)
+		if err == nil {
+			c.Add(dest)
+		}
+		return err
+	}
+}
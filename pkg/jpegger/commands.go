@@ -0,0 +1,153 @@
+package jpegger
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// How jpegger exits, so that scripts can tell what a run did
+const (
+	ExitOK = 0
+	// A fatal error, like the database failing
+	ExitFatal = 1
+	ExitUsage = 2
+	// The import finished, but some files failed
+	ExitFileErrors = 3
+	// The import found nothing new
+	ExitNothingToDo = 4
+)
+
+// An error that ends jpegger with a status of its own. Err is nil for a
+// status that isn't a failure, which prints nothing.
+type ExitStatus struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitStatus) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("exit status %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+// A jpegger subcommand
+type Command struct {
+	Name    string
+	Args    string
+	Summary string
+	Flags   *flag.FlagSet
+	Run     func(args []string) error
+}
+
+// Every command, in the order they're listed by Usage
+var Commands []*Command
+
+func init() {
+	Commands = []*Command{
+		ImportCommand,
+		ApplyCommand,
+		StatusCommand,
+		VerifyCommand,
+		OrphansCommand,
+		AdoptCommand,
+		UndoCommand,
+		DupesCommand,
+		DedupeCommand,
+		ServeCommand,
+		GalleryCommand,
+		SearchCommand,
+		TagCommand,
+		ExportCommand,
+		RejectCommand,
+		DoctorCommand,
+		DbCommand,
+	}
+}
+
+// Create the flag set for a command, including the flags every command
+// shares
+func NewFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(Database, "database", "state.db", "path to persisted state")
+	fs.StringVar(DBDriver, "db-driver", "bolt", "how the state is stored: bolt, or sqlite to query it with SQL and for network filesystems")
+	fs.StringVar(Log, "log", "actions.log", "path to result log")
+	fs.StringVar(LogFormat, "log-format", "text", "format of the result log: text, or json for one event per line")
+	fs.IntVar(LogMaxMB, "log-max-mb", 0, "start a new log once it would grow past this many megabytes. 0 never does")
+	fs.DurationVar(LogMaxAge, "log-max-age", 0, "start a new log once it has been written to for this long (e.g. 168h). 0 never does")
+	fs.IntVar(LogKeep, "log-keep", 5, "how many old logs to keep as log.1, log.2, ... when starting a new one")
+	fs.IntVar(IORetries, "io-retries", 3, "how many more times to try reading or writing a file after an error that may pass, like EIO or ESTALE on a network filesystem")
+	fs.DurationVar(IOBackoff, "io-backoff", 500*time.Millisecond, "how long to wait before the first retry after such an error. doubles with each retry")
+	fs.StringVar(ConfigPath, "config", "", "path to a TOML config file. flags given on the command line take precedence")
+	fs.BoolVar(Verbose, "v", false, "show every event of the action log on the terminal")
+	fs.BoolVar(Quiet, "q", false, "show only errors and warnings on the terminal, without the progress bar or summary")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: jpegger %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func FindCommand(name string) *Command {
+	for _, cmd := range Commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func Usage() {
+	fmt.Fprintf(os.Stderr, "usage: jpegger <command> [flags] [arguments]\n\ncommands:\n")
+	for _, cmd := range Commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun 'jpegger <command> -help' for the flags of a command\n")
+}
+
+// Arguments a command can't be run with
+type ArgumentError struct {
+	Flags   *flag.FlagSet
+	Message string
+}
+
+func (e *ArgumentError) Error() string {
+	return e.Message
+}
+
+// Complain about the arguments given to a command. Main shows the command's
+// usage along with it and exits with ExitUsage.
+func UsageError(fs *flag.FlagSet, format string, args ...interface{}) error {
+	return &ArgumentError{fs, fmt.Sprintf(format, args...)}
+}
+
+// Attach the loggers to the action log. Events go only to the log; what
+// is logged directly, which is errors and warnings, goes to the terminal
+// too.
+func OpenLog() (*LogFile, error) {
+	f, err := OpenLogFile(*Log, int64(*LogMaxMB)<<20, *LogMaxAge, *LogKeep)
+	if err != nil {
+		return nil, err
+	}
+	f.ReopenOnHangup()
+
+	console := consoleWriter{os.Stderr}
+	switch *LogFormat {
+	case "text":
+		actionLog = log.New(f, "", log.LstdFlags)
+		log.SetOutput(io.MultiWriter(f, console))
+	case "json":
+		// events carry their own timestamps
+		actionLog = log.New(f, "", 0)
+		log.SetFlags(0)
+		log.SetOutput(io.MultiWriter(jsonLogWriter{f}, console))
+	default:
+		f.Close()
+		return nil, fmt.Errorf("unknown log format %q (expected one of %v)", *LogFormat, LogFormats)
+	}
+	return f, nil
+}
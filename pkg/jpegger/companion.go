@@ -0,0 +1,94 @@
+package jpegger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// The file each placed sidecar or companion goes with, both by path
+	// relative to the output
+	Companions = "Companions"
+)
+
+var (
+	// Files that travel with the photo or video of the same name: camera
+	// thumbnails, GoPro proxies, DJI telemetry and Photos adjustments
+	CompanionExtensions = []string{".thm", ".lrv", ".srt", ".aae"}
+
+	// The ways a companion's name can differ from its file's, as a change
+	// to the stem. "" when the change doesn't apply.
+	companionStems = []func(string) string{
+		func(stem string) string { return stem },
+		// Photos' adjustments of an original, IMG_O1234.AAE for IMG_1234.HEIC
+		func(stem string) string {
+			i := strings.LastIndex(stem, "_")
+			if i < 0 {
+				return ""
+			}
+			return stem[:i+1] + "O" + stem[i+1:]
+		},
+		// GoPro proxies, GL010123.LRV for GH010123.MP4 or GX010123.MP4
+		func(stem string) string {
+			if len(stem) < 2 {
+				return ""
+			}
+			if prefix := strings.ToUpper(stem[:2]); prefix != "GH" && prefix != "GX" {
+				return ""
+			}
+			return "GL" + stem[2:]
+		},
+	}
+)
+
+// Find the companions beside a file
+func FindCompanions(name string) []string {
+	dir, base := filepath.Split(name)
+	stem := strings.TrimSuffix(base, filepath.Ext(base))
+
+	var found []string
+	seen := map[string]bool{}
+	for _, change := range companionStems {
+		candidate := change(stem)
+		if candidate == "" {
+			continue
+		}
+		for _, ext := range CompanionExtensions {
+			for _, companion := range []string{dir + candidate + ext, dir + candidate + strings.ToUpper(ext)} {
+				info, err := os.Stat(companion)
+				// a case-insensitive filesystem finds both spellings
+				if err == nil && !info.IsDir() && !seen[strings.ToLower(companion)] {
+					seen[strings.ToLower(companion)] = true
+					found = append(found, companion)
+				}
+			}
+		}
+	}
+	return found
+}
+
+// Where a companion of a file placed at dest goes. It's renamed along with
+// the file, so a collision rename keeps them together.
+func CompanionDest(companion, name, dest string) string {
+	stem := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	companionStem := strings.TrimSuffix(filepath.Base(companion), filepath.Ext(companion))
+	destStem := strings.TrimSuffix(dest, filepath.Ext(dest))
+	dir, destBase := filepath.Split(destStem)
+	for _, change := range companionStems {
+		if strings.EqualFold(change(stem), companionStem) {
+			if changed := change(destBase); changed != "" {
+				return dir + changed + filepath.Ext(companion)
+			}
+			break
+		}
+	}
+	return destStem + filepath.Ext(companion)
+}
+
+// Remember which file a placed sidecar or companion goes with
+func RecordCompanion(db Store, companionRel, rel string) error {
+	return db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte(Companions)).Put([]byte(companionRel), []byte(rel))
+	})
+}
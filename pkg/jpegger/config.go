@@ -0,0 +1,169 @@
+package jpegger
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Settings from the config file that aren't flags
+var Configured struct {
+	Inputs []string
+	Output string
+}
+
+// Read a TOML config file. Keys named after a flag set that flag unless it
+// was also given on the command line; the rest configure lists and limits
+// that have no flag. For example:
+//
+//	database = "/srv/photos/state.db"
+//	layout = "%Y/%Y-%m-%d"
+//	input = ["/srv/phone-sync", "/mnt/sd"]
+//	output = "/srv/photos/archive"
+//	extensions = [".jpg", ".jpeg", ".mov"]
+//	exclude = ["**/Thumbnails/**", "*.tmp"]
+//	exif_keys = ["Date and Time (Original)"]
+//	hash_workers = 4
+//
+//	[camera_offsets]
+//	"Canon EOS 5D" = "-2h13m"
+func LoadConfig(path string, fs *flag.FlagSet) error {
+	var raw map[string]interface{}
+	_, err := toml.DecodeFile(path, &raw)
+	if err != nil {
+		return err
+	}
+
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	// apply in a stable order so errors are repeatable
+	var keys []string
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		err := applySetting(key, raw[key], fs, given)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", path, key, err)
+		}
+	}
+	return nil
+}
+
+func applySetting(key string, value interface{}, fs *flag.FlagSet, given map[string]bool) error {
+	var err error
+	switch key {
+	case "input":
+		// one directory or a list of them
+		if s, ok := value.(string); ok {
+			Configured.Inputs = []string{s}
+		} else {
+			Configured.Inputs, err = configStrings(value)
+		}
+	case "output":
+		Configured.Output, err = configString(value)
+	case "extensions":
+		if given[key] {
+			return nil
+		}
+		var extensions []string
+		extensions, err = configStrings(value)
+		if err == nil {
+			err = Extensions.Set(strings.Join(extensions, ","))
+		}
+	case "exclude", "include", "skip_patterns":
+		// skip_patterns is the old name for exclude
+		globs, name := Includes, "include"
+		if key != "include" {
+			globs, name = Excludes, "exclude"
+		}
+		if given[name] {
+			return nil
+		}
+		var patterns []string
+		patterns, err = configStrings(value)
+		for _, pattern := range patterns {
+			if err == nil {
+				err = globs.Set(pattern)
+			}
+		}
+	case "exif_keys":
+		ExifKeys, err = configStrings(value)
+	case "camera_offsets":
+		CameraOffsets, err = configDurations(value)
+	case "hash_workers":
+		workers, ok := value.(int64)
+		if !ok || workers < 1 {
+			return fmt.Errorf("expected a positive number")
+		}
+		HashWorkers = int(workers)
+	default:
+		if fs.Lookup(key) != nil {
+			if given[key] {
+				return nil
+			}
+			return fs.Set(key, fmt.Sprint(value))
+		}
+		// may belong to a different command
+		for _, cmd := range Commands {
+			if cmd.Flags.Lookup(key) != nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown setting")
+	}
+	return err
+}
+
+func configString(value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string")
+	}
+	return s, nil
+}
+
+func configStrings(value interface{}) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of strings")
+	}
+
+	result := make([]string, len(list))
+	for i, item := range list {
+		s, err := configString(item)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = s
+	}
+	return result, nil
+}
+
+func configDurations(value interface{}) (map[string]time.Duration, error) {
+	table, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a table of durations")
+	}
+
+	result := map[string]time.Duration{}
+	for name, item := range table {
+		s, err := configString(item)
+		if err != nil {
+			return nil, err
+		}
+		result[name], err = time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return result, nil
+}
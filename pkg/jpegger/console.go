@@ -0,0 +1,104 @@
+package jpegger
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// How much a command says on the terminal. The action log gets every event
+// whatever the verbosity.
+const (
+	// Only errors and warnings
+	VerbosityQuiet = iota
+	// Problems, the progress bar and the summary
+	VerbosityNormal
+	// Every event the text log has
+	VerbosityVerbose
+)
+
+var (
+	Verbose = new(bool)
+	Quiet   = new(bool)
+
+	// Events worth a line on the terminal without -v: problems, and the
+	// run stopping, resuming, turning to watching or serving its page
+	consoleEvents = map[string]bool{
+		"resumed":            true,
+		"watching":           true,
+		"serving":            true,
+		"interrupted":        true,
+		"error":              true,
+		"permission-denied":  true,
+		"unreadable-dir":     true,
+		"retrying":           true,
+		"quarantined":        true,
+		"hook-failed":        true,
+		"date-not-written":   true,
+		"mirror-unavailable": true,
+		"mirror-failed":      true,
+		"manifest-failed":    true,
+		"scrub-drift":        true,
+		"scrub-missing":      true,
+		"scrub-unreadable":   true,
+		"scrub-failed":       true,
+		"undo-kept":          true,
+		"undo-mirror-kept":   true,
+	}
+
+	// The action log once OpenLog has attached it. Until then events go
+	// to the standard logger, which writes to the terminal.
+	actionLog *log.Logger
+
+	// Held while writing a line to the terminal, so that it doesn't land
+	// in the middle of the progress bar
+	consoleMu sync.Mutex
+)
+
+// How much to say on the terminal. -q wins over -v.
+func Verbosity() int {
+	switch {
+	case *Quiet:
+		return VerbosityQuiet
+	case *Verbose:
+		return VerbosityVerbose
+	}
+	return VerbosityNormal
+}
+
+// Writes lines to the terminal, first clearing whatever the progress bar
+// left on the last one
+type consoleWriter struct {
+	out *os.File
+}
+
+func (w consoleWriter) Write(p []byte) (int, error) {
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+	if IsTerminal(w.out) {
+		io.WriteString(w.out, "\r\033[K")
+	}
+	return w.out.Write(p)
+}
+
+// Show an event on the terminal if the verbosity asks for it. The summary
+// is shown as a table of its own.
+func showEvent(e Event) {
+	if actionLog == nil || e.Event == "summary" {
+		return // already on the terminal, or there's no log to tell apart from it
+	}
+	switch Verbosity() {
+	case VerbosityQuiet:
+		if e.Event != "error" {
+			return
+		}
+	case VerbosityNormal:
+		if !consoleEvents[e.Event] {
+			return
+		}
+	}
+	if text := e.Text(); text != "" {
+		consoleWriter{os.Stderr}.Write([]byte(text + "\n"))
+	}
+}
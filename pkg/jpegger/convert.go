@@ -0,0 +1,105 @@
+package jpegger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Where -keep-heic keeps the HEIC originals of converted photos, at
+	// the same path they'd have had in the output
+	OriginalsDir = "originals"
+
+	// The quality HEICs are converted at, out of 100
+	convertQuality = "92"
+)
+
+var (
+	ConvertHEIC = importFlags.String("convert-heic", "", "convert HEIC stills to this format as they are placed, for software that can't read HEIC. only jpeg is supported. needs heif-convert from libheif")
+	KeepHEIC    = importFlags.Bool("keep-heic", false, "with -convert-heic, keep each HEIC original under originals/ in the output")
+	HEIFConvert = importFlags.String("heif-convert", "heif-convert", "the heif-convert command -convert-heic converts with")
+)
+
+// Check -convert-heic and that heif-convert can be run
+func CheckHEICConversion() error {
+	if *ConvertHEIC != "jpeg" {
+		return fmt.Errorf("unknown -convert-heic format %q (expected jpeg)", *ConvertHEIC)
+	}
+	if _, err := exec.LookPath(*HEIFConvert); err != nil {
+		return fmt.Errorf("-convert-heic needs heif-convert: %v", err)
+	}
+	return nil
+}
+
+// The path a HEIC placed in the output is kept at with -keep-heic
+func OriginalPath(output, placed string) (string, error) {
+	rel, err := filepath.Rel(output, placed)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(output, OriginalsDir, rel), nil
+}
+
+// Replace a HEIC placed in the output with a JPEG of the same name beside
+// it, moving the HEIC to originals/ if keep and removing it otherwise. The
+// JPEG keeps the modification time of the HEIC. On an error the HEIC is
+// left where it was. Returns the JPEG and where the HEIC was kept.
+func ConvertPlacedHEIC(output, placed string, keep bool) (string, string, error) {
+	converted := strings.TrimSuffix(placed, filepath.Ext(placed)) + ".jpg"
+	if _, err := os.Lstat(converted); err == nil {
+		return "", "", fmt.Errorf("%s is taken", converted)
+	}
+	original := ""
+	if keep {
+		var err error
+		if original, err = OriginalPath(output, placed); err != nil {
+			return "", "", err
+		}
+		if _, err = os.Lstat(original); err == nil {
+			return "", "", fmt.Errorf("%s is taken", original)
+		}
+	}
+	info, err := os.Stat(placed)
+	if err != nil {
+		return "", "", err
+	}
+
+	// heif-convert goes by the extension of what it writes
+	tmp, err := ioutil.TempFile(filepath.Dir(placed), ".jpegger-*.jpg")
+	if err != nil {
+		return "", "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	cmd := exec.Command(*HEIFConvert, "-q", convertQuality, placed, tmp.Name())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("%s: %v: %s", *HEIFConvert, err, strings.TrimSpace(stderr.String()))
+	}
+	if err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return "", "", err
+	}
+	if err = os.Rename(tmp.Name(), converted); err != nil {
+		return "", "", err
+	}
+
+	if keep {
+		err = EnsureDir(filepath.Dir(original))
+		if err == nil {
+			err = os.Rename(placed, original)
+		}
+	} else {
+		err = os.Remove(placed)
+	}
+	if err != nil {
+		os.Remove(converted)
+		return "", "", err
+	}
+	return converted, original, nil
+}
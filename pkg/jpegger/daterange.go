@@ -0,0 +1,73 @@
+package jpegger
+
+import (
+	"fmt"
+	"time"
+)
+
+// The dates -since and -until accept, from coarsest to finest
+var dateBoundFormats = []string{"2006", "2006-01", "2006-01-02"}
+
+// Only files dated in [Since, Until) are imported. Zero times leave that
+// end open. The bounds are days, compared with the date a file was taken
+// where it was taken rather than as instants, as the layout places it.
+type DateRange struct {
+	Since time.Time
+	Until time.Time
+}
+
+// Read a -since or -until date in local time. A year or month covers all
+// of it, so an -until of 2017 runs to the end of 2017.
+func ParseDateBound(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for i, format := range dateBoundFormats {
+		t, err := time.ParseInLocation(format, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if end {
+			switch i {
+			case 0:
+				t = t.AddDate(1, 0, 0)
+			case 1:
+				t = t.AddDate(0, 1, 0)
+			case 2:
+				t = t.AddDate(0, 0, 1)
+			}
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("expected a date like 2015, 2015-06 or 2015-06-30, got %q", value)
+}
+
+func ParseDateRange(since, until string) (DateRange, error) {
+	var r DateRange
+	var err error
+	if r.Since, err = ParseDateBound(since, false); err != nil {
+		return r, err
+	}
+	if r.Until, err = ParseDateBound(until, true); err != nil {
+		return r, err
+	}
+	if !r.Since.IsZero() && !r.Until.IsZero() && !r.Since.Before(r.Until) {
+		return r, fmt.Errorf("-since %s is not before -until %s", since, until)
+	}
+	return r, nil
+}
+
+func (r DateRange) Contains(t time.Time) bool {
+	if !r.Since.IsZero() && t.Before(inLocation(r.Since, t.Location())) {
+		return false
+	}
+	if !r.Until.IsZero() && !t.Before(inLocation(r.Until, t.Location())) {
+		return false
+	}
+	return true
+}
+
+// The same midnight on the wall clock of loc
+func inLocation(day time.Time, loc *time.Location) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc)
+}
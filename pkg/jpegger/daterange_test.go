@@ -0,0 +1,51 @@
+package jpegger
+
+import (
+	"testing"
+	"time"
+)
+
+// Bounds are read in local time, but a file is in range by the date it
+// was taken on wherever it was taken
+func TestDateRangeContains(t *testing.T) {
+	// time.Local is read from TZ once, at start up
+	t.Setenv("TZ", "America/New_York")
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer func(old *time.Location) { time.Local = old }(time.Local)
+	time.Local = loc
+
+	r, err := ParseDateRange("2017-06", "2017")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokyo := time.FixedZone("JST", 9*60*60)
+	tests := []struct {
+		date time.Time
+		want bool
+	}{
+		// EXIF and filename dates are the wall clock, labelled UTC
+		{time.Date(2018, 1, 1, 2, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 12, 31, 23, 59, 59, 0, time.UTC), true},
+		{time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 5, 31, 23, 0, 0, 0, time.UTC), false},
+		// QuickTime dates are local
+		{time.Date(2017, 12, 31, 23, 0, 0, 0, time.Local), true},
+		{time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local), false},
+		// and ones with an offset keep it
+		{time.Date(2018, 1, 1, 9, 0, 0, 0, tokyo), false},
+		{time.Date(2017, 6, 1, 1, 0, 0, 0, tokyo), true},
+	}
+	for _, test := range tests {
+		if got := r.Contains(test.date); got != test.want {
+			t.Errorf("Contains(%v) = %v, want %v", test.date, got, test.want)
+		}
+	}
+
+	open := DateRange{}
+	if !open.Contains(time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("an open range doesn't contain 1970")
+	}
+}
@@ -0,0 +1,354 @@
+package jpegger
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	DbCommand = &Command{
+		Name:    "db",
+		Args:    "list [state] | get path|hash | grep pattern | search [-keyword k] [-caption text] [-rating n] | prune [-content] [-missing-dirs] | export | import file.json | merge other.db",
+		Summary: "inspect or prune the database, or export it to and import it from JSON",
+		Flags:   dbFlags,
+		Run:     RunDb,
+	}
+
+	dbFlags = NewFlagSet("db", "list [state] | get path|hash | grep pattern | search [-keyword k] [-caption text] [-rating n] | prune [-content] [-missing-dirs] | export | import file.json | merge other.db")
+
+	DbReplace = dbFlags.Bool("replace", false, "let import replace a database that already has content")
+
+	hashPrefix = regexp.MustCompile(`^[0-9a-f]{4,64}$`)
+)
+
+// Which source paths have each content hash. SourcePath only maps the
+// other way, so this reads all of it.
+func sourcesByKey(tx Tx) map[string][]string {
+	sources := map[string][]string{}
+	if b := tx.Bucket([]byte(SourcePath)); b != nil {
+		b.ForEach(func(path, key []byte) error {
+			sources[string(key)] = append(sources[string(key)], string(path))
+			return nil
+		})
+	}
+	return sources
+}
+
+// Find the one hash in ContentHash starting with a hex prefix
+func findKey(tx Tx, prefix string) ([]byte, error) {
+	b := tx.Bucket([]byte(ContentHash))
+	if b == nil {
+		return nil, fmt.Errorf("no content hash starts with %s", prefix)
+	}
+
+	start, _ := hex.DecodeString(prefix[:len(prefix)/2*2])
+	var found [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(start); k != nil && strings.HasPrefix(hex.EncodeToString(k), prefix); k, _ = c.Next() {
+		found = append(found, k)
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no content hash starts with %s", prefix)
+	case 1:
+		return found[0], nil
+	}
+	return nil, fmt.Errorf("%d content hashes start with %s", len(found), prefix)
+}
+
+// The state of a piece of content, nil if it isn't known
+func stateOf(tx Tx, key []byte) []byte {
+	if b := tx.Bucket([]byte(ContentHash)); b != nil {
+		return b.Get(key)
+	}
+	return nil
+}
+
+// Print everything known about a piece of content
+func printKey(tx Tx, key []byte) {
+	fmt.Printf("%-12s %x\n", "hash:", key)
+	fmt.Printf("%-12s %s\n", "state:", StateName(stateOf(tx, key)))
+	times := ContentStateTimes(tx, key)
+	for _, s := range StateNames {
+		if at, ok := times[s.Name]; ok {
+			fmt.Printf("%-12s %s\n", s.Name+":", at.Format(time.RFC3339))
+		}
+	}
+	fmt.Printf("%-12s %s\n", "keyed by:", KeyAlgorithm(tx, key))
+	if b := tx.Bucket([]byte(ContentDestination)); b != nil {
+		if dest := b.Get(key); dest != nil {
+			fmt.Printf("%-12s %s\n", "destination:", dest)
+		}
+	}
+	if taken, ok := ContentDate(tx, key); ok {
+		fmt.Printf("%-12s %s\n", "taken:", taken.Format(time.RFC3339))
+	}
+	if b := tx.Bucket([]byte(Bursts)); b != nil {
+		if burst := b.Get(key); burst != nil {
+			fmt.Printf("%-12s %s\n", "burst:", burst)
+		}
+	}
+	if b := tx.Bucket([]byte(Pairs)); b != nil {
+		if partner := b.Get(key); partner != nil {
+			fmt.Printf("%-12s %x\n", "paired with:", partner)
+		}
+	}
+	for _, path := range sourcesByKey(tx)[string(key)] {
+		fmt.Printf("%-12s %s\n", "source:", path)
+	}
+	if tags := ContentTags(tx, key); len(tags) > 0 {
+		fmt.Printf("%-12s %s\n", "tags:", strings.Join(tags, ", "))
+	}
+	if d, ok := ContentDescription(tx, key); ok {
+		if d.Caption != "" {
+			fmt.Printf("%-12s %s\n", "caption:", d.Caption)
+		}
+		if len(d.Keywords) > 0 {
+			fmt.Printf("%-12s %s\n", "keywords:", strings.Join(d.Keywords, ", "))
+		}
+		if d.Rating > 0 {
+			fmt.Printf("%-12s %d\n", "rating:", d.Rating)
+		}
+	}
+}
+
+func dbList(tx Tx, args []string) error {
+	var only []byte
+	if len(args) > 1 {
+		return UsageError(dbFlags, "list takes at most a state")
+	}
+	if len(args) == 1 {
+		found := false
+		for _, s := range StateNames {
+			if s.Name == args[0] {
+				only, found = s.State, true
+			}
+		}
+		if !found {
+			return UsageError(dbFlags, "unknown state %q", args[0])
+		}
+	}
+
+	b := tx.Bucket([]byte(ContentHash))
+	if b == nil {
+		return nil
+	}
+	sources := sourcesByKey(tx)
+	return b.ForEach(func(key, state []byte) error {
+		if only != nil && !bytes.Equal(state, only) {
+			return nil
+		}
+		fmt.Printf("%x  %-10s  %s\n", key, StateName(state), strings.Join(sources[string(key)], ", "))
+		return nil
+	})
+}
+
+func dbGet(tx Tx, args []string) error {
+	if len(args) != 1 {
+		return UsageError(dbFlags, "get takes a source path or a hash")
+	}
+	name := args[0]
+
+	if b := tx.Bucket([]byte(SourcePath)); b != nil {
+		if key := b.Get([]byte(name)); key != nil {
+			fmt.Printf("%-12s %s\n", "path:", name)
+			printKey(tx, key)
+			return nil
+		}
+	}
+
+	if !hashPrefix.MatchString(strings.ToLower(name)) {
+		return fmt.Errorf("no record of %s", name)
+	}
+	key, err := findKey(tx, strings.ToLower(name))
+	if err != nil {
+		return err
+	}
+	printKey(tx, key)
+	return nil
+}
+
+func dbGrep(tx Tx, args []string) error {
+	if len(args) != 1 {
+		return UsageError(dbFlags, "grep takes a pattern")
+	}
+	pattern, err := regexp.Compile(args[0])
+	if err != nil {
+		return UsageError(dbFlags, "invalid pattern: %v", err)
+	}
+
+	b := tx.Bucket([]byte(SourcePath))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(path, key []byte) error {
+		if pattern.Match(path) {
+			fmt.Printf("%x  %-10s  %s\n", key, StateName(stateOf(tx, key)), path)
+		}
+		return nil
+	})
+}
+
+// A repeatable flag of strings
+type StringList []string
+
+func (l *StringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ", ")
+}
+
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// List the content whose description matches every filter given
+func dbSearch(tx Tx, args []string) error {
+	fs := flag.NewFlagSet("db search", flag.ExitOnError)
+	var keywords StringList
+	fs.Var(&keywords, "keyword", "only content with this keyword, ignoring case. repeatable, and every one must match")
+	caption := fs.String("caption", "", "only content whose caption contains this, ignoring case")
+	rating := fs.Int("rating", 0, "only content rated at least this many stars")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return UsageError(dbFlags, "search takes only -keyword, -caption and -rating")
+	}
+
+	b := tx.Bucket([]byte(Descriptions))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(key, _ []byte) error {
+		d, ok := ContentDescription(tx, key)
+		if !ok || d.Rating < *rating {
+			return nil
+		}
+		if *caption != "" && !strings.Contains(strings.ToLower(d.Caption), strings.ToLower(*caption)) {
+			return nil
+		}
+		for _, keyword := range keywords {
+			if !d.HasKeyword(keyword) {
+				return nil
+			}
+		}
+
+		where := string(lookup(tx, ContentDestination, key))
+		fmt.Printf("%x  %s\n", key, where)
+		if d.Caption != "" {
+			fmt.Printf("    %s\n", d.Caption)
+		}
+		if len(d.Keywords) > 0 {
+			fmt.Printf("    keywords: %s\n", strings.Join(d.Keywords, ", "))
+		}
+		if d.Rating > 0 {
+			fmt.Printf("    rating: %d\n", d.Rating)
+		}
+		return nil
+	})
+}
+
+// Has anything been imported with the database?
+func hasContent(tx Tx) bool {
+	for _, name := range []string{ContentHash, SourcePath, Runs} {
+		if b := tx.Bucket([]byte(name)); b != nil && b.KeyN() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func dbImport(args []string) error {
+	if len(args) != 1 {
+		return UsageError(dbFlags, "import takes an exported file, - for stdin")
+	}
+
+	in := os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	lock, err := LockRun(*Database, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	db, err := OpenStore(*Database, StoreOptions{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var existing bool
+	db.View(func(tx Tx) error {
+		existing = hasContent(tx)
+		return nil
+	})
+	if existing && !*DbReplace {
+		return fmt.Errorf("%s already has content. use -replace to replace it", *Database)
+	}
+	return ImportState(db, in)
+}
+
+func RunDb(args []string) error {
+	if len(args) == 0 {
+		return UsageError(dbFlags, "expected list, get, grep, search, prune, export, import or merge")
+	}
+	if args[0] == "import" {
+		return dbImport(args[1:])
+	}
+	if args[0] == "merge" {
+		return dbMerge(args[1:])
+	}
+	if args[0] == "prune" {
+		return dbPrune(args[1:])
+	}
+
+	var action func(Tx, []string) error
+	switch args[0] {
+	case "list":
+		action = dbList
+	case "get":
+		action = dbGet
+	case "grep":
+		action = dbGrep
+	case "search":
+		action = dbSearch
+	case "export":
+		action = func(tx Tx, args []string) error {
+			if len(args) != 0 {
+				return UsageError(dbFlags, "export writes to stdout and takes no arguments")
+			}
+			return ExportState(tx, os.Stdout)
+		}
+	default:
+		return UsageError(dbFlags, "unknown action %q", args[0])
+	}
+
+	if _, err := os.Stat(*Database); err != nil {
+		return err
+	}
+	db, err := OpenReadOnlyDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx Tx) error {
+		return action(tx, args[1:])
+	})
+}
@@ -0,0 +1,295 @@
+package jpegger
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	DedupeCommand = &Command{
+		Name:    "dedupe",
+		Args:    "output_dir",
+		Summary: "find files in the output directory holding the same content, and hard link them to one copy",
+		Flags:   dedupeFlags,
+		Run:     RunDedupe,
+	}
+
+	dedupeFlags = NewFlagSet("dedupe", "output_dir")
+
+	DedupeApply = dedupeFlags.Bool("apply", false, "replace the extra copies with hard links to the one kept. without it they are only listed")
+)
+
+// A file in the output, which may be at more than one path already
+type LinkedFile struct {
+	// relative to the output, with slashes, in the order found
+	Paths    []string
+	Size     int64
+	Modified time.Time
+	// hard links to it, 0 if unknown
+	Links  uint64
+	device uint64
+}
+
+// Does linking this file's paths elsewhere free its space? Not if it's also
+// linked outside the output.
+func (f *LinkedFile) freed() bool {
+	return f.Links == 0 || f.Links <= uint64(len(f.Paths))
+}
+
+// Files on one filesystem in the output that hold the same content. The
+// first is the one kept.
+type LinkSet struct {
+	Key   []byte
+	Size  int64
+	Files []*LinkedFile
+}
+
+// The space linking the rest of the files to the first would free
+func (s LinkSet) Reclaimable() int64 {
+	var n int64
+	for _, file := range s.Files[1:] {
+		if file.freed() {
+			n += s.Size
+		}
+	}
+	return n
+}
+
+// Find the photos and videos held by more than one file under output.
+// Only files that share a size with another are hashed. The file kept is
+// one placed, as placed says, then the one with the most paths.
+func FindLinkSets(output string, placed map[string]bool) ([]LinkSet, error) {
+	files := map[string]*LinkedFile{}
+	var order []string
+	err := WithFiles(output, func(info os.FileInfo, name string) error {
+		rel, _ := filepath.Rel(output, name)
+		rel = filepath.ToSlash(rel)
+		// the object store is linked to already, and the gallery and
+		// quarantine are left alone
+		if strings.HasPrefix(rel, GalleryDir+"/") || strings.HasPrefix(rel, QuarantineDir+"/") || strings.HasPrefix(rel, ObjectsDir+"/") {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".jpegger-") || !ValidName(rel) || info.Size() == 0 {
+			return nil
+		}
+		id := fileIdentity(name, info)
+		if file, ok := files[id]; ok {
+			file.Paths = append(file.Paths, rel)
+			return nil
+		}
+		device, _ := fileDevice(info)
+		links, _ := fileLinks(info)
+		files[id] = &LinkedFile{Paths: []string{rel}, Size: info.Size(), Modified: info.ModTime(), Links: links, device: device}
+		order = append(order, id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// only a file sharing its size can share its content
+	type sizeKey struct {
+		device uint64
+		size   int64
+	}
+	bySize := map[sizeKey]int{}
+	for _, file := range files {
+		bySize[sizeKey{file.device, file.Size}] += 1
+	}
+	hashed := map[string]*LinkedFile{}
+	for _, id := range order {
+		file := files[id]
+		if bySize[sizeKey{file.device, file.Size}] > 1 {
+			hashed[file.Paths[0]] = file
+		}
+	}
+
+	type contentKey struct {
+		device uint64
+		key    string
+	}
+	byContent := map[contentKey][]*LinkedFile{}
+	want := func(rel string) bool {
+		return hashed[rel] != nil
+	}
+	err = hashTreeEach(output, want, func(string) string { return DefaultHash }, func(result verifiedFile) error {
+		if result.Err != nil {
+			fmt.Printf("unreadable %s: %v\n", result.RelPath, result.Err)
+			return nil
+		}
+		file := hashed[result.RelPath]
+		k := contentKey{file.device, string(result.Key)}
+		byContent[k] = append(byContent[k], file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var sets []LinkSet
+	for k, same := range byContent {
+		if len(same) < 2 {
+			continue
+		}
+		for _, file := range same {
+			sort.Strings(file.Paths)
+		}
+		isPlaced := func(file *LinkedFile) bool {
+			for _, rel := range file.Paths {
+				if placed[rel] {
+					return true
+				}
+			}
+			return false
+		}
+		sort.Slice(same, func(i, j int) bool {
+			if a, b := isPlaced(same[i]), isPlaced(same[j]); a != b {
+				return a
+			}
+			if len(same[i].Paths) != len(same[j].Paths) {
+				return len(same[i].Paths) > len(same[j].Paths)
+			}
+			return same[i].Paths[0] < same[j].Paths[0]
+		})
+		sets = append(sets, LinkSet{Key: []byte(k.key), Size: same[0].Size, Files: same})
+	}
+
+	// the most space to be won first
+	sort.Slice(sets, func(i, j int) bool {
+		if sets[i].Reclaimable() != sets[j].Reclaimable() {
+			return sets[i].Reclaimable() > sets[j].Reclaimable()
+		}
+		return sets[i].Files[0].Paths[0] < sets[j].Files[0].Paths[0]
+	})
+	return sets, nil
+}
+
+// Replace the file at path with a hard link to keep, through a temporary
+// name so that path always holds the content. A file that changed since it
+// was hashed is left alone.
+func linkDuplicate(keep, path string, file *LinkedFile) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() != file.Size || !info.ModTime().Equal(file.Modified) {
+		return fmt.Errorf("%s changed since it was read", path)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".jpegger-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	err = os.Link(keep, tmp.Name())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Replace each path of one of the set's files with a hard link to the file
+// kept. Returns how many were linked.
+func (s LinkSet) Link(output string, file *LinkedFile) (int, error) {
+	keep := s.Files[0]
+	linked := 0
+	for _, rel := range file.Paths {
+		err := linkDuplicate(OutputPath(output, keep.Paths[0]), OutputPath(output, rel), file)
+		if err != nil {
+			return linked, fmt.Errorf("while linking %s to %s: %v", rel, keep.Paths[0], err)
+		}
+		linked += 1
+	}
+	return linked, nil
+}
+
+func RunDedupe(args []string) error {
+	if len(args) == 0 && Configured.Output != "" {
+		args = []string{Configured.Output}
+	}
+	if len(args) != 1 {
+		return UsageError(dedupeFlags, "expected the output directory")
+	}
+	output := args[0]
+	if IsRemote(output) {
+		return fmt.Errorf("%s: only local output directories can be deduplicated", output)
+	}
+	if _, err := os.Stat(output); err != nil {
+		return err
+	}
+
+	// the files an import placed are the ones kept, when there's a
+	// database to say which. an output from before jpegger has none
+	placed := map[string]bool{}
+	if _, err := os.Stat(*Database); err == nil {
+		if *DedupeApply {
+			lock, err := LockRun(*Database, false)
+			if err != nil {
+				return err
+			}
+			defer lock.Release()
+		}
+		db, err := OpenReadOnlyDB()
+		if err != nil {
+			return err
+		}
+		err = db.View(func(tx Tx) error {
+			return tx.Bucket([]byte(DestinationPath)).ForEach(func(rel, _ []byte) error {
+				placed[string(rel)] = true
+				return nil
+			})
+		})
+		db.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	sets, err := FindLinkSets(output, placed)
+	if err != nil {
+		return fmt.Errorf("while traversing %s: %v", output, err)
+	}
+
+	var total int64
+	linked := 0
+	for _, set := range sets {
+		keep := set.Files[0]
+		fmt.Printf("%s  %s, %d files\n", hex.EncodeToString(set.Key)[:16], HumanBytes(set.Size), len(set.Files))
+		fmt.Printf("    %s, kept\n", strings.Join(keep.Paths, ", "))
+		for _, file := range set.Files[1:] {
+			action := ""
+			if *DedupeApply {
+				n, err := set.Link(output, file)
+				linked += n
+				if err != nil {
+					return err
+				}
+				action = ", linked"
+			}
+			if !file.freed() {
+				action += ", also linked outside the output"
+			}
+			fmt.Printf("    %s%s\n", strings.Join(file.Paths, ", "), action)
+		}
+		total += set.Reclaimable()
+	}
+
+	held := HumanCount(len(sets), "piece of content", "pieces of content")
+	if *DedupeApply {
+		fmt.Printf("%s held more than once, %s linked, %s reclaimed\n", held, HumanCount(linked, "file", "files"), HumanBytes(total))
+	} else {
+		fmt.Printf("%s held more than once, %s reclaimable\n", held, HumanBytes(total))
+	}
+	return nil
+}
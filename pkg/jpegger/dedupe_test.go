@@ -0,0 +1,95 @@
+package jpegger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDedupeLink(t *testing.T) {
+	output := t.TempDir()
+	files := map[string]string{
+		"2019/04/IMG_1.jpg":      "first",
+		"2019/04/IMG_1_copy.jpg": "first",
+		"2020/01/IMG_1.jpg":      "first",
+		// as large but not the same
+		"2019/04/IMG_2.jpg": "other",
+		"2019/04/IMG_3.jpg": "third one",
+		// not a photo
+		"2019/04/notes.txt": "first",
+	}
+	for name, data := range files {
+		path := filepath.Join(output, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stat := func(name string) os.FileInfo {
+		info, err := os.Stat(filepath.Join(output, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	before := map[string]os.FileInfo{}
+	for name := range files {
+		before[name] = stat(name)
+	}
+
+	// what an import placed is kept over copies made since
+	sets, err := FindLinkSets(output, map[string]bool{"2020/01/IMG_1.jpg": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 1 {
+		t.Fatalf("found %d sets, want 1", len(sets))
+	}
+	set := sets[0]
+	if kept := set.Files[0].Paths; !equalStrings(kept, []string{"2020/01/IMG_1.jpg"}) {
+		t.Errorf("kept %v", kept)
+	}
+	if got := set.Reclaimable(); got != 2*int64(len("first")) {
+		t.Errorf("%d bytes reclaimable, want %d", got, 2*len("first"))
+	}
+	linked := 0
+	for _, file := range set.Files[1:] {
+		n, err := set.Link(output, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		linked += n
+	}
+	if linked != 2 {
+		t.Errorf("linked %d files, want 2", linked)
+	}
+
+	kept := stat("2020/01/IMG_1.jpg")
+	for _, name := range []string{"2019/04/IMG_1.jpg", "2019/04/IMG_1_copy.jpg"} {
+		if !os.SameFile(stat(name), kept) {
+			t.Errorf("%s isn't linked to the copy kept", name)
+		}
+	}
+	for _, name := range []string{"2019/04/IMG_2.jpg", "2019/04/IMG_3.jpg", "2019/04/notes.txt"} {
+		if !os.SameFile(stat(name), before[name]) || os.SameFile(stat(name), kept) {
+			t.Errorf("%s was replaced", name)
+		}
+	}
+	for name, want := range files {
+		data, err := os.ReadFile(filepath.Join(output, filepath.FromSlash(name)))
+		if err != nil || string(data) != want {
+			t.Errorf("%s holds %q, %v, want %q", name, data, err, want)
+		}
+	}
+
+	// once linked there's nothing left to do
+	sets, err = FindLinkSets(output, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 0 {
+		t.Errorf("found %d sets after linking, want none", len(sets))
+	}
+}
@@ -0,0 +1,287 @@
+package jpegger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	DoctorCommand = &Command{
+		Name:    "doctor",
+		Args:    "output_dir",
+		Summary: "check the database against the source and output trees, and repair what is safe to",
+		Flags:   doctorFlags,
+		Run:     RunDoctor,
+	}
+
+	doctorFlags = NewFlagSet("doctor", "output_dir")
+
+	DoctorFix    = doctorFlags.Bool("fix", false, "repair what can be without losing anything: forget what no longer exists so the next import places it again, and link copies back to their sources with -linked")
+	DoctorLinked = doctorFlags.Bool("linked", false, "the output was imported with -mode=link, so also report placed files that are no longer hard links of their sources")
+)
+
+// A placed file that holds the same content as a source on its
+// filesystem without being a hard link of it
+type unlinkedFile struct {
+	rel, source string
+	key         []byte
+}
+
+// Put a hard link to src in place of dest, once both are checked to hold
+// content key
+func relink(src, dest string, key []byte, algorithm string) error {
+	for _, path := range []string{src, dest} {
+		found, err := HashFile(path, algorithm)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(found, key) {
+			return fmt.Errorf("%s doesn't hold %x", path, key)
+		}
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".jpegger-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	if err = os.Link(src, tmp.Name()); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), dest); err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Forget that content was placed at rel, so the next import of one of its
+// sources places it again
+func forgetPlacement(tx Tx, rel string, key []byte) error {
+	if err := tx.Bucket([]byte(DestinationPath)).Delete([]byte(rel)); err != nil {
+		return err
+	}
+	if bytes.Equal(lookup(tx, ContentDestination, key), []byte(rel)) {
+		if err := tx.Bucket([]byte(ContentDestination)).Delete(key); err != nil {
+			return err
+		}
+	}
+	hashes := tx.Bucket([]byte(ContentHash))
+	if IsPlaced(hashes.Get(key)) {
+		return hashes.Delete(key)
+	}
+	return nil
+}
+
+func RunDoctor(args []string) error {
+	if len(args) == 0 && Configured.Output != "" {
+		args = []string{Configured.Output}
+	}
+	if len(args) != 1 {
+		return UsageError(doctorFlags, "expected the output directory")
+	}
+	output := args[0]
+	if IsRemote(output) {
+		return fmt.Errorf("%s: only local output directories can be checked", output)
+	}
+	if _, err := os.Stat(*Database); err != nil {
+		return err
+	}
+
+	var db Store
+	var err error
+	if *DoctorFix {
+		var lock *RunLock
+		if lock, err = LockRun(*Database, false); err != nil {
+			return err
+		}
+		defer lock.Release()
+		db, err = OpenStore(*Database, StoreOptions{Timeout: time.Second})
+	} else {
+		db, err = OpenReadOnlyDB()
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// what the database says, gathered before the trees are looked at
+	var noDestination [][]byte
+	var sourcePaths []string
+	destinations := map[string][]byte{}
+	placedKeys := map[string][]byte{}
+	algorithms := map[string]string{}
+	// the placed files themselves rather than their sidecars and companions
+	main := map[string]bool{}
+	var sources map[string][]string
+	err = db.View(func(tx Tx) error {
+		if b := tx.Bucket([]byte(ContentHash)); b != nil {
+			b.ForEach(func(key, state []byte) error {
+				if IsPlaced(state) && lookup(tx, ContentDestination, key) == nil {
+					noDestination = append(noDestination, append([]byte(nil), key...))
+				}
+				return nil
+			})
+		}
+		if b := tx.Bucket([]byte(SourcePath)); b != nil {
+			b.ForEach(func(path, _ []byte) error {
+				sourcePaths = append(sourcePaths, string(path))
+				return nil
+			})
+		}
+		if b := tx.Bucket([]byte(DestinationPath)); b != nil {
+			b.ForEach(func(rel, key []byte) error {
+				key = append([]byte(nil), key...)
+				destinations[string(rel)] = key
+				placedKeys[string(rel)] = PlacedKey(tx, string(rel), key)
+				algorithms[string(key)] = KeyAlgorithm(tx, key)
+				return nil
+			})
+		}
+		if b := tx.Bucket([]byte(ContentDestination)); b != nil {
+			b.ForEach(func(_, rel []byte) error {
+				main[string(rel)] = true
+				return nil
+			})
+		}
+		sources = sourcesByKey(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	problems, fixed := 0, 0
+	report := func(kind, format string, args ...interface{}) {
+		problems += 1
+		fmt.Printf("%-12s %s\n", kind, fmt.Sprintf(format, args...))
+	}
+
+	// content recorded as placed that nothing says where
+	for _, key := range noDestination {
+		report("no-dest", "content %x is recorded as placed, but not where", key)
+	}
+
+	// source paths whose files are gone
+	var gone []string
+	for _, path := range sourcePaths {
+		if isGone, _ := sourceGone(path, false); isGone {
+			gone = append(gone, path)
+			report("gone-source", "%s", path)
+		}
+	}
+
+	// placed files that are missing, or copies of a source they should be
+	// links of
+	var rels []string
+	for rel := range destinations {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	// the missing files with a source left to place them from again
+	var restorable []string
+	var unlinked []unlinkedFile
+	for _, rel := range rels {
+		key := destinations[rel]
+		info, err := os.Stat(OutputPath(output, rel))
+		if err != nil {
+			// a sidecar or companion comes back with the file it goes with
+			canRestore := false
+			for _, source := range sources[string(key)] {
+				if !main[rel] {
+					break
+				}
+				if isGone, _ := sourceGone(source, true); !isGone && !IsRemote(source) {
+					canRestore = true
+				}
+			}
+			if canRestore {
+				restorable = append(restorable, rel)
+				report("missing", "%s", rel)
+			} else if main[rel] {
+				report("missing", "%s (no source left to place it from)", rel)
+			} else {
+				report("missing", "%s", rel)
+			}
+			continue
+		}
+		// a file rewritten after placing can't be a link of its source
+		if !*DoctorLinked || !bytes.Equal(placedKeys[rel], key) || IsXMPSidecar(rel) {
+			continue
+		}
+		device, _ := fileDevice(info)
+		var candidate string
+		linked := false
+		for _, source := range sources[string(key)] {
+			srcInfo, err := os.Stat(source)
+			if err != nil || IsRemote(source) {
+				continue
+			}
+			if os.SameFile(srcInfo, info) {
+				linked = true
+				break
+			}
+			if srcDevice, _ := fileDevice(srcInfo); srcDevice == device && candidate == "" {
+				candidate = source
+			}
+		}
+		if !linked && candidate != "" {
+			unlinked = append(unlinked, unlinkedFile{rel, candidate, key})
+			report("unlinked", "%s is a copy of %s", rel, candidate)
+		}
+	}
+
+	if *DoctorFix {
+		err = db.Update(func(tx Tx) error {
+			hashes := tx.Bucket([]byte(ContentHash))
+			for _, key := range noDestination {
+				if err := hashes.Delete(key); err != nil {
+					return err
+				}
+				fixed += 1
+			}
+			for _, rel := range restorable {
+				if err := forgetPlacement(tx, rel, destinations[rel]); err != nil {
+					return err
+				}
+				fixed += 1
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(gone) > 0 {
+			result, err := PruneSources(db, false, false)
+			if err != nil {
+				return err
+			}
+			fixed += result.Pruned
+		}
+		for _, u := range unlinked {
+			err := relink(u.source, OutputPath(output, u.rel), u.key, algorithms[string(u.key)])
+			if err != nil {
+				fmt.Printf("%-12s %s: %v\n", "not-fixed", u.rel, err)
+				continue
+			}
+			fixed += 1
+		}
+	}
+
+	if *DoctorFix {
+		fmt.Printf("%d problems, %d fixed\n", problems, fixed)
+		if len(restorable) > 0 {
+			fmt.Printf("the next import of their sources places %d missing files again\n", len(restorable))
+		}
+	} else {
+		fmt.Printf("%d problems\n", problems)
+	}
+	if problems > fixed {
+		return fmt.Errorf("found %d problems", problems-fixed)
+	}
+	return nil
+}
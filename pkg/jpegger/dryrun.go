@@ -0,0 +1,173 @@
+package jpegger
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var transferModeVerbs = map[TransferMode]string{
+	TransferLink:    "link",
+	TransferCopy:    "copy",
+	TransferMove:    "move",
+	TransferReflink: "reflink",
+	TransferSymlink: "symlink",
+}
+
+// Stands in for the state machine and the output tree during a dry
+// run, remembering what would have changed so that the plan stays
+// consistent without touching either.
+type DryRunPlan struct {
+	// Plan as if ForgetCopyState ran first
+	ForgetCopyState bool
+
+	db      Store
+	out     io.Writer
+	claimed map[string]bool
+	planned map[string]bool
+
+	// the steps for -plan
+	mu      sync.Mutex
+	entries []PlanEntry
+}
+
+func NewDryRunPlan(db Store, out io.Writer) *DryRunPlan {
+	return &DryRunPlan{db: db, out: out, claimed: map[string]bool{}, planned: map[string]bool{}}
+}
+
+// Open the database for a dry run. An existing database is opened read-only
+// while a missing one is replaced by an empty throwaway copy. The returned
+// function closes the database and removes anything temporary.
+func OpenDryRunDB(dbPath string) (Store, func(), error) {
+	if _, err := os.Stat(dbPath); err == nil {
+		db, err := OpenStore(dbPath, StoreOptions{ReadOnly: true})
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, func() { db.Close() }, nil
+	}
+
+	dir, err := ioutil.TempDir("", "jpegger-dry-run")
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := OpenStore(filepath.Join(dir, "state.db"), StoreOptions{})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	err = db.Update(func(tx Tx) error {
+		for _, name := range Buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	return db, func() { db.Close(); os.RemoveAll(dir) }, nil
+}
+
+// Would CommitState have moved this content from NoFile to DiscoveredFile?
+func (d *DryRunPlan) Claim(stamp FileStamp) (bool, error) {
+	key := stamp.Key
+	if d.claimed[string(key)] {
+		return false, nil
+	}
+
+	var state []byte
+	err := d.db.View(func(tx Tx) error {
+		state = tx.Bucket([]byte(ContentHash)).Get(key)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	// ForgetCopyState would have forgotten it, unless it was rejected
+	if state != nil && (!d.ForgetCopyState || bytes.Equal(state, RejectedFile)) {
+		return false, nil
+	}
+
+	d.claimed[string(key)] = true
+	return true, nil
+}
+
+// Nothing is recorded in a dry run, but the plan says what would have been
+// placed and why it went where it did
+func (d *DryRunPlan) Placed(p Placement) error {
+	entry := StampPlanEntry(transferModeVerbs[p.Mode], p.Stamp)
+	entry.Destination = p.Path
+	switch {
+	case p.Existing:
+		entry.Action, entry.Reason = PlanExisting, "the output already holds it"
+	case p.Taken != "":
+		entry.Reason = p.Taken + " is taken"
+	case p.Partner != nil:
+		entry.Reason = "paired with " + p.Partner.Path
+	}
+	d.Plan(entry)
+	for _, sidecar := range p.Sidecars {
+		d.Plan(PlanEntry{Action: transferModeVerbs[p.Mode], Source: sidecar.Source, Destination: sidecar.Path, Of: p.Path})
+	}
+	return nil
+}
+
+// Let another file of the content be claimed, as ReleaseClaim would
+func (d *DryRunPlan) Release(stamp FileStamp) error {
+	delete(d.claimed, string(stamp.Key))
+	return nil
+}
+
+// Plan to skip content claimed before
+func (d *DryRunPlan) Skipped(stamp FileStamp) (bool, error) {
+	rejected, err := Rejected(d.db, stamp.Key)
+	if err != nil {
+		return false, err
+	}
+	entry := StampPlanEntry(PlanSkip, stamp)
+	entry.Reason = "imported before"
+	if rejected {
+		entry.Reason = "rejected"
+	}
+	d.Plan(entry)
+	return rejected, nil
+}
+
+func (d *DryRunPlan) SetAside(stamp FileStamp) (bool, error) {
+	entry := StampPlanEntry(PlanQuarantine, stamp)
+	entry.Reason = stamp.Quarantine
+	d.Plan(entry)
+	return true, nil
+}
+
+func (d *DryRunPlan) PassOver(stamp FileStamp) (bool, error) {
+	entry := StampPlanEntry(PlanDuplicate, stamp)
+	entry.Of, entry.OfHash = stamp.DuplicateOf, hex.EncodeToString(stamp.DuplicateOfKey)
+	entry.Reason = "a lesser copy of " + stamp.DuplicateOf
+	d.Plan(entry)
+	return true, nil
+}
+
+// Report the transfer that would have happened. Like Transfer, fails with
+// an os.IsExist error if the destination is taken, either on disk or by an
+// earlier step of the plan.
+func (d *DryRunPlan) Transfer(mode TransferMode, src, dest string) error {
+	_, err := os.Lstat(dest)
+	if err == nil || d.planned[dest] {
+		return &os.LinkError{Op: transferModeVerbs[mode], Old: src, New: dest, Err: os.ErrExist}
+	}
+
+	d.planned[dest] = true
+	fmt.Fprintf(d.out, "%s %s -> %s\n", transferModeVerbs[mode], src, dest)
+	return nil
+}
@@ -0,0 +1,116 @@
+package jpegger
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+)
+
+var (
+	DupesCommand = &Command{
+		Name:    "dupes",
+		Summary: "list content found at more than one source path and the space it takes",
+		Flags:   dupesFlags,
+		Run:     RunDupes,
+	}
+
+	dupesFlags = NewFlagSet("dupes", "")
+)
+
+// One piece of content and every source path it was seen at
+type DuplicateSet struct {
+	Key     []byte
+	Sources []string
+	// The size of the content, -1 if none of the sources can be found
+	Size int64
+	// How many of the sources are still there
+	Present int
+}
+
+// The space deleting all but one of the sources still present would free
+func (d DuplicateSet) Reclaimable() int64 {
+	if d.Size < 0 || d.Present < 2 {
+		return 0
+	}
+	return d.Size * int64(d.Present-1)
+}
+
+// Group the source paths by their content, keeping content seen at more
+// than one
+func FindDuplicates(tx Tx) []DuplicateSet {
+	var sets []DuplicateSet
+	for key, paths := range sourcesByKey(tx) {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		sets = append(sets, DuplicateSet{Key: []byte(key), Sources: paths, Size: -1})
+	}
+	return sets
+}
+
+// Find the size of each set from whichever of its sources are still there
+func statDuplicates(sets []DuplicateSet) {
+	for i := range sets {
+		for _, path := range sets[i].Sources {
+			if IsRemote(path) {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			sets[i].Size = info.Size()
+			sets[i].Present += 1
+		}
+	}
+}
+
+func RunDupes(args []string) error {
+	if len(args) != 0 {
+		return UsageError(dupesFlags, "unexpected arguments")
+	}
+
+	if _, err := os.Stat(*Database); err != nil {
+		return err
+	}
+	db, err := OpenReadOnlyDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var sets []DuplicateSet
+	err = db.View(func(tx Tx) error {
+		sets = FindDuplicates(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	statDuplicates(sets)
+
+	// the most space to be won first
+	sort.Slice(sets, func(i, j int) bool {
+		if sets[i].Reclaimable() != sets[j].Reclaimable() {
+			return sets[i].Reclaimable() > sets[j].Reclaimable()
+		}
+		return sets[i].Sources[0] < sets[j].Sources[0]
+	})
+
+	var total int64
+	for _, set := range sets {
+		size := "size unknown"
+		if set.Size >= 0 {
+			size = HumanBytes(set.Size)
+		}
+		fmt.Printf("%s  %s, %d copies\n", hex.EncodeToString(set.Key)[:16], size, len(set.Sources))
+		for _, path := range set.Sources {
+			fmt.Printf("    %s\n", path)
+		}
+		total += set.Reclaimable()
+	}
+	fmt.Printf("%s found more than once, %s reclaimable\n", HumanCount(len(sets), "piece of content", "pieces of content"), HumanBytes(total))
+	return nil
+}
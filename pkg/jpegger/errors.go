@@ -0,0 +1,49 @@
+package jpegger
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// Every name tried for a file in its directory holds other content
+	ErrCollision = errors.New("every name tried is taken")
+	// A file is to be named by its date, and has none
+	ErrNoDate = errors.New("it has no date to be named by")
+)
+
+// An error that stops an import under any error policy, rather than
+// failing one file: the database failing as what was done is recorded, or
+// the terminal going away mid-question
+type FatalError struct {
+	// What was being done, like "recording file"
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *FatalError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("while %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("while %s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *FatalError) Unwrap() error {
+	return e.Err
+}
+
+// Does an error stop an import rather than fail one file?
+func IsFatal(err error) bool {
+	var fatal *FatalError
+	return errors.As(err, &fatal)
+}
+
+// Why a file couldn't be given a name of its own after the one it came
+// with was taken
+func collisionError(strategy CollisionStrategy, stamp FileStamp) error {
+	if strategy == CollisionTime && stamp.Time.IsZero() {
+		return ErrNoDate
+	}
+	return ErrCollision
+}
@@ -0,0 +1,238 @@
+package jpegger
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+var LogFormats = []string{"text", "json"}
+
+// Something that happened, for the action log
+type Event struct {
+	Time        time.Time  `json:"time"`
+	Event       string     `json:"event"`
+	Run         uint64     `json:"run,omitempty"`
+	Source      string     `json:"source,omitempty"`
+	Destination string     `json:"destination,omitempty"`
+	Partner     string     `json:"partner,omitempty"`
+	Hash        string     `json:"hash,omitempty"`
+	Date        *time.Time `json:"date,omitempty"`
+	DateSource  string     `json:"date_source,omitempty"`
+	Message     string     `json:"message,omitempty"`
+}
+
+// Start an event about a file
+func StampEvent(event string, stamp FileStamp) Event {
+	e := Event{Event: event, Source: stamp.Path}
+	if stamp.Key != nil {
+		e.Hash = hex.EncodeToString(stamp.Key)
+	}
+	if !stamp.Time.IsZero() {
+		date := stamp.Time
+		e.Date = &date
+		e.DateSource = stamp.Source.String()
+	}
+	return e
+}
+
+// The line for an event in the text log. Events too chatty for the text
+// log have none.
+func (e Event) Text() string {
+	switch e.Event {
+	case "run-started":
+		return fmt.Sprintf("starting run %d: %s -> %s", e.Run, e.Source, e.Destination)
+	case "resumed":
+		return fmt.Sprintf("resuming after %s", e.Source)
+	case "watching":
+		return fmt.Sprintf("initial import queued, watching %s", e.Source)
+	case "serving":
+		return fmt.Sprintf("serving the status page on %s", e.Destination)
+	case "interrupted":
+		return fmt.Sprintf("interrupted, the next run resumes after %s", e.Source)
+	case "skipped":
+		return fmt.Sprintf("skipping handled file %s", e.Source)
+	case "empty":
+		return fmt.Sprintf("skipping empty file %s", e.Source)
+	case "too-small":
+		return fmt.Sprintf("skipping %s, only %s bytes", e.Source, e.Message)
+	case "out-of-range":
+		return fmt.Sprintf("skipping %s, dated %s", e.Source, e.Date.Format("2006-01-02"))
+	case "collision":
+		return fmt.Sprintf("%s is taken, placing %s at %s", e.Message, e.Source, e.Destination)
+	case "case-collision":
+		return fmt.Sprintf("%s differs from %s only in case", e.Destination, e.Message)
+	case "symlink-skipped":
+		if e.Message != "" {
+			return fmt.Sprintf("skipping symlink %s: %s", e.Source, e.Message)
+		}
+		return fmt.Sprintf("skipping symlink %s, see -follow-symlinks", e.Source)
+	case "other-filesystem":
+		return fmt.Sprintf("skipping %s, on another filesystem", e.Source)
+	case "ignored":
+		return fmt.Sprintf("skipping ignored %s", e.Source)
+	case "moved":
+		return fmt.Sprintf("%s was moved or renamed from %s", e.Source, e.Partner)
+	case "unsettled":
+		return fmt.Sprintf("passing over %s, modified %s ago and maybe still being written", e.Source, e.Message)
+	case "rejected":
+		return fmt.Sprintf("passing over rejected %s", e.Source)
+	case "unchanged-dir":
+		return fmt.Sprintf("passing over %s, unchanged since it was last imported", e.Source)
+	case "permission-denied":
+		return fmt.Sprintf("skipping %s, permission denied", e.Source)
+	case "unreadable-dir":
+		return fmt.Sprintf("skipping %s, can't be read: %s", e.Source, e.Message)
+	case "symlink-loop":
+		return fmt.Sprintf("skipping %s, already read through another path", e.Source)
+	case "existing":
+		return fmt.Sprintf("%s already holds %s", e.Destination, e.Source)
+	case "linked":
+		if e.Partner != "" {
+			return fmt.Sprintf("finished: %s (paired with %s)", e.Source, e.Partner)
+		}
+		return fmt.Sprintf("finished: %s", e.Source)
+	case "duplicate":
+		return fmt.Sprintf("passing over %s for %s", e.Source, e.Partner)
+	case "quarantined":
+		if e.Destination != "" {
+			return fmt.Sprintf("quarantined %s at %s: %s", e.Source, e.Destination, e.Message)
+		}
+		return fmt.Sprintf("quarantined %s: %s", e.Source, e.Message)
+	case "error":
+		if e.Source != "" {
+			return fmt.Sprintf("skipping failed file %s: %s", e.Source, e.Message)
+		}
+	case "retrying":
+		return fmt.Sprintf("retrying %s: %s", e.Source, e.Message)
+	case "io-retry":
+		return fmt.Sprintf("retrying %s after %s", e.Source, e.Message)
+	case "hook-skipped":
+		return fmt.Sprintf("skipping %s, the pre-import hook %s", e.Source, e.Message)
+	case "hook-failed":
+		return fmt.Sprintf("post-import hook for %s %s", e.Destination, e.Message)
+	case "date-written":
+		return fmt.Sprintf("wrote the date %s into %s", e.Date.Format(DateFormat), e.Destination)
+	case "date-not-written":
+		return fmt.Sprintf("left the date of %s: %s", e.Destination, e.Message)
+	case "converted":
+		if e.Message != "" {
+			return fmt.Sprintf("converted %s to %s, keeping it at %s", e.Source, e.Destination, e.Message)
+		}
+		return fmt.Sprintf("converted %s to %s", e.Source, e.Destination)
+	case "not-converted":
+		return fmt.Sprintf("left %s as HEIC: %s", e.Destination, e.Message)
+	case "rotated":
+		return fmt.Sprintf("turned %s the right way up", e.Destination)
+	case "not-rotated":
+		return fmt.Sprintf("left %s turned as it was: %s", e.Destination, e.Message)
+	case "source-removed":
+		return fmt.Sprintf("moved, removed %s", e.Source)
+	case "declined":
+		return fmt.Sprintf("leaving %s, as answered: %s", e.Source, e.Message)
+	case "apple-edit-skipped":
+		return fmt.Sprintf("skipping %s, an edit of %s kept as adjustments", e.Source, e.Partner)
+	case "sidecar":
+		return fmt.Sprintf("sidecar: %s -> %s", e.Source, e.Destination)
+	case "mirror-unavailable":
+		return fmt.Sprintf("mirror %s isn't there, a later run catches it up: %s", e.Destination, e.Message)
+	case "mirror-caught-up":
+		return fmt.Sprintf("mirror %s: copied %s files placed while it was away", e.Destination, e.Message)
+	case "mirror-failed":
+		return fmt.Sprintf("stopped mirroring to %s for this run at %s: %s", e.Destination, e.Source, e.Message)
+	case "manifest-caught-up":
+		return fmt.Sprintf("added %s files placed before to the manifests in %s", e.Message, e.Destination)
+	case "image-hashes-caught-up":
+		return fmt.Sprintf("hashed the image data of %s JPEGs placed before in %s", e.Message, e.Destination)
+	case "manifest-failed":
+		return fmt.Sprintf("couldn't list %s in its manifest, a later run tries again: %s", e.Destination, e.Message)
+	case "scrub-drift":
+		return fmt.Sprintf("scrub: %s changed: %s", e.Destination, e.Message)
+	case "scrub-missing":
+		return fmt.Sprintf("scrub: %s is missing", e.Destination)
+	case "scrub-unreadable":
+		return fmt.Sprintf("scrub: can't read %s: %s", e.Destination, e.Message)
+	case "scrub-finished":
+		return fmt.Sprintf("scrub of %s %s", e.Destination, e.Message)
+	case "scrub-failed":
+		return fmt.Sprintf("scrub of %s stopped: %s", e.Destination, e.Message)
+	case "undo-mirror-kept":
+		return fmt.Sprintf("undo %d: mirror %s isn't there, kept its copy of %s", e.Run, e.Message, e.Destination)
+	case "undo-removed":
+		return fmt.Sprintf("undo %d: removed %s", e.Run, e.Destination)
+	case "undo-kept":
+		return fmt.Sprintf("undo %d: kept changed file %s", e.Run, e.Destination)
+	case "undo-object-removed":
+		return fmt.Sprintf("undo %d: removed stored object %s", e.Run, e.Destination)
+	case "summary":
+		return fmt.Sprintf("run %d: %s", e.Run, e.Message)
+	case "stopped":
+		return fmt.Sprintf("stopped: %s", e.Message)
+	case "undo-companion-kept":
+		return fmt.Sprintf("undo %d: kept %s with %s", e.Run, e.Destination, e.Partner)
+	}
+	return e.Message
+}
+
+// Write an event to the action log in the chosen format
+func Emit(e Event) {
+	e.Time = time.Now()
+	if reporting != nil {
+		reporting.Note(e)
+	}
+	showEvent(e)
+
+	output := log.Output
+	if actionLog != nil {
+		output = actionLog.Output
+	}
+	if *LogFormat != "json" {
+		if text := e.Text(); text != "" {
+			output(2, text)
+		}
+		return
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Output(2, fmt.Sprintf("while encoding event: %v", err))
+		return
+	}
+	output(2, string(line))
+}
+
+// Where the stages of a Pipeline send their events. A nil sink is Emit,
+// to the action log.
+type EventSink func(Event)
+
+func (s EventSink) Emit(e Event) {
+	if s == nil {
+		Emit(e)
+		return
+	}
+	s(e)
+}
+
+// Sits between the standard logger and the log file in JSON mode. Events
+// have a logger of their own; what's logged directly is errors and
+// warnings, so it's wrapped up as an error event.
+type jsonLogWriter struct {
+	out io.Writer
+}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	line, err := json.Marshal(Event{
+		Time:    time.Now(),
+		Event:   "error",
+		Message: string(bytes.TrimRight(p, "\n")),
+	})
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.out.Write(append(line, '\n'))
+	return len(p), err
+}
@@ -0,0 +1,43 @@
+package jpegger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Reads the EXIF tags of a file, keyed by their libexif titles (e.g.
+// "Date and Time (Original)"). Returns NoExifData if the file has none.
+type ExifReader func(path string) (map[string]string, error)
+
+var (
+	NoExifData = fmt.Errorf("no exif data")
+
+	// Every EXIF backend compiled into this binary. The libexif backend is
+	// only present in cgo builds.
+	ExifReaders = map[string]ExifReader{
+		"native": ReadNativeExif,
+	}
+)
+
+// Pick an EXIF backend by name. An empty name selects libexif when it was
+// compiled in and the native parser otherwise.
+func SelectExifReader(name string) (ExifReader, error) {
+	if name == "" {
+		if reader, ok := ExifReaders["libexif"]; ok {
+			return reader, nil
+		}
+		name = "native"
+	}
+
+	reader, ok := ExifReaders[name]
+	if !ok {
+		var names []string
+		for n := range ExifReaders {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown exif backend %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return reader, nil
+}
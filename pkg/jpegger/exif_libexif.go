@@ -0,0 +1,29 @@
+//go:build cgo
+// +build cgo
+
+package jpegger
+
+import (
+	"github.com/xiam/exif"
+)
+
+func init() {
+	ExifReaders["libexif"] = ReadLibExif
+}
+
+// Read EXIF tags using libexif. libexif only understands JPEG so RAW, TIFF,
+// HEIF, PNG, WebP and GIF files are handed to the native parser.
+func ReadLibExif(path string) (map[string]string, error) {
+	if IsRaw(path) || IsTIFF(path) || IsHEIC(path) || IsChunkedImage(path) {
+		return ReadNativeExif(path)
+	}
+
+	data, err := exif.Read(path)
+	if err != nil {
+		if err == exif.ErrNoExifData {
+			return nil, NoExifData
+		}
+		return nil, err
+	}
+	return data.Tags, nil
+}
@@ -0,0 +1,293 @@
+package jpegger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	exifIFDPointer = 0x8769
+	gpsIFDPointer  = 0x8825
+	maxIFDEntries  = 1000
+)
+
+// Tags the native parser understands, named the way libexif titles them so
+// that either backend can satisfy ExifKeys
+var exifTagTitles = map[uint16]string{
+	0x010e: "Image Description",
+	0x010f: "Manufacturer",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x0131: "Software",
+	0x0132: "Date and Time",
+	0x9003: "Date and Time (Original)",
+	0x9004: "Date and Time (Digitized)",
+	0x9010: "Offset Time",
+	0x9011: "Offset Time Original",
+	0x9012: "Offset Time Digitized",
+	0x9291: "Sub-second Time (Original)",
+	0xa002: "Pixel X Dimension",
+	0xa003: "Pixel Y Dimension",
+}
+
+// The GPS IFD has tags of its own
+var gpsTagTitles = map[uint16]string{
+	0x0001: "North or South Latitude",
+	0x0002: "Latitude",
+	0x0003: "East or West Longitude",
+	0x0004: "Longitude",
+}
+
+// Size in bytes of one value of each TIFF field type
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// Read EXIF tags without cgo. Understands JPEG files, TIFF-based files
+// (which includes most RAW formats), Fujifilm RAF, HEIF, PNG, WebP and GIF.
+func ReadNativeExif(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 12)
+	if n, _ := io.ReadFull(f, magic); n < 4 {
+		return nil, NoExifData
+	}
+
+	switch {
+	case magic[0] == 0xff && magic[1] == 0xd8:
+		return parseJPEGExif(io.NewSectionReader(f, 2, 1<<62))
+	case bytes.Equal(magic[:4], []byte("II*\x00")) || bytes.Equal(magic[:4], []byte("MM\x00*")):
+		return ParseTIFF(f)
+	case bytes.Equal(magic[:4], []byte("FUJI")):
+		return parseRAFExif(f)
+	case bytes.Equal(magic[4:8], []byte("ftyp")):
+		return parseHEIFExif(f)
+	case bytes.Equal(magic[:8], []byte("\x89PNG\r\n\x1a\n")):
+		return parsePNGExif(f)
+	case bytes.Equal(magic[:4], []byte("RIFF")) && bytes.Equal(magic[8:], []byte("WEBP")):
+		return parseWebPExif(f)
+	case bytes.Equal(magic[:4], []byte("GIF8")):
+		return parseGIFExif(f)
+	}
+	return nil, NoExifData
+}
+
+// Fujifilm RAF files aren't TIFF based but embed a JPEG preview that
+// carries the EXIF data
+func parseRAFExif(f *os.File) (map[string]string, error) {
+	header := make([]byte, 92)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, NoExifData
+	}
+	if !bytes.HasPrefix(header, []byte("FUJIFILMCCD-RAW")) {
+		return nil, NoExifData
+	}
+
+	offset := int64(binary.BigEndian.Uint32(header[84:]))
+	length := int64(binary.BigEndian.Uint32(header[88:]))
+	if length < 4 {
+		return nil, NoExifData
+	}
+	return parseJPEGExif(io.NewSectionReader(f, offset+2, length-2))
+}
+
+func parseJPEGExif(r io.Reader) (map[string]string, error) {
+	segment, err := findJPEGExif(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTIFF(bytes.NewReader(segment))
+}
+
+// Walk the JPEG markers following the start of image and return the TIFF
+// payload of the Exif APP1 segment
+func findJPEGExif(in io.Reader) ([]byte, error) {
+	r := bufio.NewReader(in)
+
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return nil, NoExifData
+		}
+		if marker[0] != 0xff {
+			return nil, NoExifData
+		}
+		// standalone markers carry no length
+		if marker[1] == 0x01 || (marker[1] >= 0xd0 && marker[1] <= 0xd7) {
+			continue
+		}
+		// metadata always comes before the start of scan
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return nil, NoExifData
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return nil, NoExifData
+		}
+		body := make([]byte, length-2)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, NoExifData
+		}
+
+		if marker[1] == 0xe1 && bytes.HasPrefix(body, []byte("Exif\x00\x00")) {
+			return body[6:], nil
+		}
+	}
+}
+
+// Decode the IFD0, Exif IFD and GPS IFD tags of a TIFF structure
+func ParseTIFF(r io.ReaderAt) (map[string]string, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, NoExifData
+	}
+
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, NoExifData
+	}
+	if order.Uint16(header[2:]) != 42 {
+		return nil, NoExifData
+	}
+
+	p := &tiffParser{r: r, order: order, tags: map[string]string{}, seen: map[uint32]bool{}}
+	err := p.readIFD(order.Uint32(header[4:]), exifTagTitles)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.tags) == 0 {
+		return nil, NoExifData
+	}
+	return p.tags, nil
+}
+
+type tiffParser struct {
+	r     io.ReaderAt
+	order binary.ByteOrder
+	tags  map[string]string
+	seen  map[uint32]bool
+}
+
+func (p *tiffParser) readIFD(offset uint32, titles map[uint16]string) error {
+	if offset == 0 || p.seen[offset] {
+		return nil
+	}
+	p.seen[offset] = true
+
+	countBuf := make([]byte, 2)
+	if _, err := p.r.ReadAt(countBuf, int64(offset)); err != nil {
+		return fmt.Errorf("reading IFD at %d: %v", offset, err)
+	}
+	count := p.order.Uint16(countBuf)
+	if count > maxIFDEntries {
+		return fmt.Errorf("IFD at %d claims %d entries", offset, count)
+	}
+
+	entries := make([]byte, 12*int(count))
+	if _, err := p.r.ReadAt(entries, int64(offset)+2); err != nil {
+		return fmt.Errorf("reading IFD at %d: %v", offset, err)
+	}
+
+	for i := 0; i < int(count); i++ {
+		entry := entries[12*i : 12*i+12]
+		tag := p.order.Uint16(entry[0:])
+
+		if tag == exifIFDPointer {
+			err := p.readIFD(p.order.Uint32(entry[8:]), titles)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if tag == gpsIFDPointer {
+			err := p.readIFD(p.order.Uint32(entry[8:]), gpsTagTitles)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		title, ok := titles[tag]
+		if !ok {
+			continue
+		}
+		value, err := p.readValue(entry)
+		if err != nil {
+			// one bad tag shouldn't hide the rest
+			continue
+		}
+		p.tags[title] = value
+	}
+
+	return nil
+}
+
+// Format the value of an IFD entry the way libexif would for simple types
+func (p *tiffParser) readValue(entry []byte) (string, error) {
+	typ := p.order.Uint16(entry[2:])
+	count := p.order.Uint32(entry[4:])
+
+	size, ok := tiffTypeSizes[typ]
+	if !ok || count == 0 || count > 1<<16 {
+		return "", fmt.Errorf("unsupported field type %d", typ)
+	}
+
+	raw := entry[8:12]
+	if size*count > 4 {
+		raw = make([]byte, size*count)
+		_, err := p.r.ReadAt(raw, int64(p.order.Uint32(entry[8:])))
+		if err != nil {
+			return "", err
+		}
+	} else {
+		raw = raw[:size*count]
+	}
+
+	switch typ {
+	case 2: // ASCII
+		return strings.TrimRight(string(raw), "\x00 "), nil
+	case 3: // SHORT
+		values := make([]string, count)
+		for i := range values {
+			values[i] = strconv.Itoa(int(p.order.Uint16(raw[2*i:])))
+		}
+		return strings.Join(values, ", "), nil
+	case 4: // LONG
+		values := make([]string, count)
+		for i := range values {
+			values[i] = strconv.FormatUint(uint64(p.order.Uint32(raw[4*i:])), 10)
+		}
+		return strings.Join(values, ", "), nil
+	case 5: // RATIONAL
+		values := make([]string, count)
+		for i := range values {
+			num := p.order.Uint32(raw[8*i:])
+			den := p.order.Uint32(raw[8*i+4:])
+			if den == 0 {
+				values[i] = "0"
+			} else {
+				values[i] = strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+			}
+		}
+		return strings.Join(values, ", "), nil
+	case 7: // UNDEFINED, usually text
+		return strings.TrimRight(string(raw), "\x00 "), nil
+	}
+	return "", fmt.Errorf("unsupported field type %d", typ)
+}
@@ -0,0 +1,208 @@
+package jpegger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// Offsets into what buildTIFF writes, for tests that spoil it
+const (
+	tiffIFD0      = 8
+	tiffExifIFD   = 38
+	tiffDateValue = 68
+)
+
+// A TIFF structure like a camera writes: the make in IFD0, and the date
+// taken and orientation in the Exif IFD it points to
+func buildTIFF(order binary.ByteOrder) []byte {
+	var b bytes.Buffer
+	w := func(v interface{}) {
+		binary.Write(&b, order, v)
+	}
+	if order == binary.LittleEndian {
+		b.WriteString("II")
+	} else {
+		b.WriteString("MM")
+	}
+	w(uint16(42))
+	w(uint32(tiffIFD0))
+
+	w(uint16(2))
+	w(uint16(0x010f))
+	w(uint16(2))
+	w(uint32(4))
+	b.WriteString("Foo\x00")
+	w(uint16(exifIFDPointer))
+	w(uint16(4))
+	w(uint32(1))
+	w(uint32(tiffExifIFD))
+	w(uint32(0))
+
+	w(uint16(2))
+	w(uint16(0x9003))
+	w(uint16(2))
+	w(uint32(20))
+	w(uint32(tiffDateValue))
+	w(uint16(0x0112))
+	w(uint16(3))
+	w(uint32(1))
+	w(uint16(6))
+	w(uint16(0))
+	w(uint32(0))
+
+	b.WriteString("2019:04:05 10:11:12\x00")
+	return b.Bytes()
+}
+
+func TestParseTIFF(t *testing.T) {
+	whole := map[string]string{
+		"Manufacturer":             "Foo",
+		"Date and Time (Original)": "2019:04:05 10:11:12",
+		"Orientation":              "6",
+	}
+	tests := []struct {
+		name  string
+		spoil func(b []byte, order binary.ByteOrder) []byte
+		want  map[string]string
+		// any error at all, rather than NoExifData
+		wantErr bool
+	}{
+		{"whole", nil, whole, false},
+		{"empty", func(b []byte, order binary.ByteOrder) []byte {
+			return nil
+		}, nil, false},
+		{"header only", func(b []byte, order binary.ByteOrder) []byte {
+			return b[:tiffIFD0]
+		}, nil, true},
+		{"unknown byte order", func(b []byte, order binary.ByteOrder) []byte {
+			copy(b, "XX")
+			return b
+		}, nil, false},
+		{"not 42", func(b []byte, order binary.ByteOrder) []byte {
+			order.PutUint16(b[2:], 43)
+			return b
+		}, nil, false},
+		{"no IFD", func(b []byte, order binary.ByteOrder) []byte {
+			order.PutUint32(b[4:], 0)
+			return b
+		}, nil, false},
+		{"too many entries", func(b []byte, order binary.ByteOrder) []byte {
+			order.PutUint16(b[tiffIFD0:], maxIFDEntries+1)
+			return b
+		}, nil, true},
+		{"entries past the end", func(b []byte, order binary.ByteOrder) []byte {
+			order.PutUint16(b[tiffIFD0:], 500)
+			return b
+		}, nil, true},
+		{"exif IFD past the end", func(b []byte, order binary.ByteOrder) []byte {
+			order.PutUint32(b[tiffIFD0+2+12+8:], 1<<30)
+			return b
+		}, nil, true},
+		{"exif IFD pointing back", func(b []byte, order binary.ByteOrder) []byte {
+			order.PutUint32(b[tiffIFD0+2+12+8:], tiffIFD0)
+			return b
+		}, map[string]string{"Manufacturer": "Foo"}, false},
+		{"value past the end", func(b []byte, order binary.ByteOrder) []byte {
+			order.PutUint32(b[tiffExifIFD+2+8:], 1<<30)
+			return b
+		}, map[string]string{"Manufacturer": "Foo", "Orientation": "6"}, false},
+		{"huge count", func(b []byte, order binary.ByteOrder) []byte {
+			order.PutUint32(b[tiffExifIFD+2+4:], 1<<31)
+			return b
+		}, map[string]string{"Manufacturer": "Foo", "Orientation": "6"}, false},
+		{"unknown type", func(b []byte, order binary.ByteOrder) []byte {
+			order.PutUint16(b[tiffExifIFD+2+12+2:], 99)
+			return b
+		}, map[string]string{"Manufacturer": "Foo", "Date and Time (Original)": "2019:04:05 10:11:12"}, false},
+		{"value cut short", func(b []byte, order binary.ByteOrder) []byte {
+			return b[:tiffDateValue+10]
+		}, map[string]string{"Manufacturer": "Foo", "Orientation": "6"}, false},
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, test := range tests {
+			t.Run(order.String()+"/"+test.name, func(t *testing.T) {
+				b := buildTIFF(order)
+				if test.spoil != nil {
+					b = test.spoil(b, order)
+				}
+				got, err := ParseTIFF(bytes.NewReader(b))
+				switch {
+				case test.wantErr:
+					if err == nil || err == NoExifData {
+						t.Errorf("got %v, %v, want an error reading it", got, err)
+					}
+				case test.want == nil:
+					if err != NoExifData {
+						t.Errorf("got %v, %v, want NoExifData", got, err)
+					}
+				case err != nil:
+					t.Errorf("got %v", err)
+				case !reflect.DeepEqual(got, test.want):
+					t.Errorf("got %v, want %v", got, test.want)
+				}
+			})
+		}
+	}
+}
+
+// However little of it is there, a TIFF structure never panics or loops
+func TestParseTIFFTruncated(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		b := buildTIFF(order)
+		for n := 0; n < len(b); n++ {
+			tags, err := ParseTIFF(bytes.NewReader(b[:n]))
+			if err == nil && len(tags) == 3 {
+				t.Errorf("%s cut to %d bytes: read all of %v", order, n, tags)
+			}
+		}
+	}
+}
+
+func TestFindJPEGExif(t *testing.T) {
+	tiff := buildTIFF(binary.BigEndian)
+	segment := func(marker byte, body []byte) []byte {
+		s := []byte{0xff, marker, 0, 0}
+		binary.BigEndian.PutUint16(s[2:], uint16(len(body)+2))
+		return append(s, body...)
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	exif := segment(0xe1, append([]byte("Exif\x00\x00"), tiff...))
+
+	tests := []struct {
+		name string
+		// what follows the start of image
+		jpeg []byte
+		want []byte
+	}{
+		{"first", exif, tiff},
+		{"after JFIF", join(segment(0xe0, []byte("JFIF\x00\x01\x02")), exif), tiff},
+		{"after XMP", join(segment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00")), exif), tiff},
+		{"after a restart marker", join([]byte{0xff, 0xd0}, exif), tiff},
+		{"empty", nil, nil},
+		{"after the scan starts", join(segment(0xda, []byte{1, 2}), exif), nil},
+		{"after the end of image", join([]byte{0xff, 0xd9}, exif), nil},
+		{"not a marker", join([]byte{0x12, 0x34}, exif), nil},
+		{"length under 2", join([]byte{0xff, 0xe0, 0, 1}, exif), nil},
+		{"length past the end", exif[:len(exif)-1], nil},
+		{"cut in the length", exif[:3], nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := findJPEGExif(bytes.NewReader(test.jpeg))
+			if test.want == nil {
+				if err != NoExifData {
+					t.Errorf("got %d bytes, %v, want NoExifData", len(got), err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, test.want) {
+				t.Errorf("got %d bytes, %v, want the %d of the TIFF structure", len(got), err, len(test.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package jpegger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	dateTimeOriginal = 0x9003
+
+	// Files placed in the output whose content was changed after placing,
+	// by path relative to the output, and the key of what they hold now
+	Rewritten = "Rewritten"
+)
+
+var NoExifDateTag = fmt.Errorf("the EXIF has no DateTimeOriginal to replace")
+
+// Set the DateTimeOriginal of a JPEG. An existing date is overwritten where
+// it is, and a JPEG without EXIF gets a small EXIF segment holding only the
+// date. Nothing else in the file changes. EXIF without the tag is left
+// alone, as adding it means rewriting the EXIF, and NoExifDateTag is
+// returned. The file keeps its modification time.
+func WriteExifDate(path string, t time.Time) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	value := []byte(t.Format(DateFormat) + "\x00")
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	segment, insertAt, err := locateJPEGExif(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if segment >= 0 {
+		err = patchExifDate(f, segment, value)
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+	} else {
+		f.Close()
+		err = insertExifSegment(path, info, insertAt, newExifSegment(value))
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
+
+// Find where the TIFF payload of the Exif APP1 segment starts, or -1 if
+// there is none and where a new one belongs: after the SOI and any JFIF
+// APP0
+func locateJPEGExif(f *os.File) (int64, int64, error) {
+	r := bufio.NewReader(f)
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return -1, 0, fmt.Errorf("not a JPEG")
+	}
+
+	offset, insertAt := int64(2), int64(2)
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return -1, 0, fmt.Errorf("damaged JPEG at %d", offset)
+		}
+		// standalone markers carry no length
+		if marker[1] == 0x01 || (marker[1] >= 0xd0 && marker[1] <= 0xd7) {
+			offset += 2
+			continue
+		}
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return -1, insertAt, nil
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return -1, 0, fmt.Errorf("damaged JPEG at %d", offset)
+		}
+		body := make([]byte, length-2)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return -1, 0, fmt.Errorf("damaged JPEG at %d", offset)
+		}
+
+		if marker[1] == 0xe1 && bytes.HasPrefix(body, []byte("Exif\x00\x00")) {
+			return offset + 4 + 6, insertAt, nil
+		}
+		start := offset
+		offset += 2 + int64(length)
+		if marker[1] == 0xe0 && start == insertAt {
+			insertAt = offset
+		}
+	}
+}
+
+// Overwrite the DateTimeOriginal in the Exif IFD of the TIFF structure at
+// start
+func patchExifDate(f *os.File, start int64, value []byte) error {
+	tiff := io.NewSectionReader(f, start, 1<<62)
+	header := make([]byte, 8)
+	if _, err := tiff.ReadAt(header, 0); err != nil {
+		return NoExifDateTag
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return NoExifDateTag
+	}
+
+	exifIFD, ok := findIFDEntry(tiff, order, order.Uint32(header[4:]), exifIFDPointer)
+	if !ok {
+		return NoExifDateTag
+	}
+	entry, ok := findIFDEntry(tiff, order, order.Uint32(exifIFD[8:]), dateTimeOriginal)
+	if !ok || order.Uint16(entry[2:]) != 2 || order.Uint32(entry[4:]) < uint32(len(value)) {
+		return NoExifDateTag
+	}
+	_, err := f.WriteAt(value, start+int64(order.Uint32(entry[8:])))
+	return err
+}
+
+// The 12 byte entry for a tag in the IFD at offset
+func findIFDEntry(r io.ReaderAt, order binary.ByteOrder, offset uint32, tag uint16) ([]byte, bool) {
+	countBuf := make([]byte, 2)
+	if offset == 0 {
+		return nil, false
+	}
+	if _, err := r.ReadAt(countBuf, int64(offset)); err != nil {
+		return nil, false
+	}
+	count := order.Uint16(countBuf)
+	if count > maxIFDEntries {
+		return nil, false
+	}
+	entries := make([]byte, 12*int(count))
+	if _, err := r.ReadAt(entries, int64(offset)+2); err != nil {
+		return nil, false
+	}
+	for i := 0; i < int(count); i++ {
+		entry := entries[12*i : 12*i+12]
+		if order.Uint16(entry) == tag {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// An Exif APP1 segment holding just a DateTimeOriginal: IFD0 pointing to
+// an Exif IFD with the one tag
+func newExifSegment(value []byte) []byte {
+	order := binary.BigEndian
+	tiff := make([]byte, 44+len(value))
+	copy(tiff, "MM\x00\x2a")
+	order.PutUint32(tiff[4:], 8)
+
+	// IFD0 at 8
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], exifIFDPointer)
+	order.PutUint16(tiff[12:], 4)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint32(tiff[18:], 26)
+
+	// Exif IFD at 26
+	order.PutUint16(tiff[26:], 1)
+	order.PutUint16(tiff[28:], dateTimeOriginal)
+	order.PutUint16(tiff[30:], 2)
+	order.PutUint32(tiff[32:], uint32(len(value)))
+	order.PutUint32(tiff[36:], 44)
+	copy(tiff[44:], value)
+
+	segment := []byte{0xff, 0xe1, 0, 0}
+	order.PutUint16(segment[2:], uint16(2+6+len(tiff)))
+	segment = append(segment, "Exif\x00\x00"...)
+	return append(segment, tiff...)
+}
+
+// Write a copy of the file with the segment at offset and rename it into
+// place
+func insertExifSegment(path string, info os.FileInfo, offset int64, segment []byte) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".jpegger-")
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tmp, in, offset)
+	if err == nil {
+		_, err = tmp.Write(segment)
+	}
+	if err == nil {
+		_, err = io.Copy(tmp, in)
+	}
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Does a file hold a different DateTimeOriginal than the date it was placed
+// by?
+func ExifDateDiffers(path string, t time.Time) bool {
+	tags, err := ReadNativeExif(path)
+	if err != nil {
+		return true
+	}
+	return tags[exifTagTitles[dateTimeOriginal]] != t.Format(DateFormat)
+}
+
+// Remember the key of a placed file whose content was changed after it
+// was placed
+func RecordRewritten(db Store, relPath string, key []byte) error {
+	return db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte(Rewritten)).Put([]byte(relPath), key)
+	})
+}
+
+// The key of what a file placed in the output should hold: key, unless it
+// was rewritten after placing
+func PlacedKey(tx Tx, relPath string, key []byte) []byte {
+	if rewritten := lookup(tx, Rewritten, []byte(relPath)); rewritten != nil {
+		return rewritten
+	}
+	return key
+}
@@ -0,0 +1,305 @@
+package jpegger
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Bumped when the meaning of the export changes
+const ExportVersion = 1
+
+// The whole database in a form that can be read and edited. Hashes are
+// hex, states are named as in StateNames and paths are as stored.
+type StateExport struct {
+	Version int `json:"version"`
+	// hash -> state
+	Content map[string]string `json:"content"`
+	// source path -> hash
+	Sources map[string]string `json:"sources"`
+	// path relative to the output -> hash
+	Destinations map[string]string `json:"destinations"`
+	// hash -> path relative to the output
+	ContentDestinations map[string]string `json:"content_destinations"`
+	// hash -> hash of the other half
+	Pairs       map[string]string `json:"pairs"`
+	Runs        []ExportedRun     `json:"runs"`
+	Checkpoints map[string]string `json:"checkpoints"`
+	// hash -> algorithm that made it, where recorded
+	KeyAlgorithms map[string]string `json:"key_algorithms,omitempty"`
+	// prefilter key -> first source path with it
+	Prefilters map[string]string `json:"prefilters,omitempty"`
+	// prefilter key -> full hash of its content
+	PrefilterHashes map[string]string `json:"prefilter_hashes,omitempty"`
+	// source path -> why it couldn't be read
+	Quarantined map[string]string `json:"quarantined,omitempty"`
+	// source path -> the last error importing it
+	FileErrors map[string]string `json:"file_errors,omitempty"`
+	// hash of a lesser copy of a shot -> hash of the copy kept
+	Duplicates map[string]string `json:"duplicates,omitempty"`
+	// hash -> when it was taken
+	Dates map[string]string `json:"dates,omitempty"`
+	// path relative to the output -> hash of what it holds since it was
+	// rewritten
+	Rewritten map[string]string `json:"rewritten,omitempty"`
+	// hash -> its caption, keywords and rating as JSON
+	Descriptions map[string]string `json:"descriptions,omitempty"`
+	// path relative to the output, a NUL and a mirror's root -> hash of
+	// the copy there
+	Mirrored map[string]string `json:"mirrored,omitempty"`
+	// path relative to the output, a NUL and the root it was found under
+	// -> when a scrub last found it intact
+	Scrubbed map[string]string `json:"scrubbed,omitempty"`
+	// path relative to the output of a sidecar or companion -> that of the
+	// file it goes with
+	Companions map[string]string `json:"companions,omitempty"`
+	// hash -> the burst directory it was placed in, relative to the output
+	Bursts map[string]string `json:"bursts,omitempty"`
+	// a question asked with -interactive, a slash and the hex of the
+	// content, or the question alone for all content -> the answer
+	Decisions map[string]string `json:"decisions,omitempty"`
+	// the hex of the image data of a placed JPEG -> the hex of its content,
+	// with -image-hash
+	ImageHashes map[string]string `json:"image_hashes,omitempty"`
+	// the hex of the content of a placed JPEG -> the hex of its image data
+	ContentImageHashes map[string]string `json:"content_image_hashes,omitempty"`
+	// the hex of the content -> the camera it was taken with and where, as
+	// JSON
+	Shots map[string]string `json:"shots,omitempty"`
+	// the hex of the content -> its tags, as a JSON list
+	Tags map[string]string `json:"tags,omitempty"`
+	// source path -> its size and modification time when it was hashed, as
+	// JSON
+	SourceStats map[string]string `json:"source_stats,omitempty"`
+	// the hex of the content -> when it last moved into each state, as JSON
+	StateTimes map[string]string `json:"state_times,omitempty"`
+}
+
+type ExportedRun struct {
+	ID      uint64    `json:"id"`
+	Started time.Time `json:"started"`
+	Input   string    `json:"input"`
+	Output  string    `json:"output"`
+	// path relative to the output -> hash
+	Files map[string]string `json:"files"`
+}
+
+// Copy a bucket into a map, formatting keys and values as strings
+func exportBucket(tx Tx, name string, key, value func([]byte) string) map[string]string {
+	result := map[string]string{}
+	if b := tx.Bucket([]byte(name)); b != nil {
+		b.ForEach(func(k, v []byte) error {
+			if v != nil { // skip nested buckets
+				result[key(k)] = value(v)
+			}
+			return nil
+		})
+	}
+	return result
+}
+
+func asString(b []byte) string {
+	return string(b)
+}
+
+func ExportState(tx Tx, out io.Writer) error {
+	state := StateExport{
+		Version:             ExportVersion,
+		Content:             exportBucket(tx, ContentHash, hex.EncodeToString, StateName),
+		Sources:             exportBucket(tx, SourcePath, asString, hex.EncodeToString),
+		Destinations:        exportBucket(tx, DestinationPath, asString, hex.EncodeToString),
+		ContentDestinations: exportBucket(tx, ContentDestination, hex.EncodeToString, asString),
+		Pairs:               exportBucket(tx, Pairs, hex.EncodeToString, hex.EncodeToString),
+		Checkpoints:         exportBucket(tx, Checkpoints, asString, asString),
+		KeyAlgorithms:       exportBucket(tx, KeyAlgorithms, hex.EncodeToString, asString),
+		Prefilters:          exportBucket(tx, Prefilters, hex.EncodeToString, asString),
+		PrefilterHashes:     exportBucket(tx, PrefilterHashes, hex.EncodeToString, hex.EncodeToString),
+		Quarantined:         exportBucket(tx, Quarantined, asString, asString),
+		FileErrors:          exportBucket(tx, FileErrors, asString, asString),
+		Duplicates:          exportBucket(tx, Duplicates, hex.EncodeToString, hex.EncodeToString),
+		Dates:               exportBucket(tx, ContentDates, hex.EncodeToString, asString),
+		Rewritten:           exportBucket(tx, Rewritten, asString, hex.EncodeToString),
+		Descriptions:        exportBucket(tx, Descriptions, hex.EncodeToString, asString),
+		Mirrored:            exportBucket(tx, Mirrored, asString, hex.EncodeToString),
+		Scrubbed:            exportBucket(tx, Scrubbed, asString, asString),
+		Companions:          exportBucket(tx, Companions, asString, asString),
+		Bursts:              exportBucket(tx, Bursts, hex.EncodeToString, asString),
+		Decisions:           exportBucket(tx, Decisions, asString, asString),
+		ImageHashes:         exportBucket(tx, ImageHashes, hex.EncodeToString, hex.EncodeToString),
+		ContentImageHashes:  exportBucket(tx, ContentImageHashes, hex.EncodeToString, hex.EncodeToString),
+		Shots:               exportBucket(tx, Shots, hex.EncodeToString, asString),
+		Tags:                exportBucket(tx, Tags, hex.EncodeToString, asString),
+		SourceStats:         exportBucket(tx, SourceStats, asString, asString),
+		StateTimes:          exportBucket(tx, StateTimes, hex.EncodeToString, asString),
+	}
+
+	runs, err := ListRuns(tx)
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		files := map[string]string{}
+		if b := tx.Bucket([]byte(RunFiles)); b != nil {
+			if runFiles := b.Bucket(RunKey(run.ID)); runFiles != nil {
+				runFiles.ForEach(func(k, v []byte) error {
+					files[string(k)] = hex.EncodeToString(v)
+					return nil
+				})
+			}
+		}
+		state.Runs = append(state.Runs, ExportedRun{run.ID, run.Started, run.Input, run.Output, files})
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(state)
+}
+
+// The stored form of a state name
+func parseStateName(name string) ([]byte, error) {
+	for _, s := range StateNames {
+		if s.Name == name {
+			return s.State, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown state %q", name)
+}
+
+func fromHex(s string) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash %q", s)
+	}
+	return b, nil
+}
+
+func fromString(s string) ([]byte, error) {
+	return []byte(s), nil
+}
+
+func parseDate(s string) ([]byte, error) {
+	if _, err := time.Parse(time.RFC3339, s); err != nil {
+		return nil, fmt.Errorf("invalid date %q", s)
+	}
+	return []byte(s), nil
+}
+
+// Fill an emptied bucket from a map, parsing keys and values back
+func importBucket(tx Tx, name string, entries map[string]string, key, value func(string) ([]byte, error)) error {
+	b := tx.Bucket([]byte(name))
+	for k, v := range entries {
+		kb, err := key(k)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		vb, err := value(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", name, k, err)
+		}
+		if err = b.Put(kb, vb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace everything in the database with an export. Runs as one
+// transaction, so a bad export changes nothing.
+func ImportState(db Store, in io.Reader) error {
+	var state StateExport
+	decoder := json.NewDecoder(in)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&state)
+	if err != nil {
+		return fmt.Errorf("while reading export: %v", err)
+	}
+	if state.Version != ExportVersion {
+		return fmt.Errorf("export is version %d, expected %d", state.Version, ExportVersion)
+	}
+
+	return db.Update(func(tx Tx) error {
+		for _, name := range Buckets {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != ErrBucketNotFound {
+				return err
+			}
+			if _, err = tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+
+		imports := []struct {
+			bucket     string
+			entries    map[string]string
+			key, value func(string) ([]byte, error)
+		}{
+			{ContentHash, state.Content, fromHex, parseStateName},
+			{SourcePath, state.Sources, fromString, fromHex},
+			{DestinationPath, state.Destinations, fromString, fromHex},
+			{ContentDestination, state.ContentDestinations, fromHex, fromString},
+			{Pairs, state.Pairs, fromHex, fromHex},
+			{Checkpoints, state.Checkpoints, fromString, fromString},
+			{KeyAlgorithms, state.KeyAlgorithms, fromHex, fromString},
+			{Prefilters, state.Prefilters, fromHex, fromString},
+			{PrefilterHashes, state.PrefilterHashes, fromHex, fromHex},
+			{Quarantined, state.Quarantined, fromString, fromString},
+			{FileErrors, state.FileErrors, fromString, fromString},
+			{Duplicates, state.Duplicates, fromHex, fromHex},
+			{ContentDates, state.Dates, fromHex, parseDate},
+			{Rewritten, state.Rewritten, fromString, fromHex},
+			{Descriptions, state.Descriptions, fromHex, fromString},
+			{Mirrored, state.Mirrored, fromString, fromHex},
+			{Scrubbed, state.Scrubbed, fromString, fromString},
+			{Companions, state.Companions, fromString, fromString},
+			{Bursts, state.Bursts, fromHex, fromString},
+			{Decisions, state.Decisions, fromString, fromString},
+			{ImageHashes, state.ImageHashes, fromHex, fromHex},
+			{ContentImageHashes, state.ContentImageHashes, fromHex, fromHex},
+			{Shots, state.Shots, fromHex, fromString},
+			{Tags, state.Tags, fromHex, fromString},
+			{SourceStats, state.SourceStats, fromString, fromString},
+			{StateTimes, state.StateTimes, fromHex, fromString},
+		}
+		for _, i := range imports {
+			err := importBucket(tx, i.bucket, i.entries, i.key, i.value)
+			if err != nil {
+				return err
+			}
+		}
+
+		runs := tx.Bucket([]byte(Runs))
+		runFiles := tx.Bucket([]byte(RunFiles))
+		for _, run := range state.Runs {
+			info, err := json.Marshal(RunInfo{Started: run.Started, Input: run.Input, Output: run.Output})
+			if err != nil {
+				return err
+			}
+			if err = runs.Put(RunKey(run.ID), info); err != nil {
+				return err
+			}
+			// later runs must be numbered after the imported ones
+			if run.ID > runs.Sequence() {
+				if err = runs.SetSequence(run.ID); err != nil {
+					return err
+				}
+			}
+
+			files, err := runFiles.CreateBucket(RunKey(run.ID))
+			if err != nil {
+				return fmt.Errorf("run %d: %v", run.ID, err)
+			}
+			for rel, hash := range run.Files {
+				key, err := fromHex(hash)
+				if err != nil {
+					return fmt.Errorf("run %d: %s: %v", run.ID, rel, err)
+				}
+				if err = files.Put([]byte(rel), key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
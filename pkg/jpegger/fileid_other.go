@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package jpegger
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// The device and inode of a file, which every path to it shares
+func fileIdentity(name string, info os.FileInfo) string {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+	}
+	return name
+}
+
+// The filesystem a file is on
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev), true
+	}
+	return 0, false
+}
+
+// How many hard links a file has
+func fileLinks(info os.FileInfo) (uint64, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink), true
+	}
+	return 0, false
+}
@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package jpegger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The path of a file with its symlinks and junctions resolved, which every
+// path to it shares. Windows paths ignore case.
+func fileIdentity(name string, info os.FileInfo) string {
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		resolved = name
+	}
+	abs, err := filepath.Abs(resolved)
+	if err == nil {
+		resolved = abs
+	}
+	return strings.ToLower(resolved)
+}
+
+// Windows mounts volumes under directories without a cheap way to tell, so
+// everything counts as one filesystem
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// Counting links needs the file open on Windows, so it's left unknown
+func fileLinks(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
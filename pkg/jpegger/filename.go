@@ -0,0 +1,50 @@
+package jpegger
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Filename patterns that carry a date, most specific first. Each captures
+// the year, month and day and optionally the hour, minute and second.
+var filenameDatePatterns = []*regexp.Regexp{
+	// IMG_20190714_183022.jpg, PXL_20190714_183022123.jpg,
+	// Screenshot_20190714-183022.png
+	regexp.MustCompile(`(?:^|[^0-9])(\d{4})(\d{2})(\d{2})[_-](\d{2})(\d{2})(\d{2})`),
+	// 2019-07-14 18.30.22.jpg, Screenshot 2019-07-14 at 18.30.22.png,
+	// Screenshot_2019-07-14-18-30-22.png
+	regexp.MustCompile(`(?:^|[^0-9])(\d{4})-(\d{2})-(\d{2})(?: at |[ _-])(\d{2})[.:-](\d{2})[.:-](\d{2})`),
+	// VID-20190714-WA0001.mp4, IMG-20190714-WA0001.jpg from WhatsApp
+	regexp.MustCompile(`(?:^|[^0-9])(\d{4})(\d{2})(\d{2})-WA\d`),
+	// 2019-07-14.jpg
+	regexp.MustCompile(`(?:^|[^0-9])(\d{4})-(\d{2})-(\d{2})(?:[^0-9]|$)`),
+}
+
+// Work out when a file was taken from its name. Like EXIF dates, it's the
+// time on the clock of whatever named it.
+func FilenameDate(name string) (time.Time, bool) {
+	base := filepath.Base(name)
+	for _, pattern := range filenameDatePatterns {
+		m := pattern.FindStringSubmatch(base)
+		if m == nil {
+			continue
+		}
+
+		fields := make([]int, 6)
+		for i, s := range m[1:] {
+			fields[i], _ = strconv.Atoi(s)
+		}
+		date := time.Date(fields[0], time.Month(fields[1]), fields[2],
+			fields[3], fields[4], fields[5], 0, time.UTC)
+
+		// time.Date rolls over things like month 13; such a name isn't a date
+		valid := date.Year() == fields[0] && int(date.Month()) == fields[1] && date.Day() == fields[2] &&
+			date.Hour() == fields[3] && date.Minute() == fields[4] && date.Second() == fields[5]
+		if valid && date.Year() >= 1970 && date.Before(time.Now().AddDate(1, 0, 0)) {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,178 @@
+package jpegger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// What each source directory looked like when a run last finished it,
+	// by its absolute path, as JSON
+	DirFingerprints = "DirFingerprints"
+)
+
+var SkipUnchanged = importFlags.Bool("skip-unchanged", false, "pass over source directories whose entries haven't changed since a run with the same flags finished them, without looking at their files. a file rewritten in place, leaving its directory as it was, is missed")
+
+// What a directory looked like, from its own modification time and the
+// names in it, which take no look at the files themselves
+type DirFingerprint struct {
+	ModTime time.Time `json:"mtime"`
+	Entries int       `json:"entries"`
+	// A hash of the names, sorted
+	Names string `json:"names"`
+	// The flags of the run, so other settings look at everything again
+	Settings string `json:"settings"`
+	// Its subdirectories, to go on into without reading it
+	Dirs []string `json:"dirs,omitempty"`
+}
+
+// Does the directory look the same?
+func (f DirFingerprint) Same(other DirFingerprint) bool {
+	return f.ModTime.Equal(other.ModTime) && f.Entries == other.Entries && f.Names == other.Names && f.Settings == other.Settings
+}
+
+// A hash of every import flag's value
+func ImportSettings() string {
+	h := sha256.New()
+	importFlags.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(h, "%s=%s\x00", f.Name, f.Value.String())
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func fingerprintDir(path, settings string) (DirFingerprint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return DirFingerprint{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return DirFingerprint{}, err
+	}
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return DirFingerprint{}, err
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00", name)
+	}
+	return DirFingerprint{
+		ModTime:  info.ModTime(),
+		Entries:  len(names),
+		Names:    hex.EncodeToString(h.Sum(nil)),
+		Settings: settings,
+	}, nil
+}
+
+// Tells a walk which directories are unchanged since a run finished them,
+// and remembers the ones it read for Save
+type Fingerprinter struct {
+	db       Store
+	settings string
+
+	mu sync.Mutex
+	// fingerprints taken before reading each directory
+	taken map[string]DirFingerprint
+	// the directories read through
+	walked map[string]DirFingerprint
+}
+
+func NewFingerprinter(db Store, settings string) *Fingerprinter {
+	return &Fingerprinter{
+		db:       db,
+		settings: settings,
+		taken:    map[string]DirFingerprint{},
+		walked:   map[string]DirFingerprint{},
+	}
+}
+
+// Is the directory the same as when a run last finished it? If so, the
+// subdirectories to go on into.
+func (f *Fingerprinter) Unchanged(path string) ([]string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, false
+	}
+	// taken before the directory is read, so a change while it is read
+	// shows next time
+	now, err := fingerprintDir(path, f.settings)
+	if err != nil {
+		return nil, false
+	}
+	f.mu.Lock()
+	_, again := f.taken[abs]
+	if !again {
+		f.taken[abs] = now
+	}
+	f.mu.Unlock()
+
+	var before DirFingerprint
+	f.db.View(func(tx Tx) error {
+		if value := lookup(tx, DirFingerprints, []byte(abs)); value != nil {
+			json.Unmarshal(value, &before)
+		}
+		return nil
+	})
+	if !now.Same(before) {
+		return nil, false
+	}
+	// the progress meter walks the inputs too
+	if !again {
+		Emit(Event{Event: "unchanged-dir", Source: path})
+	}
+	return before.Dirs, true
+}
+
+// Note a directory read through, with its subdirectories
+func (f *Fingerprinter) Walked(path string, dirs []string) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fingerprint, ok := f.taken[abs]; ok {
+		fingerprint.Dirs = dirs
+		f.walked[abs] = fingerprint
+	}
+}
+
+// Record the directories read through, except those holding a file that
+// failed, so the next run tries it again
+func (f *Fingerprinter) Save(failed []string) error {
+	retry := map[string]bool{}
+	for _, path := range failed {
+		if abs, err := filepath.Abs(filepath.Dir(path)); err == nil {
+			retry[abs] = true
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.db.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte(DirFingerprints))
+		for dir, fingerprint := range f.walked {
+			if retry[dir] {
+				continue
+			}
+			value, err := json.Marshal(fingerprint)
+			if err != nil {
+				return err
+			}
+			if err = b.Put([]byte(dir), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,231 @@
+package jpegger
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Files in an io/fs filesystem, like a zip archive, or an in-memory tree
+// for testing with testing/fstest. Files are named by Root followed by
+// their path in the filesystem. Like an S3 source, each file is copied
+// once to a hidden file in the staging directory.
+type FSSource struct {
+	FS   fs.FS
+	Root string
+	// The name of the files whose patterns leave things out, as for a
+	// directory. Empty reads none.
+	IgnoreFile string
+	staging    string
+	closer     io.Closer
+
+	mu      sync.Mutex
+	fetched map[string]bool
+}
+
+func NewFSSource(fsys fs.FS, root, staging string) *FSSource {
+	return &FSSource{
+		FS:      fsys,
+		Root:    strings.TrimSuffix(filepath.ToSlash(root), "/"),
+		staging: staging,
+		fetched: map[string]bool{},
+	}
+}
+
+// Is a name a zip archive, or a file in one? The files in an archive are
+// named by its path followed by theirs in it. A directory named like an
+// archive is just a directory, while a name whose archive is gone is still
+// taken as one, as it was recorded from it.
+func IsZip(name string) bool {
+	slashed := filepath.ToSlash(name)
+	lower := strings.ToLower(slashed)
+	for i := 0; ; {
+		j := strings.Index(lower[i:], ".zip")
+		if j < 0 {
+			return false
+		}
+		i += j + len(".zip")
+		if i < len(lower) && lower[i] != '/' {
+			continue
+		}
+		info, err := os.Stat(filepath.FromSlash(slashed[:i]))
+		if os.IsNotExist(err) || err == nil && info.Mode().IsRegular() {
+			return true
+		}
+	}
+}
+
+// Read the files in a zip archive, like a Google Takeout download, without
+// unpacking it first
+func OpenZipSource(archive, staging string) (*FSSource, error) {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	source := NewFSSource(r, archive, staging)
+	source.closer = r
+	return source, nil
+}
+
+// The path in the filesystem of a file named by the source
+func (s *FSSource) rel(name string) (string, error) {
+	rel := strings.TrimPrefix(filepath.ToSlash(name), s.Root+"/")
+	if rel == filepath.ToSlash(name) || !fs.ValidPath(rel) {
+		return "", fmt.Errorf("%s is not in %s", name, s.Root)
+	}
+	return rel, nil
+}
+
+func (s *FSSource) Walk(after string, callback func(os.FileInfo, string) error) error {
+	var rels []string
+	ignores := NewFSIgnorer(s.FS, s.IgnoreFile)
+	err := fs.WalkDir(s.FS, ".", func(rel string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel != "." && ignores.Ignored(rel, entry.IsDir()) {
+			Emit(Event{Event: "ignored", Source: s.Root + "/" + rel})
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			rels = append(rels, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the order names compare in, which is how far a walk got is kept
+	sort.Strings(rels)
+	for _, rel := range rels {
+		if after != "" && rel <= after {
+			continue
+		}
+		info, err := fs.Stat(s.FS, rel)
+		if err != nil {
+			return err
+		}
+		if err = callback(info, s.Root+"/"+rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FSSource) Fetch(name string) (string, error) {
+	rel, err := s.rel(name)
+	if err != nil {
+		return "", err
+	}
+	in, err := s.FS.Open(rel)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	// keep the extension, some EXIF readers go by it
+	f, err := os.CreateTemp(s.staging, ".jpegger-fetch-*"+path.Ext(rel))
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.fetched[f.Name()] = true
+	s.mu.Unlock()
+
+	_, err = io.Copy(f, in)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.Release(f.Name())
+		return "", fmt.Errorf("while reading %s: %v", name, err)
+	}
+	return f.Name(), nil
+}
+
+func (s *FSSource) Release(local string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetched[local] {
+		os.Remove(local)
+		delete(s.fetched, local)
+	}
+}
+
+// Remove anything fetched but never placed, and close the archive
+func (s *FSSource) Close() error {
+	s.mu.Lock()
+	for local := range s.fetched {
+		os.Remove(local)
+	}
+	s.fetched = map[string]bool{}
+	s.mu.Unlock()
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// Scans any Source, like an FSSource, an S3 bucket or an SFTP host,
+// reading EXIF with ReadExif. Each file is fetched for the rest of the
+// pipeline and let go of once it's done with.
+type SourceScanner struct {
+	Source   Source
+	ReadExif ExifReader
+	// Take dates from Google Takeout sidecars
+	Takeout bool
+	// Corrects the dates found
+	Clock Clock
+	// The files to scan, FlagFilter's if nil
+	Filter *FileFilter
+}
+
+// Files with EXIF that can't be read are found with Quarantine set. Each
+// is kept fetched until the pipeline releases it.
+func (s SourceScanner) Scan(ctx context.Context, found func(FileStamp) error) error {
+	filter := scanFilter(s.Filter)
+	err := s.Source.Walk("", func(file os.FileInfo, name string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !filter.Match(name) {
+			return nil
+		}
+		local, err := s.Source.Fetch(name)
+		if err != nil {
+			return err
+		}
+		stamp, _, err := DateFile(name, local, file, DateOptions{ReadExif: s.ReadExif, Takeout: s.Takeout, Clock: s.Clock})
+		if unread, ok := err.(*UnreadableError); ok {
+			stamp.Quarantine = unread.Reason
+		} else if err != nil {
+			s.Source.Release(local)
+			return err
+		}
+		if err = found(stamp); err != nil {
+			s.Source.Release(local)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Let go of a file fetched for the pipeline
+func (s SourceScanner) Release(stamp FileStamp) {
+	s.Source.Release(stamp.Local)
+}
@@ -0,0 +1,382 @@
+package jpegger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	GalleryCommand = &Command{
+		Name:    "gallery",
+		Args:    "output_dir",
+		Summary: "write a static HTML gallery of the output directory, by year and month",
+		Flags:   galleryFlags,
+		Run:     RunGallery,
+	}
+
+	galleryFlags = NewFlagSet("gallery", "output_dir")
+
+	ThumbnailSize = galleryFlags.Int("thumbnail-size", 240, "the longest side of each thumbnail in pixels")
+)
+
+const (
+	// Where the gallery is written, under the output directory
+	GalleryDir = "gallery"
+	// How many samples a side each thumbnail pixel averages
+	thumbnailSamples = 4
+)
+
+// A file in the gallery
+type GalleryItem struct {
+	// Relative to the output directory, with slashes
+	RelPath string
+	Taken   time.Time
+	// Relative to the gallery, empty if the file can't be shown
+	Thumbnail string
+}
+
+func (g GalleryItem) Name() string {
+	return path.Base(g.RelPath)
+}
+
+// The files taken in one month
+type GalleryMonth struct {
+	Month time.Time
+	Items []GalleryItem
+}
+
+func (g GalleryMonth) Page() string {
+	return g.Month.Format("2006-01") + ".html"
+}
+
+// The months of one year, newest first
+type GalleryYear struct {
+	Year   int
+	Months []*GalleryMonth
+}
+
+// When each file in the output was taken: from the database where it
+// recorded the date, and otherwise from the file as an import would date it
+func galleryItems(output string, dates map[string]time.Time, readExif ExifReader) ([]GalleryItem, error) {
+	var items []GalleryItem
+	err := WithOutputFiles(output, func(file os.FileInfo, name string) error {
+		rel, _ := filepath.Rel(output, name)
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(rel, GalleryDir+"/") || strings.HasPrefix(rel, QuarantineDir+"/") || strings.HasPrefix(rel, OriginalsDir+"/") || strings.HasPrefix(rel, ObjectsDir+"/") || !ValidName(rel) {
+			return nil
+		}
+		taken, ok := dates[rel]
+		if !ok {
+			stamp, _, _ := DateFile(name, name, file, DateOptions{ReadExif: readExif, Clock: FlagClock()})
+			taken = stamp.Time
+			if taken.IsZero() {
+				taken = file.ModTime()
+			}
+		}
+		items = append(items, GalleryItem{RelPath: rel, Taken: taken})
+		return nil
+	})
+	return items, err
+}
+
+// The recorded date of everything placed in the output, by its path there
+func destinationDates(db Store) (map[string]time.Time, error) {
+	dates := map[string]time.Time{}
+	err := db.View(func(tx Tx) error {
+		b := tx.Bucket([]byte(DestinationPath))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(rel, key []byte) error {
+			if taken, ok := ContentDate(tx, key); ok {
+				dates[string(rel)] = taken
+			}
+			return nil
+		})
+	})
+	return dates, err
+}
+
+// Group files by the year and month they were taken, newest first and
+// oldest first within a month
+func GroupGallery(items []GalleryItem) []*GalleryYear {
+	months := map[time.Time]*GalleryMonth{}
+	for _, item := range items {
+		month := time.Date(item.Taken.Year(), item.Taken.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if months[month] == nil {
+			months[month] = &GalleryMonth{Month: month}
+		}
+		months[month].Items = append(months[month].Items, item)
+	}
+
+	var sorted []*GalleryMonth
+	for _, m := range months {
+		sort.Slice(m.Items, func(i, j int) bool {
+			if !m.Items[i].Taken.Equal(m.Items[j].Taken) {
+				return m.Items[i].Taken.Before(m.Items[j].Taken)
+			}
+			return m.Items[i].RelPath < m.Items[j].RelPath
+		})
+		sorted = append(sorted, m)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Month.After(sorted[j].Month)
+	})
+
+	var years []*GalleryYear
+	for _, m := range sorted {
+		if len(years) == 0 || years[len(years)-1].Year != m.Month.Year() {
+			years = append(years, &GalleryYear{Year: m.Month.Year()})
+		}
+		year := years[len(years)-1]
+		year.Months = append(year.Months, m)
+	}
+	return years
+}
+
+// Make a thumbnail of a JPEG no more than size pixels a side, unless one
+// newer than the file is there already. Other files can't be decoded and
+// get none.
+func MakeThumbnail(src, dest string, size int) (bool, error) {
+	if !hasExtension(src, JPEGExtensions) {
+		return false, nil
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false, err
+	}
+	if info, err := os.Stat(dest); err == nil && info.ModTime().After(srcInfo.ModTime()) {
+		return true, nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	img, err := jpeg.Decode(ReadThrottle.Reader(f))
+	f.Close()
+	if err != nil {
+		// not every camera writes a JPEG Go can read
+		return false, nil
+	}
+
+	thumb := shrink(img, size)
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".jpegger-")
+	if err != nil {
+		return false, err
+	}
+	err = jpeg.Encode(tmp, thumb, &jpeg.Options{Quality: 80})
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// Scale an image down to fit in a square, averaging a few samples for
+// each pixel rather than reading every pixel of a large photo
+func shrink(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	n := uint32(thumbnailSamples * thumbnailSamples)
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			var r, g, b uint32
+			for sy := 0; sy < thumbnailSamples; sy++ {
+				for sx := 0; sx < thumbnailSamples; sx++ {
+					px := bounds.Min.X + (x*thumbnailSamples+sx)*w/(tw*thumbnailSamples)
+					py := bounds.Min.Y + (y*thumbnailSamples+sy)*h/(th*thumbnailSamples)
+					cr, cg, cb, _ := img.At(px, py).RGBA()
+					r, g, b = r+cr, g+cg, b+cb
+				}
+			}
+			i := thumb.PixOffset(x, y)
+			thumb.Pix[i] = uint8(r / n >> 8)
+			thumb.Pix[i+1] = uint8(g / n >> 8)
+			thumb.Pix[i+2] = uint8(b / n >> 8)
+			thumb.Pix[i+3] = 0xff
+		}
+	}
+	return thumb
+}
+
+// The thumbnail of a file, named after its path in the output so that a
+// file placed at the same path again replaces it
+func thumbnailName(rel string) string {
+	sum := sha256.Sum256([]byte(rel))
+	return path.Join("thumbnails", hex.EncodeToString(sum[:8])+".jpg")
+}
+
+var galleryStyle = `<style>
+body { font-family: sans-serif; margin: 1em; color: #222; }
+h2 { margin-top: 1.5em; }
+.grid { display: flex; flex-wrap: wrap; gap: .5em; }
+.grid a { display: flex; align-items: center; justify-content: center; width: {{.Size}}px; height: {{.Size}}px; background: #eee; color: #555; text-decoration: none; overflow: hidden; font-size: small; }
+.grid img { max-width: 100%; max-height: 100%; }
+</style>`
+
+var galleryIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Photos</title>
+{{template "style" .}}
+</head>
+<body>
+<h1>Photos</h1>
+{{range .Years}}<h2>{{.Year}}</h2>
+<ul>
+{{range .Months}}<li><a href="{{.Page}}">{{.Month.Format "January"}}</a> ({{len .Items}})</li>
+{{end}}</ul>
+{{else}}<p>Nothing has been imported yet.</p>{{end}}
+</body>
+</html>
+`))
+
+var galleryPage = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Month.Month.Format "January 2006"}}</title>
+{{template "style" .}}
+</head>
+<body>
+<p><a href="index.html">All photos</a></p>
+<h1>{{.Month.Month.Format "January 2006"}}</h1>
+<div class="grid">
+{{range .Month.Items}}<a href="../{{.RelPath}}" title="{{.Name}}">{{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="{{.Name}}" loading="lazy">{{else}}{{.Name}}{{end}}</a>
+{{end}}</div>
+</body>
+</html>
+`))
+
+func init() {
+	template.Must(galleryIndex.New("style").Parse(galleryStyle))
+	template.Must(galleryPage.New("style").Parse(galleryStyle))
+}
+
+func writeGalleryPage(name string, tmpl *template.Template, data interface{}) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = tmpl.Execute(f, data)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+func RunGallery(args []string) error {
+	if len(args) != 1 {
+		return UsageError(galleryFlags, "expected the output directory")
+	}
+	output := args[0]
+	if IsRemote(output) {
+		return UsageError(galleryFlags, "the gallery needs a local output directory")
+	}
+	if *ThumbnailSize < 16 {
+		return UsageError(galleryFlags, "-thumbnail-size must be at least 16")
+	}
+
+	// the dates the database recorded are the ones the layout used
+	dates := map[string]time.Time{}
+	if _, err := os.Stat(*Database); err == nil {
+		db, err := OpenReadOnlyDB()
+		if err != nil {
+			return err
+		}
+		dates, err = destinationDates(db)
+		db.Close()
+		if err != nil {
+			return err
+		}
+	}
+	readExif, err := SelectExifReader("")
+	if err != nil {
+		return err
+	}
+
+	items, err := galleryItems(output, dates, readExif)
+	if err != nil {
+		return err
+	}
+
+	gallery := filepath.Join(output, GalleryDir)
+	err = EnsureDir(filepath.Join(gallery, "thumbnails"))
+	if err != nil {
+		return err
+	}
+	thumbnails := 0
+	for i := range items {
+		name := thumbnailName(items[i].RelPath)
+		src := filepath.Join(output, filepath.FromSlash(items[i].RelPath))
+		ok, err := MakeThumbnail(src, filepath.Join(gallery, filepath.FromSlash(name)), *ThumbnailSize)
+		if err != nil {
+			return fmt.Errorf("while making a thumbnail of %s: %v", src, err)
+		}
+		if ok {
+			items[i].Thumbnail = name
+			thumbnails += 1
+		}
+	}
+
+	years := GroupGallery(items)
+	for _, year := range years {
+		for _, month := range year.Months {
+			data := struct {
+				Size  int
+				Month *GalleryMonth
+			}{*ThumbnailSize, month}
+			err = writeGalleryPage(filepath.Join(gallery, month.Page()), galleryPage, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	data := struct {
+		Size  int
+		Years []*GalleryYear
+	}{*ThumbnailSize, years}
+	err = writeGalleryPage(filepath.Join(gallery, "index.html"), galleryIndex, data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d files, %d with thumbnails, in %s\n", len(items), thumbnails, filepath.Join(gallery, "index.html"))
+	return nil
+}
@@ -0,0 +1,165 @@
+package jpegger
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Where a photo was taken, by name
+type Place struct {
+	Country string
+	City    string
+}
+
+// A city from the reverse-geocoding dataset
+type geoCity struct {
+	Name      string
+	Country   string
+	Latitude  float64
+	Longitude float64
+}
+
+// Finds the nearest city to a point without any network calls, using a
+// GeoNames cities file (e.g. cities15000.txt from
+// https://download.geonames.org/export/dump/). Country names come from
+// countryInfo.txt beside it if it's there; otherwise countries are named by
+// their ISO code.
+type Geocoder struct {
+	cities    []geoCity
+	countries map[string]string
+}
+
+func LoadGeocoder(citiesPath string) (*Geocoder, error) {
+	g := &Geocoder{countries: map[string]string{}}
+
+	err := readGeoNames(citiesPath, func(fields []string) error {
+		if len(fields) < 9 {
+			return fmt.Errorf("expected a GeoNames cities file")
+		}
+		lat, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			return err
+		}
+		lon, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			return err
+		}
+		g.cities = append(g.cities, geoCity{fields[1], fields[8], lat, lon})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(g.cities) == 0 {
+		return nil, fmt.Errorf("%s lists no cities", citiesPath)
+	}
+
+	countryPath := filepath.Join(filepath.Dir(citiesPath), "countryInfo.txt")
+	err = readGeoNames(countryPath, func(fields []string) error {
+		if len(fields) > 4 {
+			g.countries[fields[0]] = fields[4]
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Call a function with the fields of each line of a GeoNames file
+func readGeoNames(path string, callback func([]string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.HasPrefix(scanner.Text(), "#") {
+			continue
+		}
+		err = callback(strings.Split(scanner.Text(), "\t"))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Name the place nearest a point
+func (g *Geocoder) Lookup(lat, lon float64) Place {
+	best, bestDistance := 0, math.Inf(1)
+	for i, city := range g.cities {
+		// an equirectangular approximation is plenty to pick the nearest
+		x := (city.Longitude - lon) * math.Cos((city.Latitude+lat)*math.Pi/360)
+		y := city.Latitude - lat
+		if distance := x*x + y*y; distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+
+	city := g.cities[best]
+	country, ok := g.countries[city.Country]
+	if !ok {
+		country = city.Country
+	}
+	return Place{placeName(country), placeName(city.Name)}
+}
+
+// Keep a name to one directory
+func placeName(name string) string {
+	return strings.NewReplacer("/", "-", "\\", "-").Replace(strings.TrimSpace(name))
+}
+
+// Read the position from the GPS tags, given as degrees, minutes and
+// seconds
+func ExifPosition(tags map[string]string) (float64, float64, bool) {
+	lat, ok := parseDegrees(tags["Latitude"])
+	if !ok {
+		return 0, 0, false
+	}
+	lon, ok := parseDegrees(tags["Longitude"])
+	if !ok {
+		return 0, 0, false
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(tags["North or South Latitude"]), "S") {
+		lat = -lat
+	}
+	if strings.HasPrefix(strings.TrimSpace(tags["East or West Longitude"]), "W") {
+		lon = -lon
+	}
+	// cameras without a fix write zeroes
+	if lat == 0 && lon == 0 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+func parseDegrees(value string) (float64, bool) {
+	parts := strings.Split(value, ",")
+	if value == "" || len(parts) > 3 {
+		return 0, false
+	}
+
+	degrees := 0.0
+	scale := 1.0
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return 0, false
+		}
+		degrees += n / scale
+		scale *= 60
+	}
+	return degrees, true
+}
@@ -0,0 +1,86 @@
+package jpegger
+
+import (
+	"path"
+	"strings"
+)
+
+// A repeatable flag of glob patterns. The defaults hold until the flag is
+// first given.
+type GlobList struct {
+	Patterns []string
+	set      bool
+}
+
+func (g *GlobList) String() string {
+	if g == nil {
+		return ""
+	}
+	return strings.Join(g.Patterns, ", ")
+}
+
+func (g *GlobList) Set(pattern string) error {
+	if _, err := path.Match(strings.Replace(pattern, "**", "*", -1), ""); err != nil {
+		return err
+	}
+	if !g.set {
+		g.Patterns, g.set = nil, true
+	}
+	g.Patterns = append(g.Patterns, pattern)
+	return nil
+}
+
+// Does any pattern match the path?
+func (g *GlobList) Match(name string) bool {
+	for _, pattern := range g.Patterns {
+		if MatchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match a glob against a slash separated path. A pattern without a slash,
+// like *.tmp or Thumbnails, matches any one component of the path. Other
+// patterns match the path or any trailing part of it, and ** in them
+// matches any number of directories.
+func MatchGlob(pattern, name string) bool {
+	names := strings.Split(name, "/")
+	if !strings.Contains(pattern, "/") {
+		for _, n := range names {
+			if ok, _ := path.Match(pattern, n); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	patterns := strings.Split(pattern, "/")
+	for i := range names {
+		if matchComponents(patterns, names[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchComponents(patterns, names []string) bool {
+	if len(patterns) == 0 {
+		return len(names) == 0
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchComponents(patterns[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(patterns[0], names[0]); !ok {
+		return false
+	}
+	return matchComponents(patterns[1:], names[1:])
+}
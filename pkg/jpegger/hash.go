@@ -0,0 +1,150 @@
+package jpegger
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/zeebo/xxh3"
+	"hash"
+	"io"
+	"lukechampine.com/blake3"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// The algorithm that made each key. Keys without an entry predate
+	// -hash and were made with sha256.
+	KeyAlgorithms = "KeyAlgorithms"
+
+	DefaultHash = "sha256"
+)
+
+// Every algorithm content can be keyed with
+var HashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+	"xxh3":   func() hash.Hash { return xxh3Hash128{xxh3.New()} },
+}
+
+// xxh3 with its 128 bit digest. 64 bits is too few to tell a lifetime of
+// photos apart.
+type xxh3Hash128 struct {
+	*xxh3.Hasher
+}
+
+func (h xxh3Hash128) Size() int {
+	return 16
+}
+
+func (h xxh3Hash128) Sum(b []byte) []byte {
+	sum := h.Sum128().Bytes()
+	return append(b, sum[:]...)
+}
+
+func CheckHashAlgorithm(algorithm string) error {
+	if _, ok := HashAlgorithms[algorithm]; ok {
+		return nil
+	}
+	var names []string
+	for name := range HashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown hash %q (available: %s)", algorithm, strings.Join(names, ", "))
+}
+
+// Hash the contents of a file, starting over if reading it fails for a
+// moment
+func HashFile(path, algorithm string) ([]byte, error) {
+	if algorithm == PrefilterHash {
+		return QuickKey(path)
+	}
+	if err := CheckHashAlgorithm(algorithm); err != nil {
+		return nil, err
+	}
+
+	var sum []byte
+	err := RetryIO(path, func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := HashAlgorithms[algorithm]()
+		if _, err = io.Copy(h, ReadThrottle.Reader(f)); err != nil {
+			return err
+		}
+		sum = h.Sum(nil)
+		return nil
+	})
+	return sum, err
+}
+
+// The algorithm that made a key
+func KeyAlgorithm(tx Tx, key []byte) string {
+	if b := tx.Bucket([]byte(KeyAlgorithms)); b != nil {
+		if name := b.Get(key); name != nil {
+			return string(name)
+		}
+	}
+	return DefaultHash
+}
+
+// Record the algorithm that made a key. A key keeps the algorithm first
+// recorded for it.
+func RecordKeyAlgorithm(tx Tx, key []byte, algorithm string) error {
+	b := tx.Bucket([]byte(KeyAlgorithms))
+	if b.Get(key) != nil {
+		return nil
+	}
+	return b.Put(key, []byte(algorithm))
+}
+
+// How many pieces of content each algorithm keyed. More than one means the
+// same content could be known under two keys.
+func ContentAlgorithms(tx Tx) map[string]int {
+	counts := map[string]int{}
+	if b := tx.Bucket([]byte(ContentHash)); b != nil {
+		b.ForEach(func(key, _ []byte) error {
+			counts[KeyAlgorithm(tx, key)] += 1
+			return nil
+		})
+	}
+	return counts
+}
+
+// The algorithm most of the content was keyed with
+func MainAlgorithm(counts map[string]int) string {
+	best := DefaultHash
+	for name, n := range counts {
+		if n > counts[best] || (n == counts[best] && name < best) {
+			best = name
+		}
+	}
+	return best
+}
+
+// Refuse to key new content with a different algorithm than the database
+// already uses, as content seen before would be imported again. Prefilter
+// keys need -prefilter to be matched.
+func CheckDatabaseAlgorithm(db Store, algorithm string, prefilter bool) error {
+	var counts map[string]int
+	err := db.View(func(tx Tx) error {
+		counts = ContentAlgorithms(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for name, n := range counts {
+		if name == PrefilterHash && !prefilter {
+			return fmt.Errorf("the database keys %d files by their prefilter. use -prefilter", n)
+		}
+		if name != algorithm && name != PrefilterHash && n > 0 {
+			return fmt.Errorf("the database keys %d files with %s. use -hash=%s or a new database", n, name, name)
+		}
+	}
+	return nil
+}
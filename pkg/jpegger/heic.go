@@ -0,0 +1,178 @@
+package jpegger
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// HEIF stills, as taken by iPhones
+var HEICExtensions = []string{".heic", ".heif"}
+
+// Is the path a HEIF image?
+func IsHEIC(name string) bool {
+	return hasExtension(name, HEICExtensions)
+}
+
+// HEIF keeps EXIF as an item of the meta box. iinf says which item it is
+// and iloc where its data is. The data starts with the offset of the TIFF
+// header within it.
+func parseHEIFExif(f *os.File) (map[string]string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	atoms, err := readAtoms(io.NewSectionReader(f, 0, info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := findAtom(atoms, "meta")
+	if !ok || meta.Body.Size() < 4 {
+		return nil, NoExifData
+	}
+
+	// meta is a full box, so its version and flags come first
+	children, err := readAtoms(io.NewSectionReader(meta.Body, 4, meta.Body.Size()-4))
+	if err != nil {
+		return nil, err
+	}
+	iinf, ok := findAtom(children, "iinf")
+	if !ok {
+		return nil, NoExifData
+	}
+	iloc, ok := findAtom(children, "iloc")
+	if !ok {
+		return nil, NoExifData
+	}
+
+	id, err := findHEIFItem(iinf.Body, "Exif")
+	if err != nil {
+		return nil, err
+	}
+	offset, length, err := locateHEIFItem(iloc.Body, id)
+	if err != nil {
+		return nil, err
+	}
+
+	item := io.NewSectionReader(f, offset, length)
+	header := make([]byte, 4)
+	if _, err := item.ReadAt(header, 0); err != nil {
+		return nil, NoExifData
+	}
+	tiffStart := 4 + int64(binary.BigEndian.Uint32(header))
+	if tiffStart >= length {
+		return nil, NoExifData
+	}
+	return ParseTIFF(io.NewSectionReader(item, tiffStart, length-tiffStart))
+}
+
+// Find the ID of the first item of a type in an iinf box
+func findHEIFItem(r *io.SectionReader, itemType string) (uint32, error) {
+	version := make([]byte, 1)
+	if _, err := r.ReadAt(version, 0); err != nil {
+		return 0, NoExifData
+	}
+	// the entry count is 16 bits in version 0 and 32 after
+	start := int64(6)
+	if version[0] != 0 {
+		start = 8
+	}
+	if start > r.Size() {
+		return 0, NoExifData
+	}
+
+	entries, err := readAtoms(io.NewSectionReader(r, start, r.Size()-start))
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if entry.Type != "infe" {
+			continue
+		}
+
+		// only versions 2 and 3 carry an item type
+		header := make([]byte, 14)
+		n, _ := entry.Body.ReadAt(header, 0)
+		switch {
+		case n >= 12 && header[0] == 2 && string(header[8:12]) == itemType:
+			return uint32(binary.BigEndian.Uint16(header[4:6])), nil
+		case n >= 14 && header[0] == 3 && string(header[10:14]) == itemType:
+			return binary.BigEndian.Uint32(header[4:8]), nil
+		}
+	}
+	return 0, NoExifData
+}
+
+// Find where an item's data is in the file using an iloc box. Only items
+// stored as one extent of the file itself are supported, which is how
+// cameras store EXIF.
+func locateHEIFItem(r *io.SectionReader, id uint32) (int64, int64, error) {
+	data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(data) < 6 {
+		return 0, 0, NoExifData
+	}
+
+	version := data[0]
+	offsetSize := int(data[4] >> 4)
+	lengthSize := int(data[4] & 0xf)
+	baseOffsetSize := int(data[5] >> 4)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(data[5] & 0xf)
+	}
+
+	pos := 6
+	truncated := false
+	read := func(size int) uint64 {
+		if pos+size > len(data) {
+			truncated = true
+			return 0
+		}
+		var value uint64
+		for _, b := range data[pos : pos+size] {
+			value = value<<8 | uint64(b)
+		}
+		pos += size
+		return value
+	}
+
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count := read(idSize)
+	for i := uint64(0); i < count && !truncated; i++ {
+		itemID := read(idSize)
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			method = read(2) & 0xf
+		}
+		read(2) // data reference index
+		base := read(baseOffsetSize)
+		extents := read(2)
+
+		var offset, length uint64
+		for e := uint64(0); e < extents; e++ {
+			read(indexSize)
+			extentOffset := read(offsetSize)
+			extentLength := read(lengthSize)
+			if e == 0 {
+				offset, length = extentOffset, extentLength
+			}
+		}
+
+		if uint32(itemID) == id && !truncated {
+			if method != 0 || extents != 1 || length == 0 {
+				return 0, 0, fmt.Errorf("unsupported location for HEIF item %d", id)
+			}
+			return int64(base + offset), int64(length), nil
+		}
+	}
+	return 0, 0, NoExifData
+}
@@ -0,0 +1,76 @@
+package jpegger
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// A shell command run for each file an import places, with the file
+// described in its environment:
+//
+//	JPEGGER_SOURCE       where the file was found
+//	JPEGGER_DESTINATION  where it was placed, empty before it is
+//	JPEGGER_HASH         the hex key of its content
+//	JPEGGER_DATE         when it was taken, in RFC 3339
+//	JPEGGER_DATE_SOURCE  where that date came from, e.g. exif
+//	JPEGGER_RUN          the import run
+type Hook struct {
+	Command string
+}
+
+// A hook that exited with a failure status
+type HookFailed struct {
+	Status int
+	Output string
+}
+
+func (e *HookFailed) Error() string {
+	output := strings.TrimSpace(e.Output)
+	if output == "" {
+		return fmt.Sprintf("exited with status %d", e.Status)
+	}
+	return fmt.Sprintf("exited with status %d: %s", e.Status, output)
+}
+
+// A hook for the command, nil if there is none
+func NewHook(command string) *Hook {
+	if command == "" {
+		return nil
+	}
+	return &Hook{Command: command}
+}
+
+// Run the hook for a file. An error is a *HookFailed if the command ran
+// and failed.
+func (h *Hook) Run(run uint64, stamp FileStamp, dest string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", h.Command)
+	} else {
+		cmd = exec.Command("sh", "-c", h.Command)
+	}
+
+	date := ""
+	if !stamp.Time.IsZero() {
+		date = stamp.Time.Format(time.RFC3339)
+	}
+	cmd.Env = append(os.Environ(),
+		"JPEGGER_SOURCE="+stamp.Path,
+		"JPEGGER_DESTINATION="+dest,
+		"JPEGGER_HASH="+hex.EncodeToString(stamp.Key),
+		"JPEGGER_DATE="+date,
+		"JPEGGER_DATE_SOURCE="+stamp.Source.String(),
+		fmt.Sprintf("JPEGGER_RUN=%d", run),
+	)
+
+	output, err := cmd.CombinedOutput()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return &HookFailed{Status: exit.ExitCode(), Output: string(output)}
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+package jpegger
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// The name -ignore-file reads by default
+	DefaultIgnoreFile = ".jpeggerignore"
+)
+
+var (
+	IgnoreFile = importFlags.String("ignore-file", DefaultIgnoreFile, "leave out what the gitignore-style patterns in files of this name match, in the directory each is in and below it. empty reads none")
+
+	// Left out of every input before its ignore files are read, which can
+	// bring them back with a ! pattern
+	DefaultIgnores = []string{".AppleDouble/"}
+)
+
+// A line of an ignore file
+type ignoreRule struct {
+	// the directory of the ignore file relative to the root, "" for the
+	// root itself
+	base     string
+	patterns []string
+	// matched against the path below base rather than any one name
+	anchored bool
+	negate   bool
+	dirOnly  bool
+}
+
+// Read the lines of an ignore file in base. Like .gitignore: # starts a
+// comment, ! brings back what an earlier pattern left out, a trailing /
+// matches only directories and a slash anywhere else ties the pattern to
+// base.
+func parseIgnores(base string, lines []string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:] // \# and \! for names starting with them
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		rule.anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		rule.patterns = strings.Split(line, "/")
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Does the rule match a slash separated path relative to the root?
+func (r ignoreRule) match(rel string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	names := strings.Split(rel, "/")
+	if !r.anchored {
+		ok, _ := path.Match(r.patterns[0], names[len(names)-1])
+		return ok
+	}
+	return matchComponents(r.patterns, names)
+}
+
+// What the ignore files in a tree leave out of it. Each directory's file is
+// read the first time a path below it is asked about.
+type Ignorer struct {
+	// reads the ignore file in a directory relative to the root, nil to
+	// read none
+	read     func(dir string) ([]byte, error)
+	defaults []ignoreRule
+	rules    map[string][]ignoreRule
+}
+
+func newIgnorer(name string, read func(dir string) ([]byte, error)) *Ignorer {
+	if name == "" {
+		read = nil
+	}
+	return &Ignorer{
+		read:     read,
+		defaults: parseIgnores("", DefaultIgnores),
+		rules:    map[string][]ignoreRule{},
+	}
+}
+
+// The ignore files of a name in a local directory tree. An empty name
+// reads none.
+func NewIgnorer(root, name string) *Ignorer {
+	return newIgnorer(name, func(dir string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(root, filepath.FromSlash(dir), name))
+	})
+}
+
+// The ignore files of a name in an io/fs filesystem, like a zip archive
+func NewFSIgnorer(fsys fs.FS, name string) *Ignorer {
+	return newIgnorer(name, func(dir string) ([]byte, error) {
+		if dir == "" {
+			dir = "."
+		}
+		return fs.ReadFile(fsys, path.Join(dir, name))
+	})
+}
+
+// Only DefaultIgnores, for sources whose files can't be read as they're
+// listed
+func DefaultIgnorer() *Ignorer {
+	return newIgnorer("", nil)
+}
+
+// The rules of the ignore file in a directory, if it has one
+func (g *Ignorer) rulesIn(dir string) []ignoreRule {
+	if g.read == nil {
+		return nil
+	}
+	rules, ok := g.rules[dir]
+	if ok {
+		return rules
+	}
+	data, err := g.read(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("while reading ignore file: %v", err)
+	}
+	if err == nil {
+		rules = parseIgnores(dir, strings.Split(string(data), "\n"))
+	}
+	g.rules[dir] = rules
+	return rules
+}
+
+// Read a directory's ignore file again, after it has changed
+func (g *Ignorer) forget(dir string) {
+	delete(g.rules, dir)
+}
+
+// Is a slash separated path relative to the root left out, itself or by a
+// directory it's in? As with .gitignore, the last pattern to match decides,
+// with those in deeper files coming later.
+func (g *Ignorer) Ignored(rel string, dir bool) bool {
+	names := strings.Split(rel, "/")
+	for i := range names {
+		if g.decide(strings.Join(names[:i+1], "/"), dir || i < len(names)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the patterns leave out a path, not counting the directories it
+// is in
+func (g *Ignorer) decide(rel string, dir bool) bool {
+	ignored := false
+	apply := func(rules []ignoreRule) {
+		for _, rule := range rules {
+			if rule.match(rel, dir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	apply(g.defaults)
+	apply(g.rulesIn(""))
+	names := strings.Split(rel, "/")
+	for i := 1; i < len(names); i++ {
+		apply(g.rulesIn(strings.Join(names[:i], "/")))
+	}
+	return ignored
+}
@@ -0,0 +1,108 @@
+package jpegger
+
+import (
+	"os"
+	"testing"
+)
+
+// The ignore files of a tree, by the directory each is in. An empty name
+// reads none.
+func testIgnorer(name string, files map[string]string) *Ignorer {
+	return newIgnorer(name, func(dir string) ([]byte, error) {
+		data, ok := files[dir]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return []byte(data), nil
+	})
+}
+
+func TestIgnored(t *testing.T) {
+	files := map[string]string{
+		"": "# dependencies and caches\n" +
+			"node_modules/\n" +
+			".cache/\n" +
+			"*.tmp   \n" +
+			"\n" +
+			"/export/\n" +
+			"!/export/keep/\n" +
+			"raw/**/preview\n",
+		"album":      "*.jpg\r\n!keep.jpg\r\n\\#odd.png\r\n",
+		"album/deep": "!*.jpg\n",
+		"mac":        "!.AppleDouble/\n",
+	}
+	tests := []struct {
+		rel  string
+		dir  bool
+		want bool
+	}{
+		{"IMG_1.jpg", false, false},
+		{"a.tmp", false, true},
+		{"sub/a.tmp", false, true},
+		{"a.tmp", true, true},
+		{"node_modules", true, true},
+		{"node_modules", false, false},
+		{"sub/node_modules", true, true},
+		{"sub/node_modules/IMG_1.jpg", false, true},
+		{".cache/IMG_1.jpg", false, true},
+		{"export", true, true},
+		{"export", false, false},
+		{"sub/export", true, false},
+		{"export/keep/IMG_1.jpg", false, true},
+		{"raw/preview", true, true},
+		{"raw/2019/04/preview", true, true},
+		{"sub/raw/preview", true, false},
+		{"# dependencies and caches", false, false},
+		{"album/IMG_1.jpg", false, true},
+		{"album/keep.jpg", false, false},
+		{"album/#odd.png", false, true},
+		{"album/odd.png", false, false},
+		{"other/IMG_1.jpg", false, false},
+		{"album/deep/IMG_1.jpg", false, false},
+		{"album/deep/more/IMG_1.jpg", false, false},
+		{".AppleDouble", true, true},
+		{".AppleDouble/IMG_1.jpg", false, true},
+		{"sub/.AppleDouble/IMG_1.jpg", false, true},
+		{"mac/.AppleDouble/IMG_1.jpg", false, false},
+	}
+	ignores := testIgnorer(DefaultIgnoreFile, files)
+	for _, test := range tests {
+		if got := ignores.Ignored(test.rel, test.dir); got != test.want {
+			t.Errorf("Ignored(%q, %v) = %v, want %v", test.rel, test.dir, got, test.want)
+		}
+	}
+}
+
+func TestIgnoreFileNone(t *testing.T) {
+	ignores := testIgnorer("", map[string]string{"": "*.tmp\n"})
+	tests := []struct {
+		rel  string
+		dir  bool
+		want bool
+	}{
+		{"a.tmp", false, false},
+		{".AppleDouble/IMG_1.jpg", false, true},
+	}
+	for _, test := range tests {
+		if got := ignores.Ignored(test.rel, test.dir); got != test.want {
+			t.Errorf("Ignored(%q, %v) = %v, want %v", test.rel, test.dir, got, test.want)
+		}
+	}
+}
+
+func TestIgnoredForget(t *testing.T) {
+	files := map[string]string{"album": "*.jpg\n"}
+	ignores := testIgnorer(DefaultIgnoreFile, files)
+	if !ignores.Ignored("album/IMG_1.jpg", false) {
+		t.Fatal("album/IMG_1.jpg not ignored")
+	}
+
+	files["album"] = "*.png\n"
+	if !ignores.Ignored("album/IMG_1.jpg", false) {
+		t.Error("album's ignore file read again before it was forgotten")
+	}
+	ignores.forget("album")
+	if ignores.Ignored("album/IMG_1.jpg", false) {
+		t.Error("album/IMG_1.jpg still ignored after album's ignore file changed")
+	}
+}
@@ -0,0 +1,162 @@
+package jpegger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// The hash of the image data of each placed JPEG -> its content key
+	ImageHashes = "ImageHashes"
+	// The content key of each JPEG hashed that way -> the hash of its image
+	// data
+	ContentImageHashes = "ContentImageHashes"
+)
+
+var ImageHash = importFlags.Bool("image-hash", false, "also hash the image data of JPEGs alone, leaving out EXIF, XMP and other metadata, and pass over a JPEG whose image was placed before as a duplicate of it, so a copy with edited tags or stripped GPS isn't imported again")
+
+// Hash the image data of a JPEG: its tables, frame headers and scans,
+// leaving out the APPn segments that hold EXIF, XMP, ICC profiles and the
+// like, and comments. Editing a photo's tags leaves the hash alone.
+func ImageDataHash(path, algorithm string) ([]byte, error) {
+	if err := CheckHashAlgorithm(algorithm); err != nil {
+		return nil, err
+	}
+	var sum []byte
+	err := RetryIO(path, func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := HashAlgorithms[algorithm]()
+		if err = hashImageData(h, bufio.NewReader(ReadThrottle.Reader(f))); err != nil {
+			return err
+		}
+		sum = h.Sum(nil)
+		return nil
+	})
+	return sum, err
+}
+
+func hashImageData(h io.Writer, r *bufio.Reader) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return fmt.Errorf("not a JPEG")
+	}
+
+	offset := int64(2)
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return fmt.Errorf("damaged JPEG at %d", offset)
+		}
+		// fill bytes before a marker
+		if marker[1] == 0xff {
+			r.UnreadByte()
+			offset += 1
+			continue
+		}
+		// standalone markers carry no length
+		if marker[1] == 0x01 || (marker[1] >= 0xd0 && marker[1] <= 0xd7) {
+			offset += 2
+			continue
+		}
+		if marker[1] == 0xd9 {
+			return nil
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return fmt.Errorf("damaged JPEG at %d", offset)
+		}
+
+		metadata := (marker[1] >= 0xe0 && marker[1] <= 0xef) || marker[1] == 0xfe
+		if metadata {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(length)-2); err != nil {
+				return fmt.Errorf("damaged JPEG at %d", offset)
+			}
+		} else {
+			h.Write(marker[:])
+			binary.Write(h, binary.BigEndian, length)
+			if _, err := io.CopyN(h, r, int64(length)-2); err != nil {
+				return fmt.Errorf("damaged JPEG at %d", offset)
+			}
+		}
+		// the scans run to the end of the image
+		if marker[1] == 0xda {
+			_, err := io.Copy(h, r)
+			return err
+		}
+		offset += 2 + int64(length)
+	}
+}
+
+// The content already placed with the same image data, nil if there is
+// none
+func ImageOf(db Store, imageKey []byte) ([]byte, error) {
+	var key []byte
+	err := db.View(func(tx Tx) error {
+		key = lookup(tx, ImageHashes, imageKey)
+		return nil
+	})
+	return key, err
+}
+
+// Record the image data hash of placed content. Content whose image was
+// placed before keeps pointing at the first.
+func RecordImageHash(db Store, key, imageKey []byte) error {
+	return db.Update(func(tx Tx) error {
+		err := tx.Bucket([]byte(ContentImageHashes)).Put(key, imageKey)
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte(ImageHashes))
+		if b.Get(imageKey) != nil {
+			return nil
+		}
+		return b.Put(imageKey, key)
+	})
+}
+
+// The JPEGs placed before -image-hash was used, by content key and path
+// relative to the output
+func ImageHashBacklog(db Store) (map[string]string, error) {
+	missing := map[string]string{}
+	err := db.View(func(tx Tx) error {
+		hashed := tx.Bucket([]byte(ContentImageHashes))
+		return tx.Bucket([]byte(ContentDestination)).ForEach(func(key, rel []byte) error {
+			if IsJPEG(string(rel)) && hashed.Get(key) == nil {
+				missing[string(key)] = string(rel)
+			}
+			return nil
+		})
+	})
+	return missing, err
+}
+
+// Hash the image data of the JPEGs placed before -image-hash was used, so
+// copies of them are caught too. One that can't be read is left for a later
+// run. Returns how many were hashed.
+func CatchUpImageHashes(db Store, output, algorithm string) (int, error) {
+	backlog, err := ImageHashBacklog(db)
+	if err != nil {
+		return 0, err
+	}
+	hashed := 0
+	for key, rel := range backlog {
+		imageKey, err := ImageDataHash(OutputPath(output, rel), algorithm)
+		if err != nil {
+			continue
+		}
+		if err = RecordImageHash(db, []byte(key), imageKey); err != nil {
+			return hashed, err
+		}
+		hashed += 1
+	}
+	return hashed, nil
+}
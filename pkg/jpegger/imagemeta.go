@@ -0,0 +1,310 @@
+package jpegger
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Metadata chunks bigger than this are passed over
+const maxMetadataChunk = 16 << 20
+
+var (
+	// Images that keep their metadata in chunks rather than EXIF segments
+	ChunkedImageExtensions = []string{".png", ".webp", ".gif"}
+
+	// How PNG Creation Time is written. The PNG spec asks for RFC 1123,
+	// which is an instant, but tools write EXIF and ISO 8601 dates too.
+	pngInstantFormats = []string{time.RFC1123Z, time.RFC1123, "Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST"}
+	pngClockFormats   = append([]string{DateFormat}, xmpDateFormats...)
+)
+
+// Is the path a PNG, WebP or GIF?
+func IsChunkedImage(name string) bool {
+	return hasExtension(name, ChunkedImageExtensions)
+}
+
+// What a chunked image says about itself
+type chunkMetadata struct {
+	exif []byte
+	xmp  []byte
+	// PNG Creation Time
+	created string
+}
+
+// The tags of the image's EXIF, with the date taken from its XMP or PNG
+// Creation Time when the EXIF has none, so that these files are dated the
+// same way as others
+func (m chunkMetadata) tags() (map[string]string, error) {
+	tags := map[string]string{}
+	if m.exif != nil {
+		var err error
+		tags, err = ParseTIFF(bytes.NewReader(bytes.TrimPrefix(m.exif, []byte("Exif\x00\x00"))))
+		if err == NoExifData {
+			tags = map[string]string{}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range ExifKeys {
+		if _, ok := tags[key]; ok {
+			return tags, nil
+		}
+	}
+
+	date, err := time.Time{}, NoXMPDate
+	if m.xmp != nil {
+		date, err = ParseXMPDate(m.xmp)
+	}
+	if err == NoXMPDate && m.created != "" {
+		date, err = parsePNGCreationTime(m.created)
+	}
+	if err == nil {
+		key := ExifKeys[0]
+		tags[key] = date.Format(DateFormat)
+		if _, offset := date.Zone(); offset != 0 {
+			tags[exifOffsetKeys[key]] = date.Format("-07:00")
+		}
+	}
+	if len(tags) == 0 {
+		return nil, NoExifData
+	}
+	return tags, nil
+}
+
+func parsePNGCreationTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, format := range pngInstantFormats {
+		if date, err := time.Parse(format, value); err == nil {
+			return date.In(time.Local), nil
+		}
+	}
+	for _, format := range pngClockFormats {
+		if date, err := time.Parse(format, value); err == nil {
+			return date, nil
+		}
+	}
+	// a date that can't be read isn't worth setting the image aside for
+	return time.Time{}, NoXMPDate
+}
+
+// Read a chunk's data, unless it's too big to be metadata
+func readChunk(r io.ReaderAt, offset, length int64) ([]byte, bool) {
+	if length > maxMetadataChunk {
+		return nil, false
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, offset); err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// PNG keeps EXIF in an eXIf chunk and XMP in an iTXt chunk, and may say
+// when it was made in a text chunk
+func parsePNGExif(f *os.File) (map[string]string, error) {
+	var m chunkMetadata
+	header := make([]byte, 8)
+	for offset := int64(8); ; {
+		if _, err := f.ReadAt(header, offset); err != nil {
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		typ := string(header[4:])
+		if typ == "IEND" {
+			break
+		}
+		// a metadata chunk is read whole, image data is skipped
+		switch typ {
+		case "eXIf", "tEXt", "zTXt", "iTXt":
+			data, ok := readChunk(f, offset+8, length)
+			if !ok {
+				break
+			}
+			if typ == "eXIf" {
+				m.exif = data
+				break
+			}
+			keyword, text := parsePNGText(typ, data)
+			switch keyword {
+			case "XML:com.adobe.xmp":
+				m.xmp = text
+			case "Creation Time":
+				m.created = string(text)
+			}
+		}
+		// length, type, data and CRC
+		offset += 12 + length
+	}
+	return m.tags()
+}
+
+// Split a tEXt, zTXt or iTXt chunk into its keyword and text
+func parsePNGText(typ string, data []byte) (string, []byte) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return "", nil
+	}
+	keyword, rest := string(data[:i]), data[i+1:]
+	compressed := false
+	switch typ {
+	case "zTXt":
+		// the compression method, always zlib
+		if len(rest) < 1 {
+			return keyword, nil
+		}
+		rest, compressed = rest[1:], true
+	case "iTXt":
+		// compression flag and method, then the language and translated
+		// keyword
+		if len(rest) < 2 {
+			return keyword, nil
+		}
+		compressed = rest[0] == 1
+		rest = rest[2:]
+		for n := 0; n < 2; n++ {
+			j := bytes.IndexByte(rest, 0)
+			if j < 0 {
+				return keyword, nil
+			}
+			rest = rest[j+1:]
+		}
+	}
+	if !compressed {
+		return keyword, rest
+	}
+	z, err := zlib.NewReader(bytes.NewReader(rest))
+	if err != nil {
+		return keyword, nil
+	}
+	defer z.Close()
+	text, err := ioutil.ReadAll(io.LimitReader(z, maxMetadataChunk))
+	if err != nil {
+		return keyword, nil
+	}
+	return keyword, text
+}
+
+// WebP is a RIFF file with EXIF and XMP in chunks of their own
+func parseWebPExif(f *os.File) (map[string]string, error) {
+	var m chunkMetadata
+	header := make([]byte, 8)
+	for offset := int64(12); ; {
+		if _, err := f.ReadAt(header, offset); err != nil {
+			break
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:]))
+		switch string(header[:4]) {
+		case "EXIF":
+			m.exif, _ = readChunk(f, offset+8, length)
+		case "XMP ":
+			m.xmp, _ = readChunk(f, offset+8, length)
+		}
+		// chunks are padded to an even length
+		offset += 8 + length + length%2
+	}
+	return m.tags()
+}
+
+// GIF can carry XMP in an application extension, written so that a GIF
+// reader skips it as data sub-blocks. That's all the metadata it has.
+func parseGIFExif(f *os.File) (map[string]string, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, NoExifData
+	}
+	// the global color table
+	if flags := header[10]; flags&0x80 != 0 {
+		r.Discard(3 << (flags&7 + 1))
+	}
+
+	var m chunkMetadata
+	for m.xmp == nil {
+		introducer, err := r.ReadByte()
+		if err != nil || introducer == 0x3b {
+			break
+		}
+		switch introducer {
+		case 0x21:
+			label, err := r.ReadByte()
+			if err != nil {
+				return nil, NoExifData
+			}
+			if label == 0xff {
+				ident, err := readGIFSubBlock(r)
+				if err != nil {
+					return nil, NoExifData
+				}
+				if string(ident) == "XMP DataXMP" {
+					m.xmp = readGIFXMP(r)
+					break
+				}
+			}
+			if skipGIFSubBlocks(r) != nil {
+				return nil, NoExifData
+			}
+		case 0x2c:
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return nil, NoExifData
+			}
+			if flags := descriptor[8]; flags&0x80 != 0 {
+				r.Discard(3 << (flags&7 + 1))
+			}
+			// the LZW code size, then the image data
+			r.Discard(1)
+			if skipGIFSubBlocks(r) != nil {
+				return nil, NoExifData
+			}
+		default:
+			return nil, NoExifData
+		}
+	}
+	return m.tags()
+}
+
+func readGIFSubBlock(r *bufio.Reader) ([]byte, error) {
+	size, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	block := make([]byte, size)
+	_, err = io.ReadFull(r, block)
+	return block, err
+}
+
+func skipGIFSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err = r.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// The XMP packet of the extension, which runs up to the end of the packet
+func readGIFXMP(r *bufio.Reader) []byte {
+	var packet []byte
+	end := []byte("</x:xmpmeta>")
+	for len(packet) < maxMetadataChunk {
+		line, err := r.ReadSlice('>')
+		packet = append(packet, line...)
+		if bytes.HasSuffix(packet, end) || (err != nil && err != bufio.ErrBufferFull) {
+			break
+		}
+	}
+	return packet
+}
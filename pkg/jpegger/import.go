@@ -0,0 +1,1213 @@
+package jpegger
+
+import (
+	"context"
+	"fmt"
+	//"github.com/djherbis/times"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ImportCommand = &Command{
+		Name:    "import",
+		Args:    "input... output",
+		Summary: "link or copy new photos and videos into the output directory",
+		Flags:   importFlags,
+		Run:     RunImport,
+	}
+
+	importFlags = NewFlagSet("import", "input... output")
+
+	DeleteCopyState = importFlags.Bool("delete-copy-state", false, "delete the memory of what we've copied. does not forget hashes")
+	LayoutPattern   = importFlags.String("layout", DefaultLayout, "destination directory layout as a Go template or strftime-like pattern (e.g. %Y/%Y-%m-%d)")
+	ExifBackend     = importFlags.String("exif", "", "exif backend: libexif (cgo builds only) or native. defaults to libexif when available")
+	DryRun          = importFlags.Bool("dry-run", false, "print what would be linked or copied without changing the database or the output directory")
+	Watch           = importFlags.Bool("watch", false, "keep running after the initial import and import new files as they appear in the input directory")
+	ShowProgress    = importFlags.Bool("progress", IsTerminal(os.Stderr), "show a progress bar with an ETA. on by default when run in a terminal")
+	Mode            = importFlags.String("mode", "link", "how files are placed in the output: link, copy (for destinations on another filesystem) move (copy, check the copy and delete the source) or reflink (a copy-on-write clone on btrfs, XFS or APFS, falling back to a copy)")
+	FollowSymlinks  = importFlags.Bool("follow-symlinks", false, "import what symlinks in the input point to, directories included. a directory reached twice, like through a symlink loop, is read once. symlinks are skipped by default")
+	OneFileSystem   = importFlags.Bool("one-file-system", false, "don't go into directories under the input that are on another filesystem, like mounted snapshots, backups or network shares")
+	MaxDepth        = importFlags.Int("max-depth", 0, "only look for files this many directories deep in each input directory. 1 is the files in the input itself. 0 has no limit")
+	Takeout         = importFlags.Bool("takeout", false, "the input is a Google Takeout export: take dates from the .json sidecars of photos without EXIF dates")
+	TimeOffset      = importFlags.Duration("time-offset", 0, "shift every date by this much (e.g. -2h13m) for a camera whose clock was wrong")
+	NamePattern     = importFlags.String("name", "", "rename files as they are placed with a Go template, e.g. '{{.Date.Format \"2006-01-02_150405\"}}_{{.Hash8}}{{.Ext}}'. keeps the name they were found with by default")
+	GeoLayout       = importFlags.Bool("geo-layout", false, "add the country each photo was taken in, from its GPS tags, to the layout (e.g. 2019/07/Portugal). needs -geo-data")
+	GeoData         = importFlags.String("geo-data", "cities15000.txt", "GeoNames cities file for -geo-layout, with countryInfo.txt optionally beside it")
+	EventGap        = importFlags.Duration("event-gap", 0, "group photos taken less than this far apart (e.g. 4h) into event directories below the layout. the whole input is read before anything is placed")
+	HashName        = importFlags.String("hash", DefaultHash, "how content is keyed: sha256, or blake3 or xxh3 which are faster on large videos. a database sticks to one")
+	Prefilter       = importFlags.Bool("prefilter", false, "key new content by its size and first and last 64KB, only reading files in full when that matches another file. a database sticks to it once used")
+	MaxReadMBps     = importFlags.Float64("max-read-mbps", 0, "read at most this many megabytes a second while hashing and copying, to leave a shared disk usable. 0 is unlimited")
+	MaxIOPS         = importFlags.Float64("max-iops", 0, "make at most this many reads a second while hashing and copying. 0 is unlimited")
+	TouchDates      = importFlags.Bool("touch-dates", false, "set the access and modification times of placed files to the date they were taken, so they sort by it without EXIF. needs -mode=copy, move or reflink")
+	WriteDates      = importFlags.Bool("write-dates", false, "write the date each JPEG was placed by into the DateTimeOriginal of the placed copy, never the source, so other tools agree with the layout. needs -mode=copy, move or reflink")
+	OnError         = importFlags.String("on-error", "skip", "what to do when a file can't be imported: skip it, retry it a few times before skipping it, or abort the import. skipped files are recorded and listed at the end")
+	Prefer          = importFlags.String("prefer", "", "when one shot is found in more than one form, e.g. a RAW and a JPEG or a full size and a resized copy, import only the larger, the raw or the one with the most exif. the rest are recorded as duplicates. the whole input is read before anything is placed")
+	Collision       = importFlags.String("collision", "hash", "how a file is renamed when its name is taken by different content: hash (8 hex digits in front), sequence (_001 after), full-hash (the whole key as the name) or time (the capture time as the name)")
+	PreImportHook   = importFlags.String("pre-import-hook", "", "shell command run before each file is placed, with JPEGGER_SOURCE, JPEGGER_HASH, JPEGGER_DATE and JPEGGER_DATE_SOURCE set. the file is skipped if it fails")
+	PostImportHook  = importFlags.String("post-import-hook", "", "shell command run after each file is placed, with JPEGGER_DESTINATION set too. a failure is logged")
+	Since           = importFlags.String("since", "", "only import files dated on or after this day, month or year (e.g. 2015 or 2015-06-30)")
+	Until           = importFlags.String("until", "", "only import files dated up to the end of this day, month or year (e.g. 2017)")
+	S3Endpoint      = importFlags.String("s3-endpoint", os.Getenv("AWS_ENDPOINT_URL"), "endpoint for s3:// inputs and outputs on S3-compatible stores, e.g. s3.us-west-002.backblazeb2.com. credentials come from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+)
+
+// One of the inputs of an import and how far through it the run is
+type importInput struct {
+	Name   string
+	Source Source
+	// Where an interrupted run over it stopped
+	Checkpoint string
+	Progress   *Progress
+}
+
+func init() {
+	importFlags.Var(Excludes, "exclude", "skip files matching a glob, e.g. '**/Thumbnails/**' or '*.tmp'. repeatable")
+	importFlags.Var(Includes, "include", "only import files matching a glob. repeatable")
+	importFlags.Var(Extensions, "extensions", "comma separated extensions of the files to import, replacing the defaults")
+	importFlags.BoolVar(Wait, "wait", false, "wait for another import or undo of the database to finish rather than stopping")
+}
+
+// What an import was asked to do, checked and parsed from its arguments
+// and flags
+type importConfig struct {
+	names  []string
+	output string
+	// whether any input isn't a local directory
+	anyRemote bool
+
+	mode         TransferMode
+	layout       *Layout
+	nameTemplate *NameTemplate
+	geocoder     *Geocoder
+	collision    CollisionStrategy
+	store        *ObjectStore
+	mirrors      []string
+
+	policy    ErrorPolicy
+	prefer    PreferPolicy
+	dateRange DateRange
+	dates     DateOptions
+	filter    FileFilter
+	scrubAt   time.Time
+
+	// what new content is keyed with
+	algorithm string
+	// forget what earlier runs copied first
+	forgetCopyState bool
+	walk            WalkOptions
+}
+
+func RunImport(args []string) error {
+	config, err := parseImportArgs(args)
+	if err != nil {
+		return err
+	}
+	return runImport(config)
+}
+
+// Check the arguments and flags of an import, failing with a usage error
+// before anything is touched
+func parseImportArgs(args []string) (*importConfig, error) {
+	if len(args) == 0 && len(Configured.Inputs) > 0 && Configured.Output != "" {
+		args = append(Configured.Inputs, Configured.Output)
+	}
+
+	// we should have at least 2 arguments (inputs and an output)
+	if len(args) < 2 {
+		return nil, UsageError(importFlags, "expected one or more inputs and an output, each a directory, s3:// or dav:// URL. inputs can be mtp:// cameras, sftp:// hosts and zip archives too")
+	}
+	names := args[:len(args)-1]
+	output := args[len(args)-1]
+	if IsMTP(output) || IsSFTP(output) || IsZip(output) {
+		return nil, UsageError(importFlags, "cameras, sftp:// hosts and zip archives can only be imported from, not into")
+	}
+
+	anyRemote := false
+	for _, name := range names {
+		anyRemote = anyRemote || IsRemote(name)
+	}
+	if *Watch && *EventGap > 0 {
+		return nil, UsageError(importFlags, "-event-gap needs to see every file before placing any, so it can't be used with -watch")
+	}
+	if *Watch && *GroupBursts {
+		return nil, UsageError(importFlags, "-bursts needs to see every file before placing any, so it can't be used with -watch")
+	}
+	if *Watch && anyRemote {
+		return nil, UsageError(importFlags, "-watch needs local input directories")
+	}
+	if *MaxDepth < 0 {
+		return nil, UsageError(importFlags, "-max-depth can't be negative")
+	}
+	if *Watch && *MaxDepth > 0 {
+		return nil, UsageError(importFlags, "-max-depth can't be used with -watch, which watches every directory")
+	}
+	if *ScrubFraction < 0 || *ScrubFraction > 1 {
+		return nil, UsageError(importFlags, "-scrub is a fraction of the archive, between 0 and 1")
+	}
+	if *ScrubFraction > 0 && (!*Watch || IsRemote(output)) {
+		return nil, UsageError(importFlags, "-scrub needs -watch and a local output")
+	}
+	scrubAt, err := time.Parse("15:04", *ScrubAt)
+	if err != nil {
+		return nil, UsageError(importFlags, "invalid -scrub-at, expected a time of day like 03:00")
+	}
+
+	pattern := *LayoutPattern
+	var geocoder *Geocoder
+	if *GeoLayout {
+		pattern, err = GeoLayoutPattern(pattern)
+		if err != nil {
+			return nil, UsageError(importFlags, "invalid layout: %v", err)
+		}
+		geocoder, err = LoadGeocoder(*GeoData)
+		if err != nil {
+			return nil, UsageError(importFlags, "while loading -geo-data: %v", err)
+		}
+	}
+	layout, err := ParseLayout(pattern)
+	if err != nil {
+		return nil, UsageError(importFlags, "invalid layout: %v", err)
+	}
+	for _, value := range *ClassLayouts {
+		class, classLayout, err := ParseClassLayout(value)
+		if err != nil {
+			return nil, UsageError(importFlags, "invalid -class-layout: %v", err)
+		}
+		layout.Route(class, classLayout)
+	}
+	var nameTemplate *NameTemplate
+	if *NamePattern != "" {
+		nameTemplate, err = ParseNameTemplate(*NamePattern)
+		if err != nil {
+			return nil, UsageError(importFlags, "invalid name: %v", err)
+		}
+	}
+
+	mode, err := ParseTransferMode(*Mode)
+	if err != nil {
+		return nil, UsageError(importFlags, "invalid mode: %v", err)
+	}
+	if mode == TransferMove && (anyRemote || IsRemote(output)) {
+		return nil, UsageError(importFlags, "-mode=move needs local inputs and a local output")
+	}
+	if *VerifyCopies && IsRemote(output) {
+		return nil, UsageError(importFlags, "-verify-copies needs a local output")
+	}
+	if *TouchDates && (mode == TransferLink || IsRemote(output)) {
+		// a hard link shares its times with the source
+		return nil, UsageError(importFlags, "-touch-dates needs -mode=copy, move or reflink and a local output")
+	}
+	if *WriteDates && (mode == TransferLink || IsRemote(output)) {
+		// a hard link is the source
+		return nil, UsageError(importFlags, "-write-dates needs -mode=copy, move or reflink and a local output")
+	}
+	if *AutoRotate && (mode == TransferLink || IsRemote(output)) {
+		return nil, UsageError(importFlags, "-auto-rotate needs -mode=copy, move or reflink and a local output")
+	}
+	if *AutoRotate {
+		if err := CheckJpegtran(); err != nil {
+			return nil, err
+		}
+	}
+	if *KeepHEIC && *ConvertHEIC == "" {
+		return nil, UsageError(importFlags, "-keep-heic needs -convert-heic")
+	}
+	if *ConvertHEIC != "" {
+		if IsRemote(output) {
+			return nil, UsageError(importFlags, "-convert-heic needs a local output")
+		}
+		if err := CheckHEICConversion(); err != nil {
+			return nil, err
+		}
+	}
+	policy, err := ParseErrorPolicy(*OnError)
+	if err != nil {
+		return nil, UsageError(importFlags, "%v", err)
+	}
+	collision, err := ParseCollisionStrategy(*Collision)
+	if err != nil {
+		return nil, UsageError(importFlags, "%v", err)
+	}
+	prefer, err := ParsePreferPolicy(*Prefer)
+	if err != nil {
+		return nil, UsageError(importFlags, "%v", err)
+	}
+	if *Watch && prefer != PreferAll {
+		return nil, UsageError(importFlags, "-prefer needs to see every file before placing any, so it can't be used with -watch")
+	}
+	if *Interactive && *DryRun {
+		return nil, UsageError(importFlags, "-interactive remembers its answers, so it can't be used with -dry-run")
+	}
+	if *PlanPath != "" && (!*DryRun || *Watch || *Prefilter) {
+		// prefilter keys can't be checked against the files when applying
+		return nil, UsageError(importFlags, "-plan needs -dry-run, and can't be used with -watch or -prefilter")
+	}
+	if IsRemote(output) {
+		// nothing can be linked into a bucket or onto a server
+		mode = TransferCopy
+	}
+	if *WriteManifests && IsRemote(output) {
+		return nil, UsageError(importFlags, "-manifest needs a local output")
+	}
+	var store *ObjectStore
+	if *ObjectLinks != "" {
+		if store, err = NewObjectStore(output, *ObjectLinks, *HashName); err != nil {
+			return nil, UsageError(importFlags, "%v", err)
+		}
+		if IsRemote(output) {
+			return nil, UsageError(importFlags, "-objects needs a local output")
+		}
+		if *ConvertHEIC != "" || *WriteDates || *AutoRotate {
+			// the stored copy is what every link to it holds
+			return nil, UsageError(importFlags, "-objects can't be used with -convert-heic, -write-dates or -auto-rotate, which rewrite placed files")
+		}
+	}
+	var mirrors []string
+	for _, root := range *MirrorDirs {
+		if IsRemote(root) || IsRemote(output) {
+			return nil, UsageError(importFlags, "-mirror needs a local output and local mirrors")
+		}
+		// recorded by absolute path, so runs from anywhere agree
+		root, err = filepath.Abs(root)
+		if err != nil {
+			return nil, UsageError(importFlags, "invalid mirror: %v", err)
+		}
+		if outputRoot, _ := filepath.Abs(output); root == outputRoot {
+			return nil, UsageError(importFlags, "a mirror can't be the output directory")
+		}
+		mirrors = append(mirrors, root)
+	}
+
+	if err = CheckHashAlgorithm(*HashName); err != nil {
+		return nil, UsageError(importFlags, "%v", err)
+	}
+
+	if *MaxReadMBps < 0 || *MaxIOPS < 0 {
+		return nil, UsageError(importFlags, "-max-read-mbps and -max-iops can't be negative")
+	}
+
+	dateRange, err := ParseDateRange(*Since, *Until)
+	if err != nil {
+		return nil, UsageError(importFlags, "invalid date range: %v", err)
+	}
+
+	readExif, err := SelectExifReader(*ExifBackend)
+	if err != nil {
+		return nil, UsageError(importFlags, "invalid exif backend: %v", err)
+	}
+
+	return &importConfig{
+		names:           names,
+		output:          output,
+		anyRemote:       anyRemote,
+		mode:            mode,
+		layout:          layout,
+		nameTemplate:    nameTemplate,
+		geocoder:        geocoder,
+		collision:       collision,
+		store:           store,
+		mirrors:         mirrors,
+		policy:          policy,
+		prefer:          prefer,
+		dateRange:       dateRange,
+		dates:           DateOptions{ReadExif: readExif, Takeout: *Takeout, Apple: *Apple, Clock: FlagClock()},
+		filter:          FlagFilter(),
+		scrubAt:         scrubAt,
+		algorithm:       *HashName,
+		forgetCopyState: *DeleteCopyState,
+		walk:            WalkOptions{*FollowSymlinks, *OneFileSystem, *IgnoreFile},
+	}, nil
+}
+
+// One run of an import, from opening the database to the summary
+type importRun struct {
+	*importConfig
+	db     Store
+	dryRun *DryRunPlan
+	run    uint64
+
+	report       *RunReport
+	failures     *FileFailures
+	fingerprints *Fingerprinter
+	inputs       []*importInput
+	meter        *Meter
+	postHook     *Hook
+	// the mirrors there to copy placed files to
+	available []string
+}
+
+func runImport(config *importConfig) error {
+	ReadThrottle.SetLimits(*MaxReadMBps, *MaxIOPS)
+
+	// a dry run only reads the database
+	if !*DryRun {
+		lock, err := LockRun(*Database, *Wait)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	f, err := OpenLog()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := &importRun{importConfig: config}
+	closeDB, err := r.openDatabase()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	// count what the run does for the summary at its end
+	r.report = NewRunReport()
+	reporting = r.report
+	defer func() { reporting = nil }()
+	r.failures = NewFileFailures(r.db, config.policy)
+
+	if err = r.catchUp(); err != nil {
+		return err
+	}
+
+	// stop cleanly after the file in flight on Ctrl-C. a second Ctrl-C
+	// stops immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if *SkipUnchanged {
+		r.fingerprints = NewFingerprinter(r.db, ImportSettings())
+	}
+	closeInputs, err := r.openInputs()
+	if err != nil {
+		return err
+	}
+	defer closeInputs()
+
+	scanner := &importScanner{r: r}
+	if *Watch {
+		scanner.watcher, err = NewTreeWatcher(config.walk, config.names...)
+		if err != nil {
+			return err
+		}
+		defer scanner.watcher.Close()
+	}
+
+	// check part of the archive each night while watching. the check of
+	// the file in hand finishes before the database is closed
+	if *ScrubFraction > 0 && r.dryRun == nil {
+		var scrubbing sync.WaitGroup
+		defer scrubbing.Wait()
+		scrubCtx, stopScrubs := context.WithCancel(ctx)
+		defer stopScrubs()
+		scrubbing.Add(1)
+		go func() {
+			defer scrubbing.Done()
+			ScheduleScrubs(scrubCtx, r.db, config.output, config.mirrors, *ScrubFraction, config.scrubAt)
+		}()
+	}
+
+	// the page and API, from the database this import holds
+	if *ImportServe != "" {
+		stopServing, err := ServeImport(*ImportServe, r.db)
+		if err != nil {
+			return err
+		}
+		defer stopServing()
+	}
+
+	pipeline, err := r.pipeline(scanner)
+	if err != nil {
+		return err
+	}
+	// the bar would draw over the questions
+	if *ShowProgress && !*Watch && !*Interactive && Verbosity() != VerbosityQuiet {
+		r.meter = NewMeter(os.Stderr)
+		go r.meter.Count(r.inputs)
+		r.meter.Start()
+	}
+	err = pipeline.Run(ctx)
+	if r.meter != nil {
+		r.meter.Stop()
+	}
+	return r.finish(err, scanner.unsettled)
+}
+
+// Open the database and start a run in it, or open it read-only with a
+// plan standing in for the changes of a dry run. Returns how to close it.
+func (r *importRun) openDatabase() (func(), error) {
+	if *DryRun {
+		db, closeDB, err := OpenDryRunDB(*Database)
+		if err != nil {
+			return nil, err
+		}
+		r.db = db
+		r.dryRun = NewDryRunPlan(db, os.Stdout)
+		r.dryRun.ForgetCopyState = r.forgetCopyState
+		if err = CheckDatabaseAlgorithm(db, r.algorithm, *Prefilter); err != nil {
+			closeDB()
+			return nil, err
+		}
+		return closeDB, nil
+	}
+
+	db, err := OpenStore(*Database, StoreOptions{})
+	if err != nil {
+		return nil, err
+	}
+	err = CreateBuckets(db)
+	if err == nil && r.forgetCopyState {
+		err = ForgetCopyState(db)
+	}
+	if err == nil {
+		err = CheckDatabaseAlgorithm(db, r.algorithm, *Prefilter)
+	}
+	if err == nil {
+		r.run, err = StartRun(db, r.names, r.output, r.mode)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	r.db = db
+	Emit(Event{Event: "run-started", Run: r.run, Source: strings.Join(r.names, ", "), Destination: r.output})
+	return func() { db.Close() }, nil
+}
+
+// Bring the mirrors, manifests and image hashes up to date with what was
+// placed before they were asked for, or while a mirror wasn't there
+func (r *importRun) catchUp() error {
+	if r.dryRun != nil {
+		return nil
+	}
+
+	// a mirror that isn't there is left for a later run
+	for _, root := range r.mirrors {
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			message := "not a directory"
+			if err != nil {
+				message = err.Error()
+			}
+			Emit(Event{Event: "mirror-unavailable", Destination: root, Message: message})
+			continue
+		}
+		backlog, err := MirrorBacklog(r.db, root)
+		if err != nil {
+			return err
+		}
+		copied := 0
+		for _, rel := range backlog {
+			if err = MirrorFile(r.db, r.output, root, rel); err != nil {
+				break
+			}
+			copied += 1
+		}
+		if copied > 0 {
+			Emit(Event{Event: "mirror-caught-up", Destination: root, Message: fmt.Sprint(copied)})
+		}
+		if err != nil {
+			Emit(Event{Event: "mirror-failed", Destination: root, Source: backlog[copied], Message: err.Error()})
+			continue
+		}
+		r.available = append(r.available, root)
+	}
+
+	// a file that can't be added is left for a later run, like one added
+	// as it is placed
+	if *WriteManifests {
+		backlog, err := ManifestBacklog(r.db, r.output)
+		if err == nil {
+			err = AddToManifests(r.db, r.output, backlog...)
+		}
+		if err != nil {
+			Emit(Event{Event: "manifest-failed", Destination: r.output, Message: err.Error()})
+		} else if len(backlog) > 0 {
+			Emit(Event{Event: "manifest-caught-up", Destination: r.output, Message: fmt.Sprint(len(backlog))})
+		}
+	}
+
+	if *ImageHash && !IsRemote(r.output) {
+		hashed, err := CatchUpImageHashes(r.db, r.output, r.algorithm)
+		if err != nil {
+			return fmt.Errorf("while hashing image data: %w", err)
+		}
+		if hashed > 0 {
+			Emit(Event{Event: "image-hashes-caught-up", Destination: r.output, Message: fmt.Sprint(hashed)})
+		}
+	}
+	return nil
+}
+
+// Open each input, picking up where an interrupted run over it left off.
+// Returns how to close them.
+func (r *importRun) openInputs() (func(), error) {
+	// remote files are staged next to the output so they can be linked
+	staging := ""
+	if r.anyRemote && !IsRemote(r.output) && r.dryRun == nil {
+		staging = r.output
+		if err := EnsureDir(r.output); err != nil {
+			return nil, fmt.Errorf("while creating directory %s: %w", r.output, err)
+		}
+	}
+
+	var sources []Source
+	closeInputs := func() {
+		for _, source := range sources {
+			source.Close()
+		}
+	}
+	for _, name := range r.names {
+		source, err := OpenSource(name, staging)
+		if err != nil {
+			closeInputs()
+			return nil, err
+		}
+		sources = append(sources, source)
+		switch s := source.(type) {
+		case DirSource:
+			s.WalkOptions, s.Fingerprints, s.MaxDepth = r.walk, r.fingerprints, *MaxDepth
+			source = s
+		case *FSSource:
+			s.IgnoreFile = r.walk.IgnoreFile
+		}
+
+		checkpoint := ""
+		if !r.forgetCopyState {
+			checkpoint, err = LoadCheckpoint(r.db, name)
+			if err != nil {
+				closeInputs()
+				return nil, err
+			}
+			if checkpoint != "" {
+				Emit(Event{Event: "resumed", Source: checkpoint})
+			}
+		}
+		r.inputs = append(r.inputs, &importInput{name, source, checkpoint, NewProgress(name, checkpoint)})
+	}
+	return closeInputs, nil
+}
+
+// The stages of the import, as its flags ask
+func (r *importRun) pipeline(scanner *importScanner) (*Pipeline, error) {
+	var hasher Hasher = StoreHasher{DB: r.db, Algorithm: r.algorithm}
+	if *Prefilter {
+		hasher = PrefilterHasher{DB: r.db, Algorithm: r.algorithm, Output: r.output}
+	}
+
+	linker := &importLinker{LayoutLinker: &LayoutLinker{
+		Output:      r.output,
+		Layout:      r.layout,
+		Name:        r.nameTemplate,
+		Mode:        r.mode,
+		Collision:   r.collision,
+		Objects:     r.store,
+		Algorithm:   r.algorithm,
+		DB:          r.db,
+		Verify:      *VerifyCopies,
+		ConvertHEIC: *ConvertHEIC != "",
+		KeepHEIC:    *KeepHEIC,
+		WriteDates:  *WriteDates,
+		AutoRotate:  *AutoRotate,
+		TouchDates:  *TouchDates,
+	}, run: r.run}
+	if IsRemote(r.output) {
+		dest, err := OpenDestination(r.output)
+		if err != nil {
+			return nil, err
+		}
+		linker.Transfer = dest.Transfer
+	}
+	if *Interactive {
+		linker.prompter = NewPrompter(r.db, os.Stdin, consoleWriter{os.Stderr})
+		linker.Taken = linker.taken
+	}
+
+	// a dry run only simulates the state machine and the output tree
+	var stater recordingStater = &StoreStater{DB: r.db, Run: r.run, Algorithm: r.algorithm}
+	if r.dryRun != nil {
+		stater = r.dryRun
+		linker.Transfer, linker.DryRun = r.dryRun.Transfer, true
+	} else {
+		linker.preHook, r.postHook = NewHook(*PreImportHook), NewHook(*PostImportHook)
+	}
+
+	return &Pipeline{
+		Scanner:     scanner,
+		Hasher:      timedHasher{hasher, r.report},
+		Stater:      &importStater{stater, r},
+		Linker:      linker,
+		HashWorkers: HashWorkers,
+		Inspect:     r.inspect,
+		Arrange:     r.arrangers(),
+		Prepare:     r.sameImage,
+		Attempt:     r.attempt,
+		Done:        r.done,
+		Progress:    r.linked,
+	}, nil
+}
+
+// All content is new once what was copied is forgotten, which a dry run
+// only pretends to do
+func (r *importRun) newContent(key []byte) (bool, error) {
+	if r.dryRun != nil && r.forgetCopyState {
+		return true, nil
+	}
+	return NewContent(r.db, key)
+}
+
+// Validate a file and hash its image data once it's keyed, as asked
+func (r *importRun) inspect(stamp *FileStamp) error {
+	defer r.report.Time("hashing", time.Now())
+	if *Validate && stamp.Quarantine == "" {
+		isNew, err := r.newContent(stamp.Key)
+		if err != nil {
+			return &FatalError{"validating", stamp.Path, err}
+		}
+		// content placed before was validated then, if at all
+		if isNew {
+			if err = ValidateFile(stamp.Path, stamp.Local); err != nil {
+				stamp.Quarantine = err.Error()
+			}
+		}
+	}
+	// a JPEG too damaged to find its image data in is still imported, by
+	// its content alone
+	if *ImageHash && IsJPEG(stamp.Path) {
+		stamp.ImageKey, _ = ImageDataHash(stamp.Local, r.algorithm)
+	}
+	return nil
+}
+
+// The orderings -prefer, -event-gap and -bursts put every file in before
+// any is placed
+func (r *importRun) arrangers() []func([]FileStamp) ([]FileStamp, error) {
+	var arrange []func([]FileStamp) ([]FileStamp, error)
+	if r.prefer != PreferAll {
+		arrange = append(arrange, func(stamps []FileStamp) ([]FileStamp, error) {
+			return PreferBest(r.prefer, stamps), nil
+		})
+	}
+	if *EventGap > 0 {
+		arrange = append(arrange, func(stamps []FileStamp) ([]FileStamp, error) {
+			known, fresh, err := r.splitFresh(stamps, "grouping events")
+			if err != nil {
+				return nil, err
+			}
+			grouped, err := ClusterEvents(fresh, *EventGap, r.layout, r.output)
+			if err != nil {
+				return nil, err
+			}
+			return append(known, grouped...), nil
+		})
+	}
+	if *GroupBursts {
+		arrange = append(arrange, func(stamps []FileStamp) ([]FileStamp, error) {
+			known, shots, err := r.splitFresh(stamps, "finding bursts")
+			if err != nil {
+				return nil, err
+			}
+			return append(known, FindBursts(shots)...), nil
+		})
+	}
+	return arrange
+}
+
+// Only content to be placed for the first time is grouped, so what was
+// placed before doesn't pull new files into a group of its own
+func (r *importRun) splitFresh(stamps []FileStamp, grouping string) (known, fresh []FileStamp, err error) {
+	for _, stamp := range stamps {
+		if stamp.Quarantine != "" || stamp.DuplicateOf != "" {
+			known = append(known, stamp)
+			continue
+		}
+		isNew, err := r.newContent(stamp.Key)
+		if err != nil {
+			return nil, nil, &FatalError{grouping, "", err}
+		}
+		if isNew {
+			fresh = append(fresh, stamp)
+		} else {
+			known = append(known, stamp)
+		}
+	}
+	return known, fresh, nil
+}
+
+// With -image-hash, take a JPEG whose image was placed before as a copy of
+// it with its tags edited
+func (r *importRun) sameImage(stamp *FileStamp) error {
+	if stamp.ImageKey == nil {
+		return nil
+	}
+	original, err := ImageOf(r.db, stamp.ImageKey)
+	if err != nil {
+		return &FatalError{"looking up the image of", stamp.Path, err}
+	}
+	if original == nil || string(original) == string(stamp.Key) {
+		return nil
+	}
+	var rel []byte
+	r.db.View(func(tx Tx) error {
+		rel = lookup(tx, ContentDestination, original)
+		return nil
+	})
+	stamp.DuplicateOf, stamp.DuplicateOfKey = OutputPath(r.output, string(rel)), original
+	return nil
+}
+
+// Place a file under the error policy
+func (r *importRun) attempt(stamp FileStamp, place func() error) error {
+	defer r.report.Time("placing", time.Now())
+	return r.failures.Attempt(stamp.Path, place)
+}
+
+// Count a file handled, and note how far through its input the run is
+func (r *importRun) done(stamp FileStamp) error {
+	r.report.Process(stamp.Size)
+	if r.meter != nil {
+		r.meter.Add(stamp.Size)
+	}
+	in := r.inputs[stamp.Input]
+	in.Progress.Done(stamp.Seq)
+	if r.dryRun == nil && in.Progress.Handled%CheckpointInterval == 0 {
+		if err := SaveCheckpoint(r.db, in.Name, in.Progress.Checkpoint); err != nil {
+			return &FatalError{"saving progress", "", err}
+		}
+	}
+	return nil
+}
+
+// Run the post-import hook on each file linked. The file is in place, so
+// a failing hook doesn't undo it.
+func (r *importRun) linked(progress PipelineProgress) {
+	if progress.Stage != StageLinked || r.postHook == nil {
+		return
+	}
+	dest := OutputPath(r.output, progress.Destination)
+	if err := r.postHook.Run(r.run, progress.Stamp, dest); err != nil {
+		event := StampEvent("hook-failed", progress.Stamp)
+		event.Destination = dest
+		event.Message = err.Error()
+		Emit(event)
+	}
+}
+
+// List a newly placed file in its manifest and copy it to the mirrors. A
+// mirror that fails is left for a later run to catch up rather than
+// failing the import.
+func (r *importRun) placed(rel string) {
+	if *WriteManifests {
+		if err := AddToManifests(r.db, r.output, rel); err != nil {
+			Emit(Event{Event: "manifest-failed", Destination: OutputPath(r.output, rel), Message: err.Error()})
+		}
+	}
+	for i := 0; i < len(r.available); {
+		err := MirrorFile(r.db, r.output, r.available[i], rel)
+		if err != nil {
+			Emit(Event{Event: "mirror-failed", Destination: r.available[i], Source: rel, Message: err.Error()})
+			r.available = append(r.available[:i], r.available[i+1:]...)
+			continue
+		}
+		Emit(Event{Event: "mirrored", Destination: OutputPath(r.available[i], rel)})
+		i += 1
+	}
+}
+
+// Write the plan and the checkpoints, summarize the run and say how it
+// ended. err is what stopped the pipeline, if anything did.
+func (r *importRun) finish(err error, unsettled []string) error {
+	var fatalErr error
+	if err != nil && err != context.Canceled {
+		fatalErr = err
+	}
+	if r.dryRun != nil && *PlanPath != "" {
+		if err := r.dryRun.WritePlan(*PlanPath, r.names, r.output, r.algorithm); err != nil {
+			return fmt.Errorf("while writing the plan: %w", err)
+		}
+	}
+
+	var stopped []string
+	for _, in := range r.inputs {
+		if err == nil {
+			// finished, so the next run starts from the top
+			in.Progress.Checkpoint = ""
+		}
+		if r.dryRun == nil {
+			if sErr := SaveCheckpoint(r.db, in.Name, in.Progress.Checkpoint); sErr != nil && fatalErr == nil {
+				fatalErr = &FatalError{"saving progress", "", sErr}
+			}
+		}
+		if in.Progress.Checkpoint != "" {
+			stopped = append(stopped, in.Progress.Checkpoint)
+		}
+	}
+	failed := r.failures.Failed()
+	// a directory is only passed over once a whole run has been through it
+	if r.fingerprints != nil && r.dryRun == nil && err == nil && fatalErr == nil {
+		if sErr := r.fingerprints.Save(append(failed, unsettled...)); sErr != nil {
+			fatalErr = &FatalError{"saving directory fingerprints", "", sErr}
+		}
+	}
+	if r.dryRun == nil {
+		Emit(Event{Event: "summary", Run: r.run, Message: r.report.Line(len(failed))})
+		if Verbosity() != VerbosityQuiet {
+			r.report.Write(os.Stderr, len(failed))
+		}
+	}
+	if small := r.report.Small(); len(small) > 0 && Verbosity() != VerbosityQuiet {
+		SummarizeSmall(os.Stderr, small)
+	}
+	if len(failed) > 0 {
+		Emit(Event{Event: "failed", Message: fmt.Sprintf("%d files failed", len(failed))})
+		SummarizeFailures(os.Stderr, failed)
+	}
+	if fatalErr != nil {
+		Emit(Event{Event: "stopped", Message: fatalErr.Error()})
+		if len(stopped) > 0 {
+			Emit(Event{Event: "interrupted", Source: strings.Join(stopped, ", ")})
+		}
+		return fatalErr
+	}
+	if err != nil {
+		Emit(Event{Event: "interrupted", Source: strings.Join(stopped, ", ")})
+		return fmt.Errorf("interrupted, the next run resumes after %s", strings.Join(stopped, ", "))
+	}
+	if len(failed) > 0 {
+		return &ExitStatus{ExitFileErrors, fmt.Errorf("%d files failed to import", len(failed))}
+	}
+	if r.dryRun == nil && r.report.Handled() == 0 {
+		return &ExitStatus{ExitNothingToDo, nil}
+	}
+	return nil
+}
+
+// Finds the files of each input in turn, then with -watch those that
+// appear in them, and dates them
+type importScanner struct {
+	r       *importRun
+	watcher *TreeWatcher
+	// passed over by -min-age, for the next run to come back to
+	unsettled []string
+
+	found func(FileStamp) error
+	// the error that stopped the scan
+	err error
+}
+
+func (s *importScanner) Scan(ctx context.Context, found func(FileStamp) error) error {
+	s.found = found
+	// one input after another, so duplicates across them are placed from
+	// the first input they're found in
+	for i, in := range s.r.inputs {
+		err := in.Source.Walk(in.Checkpoint, func(file os.FileInfo, name string) error {
+			return s.examine(ctx, i, file, name, true)
+		})
+		if err != nil {
+			return s.stopped(err, "traversing")
+		}
+	}
+	if s.watcher == nil {
+		return nil
+	}
+	Emit(Event{Event: "watching", Source: strings.Join(s.r.names, ", ")})
+	err := s.watcher.Run(ctx, func(file os.FileInfo, name string) error {
+		return s.examine(ctx, s.inputOf(name), file, name, false)
+	})
+	if err != nil {
+		return s.stopped(err, "watching")
+	}
+	return nil
+}
+
+func (s *importScanner) stopped(err error, doing string) error {
+	if s.err != nil {
+		return s.err
+	}
+	if err == context.Canceled {
+		return err
+	}
+	return fmt.Errorf("while %s files: %w", doing, err)
+}
+
+func (s *importScanner) Release(stamp FileStamp) {
+	s.r.inputs[stamp.Input].Source.Release(stamp.Local)
+}
+
+// The input a watched file appeared in
+func (s *importScanner) inputOf(name string) int {
+	for i, in := range s.r.inputs {
+		if strings.HasPrefix(name, in.Name+string(filepath.Separator)) {
+			return i
+		}
+	}
+	return 0
+}
+
+// Look at one file under the error policy
+func (s *importScanner) examine(ctx context.Context, input int, file os.FileInfo, name string, tracked bool) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	s.r.report.Scan(s.r.filter.Match(name))
+	defer s.r.report.Time("reading", time.Now())
+	err := s.r.failures.Attempt(name, func() error {
+		return s.read(input, file, name, tracked)
+	})
+	if err != nil {
+		s.err = err
+	}
+	return err
+}
+
+// Fetch and date a file, unless it's to be passed over
+func (s *importScanner) read(input int, file os.FileInfo, name string, tracked bool) (err error) {
+	r := s.r
+	if !r.filter.Match(name) {
+		return nil
+	}
+	if Unsettled(file, time.Now()) {
+		s.passUnsettled(file, name)
+		return nil
+	}
+	// the original is imported with the adjustments that make the edit
+	if r.dates.Apple {
+		if original := AppleEditOriginal(name); original != "" {
+			Emit(Event{Event: "apple-edit-skipped", Source: name, Partner: original})
+			return nil
+		}
+	}
+	if file.Size() == 0 || file.Size() < *MinSize {
+		return s.skipSmall(name, file)
+	}
+
+	// don't download what an earlier run already placed
+	if IsRemote(name) && !r.forgetCopyState {
+		copied, err := AlreadyCopied(r.db, name, FileStat(file))
+		if err != nil {
+			return err
+		}
+		if copied {
+			Emit(Event{Event: "skipped", Source: name})
+			return nil
+		}
+	}
+	in := r.inputs[input]
+	// content imported from elsewhere can be recognized where it is. a
+	// file that can't be hashed there is fetched and hashed here
+	if hasher, ok := in.Source.(RemoteHasher); ok && !r.forgetCopyState && !*Prefilter {
+		copied, err := CopiedRemotely(r.db, hasher, name, r.algorithm, FileStat(file))
+		if err == nil && copied {
+			Emit(Event{Event: "skipped", Source: name})
+			return nil
+		}
+	}
+	local, err := in.Source.Fetch(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			in.Source.Release(local)
+		}
+	}()
+
+	stamp, tags, err := DateFile(name, local, file, r.dates)
+	stamp.Input = input
+	if unread, ok := err.(*UnreadableError); ok {
+		// handed on to be set aside
+		stamp.Quarantine = unread.Reason
+		s.hand(in, stamp, tracked)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if lat, lon, ok := ExifPosition(tags); ok {
+		stamp.Position = []float64{lat, lon}
+		if r.geocoder != nil {
+			stamp.Place = r.geocoder.Lookup(lat, lon)
+		}
+	}
+	// the metadata is being read past anyway. a caption that can't be read
+	// is no reason to leave the photo behind
+	stamp.Description, _ = ReadDescription(local, stamp.Sidecar)
+
+	if !r.dateRange.Contains(stamp.Time) {
+		in.Source.Release(stamp.Local)
+		Emit(StampEvent("out-of-range", stamp))
+		if r.dryRun != nil {
+			entry := StampPlanEntry(PlanSkip, stamp)
+			entry.Reason = "outside -since and -until"
+			r.dryRun.Plan(entry)
+		}
+		return nil
+	}
+	s.hand(in, stamp, tracked)
+	return nil
+}
+
+// Hand a dated file on to the pipeline. Once it's stopping the file is let
+// go of, and the walk stops at the next.
+func (s *importScanner) hand(in *importInput, stamp FileStamp, tracked bool) {
+	Emit(StampEvent("discovered", stamp))
+	if s.found(in.Progress.Track(stamp, tracked)) != nil {
+		in.Source.Release(stamp.Local)
+	}
+}
+
+// Pass over an empty file, or one under -min-size. An interrupted sync
+// leaves empty files behind, and hashing nothing would archive them.
+func (s *importScanner) skipSmall(name string, file os.FileInfo) error {
+	r := s.r
+	size := file.Size()
+	event := Event{Event: "too-small", Source: name, Message: fmt.Sprint(size)}
+	reason := "smaller than -min-size"
+	if size == 0 {
+		event, reason = Event{Event: "empty", Source: name}, "empty"
+		if r.dryRun == nil {
+			fresh, err := RecordEmpty(r.db, name, r.algorithm, FileStat(file))
+			if err != nil {
+				return &FatalError{"recording file", name, err}
+			}
+			if !fresh {
+				Emit(Event{Event: "skipped", Source: name})
+				return nil
+			}
+		}
+	}
+	Emit(event)
+	if r.dryRun != nil {
+		r.dryRun.Plan(PlanEntry{Action: PlanSkip, Source: name, Reason: reason})
+	}
+	return nil
+}
+
+// Pass over a file that may still be being written, by -min-age. A watch
+// comes back to it; otherwise the next run does.
+func (s *importScanner) passUnsettled(file os.FileInfo, name string) {
+	Emit(Event{Event: "unsettled", Source: name, Message: time.Since(file.ModTime()).Truncate(time.Second).String()})
+	if s.r.dryRun != nil {
+		s.r.dryRun.Plan(PlanEntry{Action: PlanSkip, Source: name, Reason: "modified within -min-age"})
+	}
+	if s.watcher != nil {
+		s.watcher.Later(file, name)
+	} else {
+		s.unsettled = append(s.unsettled, name)
+	}
+}
+
+// Keys files as the Hasher does, counting the time taken in the report
+type timedHasher struct {
+	Hasher
+	report *RunReport
+}
+
+func (h timedHasher) Key(stamp FileStamp) ([]byte, error) {
+	defer h.report.Time("hashing", time.Now())
+	return h.Hasher.Key(stamp)
+}
+
+type recordingStater interface {
+	Stater
+	Recorder
+}
+
+// Records files as the Stater does, then lists what was placed in the
+// manifests, copies it to the mirrors and forgets that the file failed
+// before
+type importStater struct {
+	recordingStater
+	r *importRun
+}
+
+func (s *importStater) Placed(p Placement) error {
+	if err := s.recordingStater.Placed(p); err != nil {
+		return err
+	}
+	if s.r.dryRun != nil {
+		return nil
+	}
+	if p.Original != "" {
+		s.r.placed(p.Original)
+	}
+	for _, sidecar := range p.Sidecars {
+		s.r.placed(sidecar.Destination)
+	}
+	s.r.placed(p.Destination)
+	return s.r.failures.Succeeded(p.Stamp.Path)
+}
+
+// Handled, so an earlier failure no longer matters
+func (s *importStater) Skipped(stamp FileStamp) (bool, error) {
+	rejected, err := s.recordingStater.Skipped(stamp)
+	if err == nil {
+		err = s.r.failures.Succeeded(stamp.Path)
+	}
+	return rejected, err
+}
+
+// Places files as the LayoutLinker does, once the pre-import hook and
+// -interactive let it
+type importLinker struct {
+	*LayoutLinker
+	run      uint64
+	preHook  *Hook
+	prompter *Prompter
+}
+
+func (l *importLinker) Link(stamp FileStamp) (Placement, error) {
+	// a file the hook turns down is left for a later run
+	if l.preHook != nil {
+		err := l.preHook.Run(l.run, stamp, "")
+		if failed, ok := err.(*HookFailed); ok {
+			return Placement{}, &Declined{Event: "hook-skipped", Reason: failed.Error()}
+		}
+		if err != nil {
+			return Placement{}, fmt.Errorf("while running the pre-import hook for %s: %w", stamp.Path, err)
+		}
+	}
+
+	// a file dated only by its modification time may well be dated wrong
+	if l.prompter != nil && stamp.Source == DateSourceFilesystem {
+		keep, date, err := l.prompter.AskDate(stamp)
+		if err != nil {
+			return Placement{}, &FatalError{"asking about", stamp.Path, err}
+		}
+		if !keep {
+			return Placement{}, &Declined{Reason: "it has no date of its own"}
+		}
+		if !date.Equal(stamp.Time) {
+			stamp.Time, stamp.Source = date, DateSourceManual
+		}
+	}
+	return l.LayoutLinker.Link(stamp)
+}
+
+// Ask whether to rename a file whose name is taken. Another copy of the
+// shot there is passed over for good, like a lesser copy with -prefer.
+func (l *importLinker) taken(stamp FileStamp, taken string) error {
+	takenRel, _ := filepath.Rel(l.Output, taken)
+	takenKey, takenDate, dated := placedShot(l.DB, filepath.ToSlash(takenRel))
+	nearDuplicate := dated && !stamp.Time.IsZero() && takenDate.Equal(stamp.Time)
+	rename, err := l.prompter.AskCollision(stamp, taken, nearDuplicate)
+	if err != nil {
+		return &FatalError{"asking about", stamp.Path, err}
+	}
+	switch {
+	case rename:
+		return nil
+	case nearDuplicate:
+		return &Declined{Reason: "another copy of " + taken, DuplicateOf: taken, DuplicateOfKey: takenKey}
+	}
+	return &Declined{Reason: taken + " is taken"}
+}
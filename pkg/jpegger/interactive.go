@@ -0,0 +1,194 @@
+package jpegger
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// What was decided at a prompt, by the kind of question and the hex of
+	// the content asked about, or by the kind alone for every question of
+	// it
+	Decisions = "Decisions"
+
+	// The questions -interactive asks
+	QuestionCollision     = "collision"
+	QuestionNearDuplicate = "near-duplicate"
+	QuestionDate          = "date"
+
+	// The answers to them. A date question may also be answered with a
+	// date, which is recorded in RFC 3339.
+	AnswerRename = "rename"
+	AnswerKeep   = "keep"
+	AnswerSkip   = "skip"
+)
+
+var (
+	Interactive = importFlags.Bool("interactive", false, "ask on the terminal what to do about a name taken by other content, a second copy of a shot and a file dated only by its modification time. answers are remembered")
+
+	// The ways a date can be typed at a date question
+	answerDateFormats = []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+)
+
+// One answer to a question, picked by its letter. Its capital picks it for
+// every later question of the kind too.
+type Choice struct {
+	Letter byte
+	Answer string
+	Help   string
+}
+
+// Asks what to do on the terminal and remembers the answers
+type Prompter struct {
+	db  Store
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func NewPrompter(db Store, in io.Reader, out io.Writer) *Prompter {
+	return &Prompter{db, bufio.NewReader(in), out}
+}
+
+func decisionKey(kind string, key []byte) []byte {
+	return []byte(kind + "/" + hex.EncodeToString(key))
+}
+
+// What was decided about content before, for it or for every question of
+// the kind. "" if nothing was.
+func (p *Prompter) decided(kind string, key []byte) string {
+	var answer string
+	p.db.View(func(tx Tx) error {
+		b := tx.Bucket([]byte(Decisions))
+		if v := b.Get(decisionKey(kind, key)); v != nil {
+			answer = string(v)
+		} else if v := b.Get([]byte(kind)); v != nil {
+			answer = string(v)
+		}
+		return nil
+	})
+	return answer
+}
+
+func (p *Prompter) remember(kind string, key []byte, answer string, always bool) error {
+	return p.db.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte(Decisions))
+		if always {
+			if err := b.Put([]byte(kind), []byte(answer)); err != nil {
+				return err
+			}
+		}
+		return b.Put(decisionKey(kind, key), []byte(answer))
+	})
+}
+
+// Ask a question about content, unless it was answered before. free reads
+// an answer that isn't one of the choices, and may be nil. With nothing
+// more to read, the first choice is taken.
+func (p *Prompter) Ask(kind string, key []byte, question string, choices []Choice, free func(string) (string, bool)) (string, error) {
+	if answer := p.decided(kind, key); answer != "" {
+		return answer, nil
+	}
+
+	var letters []string
+	for _, choice := range choices {
+		letters = append(letters, fmt.Sprintf("[%c] %s", choice.Letter, choice.Help))
+	}
+	for {
+		fmt.Fprintf(p.out, "%s\n  %s (capital for always): ", question, strings.Join(letters, ", "))
+		line, err := p.in.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if err == io.EOF && line == "" {
+			fmt.Fprintln(p.out)
+			return choices[0].Answer, nil
+		}
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		if len(line) == 1 {
+			for _, choice := range choices {
+				if line[0] == choice.Letter || line[0] == choice.Letter-'a'+'A' {
+					return choice.Answer, p.remember(kind, key, choice.Answer, line[0] != choice.Letter)
+				}
+			}
+		}
+		if free != nil {
+			if answer, ok := free(line); ok {
+				return answer, p.remember(kind, key, answer, false)
+			}
+		}
+		fmt.Fprintf(p.out, "  didn't understand %q\n", line)
+	}
+}
+
+// The content placed at a path in the output and when it was taken, if
+// that's known
+func placedShot(db Store, relPath string) ([]byte, time.Time, bool) {
+	var key []byte
+	var taken time.Time
+	var ok bool
+	db.View(func(tx Tx) error {
+		key = lookup(tx, DestinationPath, []byte(relPath))
+		if key != nil {
+			taken, ok = ContentDate(tx, key)
+		}
+		return nil
+	})
+	return key, taken, ok
+}
+
+// Read a date typed at a date question as the answer to record
+func parseAnswerDate(line string) (string, bool) {
+	for _, format := range answerDateFormats {
+		if date, err := time.ParseInLocation(format, line, time.Local); err == nil {
+			return date.Format(time.RFC3339), true
+		}
+	}
+	return "", false
+}
+
+// Ask about a file dated only by when it was last modified. Returns
+// whether to import it and the date to import it by.
+func (p *Prompter) AskDate(stamp FileStamp) (bool, time.Time, error) {
+	question := fmt.Sprintf("%s has no date of its own and was last modified %s.", stamp.Path, stamp.Time.Format(answerDateFormats[0]))
+	answer, err := p.Ask(QuestionDate, stamp.Key, question, []Choice{
+		{'k', AnswerKeep, "keep that date"},
+		{'s', AnswerSkip, "skip it"},
+	}, func(line string) (string, bool) {
+		return parseAnswerDate(line)
+	})
+	if err != nil || answer == AnswerSkip {
+		return false, time.Time{}, err
+	}
+	if answer == AnswerKeep {
+		return true, stamp.Time, nil
+	}
+	date, err := time.Parse(time.RFC3339, answer)
+	return err == nil, date, err
+}
+
+// Ask about a file whose name is taken by other content, which is another
+// copy of the same shot if nearDuplicate. Returns whether to place it under
+// another name.
+func (p *Prompter) AskCollision(stamp FileStamp, taken string, nearDuplicate bool) (bool, error) {
+	kind := QuestionCollision
+	question := fmt.Sprintf("%s is taken by other content, placing %s.", taken, stamp.Path)
+	choices := []Choice{
+		{'r', AnswerRename, "place it under another name"},
+		{'s', AnswerSkip, "skip it"},
+	}
+	if nearDuplicate {
+		kind = QuestionNearDuplicate
+		question = fmt.Sprintf("%s looks like another copy of %s, taken at the same moment.", stamp.Path, taken)
+		choices = []Choice{
+			{'k', AnswerKeep, "keep both"},
+			{'s', AnswerSkip, "skip this copy"},
+		}
+	}
+	answer, err := p.Ask(kind, stamp.Key, question, choices, nil)
+	return answer != AnswerSkip, err
+}
@@ -0,0 +1,36 @@
+package jpegger
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// Errors a network filesystem or a flaky USB drive can give for a moment
+var transientErrors = []error{syscall.EIO, syscall.ESTALE, syscall.EAGAIN, syscall.ETIMEDOUT}
+
+// Might trying again succeed?
+func IsTransient(err error) bool {
+	for _, transient := range transientErrors {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// Do some I/O, trying again up to -io-retries times if it fails with a
+// transient error. The pause starts at -io-backoff and doubles each time.
+// The whole operation is repeated, so it must be safe to start over.
+func RetryIO(what string, do func() error) error {
+	delay := *IOBackoff
+	for attempt := 0; ; attempt += 1 {
+		err := do()
+		if err == nil || !IsTransient(err) || attempt >= *IORetries {
+			return err
+		}
+		Emit(Event{Event: "io-retry", Source: what, Message: err.Error()})
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,806 @@
+// Examines the EXIF data in a file to determine where it should be linked
+// into an output directory structure. If EXIF is not available then the
+// files creation time instead.
+package jpegger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// Flags shared by every command
+	Database   = new(string)
+	DBDriver   = new(string)
+	Log        = new(string)
+	ConfigPath = new(string)
+	LogFormat  = new(string)
+	IORetries  = new(int)
+	IOBackoff  = new(time.Duration)
+
+	// How many files are hashed at once
+	HashWorkers = 3
+
+	// What's imported when -extensions isn't given
+	DefaultExtensions = []string{".mov", ".jpg", ".jpeg", ".avi", ".mp4", ".cr2", ".nef", ".arw", ".dng", ".raf", ".heic", ".heif", ".mkv", ".mts", ".m2ts", ".3gp", ".webm", ".png", ".gif", ".webp", ".tif", ".tiff"}
+	Extensions        = func() *ExtensionList {
+		l := ExtensionList(DefaultExtensions)
+		return &l
+	}()
+	ExifKeys = []string{
+		"Date and Time (Original)",
+		"Date and Time (Digitized)",
+		"Create Date",
+	}
+
+	// Files to leave out, and when any are given the only files to take
+	Excludes = &GlobList{}
+	Includes = &GlobList{}
+
+	PreconditionFailed = fmt.Errorf("precondition not met")
+
+	NoFile         []byte = nil
+	DiscoveredFile        = []byte{1}
+	CopiedFile            = []byte{2}
+	// Content of a file that couldn't be read, kept from being imported
+	QuarantinedFile = []byte{3}
+	// Content passed over for a better copy of the same shot
+	DuplicateFile = []byte{4}
+	// Content of empty files, which are skipped
+	EmptyFile = []byte{5}
+	// Content whose placed copy was hashed again and matched
+	VerifiedFile = []byte{6}
+	// Content rejected with jpegger reject, never to be imported
+	RejectedFile = []byte{7}
+)
+
+const (
+	DateKey     = "Date and Time"
+	DateFormat  = "2006:01:02 15:04:05"
+	ContentHash = "ContentHash"
+	SourcePath  = "SourcePath"
+	// Where each file landed, relative to the output directory, and the
+	// reverse
+	DestinationPath    = "DestinationPath"
+	ContentDestination = "ContentDestination"
+	// What each import run did
+	Runs     = "Runs"
+	RunFiles = "RunFiles"
+	// When each piece of content was taken, in RFC 3339 with the offset it
+	// was dated in
+	ContentDates = "ContentDates"
+)
+
+// Every top level bucket
+var Buckets = []string{ContentHash, SourcePath, DestinationPath, ContentDestination, Runs, RunFiles, Checkpoints, Pairs, KeyAlgorithms, Prefilters, PrefilterHashes, Quarantined, FileErrors, Duplicates, ContentDates, Rewritten, Descriptions, Mirrored, Scrubbed, Companions, Bursts, Decisions, ImageHashes, ContentImageHashes, Shots, Tags, DirFingerprints, SourceStats, StateTimes}
+
+// Where the file date came from.
+type DateSource int
+
+const (
+	DateSourceExif = DateSource(iota)
+	DateSourceFilesystem
+	DateSourceContainer
+	DateSourceTakeout
+	DateSourceXMP
+	DateSourceFilename
+	DateSourceApple
+	// Typed in at -interactive
+	DateSourceManual
+)
+
+var dateSourceNames = map[DateSource]string{
+	DateSourceExif:       "exif",
+	DateSourceFilesystem: "filesystem",
+	DateSourceContainer:  "container",
+	DateSourceTakeout:    "takeout",
+	DateSourceXMP:        "xmp",
+	DateSourceFilename:   "filename",
+	DateSourceApple:      "apple",
+	DateSourceManual:     "manual",
+}
+
+func (s DateSource) String() string {
+	return dateSourceNames[s]
+}
+
+// A flag of comma separated file extensions. They're kept lowercase with
+// a leading dot however they're given.
+type ExtensionList []string
+
+func (l *ExtensionList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *ExtensionList) Set(value string) error {
+	var extensions []string
+	for _, ext := range strings.Split(value, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions = append(extensions, ext)
+	}
+	if len(extensions) == 0 {
+		return fmt.Errorf("no extensions in %q", value)
+	}
+	*l = extensions
+	return nil
+}
+
+// Which files are photos and videos to import: those with one of the
+// extensions that no exclude matches and, when there are any, an include
+// does
+type FileFilter struct {
+	Extensions []string
+	Excludes   GlobList
+	Includes   GlobList
+}
+
+// The filter set by -extensions, -exclude and -include, or the config file
+func FlagFilter() FileFilter {
+	return FileFilter{*Extensions, *Excludes, *Includes}
+}
+
+// The default extensions, with nothing excluded
+func DefaultFilter() FileFilter {
+	return FileFilter{Extensions: DefaultExtensions}
+}
+
+func (f FileFilter) Match(path string) bool {
+	if f.Excludes.Match(path) {
+		return false
+	}
+	if len(f.Includes.Patterns) > 0 && !f.Includes.Match(path) {
+		return false
+	}
+
+	path = strings.ToLower(path)
+	for _, ext := range f.Extensions {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is the path an example of the extensions that we care about?
+func ValidName(path string) bool {
+	return FlagFilter().Match(path)
+}
+
+// Call a function with FileInfo for every file recursively under a
+// starting point, in sorted order, depth first. Symlinks are skipped unless
+// -follow-symlinks, and other filesystems with -one-file-system.
+// Directories that can't be read are reported and passed over; an error
+// from the callback ends the walk and is returned.
+func WithFiles(path string, callback func(os.FileInfo, string) error) error {
+	walk, err := newTreeWalk(path)
+	if err != nil {
+		return err
+	}
+	return walk.walk(path, nil, 0, callback)
+}
+
+// A file to link to a new location
+type FileStamp struct {
+	Path   string
+	Time   time.Time
+	Source DateSource
+	Key    []byte
+	Size   int64
+	// Where the content can be read, the same as Path for local files
+	Local string
+	// The XMP sidecar that goes with the file, if any
+	Sidecar string
+	// Files that go with it, such as thumbnails and telemetry
+	Companions []string
+	// Where it was taken, with -geo-layout
+	Place Place
+	// Its latitude and longitude, from its GPS tags
+	Position []float64
+	// The event directory it belongs in, with -event-gap
+	EventDir string
+	// The directory of the burst it was shot in, below that, with -bursts
+	Burst string
+	// The make and model of camera that took it, from its EXIF
+	Make   string
+	Camera string
+	// What kind of file it is: camera, screenshot, messenger or other
+	Class string
+	// Which of the inputs it came from
+	Input int
+	// Position in the traversal of that input, 0 if not tracked
+	Seq uint64
+	// Why the file couldn't be read, if it couldn't
+	Quarantine string
+	// How many EXIF tags it has
+	Tags int
+	// The better copy of the same shot imported in its place, with -prefer
+	DuplicateOf    string
+	DuplicateOfKey []byte
+	// When the file was last modified, to tell whether it has changed
+	// since its key was cached
+	Modified time.Time
+	// The hash of its image data alone, for JPEGs with -image-hash
+	ImageKey []byte
+	// Its caption, keywords and rating, from IPTC or XMP
+	Description Description
+}
+
+// Compute a unique key based on the contents of the file. The key is
+// cached by name unless it was made with another algorithm or the file has
+// changed size or modification time from seen; local is where the content
+// is read from.
+func FileKey(db Store, path, local, algorithm string, seen SourceStat) ([]byte, error) {
+	var cachedKey []byte
+	recorded := false
+
+	err := db.View(func(tx Tx) error {
+		// the key must outlive the transaction
+		cachedKey, recorded = cachedSourceKey(tx, path, seen)
+		if cachedKey != nil && KeyAlgorithm(tx, cachedKey) != algorithm {
+			cachedKey = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cachedKey != nil {
+		// check a key cached by an older jpegger from now on
+		if !recorded && !db.IsReadOnly() {
+			err = db.Update(func(tx Tx) error {
+				return putSourceStat(tx, path, seen)
+			})
+		}
+		return cachedKey, err
+	}
+
+	// otherwise, compute the hash
+	key, err := HashFile(local, algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	// a dry run must leave the database as it found it
+	if db.IsReadOnly() {
+		return key, nil
+	}
+
+	err = db.Update(func(tx Tx) error {
+		// associate the key with the path
+		err := putSourceKey(tx, path, key, seen)
+		if err != nil {
+			return err
+		}
+		return RecordKeyAlgorithm(tx, key, algorithm)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Transition the state machine for this file from one state to the next.
+// Error if the file was not in the anticipated state.
+func CommitState(db Store, path string, key, reqPrevState, reqNextState []byte) (bool, error) {
+	transitioned := false
+
+	rErr := db.Update(func(tx Tx) error {
+		// record the state transition
+		b := tx.Bucket([]byte(ContentHash))
+		prevState := b.Get(key)
+		if bytes.Compare(prevState, reqPrevState) != 0 {
+			return nil
+		}
+		err := b.Put(key, reqNextState)
+		if err != nil {
+			return err
+		}
+		transitioned = true
+
+		return recordStateTime(tx, key, reqNextState, time.Now())
+	})
+
+	return transitioned, rErr
+}
+
+// Remember which content an import run placed at a path in the output
+// directory, how it was keyed and when it was taken, if that's known
+func RecordDestination(db Store, run uint64, relPath string, key []byte, algorithm string, taken time.Time) error {
+	return db.Update(func(tx Tx) error {
+		err := recordDestination(tx, relPath, key, algorithm, taken)
+		if err != nil {
+			return err
+		}
+		files, err := tx.Bucket([]byte(RunFiles)).CreateBucketIfNotExists(RunKey(run))
+		if err != nil {
+			return err
+		}
+		return files.Put([]byte(relPath), key)
+	})
+}
+
+// Record where content was found already in the output. No run placed it.
+func RecordExisting(db Store, relPath string, key []byte, algorithm string, taken time.Time) error {
+	return db.Update(func(tx Tx) error {
+		return recordDestination(tx, relPath, key, algorithm, taken)
+	})
+}
+
+func recordDestination(tx Tx, relPath string, key []byte, algorithm string, taken time.Time) error {
+	err := tx.Bucket([]byte(DestinationPath)).Put([]byte(relPath), key)
+	if err != nil {
+		return err
+	}
+	// whatever was rewritten at the path before is gone
+	err = tx.Bucket([]byte(Rewritten)).Delete([]byte(relPath))
+	if err != nil {
+		return err
+	}
+	err = RecordKeyAlgorithm(tx, key, algorithm)
+	if err != nil {
+		return err
+	}
+	if !taken.IsZero() {
+		err = tx.Bucket([]byte(ContentDates)).Put(key, []byte(taken.Format(time.RFC3339)))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(ContentDestination)).Put(key, []byte(relPath))
+}
+
+// When a piece of content was taken. Content placed before dates were
+// recorded has none.
+func ContentDate(tx Tx, key []byte) (time.Time, bool) {
+	b := tx.Bucket([]byte(ContentDates))
+	if b == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, string(b.Get(key)))
+	return t, err == nil
+}
+
+// Recursively create a directory if it doesn't exist
+func EnsureDir(path string) error {
+	err := os.MkdirAll(path, os.ModePerm)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil
+		} else {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create the buckets we rely on
+func CreateBuckets(db Store) error {
+	return db.Update(createBuckets)
+}
+
+func createBuckets(tx Tx) error {
+	for _, name := range Buckets {
+		_, err := tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return fmt.Errorf("while creating bucket %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Forget what was copied, for -delete-copy-state, so that everything is
+// imported again. Hashes are kept, as is what was rejected.
+func ForgetCopyState(db Store) error {
+	return db.Update(func(tx Tx) error {
+		rejected := rejectedKeys(tx)
+		err := tx.DeleteBucket([]byte(ContentHash))
+		if err != nil && err != ErrBucketNotFound {
+			return err
+		}
+		// quarantined files get another chance too
+		err = tx.DeleteBucket([]byte(Quarantined))
+		if err != nil && err != ErrBucketNotFound {
+			return err
+		}
+		// and every directory is looked through again
+		err = tx.DeleteBucket([]byte(DirFingerprints))
+		if err != nil && err != ErrBucketNotFound {
+			return err
+		}
+
+		if err = createBuckets(tx); err != nil {
+			return err
+		}
+		for _, key := range rejected {
+			if err := tx.Bucket([]byte(ContentHash)).Put(key, RejectedFile); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Run the jpegger command line. args are as in os.Args.
+func Main(args []string) {
+	if len(args) < 2 {
+		Usage()
+		os.Exit(ExitUsage)
+	}
+
+	switch args[1] {
+	case "help", "-h", "-help", "--help":
+		Usage()
+		return
+	}
+
+	cmd, rest := FindCommand(args[1]), args[2:]
+	if cmd == nil {
+		// older invocations have no command and mean import
+		cmd, rest = ImportCommand, args[1:]
+	}
+
+	cmd.Flags.Parse(rest)
+	if *ConfigPath != "" {
+		err := LoadConfig(*ConfigPath, cmd.Flags)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "while loading config: %v\n", err)
+			os.Exit(ExitUsage)
+		}
+	}
+
+	err := cmd.Run(cmd.Flags.Args())
+	var usage *ArgumentError
+	if errors.As(err, &usage) {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", usage.Flags.Name(), usage.Message)
+		usage.Flags.Usage()
+		os.Exit(ExitUsage)
+	}
+	if status, ok := err.(*ExitStatus); ok {
+		if status.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.Name, status.Err)
+		}
+		os.Exit(status.Code)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.Name, err)
+		os.Exit(ExitFatal)
+	}
+}
+
+// A walk over a directory tree
+type treeWalk struct {
+	// the directories it has been into, by fileIdentity
+	visited map[string]bool
+	// the filesystem it started on, for -one-file-system
+	device uint64
+	// what it skips is left for another walk to report
+	quiet bool
+	// passes over directories unchanged since a run finished them, with
+	// -skip-unchanged
+	fingerprints *Fingerprinter
+	// how many directories deep files are looked for, with -max-depth. 0
+	// has no limit
+	maxDepth int
+	options  WalkOptions
+	// where it started, which ignores are relative to
+	root    string
+	ignores *Ignorer
+	// the object store of an output, symlinks into which are taken as the
+	// files they point to
+	objects string
+}
+
+// A directory a walk is reading
+type walkDir struct {
+	path string
+	// its subdirectories, for the fingerprint
+	dirs []string
+	// fingerprinted once it's read through
+	fingerprinted bool
+	failed        bool
+}
+
+// Where a path is relative to the file a walk resumes after, both as the
+// components of their paths
+type checkpointPlace int
+
+const (
+	beforeCheckpoint = checkpointPlace(iota)
+	// a directory the checkpoint is in
+	aroundCheckpoint
+	atCheckpoint
+	pastCheckpoint
+)
+
+func placeOfCheckpoint(components, after []string) checkpointPlace {
+	for i, name := range components {
+		if i == len(after) {
+			return pastCheckpoint
+		}
+		if name < after[i] {
+			return beforeCheckpoint
+		}
+		if name > after[i] {
+			return pastCheckpoint
+		}
+	}
+	if len(components) < len(after) {
+		return aroundCheckpoint
+	}
+	return atCheckpoint
+}
+
+func newTreeWalk(root string) (*treeWalk, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	device, _ := fileDevice(info)
+	return &treeWalk{
+		visited: map[string]bool{fileIdentity(root, info): true},
+		device:  device,
+		root:    root,
+	}, nil
+}
+
+// A walk of an input, leaving out what its ignore files say. An output's
+// files are all its own, whatever ignore files were copied into it.
+func newInputWalk(root string, options WalkOptions) (*treeWalk, error) {
+	walk, err := newTreeWalk(root)
+	if err != nil {
+		return nil, err
+	}
+	walk.options = options
+	walk.ignores = NewIgnorer(root, options.IgnoreFile)
+	return walk, nil
+}
+
+func (w *treeWalk) skip(event, name, message string) {
+	if !w.quiet {
+		Emit(Event{Event: event, Source: name, Message: message})
+	}
+}
+
+// Do the ignore files under where the walk started leave out a name?
+func (w *treeWalk) ignored(name string, dir bool) bool {
+	if w.ignores == nil {
+		return false
+	}
+	rel, err := filepath.Rel(w.root, name)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	return w.ignores.Ignored(filepath.ToSlash(rel), dir)
+}
+
+// Report what couldn't be read, which the walk passes over
+func (w *treeWalk) unreadable(name string, err error) {
+	if errors.Is(err, fs.ErrPermission) {
+		w.skip("permission-denied", name, err.Error())
+	} else {
+		w.skip("unreadable-dir", name, err.Error())
+	}
+}
+
+// Walk the tree under root, calling callback for every file after the one
+// at after, given as the components of its path relative to root. Whole
+// directories before it are skipped without being read. level is how many
+// directories root is below where the walk started.
+func (w *treeWalk) walk(root string, after []string, level int, callback func(os.FileInfo, string) error) error {
+	// the directories being read, innermost last
+	var open []*walkDir
+	// note the directories a name isn't in as read through
+	leave := func(name string) {
+		for len(open) > 0 {
+			top := open[len(open)-1]
+			if name != "" && strings.HasPrefix(name, top.path+string(filepath.Separator)) {
+				return
+			}
+			open = open[:len(open)-1]
+			if top.fingerprinted && !top.failed {
+				w.fingerprints.Walked(top.path, top.dirs)
+			}
+		}
+	}
+	// start reading a directory at depth. the one a run stopped in was
+	// only partly read, so it's neither passed over nor fingerprinted. one
+	// unchanged since a run finished it isn't read at all, only the
+	// subdirectories that run found
+	enter := func(name string, depth int, partly bool) error {
+		dir := &walkDir{path: filepath.Clean(name)}
+		if w.fingerprints != nil && !partly {
+			if dirs, unchanged := w.fingerprints.Unchanged(name); unchanged {
+				if err := w.walkUnchanged(name, dirs, depth, callback); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+			dir.fingerprinted = true
+		}
+		open = append(open, dir)
+		return nil
+	}
+
+	err := filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		rel, relErr := filepath.Rel(root, name)
+		if relErr != nil {
+			return relErr
+		}
+		if err != nil {
+			// the starting point can't be read at all
+			if rel == "." && level == 0 {
+				return err
+			}
+			w.unreadable(name, err)
+			if len(open) > 0 && open[len(open)-1].path == filepath.Clean(name) {
+				open[len(open)-1].failed = true
+			}
+			return nil
+		}
+		if rel == "." {
+			return enter(name, level, len(after) > 0)
+		}
+		leave(name)
+		parent := open[len(open)-1]
+
+		components := strings.Split(filepath.ToSlash(rel), "/")
+		place := pastCheckpoint
+		if after != nil {
+			place = placeOfCheckpoint(components, after)
+			if place == beforeCheckpoint {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if place == atCheckpoint && !entry.IsDir() {
+				after = nil
+				return nil
+			}
+			if place != aroundCheckpoint {
+				after = nil
+			}
+		}
+		if w.ignored(name, entry.IsDir()) {
+			w.skip("ignored", name, "")
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			return nil // gone already
+		}
+		if err != nil {
+			w.unreadable(name, err)
+			return nil
+		}
+		file, ok := w.entry(name, info)
+		if !ok {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		depth := level + len(components)
+		if !file.IsDir() {
+			return callback(file, name)
+		}
+		parent.dirs = append(parent.dirs, file.Name())
+		if w.maxDepth > 0 && depth >= w.maxDepth {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			// a followed symlink, walked as a tree of its own
+			var rest []string
+			if place == aroundCheckpoint {
+				rest = after[len(components):]
+			}
+			return w.walk(name+string(filepath.Separator), rest, depth, callback)
+		}
+		return enter(name, depth, place == aroundCheckpoint)
+	})
+	leave("")
+	return err
+}
+
+// Go on into the subdirectories a run found in a directory at depth that
+// is unchanged since, without reading it or looking at its files
+func (w *treeWalk) walkUnchanged(path string, dirs []string, depth int, callback func(os.FileInfo, string) error) error {
+	if w.maxDepth > 0 && depth+1 >= w.maxDepth {
+		return nil
+	}
+	for _, name := range dirs {
+		sub := filepath.Join(path, name)
+		info, err := os.Lstat(sub)
+		if err != nil {
+			continue // gone, and the directory would have changed
+		}
+		if w.ignored(sub, info.IsDir()) {
+			w.skip("ignored", sub, "")
+			continue
+		}
+		info, ok := w.entry(sub, info)
+		if !ok || !info.IsDir() {
+			continue
+		}
+		if err = w.walk(sub, nil, depth+1, callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// What a symlink into the object store points to
+func (w *treeWalk) storedObject(name string) (os.FileInfo, bool) {
+	target, err := filepath.EvalSymlinks(name)
+	if err != nil || !strings.HasPrefix(target, w.objects+string(filepath.Separator)) {
+		return nil, false
+	}
+	info, err := os.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, false
+	}
+	return info, true
+}
+
+// What the walk should take a directory entry as, and whether to take it
+// at all. A symlink is skipped unless FollowSymlinks, and then stands for
+// what it points to, as does one into an output's object store. A
+// directory already visited is skipped so a symlink loop ends, as is one
+// on another filesystem with OneFileSystem.
+func (w *treeWalk) entry(name string, file os.FileInfo) (os.FileInfo, bool) {
+	if file.Mode()&os.ModeSymlink != 0 && w.objects != "" {
+		if stored, ok := w.storedObject(name); ok {
+			return stored, true
+		}
+	}
+	if file.Mode()&os.ModeSymlink != 0 {
+		if !w.options.FollowSymlinks {
+			w.skip("symlink-skipped", name, "")
+			return nil, false
+		}
+		target, err := os.Stat(name)
+		if err != nil {
+			w.skip("symlink-skipped", name, err.Error())
+			return nil, false
+		}
+		file = target
+	}
+	if file.IsDir() {
+		if device, ok := fileDevice(file); w.options.OneFileSystem && ok && device != w.device {
+			w.skip("other-filesystem", name, "")
+			return nil, false
+		}
+		id := fileIdentity(name, file)
+		if w.visited[id] {
+			w.skip("symlink-loop", name, "")
+			return nil, false
+		}
+		w.visited[id] = true
+	}
+	return file, true
+}
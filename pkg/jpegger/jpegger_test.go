@@ -0,0 +1,93 @@
+package jpegger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlaceOfCheckpoint(t *testing.T) {
+	tests := []struct {
+		components string
+		after      string
+		want       checkpointPlace
+	}{
+		{"2019", "2019/04/IMG_1.jpg", aroundCheckpoint},
+		{"2019/04", "2019/04/IMG_1.jpg", aroundCheckpoint},
+		{"2019/04/IMG_1.jpg", "2019/04/IMG_1.jpg", atCheckpoint},
+		{"2019/04/IMG_0.jpg", "2019/04/IMG_1.jpg", beforeCheckpoint},
+		{"2019/04/IMG_2.jpg", "2019/04/IMG_1.jpg", pastCheckpoint},
+		{"2019/03", "2019/04/IMG_1.jpg", beforeCheckpoint},
+		{"2019/05", "2019/04/IMG_1.jpg", pastCheckpoint},
+		{"2018/12/IMG_9.jpg", "2019/04/IMG_1.jpg", beforeCheckpoint},
+		{"2020", "2019/04/IMG_1.jpg", pastCheckpoint},
+		// a directory named like the file the walk stopped at sorts the
+		// same, but what's in it comes after
+		{"2019/04/IMG_1.jpg/x.jpg", "2019/04/IMG_1.jpg", pastCheckpoint},
+		// names compare by byte, as the walk sorts them
+		{"2019/04/img_1.jpg", "2019/04/IMG_1.jpg", pastCheckpoint},
+		{"2019/04/IMG_1.jpeg", "2019/04/IMG_1.jpg", beforeCheckpoint},
+		{"2019/04/IMG_1", "2019/04/IMG_1.jpg", beforeCheckpoint},
+		{"IMG_1.jpg", "IMG_1.jpg", atCheckpoint},
+		{"A.jpg", "IMG_1.jpg", beforeCheckpoint},
+		{"2019", "IMG_1.jpg", beforeCheckpoint},
+	}
+	for _, test := range tests {
+		got := placeOfCheckpoint(strings.Split(test.components, "/"), strings.Split(test.after, "/"))
+		if got != test.want {
+			t.Errorf("placeOfCheckpoint(%q, %q) = %d, want %d", test.components, test.after, got, test.want)
+		}
+	}
+}
+
+func TestWithFilesAfter(t *testing.T) {
+	root := t.TempDir()
+	names := []string{
+		"2018/12/IMG_9.jpg",
+		"2019/03/IMG_5.jpg",
+		"2019/04/IMG_0.jpg",
+		"2019/04/IMG_1.jpg",
+		"2019/04/IMG_2.jpg",
+		"2019/05/IMG_3.jpg",
+		"IMG_4.jpg",
+	}
+	for _, name := range names {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		after string
+		want  []string
+	}{
+		{"", names},
+		{"2019/04/IMG_1.jpg", names[4:]},
+		{"2019/04/IMG_0.jpg", names[3:]},
+		// a checkpoint whose file is gone since
+		{"2019/04/IMG_15.jpg", names[4:]},
+		// one that's a directory now, whose files all sort after it
+		{"2019/04", names[2:]},
+		{"2019", names[1:]},
+		{"IMG_4.jpg", nil},
+	}
+	for _, test := range tests {
+		var got []string
+		err := WithFilesAfter(root, test.after, func(info os.FileInfo, name string) error {
+			rel, _ := filepath.Rel(root, name)
+			got = append(got, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalStrings(got, test.want) {
+			t.Errorf("after %q: got %v, want %v", test.after, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package jpegger
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const DefaultLayout = "{{.Year}}/{{.Month}}"
+
+// Values available to layout and name templates
+type LayoutFields struct {
+	Year   string
+	Month  string
+	Day    string
+	Hour   string
+	Minute string
+	Second string
+	Time   time.Time
+	// The same as Time
+	Date time.Time
+	// Where the file was taken, with -geo-layout. Empty if unknown.
+	Country string
+	City    string
+	// The name the file was found with, without and with its extension
+	Name string
+	Ext  string
+	// The hex of the file's key and its first 8 digits
+	Hash  string
+	Hash8 string
+	// What kind of file it is: camera, screenshot, messenger or other
+	Class string
+	// The make and model of camera that took it, and the two together
+	// without the make said twice, e.g. Canon and Canon EOS R5. Empty if
+	// its EXIF doesn't say.
+	Make   string
+	Model  string
+	Camera string
+}
+
+// strftime directives and the template actions they stand for
+var strftimeFields = map[byte]string{
+	'Y': "{{.Year}}",
+	'm': "{{.Month}}",
+	'd': "{{.Day}}",
+	'H': "{{.Hour}}",
+	'M': "{{.Minute}}",
+	'S': "{{.Second}}",
+	'y': `{{.Time.Format "06"}}`,
+	'b': `{{.Time.Format "Jan"}}`,
+	'B': `{{.Time.Format "January"}}`,
+	'%': "%",
+}
+
+// Decides the directory, relative to the output, that a file belongs in
+type Layout struct {
+	tmpl *template.Template
+	// Layouts for kinds of files placed differently, by class
+	classes map[string]*Layout
+}
+
+// Translate a strftime-like pattern into the equivalent template
+func strftimeToTemplate(pattern string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			out.WriteByte(pattern[i])
+			continue
+		}
+		if i+1 == len(pattern) {
+			return "", fmt.Errorf("dangling %% at end of layout %q", pattern)
+		}
+		i++
+		action, ok := strftimeFields[pattern[i]]
+		if !ok {
+			return "", fmt.Errorf("unsupported directive %%%c in layout %q", pattern[i], pattern)
+		}
+		out.WriteString(action)
+	}
+	return out.String(), nil
+}
+
+// Parse a layout given either as a Go template or a strftime-like pattern
+func ParseLayout(pattern string) (*Layout, error) {
+	if !strings.Contains(pattern, "{{") {
+		converted, err := strftimeToTemplate(pattern)
+		if err != nil {
+			return nil, err
+		}
+		pattern = converted
+	}
+
+	tmpl, err := template.New("layout").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &Layout{tmpl: tmpl}, nil
+}
+
+// Add the country a file was taken in to the end of a layout, unless the
+// layout already places files by where they were taken
+func GeoLayoutPattern(pattern string) (string, error) {
+	if !strings.Contains(pattern, "{{") {
+		converted, err := strftimeToTemplate(pattern)
+		if err != nil {
+			return "", err
+		}
+		pattern = converted
+	}
+
+	if strings.Contains(pattern, ".Country") || strings.Contains(pattern, ".City") {
+		return pattern, nil
+	}
+	return pattern + "/{{.Country}}", nil
+}
+
+// Gather the template values describing a file
+func NewLayoutFields(stamp FileStamp) LayoutFields {
+	t := stamp.Time
+	name := filepath.Base(stamp.Path)
+	hash := hex.EncodeToString(stamp.Key)
+	hash8 := hash
+	if len(hash8) > 8 {
+		hash8 = hash8[:8]
+	}
+	return LayoutFields{
+		Year:    fmt.Sprintf("%d", t.Year()),
+		Month:   fmt.Sprintf("%02d", t.Month()),
+		Day:     fmt.Sprintf("%02d", t.Day()),
+		Hour:    fmt.Sprintf("%02d", t.Hour()),
+		Minute:  fmt.Sprintf("%02d", t.Minute()),
+		Second:  fmt.Sprintf("%02d", t.Second()),
+		Time:    t,
+		Date:    t,
+		Country: stamp.Place.Country,
+		City:    stamp.Place.City,
+		Name:    strings.TrimSuffix(name, filepath.Ext(name)),
+		Ext:     filepath.Ext(name),
+		Hash:    hash,
+		Hash8:   hash8,
+		Class:   stamp.Class,
+		Make:    placeName(stamp.Make),
+		Model:   placeName(stamp.Camera),
+		Camera:  placeName(CameraName(stamp.Make, stamp.Camera)),
+	}
+}
+
+// Name a camera by its make and model. Many models already start with the
+// make, and some makes are a whole company name, so the model is used alone
+// when it starts with the make's first word.
+func CameraName(make, model string) string {
+	fields := strings.Fields(make)
+	if len(fields) == 0 {
+		return model
+	}
+	if model == "" {
+		return make
+	}
+	if strings.HasPrefix(strings.ToLower(model), strings.ToLower(fields[0])) {
+		return model
+	}
+	return make + " " + model
+}
+
+// Place files of a class by another layout
+func (l *Layout) Route(class string, layout *Layout) {
+	if l.classes == nil {
+		l.classes = map[string]*Layout{}
+	}
+	l.classes[class] = layout
+}
+
+// Create a path fragment for a file
+func (l *Layout) Path(stamp FileStamp) (string, error) {
+	if routed, ok := l.classes[stamp.Class]; ok {
+		return routed.Path(stamp)
+	}
+	var buf bytes.Buffer
+	err := l.tmpl.Execute(&buf, NewLayoutFields(stamp))
+	if err != nil {
+		return "", err
+	}
+
+	dir := path.Clean(buf.String())
+	if path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", fmt.Errorf("layout produced %q which escapes the output directory", dir)
+	}
+	return dir, nil
+}
+
+// Decides the name a file is given in its directory
+type NameTemplate struct {
+	tmpl *template.Template
+}
+
+func ParseNameTemplate(pattern string) (*NameTemplate, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &NameTemplate{tmpl}, nil
+}
+
+// Name a file. The name can't reach into another directory; that is the
+// layout's job.
+func (n *NameTemplate) Name(stamp FileStamp) (string, error) {
+	var buf bytes.Buffer
+	err := n.tmpl.Execute(&buf, NewLayoutFields(stamp))
+	if err != nil {
+		return "", err
+	}
+
+	name := buf.String()
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("name template produced %q which isn't a file name", name)
+	}
+	return name, nil
+}
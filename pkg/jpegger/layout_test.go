@@ -0,0 +1,52 @@
+package jpegger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStrftimeToTemplate(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+		// the directory it gives for 2019-04-05 10:11:12, "" if it fails
+		path string
+	}{
+		{"%Y/%m", "{{.Year}}/{{.Month}}", "2019/04"},
+		{"%Y/%m/%d", "{{.Year}}/{{.Month}}/{{.Day}}", "2019/04/05"},
+		{"%Y-%m-%d %H.%M.%S", "{{.Year}}-{{.Month}}-{{.Day}} {{.Hour}}.{{.Minute}}.{{.Second}}", "2019-04-05 10.11.12"},
+		{"%y/%b", `{{.Time.Format "06"}}/{{.Time.Format "Jan"}}`, "19/Apr"},
+		{"%B %Y", `{{.Time.Format "January"}} {{.Year}}`, "April 2019"},
+		{"100%%/%Y", "100%/{{.Year}}", "100%/2019"},
+		{"photos", "photos", "photos"},
+		{"", "", "."},
+		{"%", "", ""},
+		{"%Y/%", "", ""},
+		{"%Q", "", ""},
+		{"%Y/%j", "", ""},
+	}
+	stamp := FileStamp{Path: "IMG_1.jpg", Time: time.Date(2019, 4, 5, 10, 11, 12, 0, time.UTC)}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			got, err := strftimeToTemplate(test.pattern)
+			if test.path == "" {
+				if err == nil {
+					t.Errorf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("got %q, %v, want %q", got, err, test.want)
+			}
+
+			layout, err := ParseLayout(test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path, err := layout.Path(stamp)
+			if err != nil || path != test.path {
+				t.Errorf("placed in %q, %v, want %q", path, err, test.path)
+			}
+		})
+	}
+}
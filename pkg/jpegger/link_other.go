@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package jpegger
+
+import (
+	"syscall"
+)
+
+// What link gives on filesystems without hard links, like FAT and exFAT on
+// an SD card, and across filesystems
+var linkUnsupportedErrors = []error{syscall.EPERM, syscall.EXDEV, syscall.ENOTSUP, syscall.EOPNOTSUPP, syscall.ENOSYS}
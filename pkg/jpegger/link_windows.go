@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package jpegger
+
+import (
+	"syscall"
+)
+
+// What CreateHardLink gives on FAT and exFAT, which have no hard links, and
+// across volumes
+var linkUnsupportedErrors = []error{
+	syscall.Errno(1),  // ERROR_INVALID_FUNCTION
+	syscall.Errno(17), // ERROR_NOT_SAME_DEVICE
+	syscall.Errno(50), // ERROR_NOT_SUPPORTED
+}
@@ -0,0 +1,144 @@
+package jpegger
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	LogMaxMB  = new(int)
+	LogMaxAge = new(time.Duration)
+	LogKeep   = new(int)
+)
+
+// The action log. It's rotated once it grows past a size or has been
+// written to for long enough, keeping a few old logs as log.1, log.2, ...,
+// and can be reopened after something else has moved it away.
+type LogFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	size int64
+	// when the log was started, as near as can be told
+	started time.Time
+
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	hangups chan os.Signal
+}
+
+// Open the log at path for appending. Rotation is off while maxSize and
+// maxAge are 0.
+func OpenLogFile(path string, maxSize int64, maxAge time.Duration, keep int) (*LogFile, error) {
+	l := &LogFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+
+	// the last rotation was about when the last log stopped being written
+	// to. without one the log is as old as this run.
+	l.started = time.Now()
+	if previous, err := os.Stat(rotatedLogName(l.path, 1)); err == nil && info.Size() > 0 {
+		l.started = previous.ModTime()
+	}
+	return nil
+}
+
+func rotatedLogName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// Move the log to log.1, the older ones down a place and the oldest away,
+// and start a new one
+func (l *LogFile) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	os.Remove(rotatedLogName(l.path, l.keep))
+	for n := l.keep - 1; n >= 1; n-- {
+		os.Rename(rotatedLogName(l.path, n), rotatedLogName(l.path, n+1))
+	}
+	if l.keep > 0 {
+		if err := os.Rename(l.path, rotatedLogName(l.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.started = time.Now()
+	return nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	full := l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize
+	old := l.maxAge > 0 && l.size > 0 && time.Since(l.started) >= l.maxAge
+	if full || old {
+		if err := l.rotate(); err != nil {
+			return 0, fmt.Errorf("while rotating %s: %v", l.path, err)
+		}
+	}
+
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Close the log and open whatever is at its path now, for logrotate and
+// the like having moved it away
+func (l *LogFile) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Reopen the log whenever the process is sent SIGHUP, until it's closed
+func (l *LogFile) ReopenOnHangup() {
+	l.hangups = make(chan os.Signal, 1)
+	signal.Notify(l.hangups, syscall.SIGHUP)
+	go func(hangups chan os.Signal) {
+		for range hangups {
+			if err := l.Reopen(); err != nil {
+				fmt.Fprintf(os.Stderr, "while reopening %s: %v\n", l.path, err)
+			}
+		}
+	}(l.hangups)
+}
+
+func (l *LogFile) Close() error {
+	if l.hangups != nil {
+		signal.Stop(l.hangups)
+		close(l.hangups)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
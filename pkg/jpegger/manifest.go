@@ -0,0 +1,226 @@
+package jpegger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// The checksum file written to each directory of the output, in the
+	// format sha256sum -c reads
+	ManifestName = "SHA256SUMS"
+
+	sha256Size = 32
+)
+
+var WriteManifests = new(bool)
+
+func init() {
+	importFlags.BoolVar(WriteManifests, "manifest", false, "keep a "+ManifestName+" in each output directory listing what was placed there, so the archive can be checked with sha256sum -c without jpegger. files placed before are added on the first run with it")
+}
+
+// Names escaped the way sha256sum escapes them: a line for a name holding
+// a backslash or newline starts with a backslash
+var manifestEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+var manifestUnescaper = strings.NewReplacer("\\\\", "\\", "\\n", "\n")
+
+// The checksums in a directory's manifest, by name. A missing manifest is
+// empty.
+func ReadManifest(dir string) (map[string]string, error) {
+	sums := map[string]string{}
+	f, err := os.Open(filepath.Join(dir, ManifestName))
+	if os.IsNotExist(err) {
+		return sums, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+		// the hash, then a space and a space or * for binary mode
+		if len(line) < 2*sha256Size+2 {
+			continue
+		}
+		sum, name := line[:2*sha256Size], line[2*sha256Size+2:]
+		if escaped {
+			name = manifestUnescaper.Replace(name)
+		}
+		sums[name] = sum
+	}
+	return sums, scanner.Err()
+}
+
+// Replace a directory's manifest with sums, sorted by name, or remove it if
+// there are none
+func writeManifest(dir string, sums map[string]string) error {
+	name := filepath.Join(dir, ManifestName)
+	if len(sums) == 0 {
+		err := os.Remove(name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var names []string
+	for n := range sums {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var out bytes.Buffer
+	for _, n := range names {
+		if escaped := manifestEscaper.Replace(n); escaped != n {
+			fmt.Fprintf(&out, "\\%s  %s\n", sums[n], escaped)
+		} else {
+			fmt.Fprintf(&out, "%s  %s\n", sums[n], n)
+		}
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".jpegger-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(out.Bytes())
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// The sha256 of a file placed in the output, from the database when it
+// keys content with sha256 and otherwise by reading the file
+func placedSHA256(db Store, output, relPath string) (string, error) {
+	var key []byte
+	err := db.View(func(tx Tx) error {
+		placed := lookup(tx, DestinationPath, []byte(relPath))
+		if placed != nil && KeyAlgorithm(tx, placed) == "sha256" {
+			key = PlacedKey(tx, relPath, placed)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		key, err = HashFile(OutputPath(output, relPath), "sha256")
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// Add placed files to the manifests of their directories. Sidecars are
+// left out as they change with every edit.
+func AddToManifests(db Store, output string, relPaths ...string) error {
+	byDir := map[string][]string{}
+	for _, rel := range relPaths {
+		if !IsXMPSidecar(rel) {
+			byDir[path.Dir(rel)] = append(byDir[path.Dir(rel)], rel)
+		}
+	}
+
+	for dir, rels := range byDir {
+		local := OutputPath(output, dir)
+		sums, err := ReadManifest(local)
+		if err != nil {
+			return err
+		}
+		changed := false
+		for _, rel := range rels {
+			sum, err := placedSHA256(db, output, rel)
+			if err != nil {
+				return err
+			}
+			if sums[path.Base(rel)] != sum {
+				sums[path.Base(rel)] = sum
+				changed = true
+			}
+		}
+		if changed {
+			if err = writeManifest(local, sums); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Take a file out of the manifest of its directory, if it has one
+func RemoveFromManifest(output, relPath string) error {
+	dir := OutputPath(output, path.Dir(relPath))
+	sums, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := sums[path.Base(relPath)]; !ok {
+		return nil
+	}
+	delete(sums, path.Base(relPath))
+	return writeManifest(dir, sums)
+}
+
+// The placed files missing from the manifests of their directories, like
+// those placed before -manifest was used
+func ManifestBacklog(db Store, output string) ([]string, error) {
+	var placed []string
+	err := db.View(func(tx Tx) error {
+		b := tx.Bucket([]byte(DestinationPath))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(rel, _ []byte) error {
+			if !IsXMPSidecar(string(rel)) {
+				placed = append(placed, string(rel))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	manifests := map[string]map[string]string{}
+	for _, rel := range placed {
+		dir := path.Dir(rel)
+		if manifests[dir] == nil {
+			manifests[dir], err = ReadManifest(OutputPath(output, dir))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := manifests[dir][path.Base(rel)]; ok {
+			continue
+		}
+		// gone since, which verify reports
+		if _, err := os.Stat(OutputPath(output, rel)); err == nil {
+			missing = append(missing, rel)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,222 @@
+package jpegger
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// When two databases disagree about a piece of content, it keeps the state
+// furthest along this list. Copied content is in an archive whichever
+// machine copied it.
+var statePrecedence = [][]byte{DiscoveredFile, EmptyFile, QuarantinedFile, DuplicateFile, CopiedFile, VerifiedFile, RejectedFile}
+
+func stateRank(state []byte) int {
+	for i, s := range statePrecedence {
+		if bytes.Equal(s, state) {
+			return i
+		}
+	}
+	return -1
+}
+
+// The buckets a merge unions, how to print their entries, and which value
+// wins when both databases have the key. Checkpoints and directory
+// fingerprints belong to the inputs of one machine and runs are renumbered,
+// so none of them are here.
+var mergeBuckets = []struct {
+	name       string
+	key, value func([]byte) string
+	// the value to keep; by default this database's
+	resolve func(ours, theirs []byte) []byte
+}{
+	{ContentHash, hex.EncodeToString, StateName, func(ours, theirs []byte) []byte {
+		if stateRank(theirs) > stateRank(ours) {
+			return theirs
+		}
+		return ours
+	}},
+	{SourcePath, asString, hex.EncodeToString, nil},
+	{SourceStats, asString, asString, nil},
+	{DestinationPath, asString, hex.EncodeToString, nil},
+	{ContentDestination, hex.EncodeToString, asString, nil},
+	{Pairs, hex.EncodeToString, hex.EncodeToString, nil},
+	{KeyAlgorithms, hex.EncodeToString, asString, nil},
+	{Prefilters, hex.EncodeToString, asString, nil},
+	{PrefilterHashes, hex.EncodeToString, hex.EncodeToString, nil},
+	{Quarantined, asString, asString, nil},
+	{FileErrors, asString, asString, nil},
+	{Duplicates, hex.EncodeToString, hex.EncodeToString, nil},
+	{ContentDates, hex.EncodeToString, asString, nil},
+	{Rewritten, asString, hex.EncodeToString, nil},
+	{Descriptions, hex.EncodeToString, asString, nil},
+	{Mirrored, asString, hex.EncodeToString, nil},
+	{Companions, asString, asString, nil},
+	{Bursts, hex.EncodeToString, asString, nil},
+	{Decisions, asString, asString, nil},
+	{ImageHashes, hex.EncodeToString, hex.EncodeToString, nil},
+	{ContentImageHashes, hex.EncodeToString, hex.EncodeToString, nil},
+	{Shots, hex.EncodeToString, asString, nil},
+	{Tags, hex.EncodeToString, asString, mergeTags},
+	{StateTimes, hex.EncodeToString, asString, mergeStateTimes},
+	{Scrubbed, asString, asString, func(ours, theirs []byte) []byte {
+		// the later check
+		if string(theirs) > string(ours) {
+			return theirs
+		}
+		return ours
+	}},
+}
+
+// Add everything another database knows to this one. Entries only the other
+// has are copied; where both have one and they differ it is resolved as
+// mergeBuckets says and reported to out. The other's runs are added after
+// this one's so that they can still be undone.
+func MergeState(tx, other Tx, name string, out io.Writer) error {
+	ourAlgorithms, theirAlgorithms := ContentAlgorithms(tx), ContentAlgorithms(other)
+	if len(ourAlgorithms) > 0 && len(theirAlgorithms) > 0 {
+		ours, theirs := MainAlgorithm(ourAlgorithms), MainAlgorithm(theirAlgorithms)
+		if ours != theirs {
+			return fmt.Errorf("%s keys content with %s and this database with %s, so their content can't be matched up", name, theirs, ours)
+		}
+	}
+
+	for _, m := range mergeBuckets {
+		theirs := other.Bucket([]byte(m.name))
+		if theirs == nil {
+			continue
+		}
+		ours := tx.Bucket([]byte(m.name))
+
+		added, conflicts := 0, 0
+		err := theirs.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil // nested buckets aren't entries
+			}
+			current := ours.Get(k)
+			if current == nil {
+				added += 1
+				return ours.Put(k, v)
+			}
+			if bytes.Equal(current, v) {
+				return nil
+			}
+
+			conflicts += 1
+			kept := current
+			if m.resolve != nil {
+				kept = m.resolve(current, v)
+			}
+			fmt.Fprintf(out, "%s %s: here %s, in %s %s, keeping %s\n", m.name, m.key(k), m.value(current), name, m.value(v), m.value(kept))
+			if bytes.Equal(kept, current) {
+				return nil
+			}
+			return ours.Put(k, append([]byte(nil), kept...))
+		})
+		if err != nil {
+			return err
+		}
+		if added > 0 || conflicts > 0 {
+			fmt.Fprintf(out, "%s: %d added, %d conflicting\n", m.name, added, conflicts)
+		}
+	}
+
+	return mergeRuns(tx, other, name, out)
+}
+
+// Append the runs of another database, renumbered after this one's. Runs
+// merged before are left alone.
+func mergeRuns(tx, other Tx, name string, out io.Writer) error {
+	// the same run has the same start, input and output in both
+	runKey := func(run RunInfo) string {
+		return run.Started.UTC().Format(time.RFC3339Nano) + "\x00" + run.Input + "\x00" + run.Output
+	}
+	known := map[string]bool{}
+	ours, err := ListRuns(tx)
+	if err != nil {
+		return err
+	}
+	for _, run := range ours {
+		known[runKey(run)] = true
+	}
+
+	runs, err := ListRuns(other)
+	if err != nil {
+		return err
+	}
+	ourRuns := tx.Bucket([]byte(Runs))
+	for _, run := range runs {
+		if known[runKey(run)] {
+			continue
+		}
+		id, err := ourRuns.NextSequence()
+		if err != nil {
+			return err
+		}
+		info, err := json.Marshal(RunInfo{Started: run.Started, Input: run.Input, Output: run.Output})
+		if err != nil {
+			return err
+		}
+		if err = ourRuns.Put(RunKey(id), info); err != nil {
+			return err
+		}
+
+		theirFiles := other.Bucket([]byte(RunFiles)).Bucket(RunKey(run.ID))
+		if theirFiles == nil {
+			continue
+		}
+		files, err := tx.Bucket([]byte(RunFiles)).CreateBucketIfNotExists(RunKey(id))
+		if err != nil {
+			return err
+		}
+		err = theirFiles.ForEach(func(k, v []byte) error {
+			return files.Put(k, v)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "run %d of %s is run %d here\n", run.ID, name, id)
+	}
+	return nil
+}
+
+func dbMerge(args []string) error {
+	if len(args) != 1 {
+		return UsageError(dbFlags, "merge takes the database to merge in")
+	}
+	if _, err := os.Stat(args[0]); err != nil {
+		return err
+	}
+
+	other, err := OpenStore(args[0], StoreOptions{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+
+	lock, err := LockRun(*Database, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	db, err := OpenStore(*Database, StoreOptions{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = CreateBuckets(db); err != nil {
+		return err
+	}
+
+	// one transaction, so a failed merge changes nothing
+	return db.Update(func(tx Tx) error {
+		return other.View(func(otherTx Tx) error {
+			return MergeState(tx, otherTx, args[0], os.Stdout)
+		})
+	})
+}
@@ -0,0 +1,231 @@
+package jpegger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// What people wrote about each piece of content, as JSON
+	Descriptions = "Descriptions"
+
+	xmpNamespace   = "http://ns.adobe.com/xap/1.0/\x00"
+	photoshopMagic = "Photoshop 3.0\x00"
+	iptcResource   = 0x0404
+
+	// IPTC-IIM datasets of the application record
+	iptcKeywords = 25
+	iptcCaption  = 120
+)
+
+var (
+	xmpCaption  = regexp.MustCompile(`(?s)<dc:description>.*?<rdf:li[^>]*>([^<]*)</rdf:li>`)
+	xmpSubject  = regexp.MustCompile(`(?s)<dc:subject>(.*?)</dc:subject>`)
+	xmpListItem = regexp.MustCompile(`<rdf:li[^>]*>([^<]*)</rdf:li>`)
+	xmpRating   = regexp.MustCompile(`xmp:Rating(?:="([^"]*)"|>([^<]*)<)`)
+)
+
+// What people wrote about a photo: its caption, keywords and star rating
+type Description struct {
+	Caption  string   `json:"caption,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+	Rating   int      `json:"rating,omitempty"`
+}
+
+func (d Description) IsEmpty() bool {
+	return d.Caption == "" && len(d.Keywords) == 0 && d.Rating == 0
+}
+
+// Fill in what d lacks from another description
+func (d *Description) merge(other Description) {
+	if d.Caption == "" {
+		d.Caption = other.Caption
+	}
+	if len(d.Keywords) == 0 {
+		d.Keywords = other.Keywords
+	}
+	if d.Rating == 0 {
+		d.Rating = other.Rating
+	}
+}
+
+// Read the description of a file from its XMP sidecar, if it has one, and
+// the XMP and IPTC in a JPEG. The sidecar comes first as it holds the
+// latest edits.
+func ReadDescription(local, sidecar string) (Description, error) {
+	var d Description
+	if sidecar != "" {
+		data, err := ioutil.ReadFile(sidecar)
+		if err != nil {
+			return d, err
+		}
+		d = parseXMPDescription(data)
+	}
+	if !hasExtension(local, JPEGExtensions) {
+		return d, nil
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return d, err
+	}
+	defer f.Close()
+	var xmp, iptc Description
+	walkJPEGSegments(f, func(marker byte, body []byte) {
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(body, []byte(xmpNamespace)):
+			xmp = parseXMPDescription(body[len(xmpNamespace):])
+		case marker == 0xed && bytes.HasPrefix(body, []byte(photoshopMagic)):
+			iptc = parsePhotoshopIPTC(body[len(photoshopMagic):])
+		}
+	})
+	d.merge(xmp)
+	d.merge(iptc)
+	return d, nil
+}
+
+// Call fn with each metadata segment of a JPEG, up to the image data. A
+// damaged JPEG ends the walk early.
+func walkJPEGSegments(in io.Reader, fn func(marker byte, body []byte)) {
+	r := bufio.NewReader(in)
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return
+	}
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			return
+		}
+		// standalone markers carry no length
+		if marker[1] == 0x01 || (marker[1] >= 0xd0 && marker[1] <= 0xd7) {
+			continue
+		}
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return
+		}
+		body := make([]byte, length-2)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		fn(marker[1], body)
+	}
+}
+
+// The caption, keywords and rating in an XMP packet. Like ReadXMPDate, this
+// looks for the properties rather than parsing the RDF.
+func parseXMPDescription(data []byte) Description {
+	var d Description
+	if m := xmpCaption.FindSubmatch(data); m != nil {
+		d.Caption = strings.TrimSpace(html.UnescapeString(string(m[1])))
+	}
+	if m := xmpSubject.FindSubmatch(data); m != nil {
+		for _, item := range xmpListItem.FindAllSubmatch(m[1], -1) {
+			if keyword := strings.TrimSpace(html.UnescapeString(string(item[1]))); keyword != "" {
+				d.Keywords = append(d.Keywords, keyword)
+			}
+		}
+	}
+	if m := xmpRating.FindSubmatch(data); m != nil {
+		// -1 marks a rejected photo, which isn't a rating
+		if rating, err := strconv.Atoi(strings.TrimSpace(string(m[1]) + string(m[2]))); err == nil && rating > 0 {
+			d.Rating = rating
+		}
+	}
+	return d
+}
+
+// The caption and keywords in the IPTC-IIM record of a Photoshop image
+// resource block
+func parsePhotoshopIPTC(data []byte) Description {
+	var d Description
+	for len(data) >= 12 && bytes.HasPrefix(data, []byte("8BIM")) {
+		id := binary.BigEndian.Uint16(data[4:])
+		// a pascal string name, padded to an even length
+		nameLen := int(data[6]) + 1
+		nameLen += nameLen % 2
+		if 6+nameLen+4 > len(data) {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(data[6+nameLen:]))
+		start := 6 + nameLen + 4
+		if size < 0 || start+size > len(data) {
+			break
+		}
+		if id == iptcResource {
+			d = parseIIM(data[start : start+size])
+		}
+		next := start + size + size%2
+		if next > len(data) {
+			break
+		}
+		data = data[next:]
+	}
+	return d
+}
+
+func parseIIM(data []byte) Description {
+	var d Description
+	for len(data) >= 5 && data[0] == 0x1c {
+		record, dataset := data[1], data[2]
+		size := int(binary.BigEndian.Uint16(data[3:]))
+		// extended datasets are only used for very long values
+		if size&0x8000 != 0 || 5+size > len(data) {
+			break
+		}
+		value := strings.TrimSpace(string(data[5 : 5+size]))
+		if record == 2 && value != "" {
+			switch dataset {
+			case iptcKeywords:
+				d.Keywords = append(d.Keywords, value)
+			case iptcCaption:
+				d.Caption = value
+			}
+		}
+		data = data[5+size:]
+	}
+	return d
+}
+
+func RecordDescription(db Store, key []byte, d Description) error {
+	value, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte(Descriptions)).Put(key, value)
+	})
+}
+
+// The description recorded for a piece of content, if any
+func ContentDescription(tx Tx, key []byte) (Description, bool) {
+	var d Description
+	value := lookup(tx, Descriptions, key)
+	if value == nil || json.Unmarshal(value, &d) != nil {
+		return d, false
+	}
+	return d, true
+}
+
+// Does a description have the keyword, ignoring case?
+func (d Description) HasKeyword(keyword string) bool {
+	for _, k := range d.Keywords {
+		if strings.EqualFold(k, keyword) {
+			return true
+		}
+	}
+	return false
+}
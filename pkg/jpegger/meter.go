@@ -0,0 +1,159 @@
+package jpegger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	meterInterval = 500 * time.Millisecond
+	meterWidth    = 30
+)
+
+// Draws a progress bar for an import. The candidate files are counted in
+// the background so that importing can start right away; until the count
+// is finished there is no bar or ETA.
+type Meter struct {
+	mu         sync.Mutex
+	out        io.Writer
+	started    time.Time
+	counted    bool
+	totalFiles int64
+	totalBytes int64
+	files      int64
+	bytes      int64
+	done       chan struct{}
+	stopped    sync.WaitGroup
+}
+
+// Is the file a terminal rather than a pipe or a file?
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func NewMeter(out io.Writer) *Meter {
+	return &Meter{out: out, started: time.Now(), done: make(chan struct{})}
+}
+
+// Count the files an import will look at, skipping those before each
+// checkpoint just as the import does
+func (m *Meter) Count(inputs []*importInput) {
+	for _, in := range inputs {
+		in.Source.Walk(in.Checkpoint, func(file os.FileInfo, name string) error {
+			if !ValidName(name) {
+				return nil
+			}
+			m.mu.Lock()
+			m.totalFiles += 1
+			m.totalBytes += file.Size()
+			m.mu.Unlock()
+			return nil
+		})
+	}
+
+	m.mu.Lock()
+	m.counted = true
+	m.mu.Unlock()
+}
+
+// Note a handled file
+func (m *Meter) Add(size int64) {
+	m.mu.Lock()
+	m.files += 1
+	m.bytes += size
+	m.mu.Unlock()
+}
+
+// Redraw periodically until Stop is called
+func (m *Meter) Start() {
+	m.stopped.Add(1)
+	go func() {
+		defer m.stopped.Done()
+		ticker := time.NewTicker(meterInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.done:
+				m.draw()
+				consoleMu.Lock()
+				fmt.Fprintln(m.out)
+				consoleMu.Unlock()
+				return
+			case <-ticker.C:
+				m.draw()
+			}
+		}
+	}()
+}
+
+func (m *Meter) Stop() {
+	close(m.done)
+	m.stopped.Wait()
+}
+
+func (m *Meter) draw() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elapsed := time.Since(m.started).Seconds()
+	fileRate := float64(m.files) / elapsed
+	byteRate := float64(m.bytes) / elapsed
+
+	var line string
+	if m.counted && m.totalFiles > 0 {
+		fraction := float64(m.bytes) / float64(m.totalBytes)
+		if m.totalBytes == 0 {
+			fraction = float64(m.files) / float64(m.totalFiles)
+		}
+		if fraction > 1 {
+			fraction = 1
+		}
+		filled := int(fraction * meterWidth)
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", meterWidth-filled)
+
+		eta := "?"
+		if byteRate > 0 {
+			remaining := time.Duration(float64(m.totalBytes-m.bytes)/byteRate) * time.Second
+			eta = remaining.Round(time.Second).String()
+		}
+		line = fmt.Sprintf("[%s] %d/%d files  %s/%s  %.1f files/s  %s/s  ETA %s",
+			bar, m.files, m.totalFiles, HumanBytes(m.bytes), HumanBytes(m.totalBytes),
+			fileRate, HumanBytes(int64(byteRate)), eta)
+	} else {
+		line = fmt.Sprintf("%d files  %s  %.1f files/s  %s/s  (counting)",
+			m.files, HumanBytes(m.bytes), fileRate, HumanBytes(int64(byteRate)))
+	}
+
+	// clear whatever the last line left behind
+	consoleMu.Lock()
+	fmt.Fprintf(m.out, "\r%s\033[K", line)
+	consoleMu.Unlock()
+}
+
+// Format a byte count for people
+func HumanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Format a count of things for people, as "1 file" or "2 files"
+func HumanCount(n int, one, many string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, one)
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
@@ -0,0 +1,141 @@
+package jpegger
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Which placed files each mirror holds, by path relative to the output
+	// and the mirror's root separated by a NUL, and the key it was copied
+	// with
+	Mirrored = "Mirrored"
+)
+
+// Further directories each placed file is copied to, e.g. a USB drive kept
+// in step with a RAID. repeatable
+var MirrorDirs = &StringList{}
+
+func init() {
+	importFlags.Var(MirrorDirs, "mirror", "also copy everything placed in the output to this directory, e.g. a backup drive. repeatable. a mirror that isn't there is caught up by a later import")
+}
+
+func mirrorEntry(relPath, root string) []byte {
+	return []byte(relPath + "\x00" + root)
+}
+
+// Copy a file placed in the output to the same path under a mirror, unless
+// the database records the mirror holding it already. A file found there
+// holding the same content is recorded rather than copied.
+func MirrorFile(db Store, output, root, relPath string) error {
+	var key []byte
+	var algorithm string
+	done := false
+	err := db.View(func(tx Tx) error {
+		placed := lookup(tx, DestinationPath, []byte(relPath))
+		if placed == nil {
+			return nil
+		}
+		key = PlacedKey(tx, relPath, placed)
+		algorithm = KeyAlgorithm(tx, placed)
+		done = bytes.Equal(lookup(tx, Mirrored, mirrorEntry(relPath, root)), key)
+		return nil
+	})
+	if err != nil || key == nil || done {
+		return err
+	}
+
+	src, dest := OutputPath(output, relPath), OutputPath(root, relPath)
+	err = EnsureDir(filepath.Dir(dest))
+	if err != nil {
+		return err
+	}
+	err = RetryIO(src, func() error {
+		return CopyFile(src, dest)
+	})
+	if os.IsExist(err) {
+		found, hErr := HashFile(dest, algorithm)
+		if hErr != nil {
+			return hErr
+		}
+		if !bytes.Equal(found, key) {
+			return fmt.Errorf("%s already holds something else", dest)
+		}
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte(Mirrored)).Put(mirrorEntry(relPath, root), key)
+	})
+}
+
+// The placed files a mirror doesn't hold yet, like everything placed while
+// its drive was unplugged
+func MirrorBacklog(db Store, root string) ([]string, error) {
+	var missing []string
+	err := db.View(func(tx Tx) error {
+		b := tx.Bucket([]byte(DestinationPath))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(rel, key []byte) error {
+			held := lookup(tx, Mirrored, mirrorEntry(string(rel), root))
+			if !bytes.Equal(held, PlacedKey(tx, string(rel), key)) {
+				missing = append(missing, string(rel))
+			}
+			return nil
+		})
+	})
+	return missing, err
+}
+
+// Forget that the mirrors hold a placed file, removing their copies if they
+// still hold what was placed. A mirror that can't be reached keeps its copy
+// and its record, and is returned.
+func RemoveMirrored(db Store, relPath string, key []byte, algorithm string) ([]string, error) {
+	var roots []string
+	prefix := mirrorEntry(relPath, "")
+	err := db.View(func(tx Tx) error {
+		b := tx.Bucket([]byte(Mirrored))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			roots = append(roots, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var unreachable []string
+	for _, root := range roots {
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			unreachable = append(unreachable, root)
+			continue
+		}
+		path := OutputPath(root, relPath)
+		removed, err := removePlaced(path, key, algorithm)
+		if err != nil {
+			return unreachable, fmt.Errorf("while removing %s: %v", path, err)
+		}
+		if removed {
+			removeEmptyParents(root, path)
+		}
+		// a copy that changed is the owner's now, like one in the output
+		err = db.Update(func(tx Tx) error {
+			return tx.Bucket([]byte(Mirrored)).Delete(mirrorEntry(relPath, root))
+		})
+		if err != nil {
+			return unreachable, err
+		}
+	}
+	return unreachable, nil
+}
@@ -0,0 +1,69 @@
+package jpegger
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Notices content imported before turning up at a new path because its
+// source was moved or renamed, like a phone sync reshuffling folders, and
+// drops the old paths so the database follows the file
+type MoveTracker struct {
+	db Store
+
+	once sync.Once
+	mu   sync.Mutex
+	// the source paths of each content, read the first time one is needed
+	sources map[string][]string
+}
+
+func NewMoveTracker(db Store) *MoveTracker {
+	return &MoveTracker{db: db}
+}
+
+// Drop the other source paths of content found at path whose files are
+// gone, as it was moved or renamed from there. Returns the paths dropped.
+// A path whose directory is gone too is kept, as that may only mean a card
+// isn't in.
+func (m *MoveTracker) Moved(path string, key []byte) ([]string, error) {
+	m.once.Do(func() {
+		m.db.View(func(tx Tx) error {
+			m.sources = sourcesByKey(tx)
+			return nil
+		})
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var moved, kept []string
+	for _, source := range m.sources[string(key)] {
+		if source == path {
+			continue
+		}
+		if gone, _ := sourceGone(source, false); gone {
+			moved = append(moved, source)
+		} else {
+			kept = append(kept, source)
+		}
+	}
+	m.sources[string(key)] = append(kept, path)
+	if len(moved) == 0 {
+		return nil, nil
+	}
+
+	err := m.db.Update(func(tx Tx) error {
+		for _, source := range moved {
+			// only if it still has this content
+			if !bytes.Equal(lookup(tx, SourcePath, []byte(source)), key) {
+				continue
+			}
+			for _, bucket := range []string{SourcePath, SourceStats} {
+				if err := tx.Bucket([]byte(bucket)).Delete([]byte(source)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return moved, err
+}
@@ -0,0 +1,256 @@
+package jpegger
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var GPhoto2 = importFlags.String("gphoto2", "gphoto2", "the gphoto2 command mtp:// inputs are read with")
+
+var (
+	// gphoto2 --list-files starts each folder with a line like
+	// There are 2 files in folder '/store_00010001/DCIM/100CANON':
+	gphotoFolder = regexp.MustCompile(`in folder '(.*)'[:.]$`)
+	// and lists its files like
+	// #1     IMG_0001.JPG               rd  5123 KB image/jpeg 1571234567
+	// where everything after the name is there if the camera says
+	gphotoFile = regexp.MustCompile(`^#(\d+)\s+(.+?)(?:\s+[r-][d-])?(?:\s+(\d+) KB)?(?:\s+\d+x\d+)?(?:\s+\S+/\S+)?(?:\s+(\d+))?\s*$`)
+)
+
+// Is the path an mtp://port/folder URL?
+func IsMTP(path string) bool {
+	return strings.HasPrefix(path, "mtp://")
+}
+
+// Is the path one that has to be fetched before it can be read?
+func IsRemote(path string) bool {
+	return IsS3(path) || IsMTP(path) || IsSFTP(path) || IsWebDAV(path) || IsZip(path)
+}
+
+// Split an mtp://port/folder URL. Without a port gphoto2 picks the camera
+// connected, and without a folder everything on it is read.
+func ParseMTPURL(name string) (port, folder string, err error) {
+	if !IsMTP(name) {
+		return "", "", fmt.Errorf("%s is not an mtp:// URL", name)
+	}
+	rest := strings.TrimPrefix(name, "mtp://")
+	port, folder = rest, "/"
+	if i := strings.Index(rest, "/"); i >= 0 {
+		port, folder = rest[:i], path.Clean(rest[i:])
+	}
+	return port, folder, nil
+}
+
+// A file on a camera, as gphoto2 lists it
+type mtpFile struct {
+	Folder string
+	Name   string
+	// Its number in the folder, which is how gphoto2 fetches it
+	Number int
+	// To the kilobyte
+	Size    int64
+	ModTime time.Time
+}
+
+func (f mtpFile) Path() string {
+	return path.Join(f.Folder, f.Name)
+}
+
+// Read the output of gphoto2 --list-files
+func parseGphotoList(r io.Reader) ([]mtpFile, error) {
+	var files []mtpFile
+	folder := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := gphotoFolder.FindStringSubmatch(line); m != nil {
+			folder = m[1]
+			continue
+		}
+		m := gphotoFile.FindStringSubmatch(line)
+		if m == nil || folder == "" {
+			continue
+		}
+		file := mtpFile{Folder: folder, Name: m[2]}
+		file.Number, _ = strconv.Atoi(m[1])
+		if kb, err := strconv.ParseInt(m[3], 10, 64); err == nil {
+			file.Size = kb * 1024
+		}
+		if secs, err := strconv.ParseInt(m[4], 10, 64); err == nil {
+			file.ModTime = time.Unix(secs, 0)
+		}
+		files = append(files, file)
+	}
+	return files, scanner.Err()
+}
+
+// The listing's view of a file on a camera
+type mtpFileInfo struct {
+	file mtpFile
+}
+
+func (i mtpFileInfo) Name() string       { return i.file.Name }
+func (i mtpFileInfo) Size() int64        { return i.file.Size }
+func (i mtpFileInfo) Mode() os.FileMode  { return 0444 }
+func (i mtpFileInfo) ModTime() time.Time { return i.file.ModTime }
+func (i mtpFileInfo) IsDir() bool        { return false }
+func (i mtpFileInfo) Sys() interface{}   { return nil }
+
+// The files on a camera or phone connected by USB, read over PTP or MTP
+// with gphoto2. Like an S3 source, each file is fetched once to a hidden
+// file in the staging directory. Only one gphoto2 can talk to a camera at
+// a time, so they take turns.
+type MTPSource struct {
+	port    string
+	folder  string
+	staging string
+
+	list    sync.Once
+	files   []mtpFile
+	listErr error
+
+	mu      sync.Mutex
+	byName  map[string]mtpFile
+	fetched map[string]bool
+}
+
+func NewMTPSource(input, staging string) (*MTPSource, error) {
+	port, folder, err := ParseMTPURL(input)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath(*GPhoto2); err != nil {
+		return nil, fmt.Errorf("mtp:// inputs need gphoto2: %v", err)
+	}
+	return &MTPSource{
+		port:    port,
+		folder:  folder,
+		staging: staging,
+		byName:  map[string]mtpFile{},
+		fetched: map[string]bool{},
+	}, nil
+}
+
+// Run gphoto2 against the camera. The C locale keeps its messages the
+// ones parseGphotoList looks for.
+func (s *MTPSource) gphoto2(args ...string) ([]byte, error) {
+	if s.port != "" {
+		args = append([]string{"--port", s.port}, args...)
+	}
+	cmd := exec.Command(*GPhoto2, args...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	s.mu.Lock()
+	out, err := cmd.Output()
+	s.mu.Unlock()
+	if err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = strings.TrimSpace(string(out))
+		}
+		return nil, fmt.Errorf("gphoto2 %s: %v: %s", strings.Join(args, " "), err, message)
+	}
+	return out, nil
+}
+
+// The name a file is imported by
+func (s *MTPSource) name(file mtpFile) string {
+	return "mtp://" + s.port + file.Path()
+}
+
+// List the camera once, however many times it is walked
+func (s *MTPSource) listing() ([]mtpFile, error) {
+	s.list.Do(func() {
+		var out []byte
+		out, s.listErr = s.gphoto2("--list-files", "--folder", s.folder)
+		if s.listErr != nil {
+			return
+		}
+		s.files, s.listErr = parseGphotoList(bytes.NewReader(out))
+		sort.Slice(s.files, func(i, j int) bool { return s.files[i].Path() < s.files[j].Path() })
+
+		s.mu.Lock()
+		for _, file := range s.files {
+			s.byName[s.name(file)] = file
+		}
+		s.mu.Unlock()
+	})
+	return s.files, s.listErr
+}
+
+func (s *MTPSource) Walk(after string, callback func(os.FileInfo, string) error) error {
+	files, err := s.listing()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		rel := strings.TrimPrefix(strings.TrimPrefix(file.Path(), s.folder), "/")
+		if after != "" && rel <= after {
+			continue
+		}
+		if err := callback(mtpFileInfo{file}, s.name(file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MTPSource) Fetch(name string) (string, error) {
+	s.mu.Lock()
+	file, ok := s.byName[name]
+	s.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("%s isn't on the camera", name)
+	}
+
+	// keep the extension, some EXIF readers go by it. gphoto2 expands %
+	// in the name it writes to, and the temporary names have none
+	f, err := os.CreateTemp(s.staging, ".jpegger-fetch-*"+path.Ext(file.Name))
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	s.mu.Lock()
+	s.fetched[f.Name()] = true
+	s.mu.Unlock()
+
+	_, err = s.gphoto2("--folder", file.Folder, "--get-file", strconv.Itoa(file.Number), "--filename", f.Name(), "--force-overwrite")
+	if err != nil {
+		s.Release(f.Name())
+		return "", fmt.Errorf("while downloading %s: %v", name, err)
+	}
+	return f.Name(), nil
+}
+
+func (s *MTPSource) Release(local string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetched[local] {
+		os.Remove(local)
+		delete(s.fetched, local)
+	}
+}
+
+// Remove anything fetched but never placed, e.g. after an interruption
+func (s *MTPSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for local := range s.fetched {
+		os.Remove(local)
+	}
+	s.fetched = map[string]bool{}
+	return nil
+}
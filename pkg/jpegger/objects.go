@@ -0,0 +1,145 @@
+package jpegger
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Where -objects stores content under the output
+	ObjectsDir = "objects"
+)
+
+var ObjectLinks = importFlags.String("objects", "", "store each content once under objects/ in the output, named by its key, and place it by the layout as a hard link (hardlink) or relative symlink (symlink) to the stored copy. the stored copy is placed by -mode")
+
+// The path content is stored at with -objects, relative to the output: its
+// key in hex, split after two digits so no directory grows too large, with
+// the extension it came with
+func ObjectPath(key []byte, ext string) string {
+	name := hex.EncodeToString(key)
+	return path.Join(ObjectsDir, name[:2], name[2:]+strings.ToLower(ext))
+}
+
+// The key of content stored at a path relative to the output, if it's in
+// the object store
+func ObjectKey(rel string) ([]byte, bool) {
+	parts := strings.Split(rel, "/")
+	if len(parts) != 3 || parts[0] != ObjectsDir {
+		return nil, false
+	}
+	name := parts[1] + strings.TrimSuffix(parts[2], path.Ext(parts[2]))
+	key, err := hex.DecodeString(name)
+	return key, err == nil && len(parts[1]) == 2
+}
+
+// Content stored once in an output, with the layout's files linking to it
+type ObjectStore struct {
+	Output string
+	// How the layout's files link to the stored ones, TransferLink or
+	// TransferSymlink
+	Links TransferMode
+	// What new content is keyed with, for checking a stored copy
+	Algorithm string
+}
+
+// Open the store of an output for -objects
+func NewObjectStore(output, links, algorithm string) (*ObjectStore, error) {
+	switch links {
+	case "hardlink":
+		return &ObjectStore{output, TransferLink, algorithm}, nil
+	case "symlink":
+		return &ObjectStore{output, TransferSymlink, algorithm}, nil
+	}
+	return nil, fmt.Errorf("unknown -objects %q (expected hardlink or symlink)", links)
+}
+
+// Store content found at src by mode, unless it's stored already. Returns
+// where it's stored, and whether this call stored it. One stored before
+// may be linked to from elsewhere, so only a new one is the caller's to
+// remove.
+func (s *ObjectStore) Put(mode TransferMode, src string, key []byte, ext, keyAlgorithm string) (string, bool, error) {
+	object := OutputPath(s.Output, ObjectPath(key, ext))
+	err := EnsureDir(filepath.Dir(object))
+	if err != nil {
+		return "", false, err
+	}
+	err = Transfer(mode, src, object)
+	if os.IsExist(err) {
+		// placed by an earlier run, and maybe unlinked by an undo since
+		if SameContent(src, object, key, keyAlgorithm, s.Algorithm) {
+			return object, false, nil
+		}
+		return "", false, fmt.Errorf("%s holds other content than its name says", object)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return object, true, nil
+}
+
+// Link to src at dest by a path relative to dest's directory, so the
+// output can be moved as a whole. Like os.Link, the error satisfies
+// os.IsExist if something is already at dest.
+func SymlinkFile(src, dest string) error {
+	target, err := filepath.Rel(filepath.Dir(dest), src)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, dest)
+}
+
+// Like WithFiles over an output directory, where symlinks into its object
+// store are taken as the files they point to
+func WithOutputFiles(output string, callback func(os.FileInfo, string) error) error {
+	walk, err := newTreeWalk(output)
+	if err != nil {
+		return err
+	}
+	if objects, err := filepath.EvalSymlinks(filepath.Join(output, ObjectsDir)); err == nil {
+		walk.objects = objects
+	}
+	return walk.walk(output, nil, 0, callback)
+}
+
+// Remove the stored copies of content that no placed file in the database
+// links to any more. A hard link to one from a view of the store keeps its
+// data, but a symlink is left dangling. Returns the paths removed.
+func RemoveUnlinkedObjects(db Store, output string, keys [][]byte) ([]string, error) {
+	linked := map[string]bool{}
+	err := db.View(func(tx Tx) error {
+		if b := tx.Bucket([]byte(DestinationPath)); b != nil {
+			b.ForEach(func(rel, key []byte) error {
+				linked[string(key)] = true
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, key := range keys {
+		if linked[string(key)] {
+			continue
+		}
+		// stored with whatever extension the content came with
+		objects, err := filepath.Glob(OutputPath(output, ObjectPath(key, "")) + "*")
+		if err != nil {
+			return removed, err
+		}
+		for _, object := range objects {
+			if err = os.Remove(object); err != nil {
+				return removed, err
+			}
+			removeEmptyParents(output, object)
+			removed = append(removed, object)
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,147 @@
+package jpegger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// What an import does when a file fails
+type ErrorPolicy int
+
+const (
+	// Record the failure and carry on with the next file
+	ErrorSkip = ErrorPolicy(iota)
+	// Try the file again a few times before skipping it
+	ErrorRetry
+	// Stop the import
+	ErrorAbort
+)
+
+var errorPolicyNames = map[string]ErrorPolicy{
+	"skip":  ErrorSkip,
+	"retry": ErrorRetry,
+	"abort": ErrorAbort,
+}
+
+const (
+	// Source paths that failed to import and the last error for each
+	FileErrors = "FileErrors"
+
+	// How many times -on-error=retry tries a file, and how long it waits
+	// after the first failure. The wait doubles each time.
+	RetryAttempts = 3
+	RetryDelay    = time.Second
+)
+
+func ParseErrorPolicy(name string) (ErrorPolicy, error) {
+	policy, ok := errorPolicyNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown policy %q (expected skip, retry or abort)", name)
+	}
+	return policy, nil
+}
+
+// Applies the error policy to each file of an import and keeps count of
+// the files that failed. Failures are recorded in the database unless it's
+// read only.
+type FileFailures struct {
+	Policy ErrorPolicy
+	db     Store
+
+	mu     sync.Mutex
+	failed []string
+}
+
+func NewFileFailures(db Store, policy ErrorPolicy) *FileFailures {
+	return &FileFailures{Policy: policy, db: db}
+}
+
+// Do something to one file. A failure stops the import under the abort
+// policy, as does the database failing under any; otherwise it is logged
+// and recorded, and the import goes on. Returns the error that stops it.
+func (f *FileFailures) Attempt(path string, do func() error) error {
+	delay := RetryDelay
+	for attempt := 1; ; attempt += 1 {
+		err := do()
+		if err == nil {
+			return nil
+		}
+		if f.Policy == ErrorAbort || IsFatal(err) {
+			return err
+		}
+		if f.Policy == ErrorRetry && attempt < RetryAttempts {
+			Emit(Event{Event: "retrying", Source: path, Message: err.Error()})
+			time.Sleep(delay)
+			delay *= 2
+			continue
+		}
+
+		message := err.Error()
+		Emit(Event{Event: "error", Source: path, Message: message})
+		f.mu.Lock()
+		f.failed = append(f.failed, path)
+		f.mu.Unlock()
+		if !f.db.IsReadOnly() {
+			err = f.db.Update(func(tx Tx) error {
+				return tx.Bucket([]byte(FileErrors)).Put([]byte(path), []byte(message))
+			})
+			if err != nil {
+				return &FatalError{"recording the failure of", path, err}
+			}
+		}
+		return nil
+	}
+}
+
+// Forget an earlier failure of a file that has now been imported
+func (f *FileFailures) Succeeded(path string) error {
+	var found bool
+	err := f.db.View(func(tx Tx) error {
+		found = lookup(tx, FileErrors, []byte(path)) != nil
+		return nil
+	})
+	if err != nil || !found || f.db.IsReadOnly() {
+		return err
+	}
+	return f.db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte(FileErrors)).Delete([]byte(path))
+	})
+}
+
+// The files that failed in this import
+func (f *FileFailures) Failed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.failed...)
+}
+
+// How many failed files are listed at the end of an import. The rest are
+// in the log and the database.
+const failuresListed = 20
+
+// List the files that failed at the end of an import
+func SummarizeFailures(out io.Writer, failed []string) {
+	fmt.Fprintf(out, "%d files failed, see the log for why:\n", len(failed))
+	for i, path := range failed {
+		if i == failuresListed {
+			fmt.Fprintf(out, "  ... and %d more\n", len(failed)-i)
+			break
+		}
+		fmt.Fprintf(out, "  %s\n", path)
+	}
+}
+
+// Give back content claimed by a placement that failed, so the next
+// attempt at it isn't skipped as handled
+func ReleaseClaim(db Store, key []byte) error {
+	return db.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte(ContentHash))
+		if !bytes.Equal(b.Get(key), DiscoveredFile) {
+			return nil
+		}
+		return b.Delete(key)
+	})
+}
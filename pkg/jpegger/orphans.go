@@ -0,0 +1,250 @@
+package jpegger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	OrphansCommand = &Command{
+		Name:    "orphans",
+		Args:    "output_dir",
+		Summary: "list files in the output directory that no import placed, and adopt or delete them",
+		Flags:   orphansFlags,
+		Run:     RunOrphans,
+	}
+
+	orphansFlags = NewFlagSet("orphans", "output_dir")
+
+	AdoptOrphans  = orphansFlags.Bool("adopt", false, "record orphans holding content the database doesn't know as if an import had placed them where they are")
+	DeleteOrphans = orphansFlags.Bool("delete", false, "delete orphans other than stored objects. with -adopt, only those that can't be adopted: leftovers and copies of content already in the output")
+	DeleteObjects = orphansFlags.Bool("delete-objects", false, "delete stored objects nothing placed links to. other views of the store may still link to them")
+)
+
+// Why a file in the output is an orphan
+type OrphanKind int
+
+const (
+	// Content the database doesn't know, like a file copied in by hand
+	OrphanUnknown = OrphanKind(iota)
+	// Another copy of content the database placed elsewhere
+	OrphanCopy
+	// A temporary file left by an interrupted run
+	OrphanLeftover
+	// A file that couldn't be read
+	OrphanUnreadable
+	// Content in the object store that nothing placed links to, like
+	// after an undo
+	OrphanObject
+)
+
+var orphanKindNames = map[OrphanKind]string{
+	OrphanUnknown:    "unknown",
+	OrphanCopy:       "copy",
+	OrphanLeftover:   "leftover",
+	OrphanUnreadable: "unreadable",
+	OrphanObject:     "object",
+}
+
+func (k OrphanKind) String() string {
+	return orphanKindNames[k]
+}
+
+// A file in the output directory that the database has no record of
+// placing
+type Orphan struct {
+	// Relative to the output directory, with slashes
+	RelPath string
+	Kind    OrphanKind
+	// The content's key by the database's usual algorithm, and for a copy,
+	// where the database placed the content
+	Key       []byte
+	Algorithm string
+	CopyOf    string
+	Err       error
+}
+
+// Find the photos and videos under output that aren't recorded as placed
+// there, and files left by interrupted runs. Only those are hashed, by each
+// algorithm the database keys content with, so a copy of known content is
+// found however it was keyed.
+func FindOrphans(db Store, output string) ([]Orphan, error) {
+	var algorithms []string
+	usual := DefaultHash
+	placed := map[string]bool{}
+	// the content placed, which objects are kept for
+	linked := map[string]bool{}
+	err := db.View(func(tx Tx) error {
+		counts := ContentAlgorithms(tx)
+		usual = MainAlgorithm(counts)
+		algorithms = append(algorithms, usual)
+		for name := range counts {
+			if name != usual {
+				algorithms = append(algorithms, name)
+			}
+		}
+		if b := tx.Bucket([]byte(DestinationPath)); b != nil {
+			b.ForEach(func(rel, key []byte) error {
+				placed[string(rel)] = true
+				linked[string(key)] = true
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	err = WithOutputFiles(output, func(file os.FileInfo, path string) error {
+		rel, _ := filepath.Rel(output, path)
+		rel = filepath.ToSlash(rel)
+		if key, ok := ObjectKey(rel); ok {
+			if !linked[string(key)] {
+				orphans = append(orphans, Orphan{RelPath: rel, Kind: OrphanObject, Key: key})
+			}
+			return nil
+		}
+		if placed[rel] || strings.HasPrefix(rel, QuarantineDir+"/") || strings.HasPrefix(rel, GalleryDir+"/") {
+			return nil
+		}
+		if strings.HasPrefix(file.Name(), ".jpegger-") {
+			orphans = append(orphans, Orphan{RelPath: rel, Kind: OrphanLeftover})
+			return nil
+		}
+		// anything else that isn't a photo or video is the owner's business
+		if !ValidName(rel) {
+			return nil
+		}
+
+		orphan := Orphan{RelPath: rel, Kind: OrphanUnknown, Algorithm: usual}
+		for _, algorithm := range algorithms {
+			key, err := HashFile(path, algorithm)
+			if err != nil {
+				orphan.Kind, orphan.Err = OrphanUnreadable, err
+				break
+			}
+			if orphan.Key == nil {
+				orphan.Key = key
+			}
+			var dest []byte
+			db.View(func(tx Tx) error {
+				if lookup(tx, ContentHash, key) != nil {
+					dest = lookup(tx, ContentDestination, key)
+					if dest == nil {
+						dest = []byte{}
+					}
+				}
+				return nil
+			})
+			if dest != nil {
+				orphan.Kind, orphan.Key, orphan.Algorithm, orphan.CopyOf = OrphanCopy, key, algorithm, string(dest)
+				break
+			}
+		}
+		orphans = append(orphans, orphan)
+		return nil
+	})
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].RelPath < orphans[j].RelPath })
+	return orphans, err
+}
+
+func RunOrphans(args []string) error {
+	if len(args) == 0 && Configured.Output != "" {
+		args = []string{Configured.Output}
+	}
+	if len(args) != 1 {
+		return UsageError(orphansFlags, "expected the output directory")
+	}
+	output := args[0]
+	if IsRemote(output) {
+		return fmt.Errorf("%s: only local output directories can be searched for orphans", output)
+	}
+	if _, err := os.Stat(*Database); err != nil {
+		return err
+	}
+
+	// an import running meanwhile stores objects and places files before
+	// recording them, so they'd look orphaned
+	if *AdoptOrphans || *DeleteOrphans || *DeleteObjects {
+		lock, err := LockRun(*Database, false)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	var db Store
+	var err error
+	if *AdoptOrphans {
+		db, err = OpenStore(*Database, StoreOptions{Timeout: time.Second})
+		if err != nil {
+			return err
+		}
+		if err = CreateBuckets(db); err != nil {
+			db.Close()
+			return err
+		}
+	} else {
+		db, err = OpenReadOnlyDB()
+		if err != nil {
+			return err
+		}
+	}
+	defer db.Close()
+
+	orphans, err := FindOrphans(db, output)
+	if err != nil {
+		return fmt.Errorf("while traversing %s: %v", output, err)
+	}
+	readExif, err := SelectExifReader("")
+	if err != nil {
+		return err
+	}
+
+	adopted, deleted := 0, 0
+	for _, orphan := range orphans {
+		path := filepath.Join(output, filepath.FromSlash(orphan.RelPath))
+		detail := ""
+		switch orphan.Kind {
+		case OrphanCopy:
+			detail = fmt.Sprintf(" (content %x, placed at %s)", orphan.Key[:4], orphan.CopyOf)
+		case OrphanUnreadable:
+			detail = fmt.Sprintf(": %v", orphan.Err)
+		}
+		action := ""
+
+		switch {
+		case *AdoptOrphans && orphan.Kind == OrphanUnknown:
+			_, err = AdoptFile(db, output, orphan.RelPath, orphan.Key, orphan.Algorithm, readExif)
+			if err != nil {
+				return fmt.Errorf("while adopting %s: %v", path, err)
+			}
+			adopted += 1
+			action = ", adopted"
+		case *DeleteObjects && orphan.Kind == OrphanObject, *DeleteOrphans && orphan.Kind != OrphanUnreadable && orphan.Kind != OrphanObject:
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+			deleted += 1
+			action = ", deleted"
+		}
+		fmt.Printf("%-10s %s%s%s\n", orphan.Kind, orphan.RelPath, detail, action)
+	}
+
+	fmt.Printf("%d orphans", len(orphans))
+	if *AdoptOrphans {
+		fmt.Printf(", %d adopted", adopted)
+	}
+	if *DeleteOrphans || *DeleteObjects {
+		fmt.Printf(", %d deleted", deleted)
+	}
+	fmt.Println()
+	return nil
+}
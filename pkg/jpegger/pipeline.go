@@ -0,0 +1,1016 @@
+package jpegger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The stages of an import, for programs that use jpegger as a library.
+// jpegger import runs the same Pipeline, with its inputs, resuming and
+// prompts added through the hooks below.
+
+// Finds the files to import and dates them
+type Scanner interface {
+	// found returns an error only if it didn't take the file, like when
+	// the pipeline is stopping
+	Scan(ctx context.Context, found func(FileStamp) error) error
+}
+
+// A Scanner that fetches files for the pipeline, to be let go of once it's
+// done with each
+type Releaser interface {
+	Release(stamp FileStamp)
+}
+
+// Keys files by their content
+type Hasher interface {
+	Key(stamp FileStamp) ([]byte, error)
+}
+
+// Tracks content through an import so that each is placed once
+type Stater interface {
+	// Claim content for placing. false if it was claimed before.
+	Claim(stamp FileStamp) (bool, error)
+	// Record where claimed content was placed
+	Placed(placement Placement) error
+	// Give back a claim after placing failed
+	Release(stamp FileStamp) error
+}
+
+// A Stater that records the files it doesn't place, as the command line's
+// does, so that the next run knows them
+type Recorder interface {
+	// Note a file whose content was claimed before. Returns whether the
+	// content was rejected, rather than placed.
+	Skipped(stamp FileStamp) (bool, error)
+	// Record a file that couldn't be read. false if its content was
+	// handled before.
+	SetAside(stamp FileStamp) (bool, error)
+	// Record a lesser copy of content placed from elsewhere. false if it
+	// was recorded before.
+	PassOver(stamp FileStamp) (bool, error)
+}
+
+// Places files
+type Linker interface {
+	Link(stamp FileStamp) (Placement, error)
+}
+
+// A Linker that keeps what can be read of the files set aside. Returns
+// where, or "" if nowhere.
+type Quarantiner interface {
+	Quarantine(stamp FileStamp) string
+}
+
+// A file an XMP sidecar or companion was placed beside
+type PlacedSidecar struct {
+	Source string
+	// Where it went, and relative to the output with slashes
+	Path        string
+	Destination string
+	Key         []byte
+}
+
+// Where a Linker put a file
+type Placement struct {
+	// The file as placed, which may have been redated on the way
+	Stamp FileStamp
+	Mode  TransferMode
+	// Where it went, and relative to the output with slashes
+	Path        string
+	Destination string
+	// The output already held the content, so this run didn't place it
+	Existing bool
+	// The name it was meant to have, when other content had taken it
+	Taken string
+	// The copy was checked against the key
+	Verified bool
+	// Only planned, as by a dry run: nothing was placed
+	Planned bool
+	// What the placed file holds since it was rewritten, if it was
+	Rewritten []byte
+	// Where the HEIC a JPEG was converted from was kept, relative to the
+	// output, if it was
+	Original string
+	// The other half of its pair, placed before it
+	Partner  *PairPlacement
+	Sidecars []PlacedSidecar
+}
+
+// A file a Linker left for a later run, like one a hook turned down. It
+// isn't a failure.
+type Declined struct {
+	// The event logged, "declined" if empty
+	Event  string
+	Reason string
+	// Set when the file is another copy of content placed at DuplicateOf,
+	// so that it's passed over for good
+	DuplicateOf    string
+	DuplicateOfKey []byte
+}
+
+func (d *Declined) Error() string {
+	return d.Reason
+}
+
+// The files to scan, FlagFilter's when there's none
+func scanFilter(filter *FileFilter) FileFilter {
+	if filter == nil {
+		return DefaultFilter()
+	}
+	return *filter
+}
+
+// Scans local directories, reading EXIF with ReadExif
+type DirScanner struct {
+	Inputs   []string
+	ReadExif ExifReader
+	// Take dates from Google Takeout sidecars
+	Takeout bool
+	// Take dates from iCloud Photo Details.csv files and leave out the
+	// edits Photos saved beside originals
+	Apple bool
+	// Corrects the dates found
+	Clock Clock
+	// The files to scan, FlagFilter's if nil
+	Filter *FileFilter
+	WalkOptions
+}
+
+// Files with EXIF that can't be read are found with Quarantine set
+func (s DirScanner) Scan(ctx context.Context, found func(FileStamp) error) error {
+	filter := scanFilter(s.Filter)
+	options := DateOptions{ReadExif: s.ReadExif, Takeout: s.Takeout, Apple: s.Apple, Clock: s.Clock}
+	for i, input := range s.Inputs {
+		err := DirSource{Root: input, WalkOptions: s.WalkOptions}.Walk("", func(file os.FileInfo, name string) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !filter.Match(name) || (s.Apple && AppleEditOriginal(name) != "") {
+				return nil
+			}
+			stamp, _, err := DateFile(name, name, file, options)
+			if unread, ok := err.(*UnreadableError); ok {
+				stamp.Quarantine = unread.Reason
+			} else if err != nil {
+				return err
+			}
+			stamp.Input = i
+			return found(stamp)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys files with Algorithm, caching keys by path in DB
+type StoreHasher struct {
+	DB        Store
+	Algorithm string
+}
+
+func (h StoreHasher) Key(stamp FileStamp) ([]byte, error) {
+	return FileKey(h.DB, stamp.Path, stamp.Local, h.Algorithm, StampStat(stamp))
+}
+
+// Keys files by their size and first and last 64KB, as with -prefilter,
+// reading one in full only when that matches content seen before. Output
+// is where that content may have been placed, should its source be gone.
+type PrefilterHasher struct {
+	DB        Store
+	Algorithm string
+	Output    string
+}
+
+func (h PrefilterHasher) Key(stamp FileStamp) ([]byte, error) {
+	return PrefilterKey(h.DB, stamp.Path, stamp.Local, h.Algorithm, h.Output, StampStat(stamp))
+}
+
+// Tracks content in DB as the command line does, recording what is placed
+// against Run. The database needs the buckets from CreateBuckets.
+type StoreStater struct {
+	DB        Store
+	Run       uint64
+	Algorithm string
+	Events    EventSink
+
+	once  sync.Once
+	moves *MoveTracker
+}
+
+func (s *StoreStater) Claim(stamp FileStamp) (bool, error) {
+	return CommitState(s.DB, stamp.Path, stamp.Key, NoFile, DiscoveredFile)
+}
+
+// Record everything about the file placed, then that its content was
+// copied, so that a run stopped part way places it again
+func (s *StoreStater) Placed(p Placement) error {
+	stamp := p.Stamp
+	if p.Original != "" {
+		err := RecordDestination(s.DB, s.Run, p.Original, stamp.Key, s.Algorithm, time.Time{})
+		if err == nil {
+			err = RecordCompanion(s.DB, p.Original, p.Destination)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, sidecar := range p.Sidecars {
+		err := RecordDestination(s.DB, s.Run, sidecar.Destination, sidecar.Key, s.Algorithm, time.Time{})
+		if err == nil {
+			err = RecordCompanion(s.DB, sidecar.Destination, p.Destination)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if p.Existing {
+		// it wasn't placed by this run, so undoing the run leaves it
+		err = RecordExisting(s.DB, p.Destination, stamp.Key, s.Algorithm, stamp.Time)
+	} else {
+		err = RecordDestination(s.DB, s.Run, p.Destination, stamp.Key, s.Algorithm, stamp.Time)
+	}
+	if err == nil && p.Rewritten != nil {
+		err = RecordRewritten(s.DB, p.Destination, p.Rewritten)
+	}
+	if err == nil && !stamp.Description.IsEmpty() {
+		err = RecordDescription(s.DB, stamp.Key, stamp.Description)
+	}
+	if shot := StampShotInfo(stamp); err == nil && !shot.IsEmpty() {
+		err = RecordShotInfo(s.DB, stamp.Key, shot)
+	}
+	if err == nil && stamp.Burst != "" {
+		err = RecordBurst(s.DB, stamp.Key, path.Dir(p.Destination))
+	}
+	if err == nil && stamp.ImageKey != nil {
+		err = RecordImageHash(s.DB, stamp.Key, stamp.ImageKey)
+	}
+	if err == nil && p.Partner != nil {
+		err = RecordPair(s.DB, stamp.Key, p.Partner.Key)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = CommitState(s.DB, stamp.Path, stamp.Key, DiscoveredFile, CopiedFile)
+	if err == nil && p.Verified {
+		_, err = MarkVerified(s.DB, stamp.Key)
+	}
+	if err != nil {
+		return err
+	}
+	return ReleaseQuarantine(s.DB, stamp.Path)
+}
+
+func (s *StoreStater) Release(stamp FileStamp) error {
+	return ReleaseClaim(s.DB, stamp.Key)
+}
+
+// Content found at a new path with its old one gone was moved there, so
+// the old path is dropped
+func (s *StoreStater) Skipped(stamp FileStamp) (bool, error) {
+	rejected, err := Rejected(s.DB, stamp.Key)
+	if err != nil {
+		return false, err
+	}
+	s.once.Do(func() {
+		s.moves = NewMoveTracker(s.DB)
+	})
+	moved, err := s.moves.Moved(stamp.Path, stamp.Key)
+	if err != nil {
+		return false, err
+	}
+	for _, from := range moved {
+		event := StampEvent("moved", stamp)
+		event.Partner = from
+		s.Events.Emit(event)
+	}
+	return rejected, nil
+}
+
+// Content that can be hashed is quarantined, so other copies of it are
+// skipped too
+func (s *StoreStater) SetAside(stamp FileStamp) (bool, error) {
+	if stamp.Key != nil {
+		transitioned, err := CommitState(s.DB, stamp.Path, stamp.Key, NoFile, QuarantinedFile)
+		if err != nil || !transitioned {
+			return false, err
+		}
+	}
+	return true, RecordQuarantine(s.DB, stamp.Path, stamp.Quarantine)
+}
+
+func (s *StoreStater) PassOver(stamp FileStamp) (bool, error) {
+	return RecordDuplicate(s.DB, stamp.Path, stamp.Key, stamp.DuplicateOfKey)
+}
+
+// Places files under Output by Layout, renaming by Collision when a name
+// is taken by other content. Name, if set, names the files. RAW+JPEG pairs
+// and Live Photos are placed together, and XMP sidecars and companions
+// beside what they go with.
+type LayoutLinker struct {
+	Output    string
+	Layout    *Layout
+	Name      *NameTemplate
+	Mode      TransferMode
+	Collision CollisionStrategy
+	// Places files in place of Transfer, like a RemoteDestination does
+	Transfer func(TransferMode, string, string) error
+	// Only call Transfer, with each file named as it was found: nothing
+	// in the output is made, checked or rewritten
+	DryRun bool
+	// Stores content once, for the layout to link to, as with -objects
+	Objects *ObjectStore
+	// What new content is keyed with. DB, if set, says how content seen
+	// before was keyed.
+	Algorithm string
+	DB        Store
+	// Check each copy against its key, as a move always does
+	Verify bool
+	// Rewrite placed files: convert HEICs to JPEGs, keeping the HEIC under
+	// originals/ with KeepHEIC, write the dates they were placed by into
+	// JPEGs, turn JPEGs upright, and set their times to when they were
+	// taken
+	ConvertHEIC bool
+	KeepHEIC    bool
+	WriteDates  bool
+	AutoRotate  bool
+	TouchDates  bool
+	// Called with the first name found taken by other content, if set. A
+	// *Declined leaves the file for a later run.
+	Taken  func(stamp FileStamp, taken string) error
+	Events EventSink
+
+	once     sync.Once
+	pairs    *PairTracker
+	transfer func(TransferMode, string, string) error
+}
+
+func (l *LayoutLinker) setup() {
+	l.pairs = NewPairTracker()
+	l.transfer = l.Transfer
+	if l.transfer == nil {
+		l.transfer = Transfer
+	}
+	// names differing only in case would be one file on a case-insensitive
+	// filesystem, so they are renamed like any taken name
+	if !IsRemote(l.Output) {
+		folder := NewCaseFolder()
+		folder.Events = l.Events
+		l.transfer = folder.Transfer(l.transfer)
+	}
+}
+
+// How content was keyed
+func (l *LayoutLinker) keyAlgorithm(key []byte) string {
+	if l.DB == nil {
+		return l.Algorithm
+	}
+	var algorithm string
+	l.DB.View(func(tx Tx) error {
+		algorithm = KeyAlgorithm(tx, key)
+		return nil
+	})
+	return algorithm
+}
+
+func (l *LayoutLinker) emit(name string, stamp FileStamp, dest, message string) {
+	event := StampEvent(name, stamp)
+	event.Destination, event.Message = dest, message
+	l.Events.Emit(event)
+}
+
+// The directory a file goes in and the name it's given there
+func (l *LayoutLinker) destination(stamp FileStamp) (string, string, error) {
+	name := filepath.Base(stamp.Path)
+	if l.Name != nil {
+		var err error
+		name, err = l.Name.Name(stamp)
+		if err != nil {
+			return "", "", fmt.Errorf("while naming %s: %w", stamp.Path, err)
+		}
+	}
+	fragment, err := l.Layout.Path(stamp)
+	if err != nil {
+		return "", "", fmt.Errorf("while forming path for %s: %w", stamp.Path, err)
+	}
+	if stamp.EventDir != "" {
+		fragment = stamp.EventDir
+	}
+	if stamp.Burst != "" {
+		fragment += "/" + stamp.Burst
+	}
+	return NormalizeName(fragment), NormalizeName(name), nil
+}
+
+func (l *LayoutLinker) Link(stamp FileStamp) (placement Placement, err error) {
+	l.once.Do(l.setup)
+	placement = Placement{Stamp: stamp, Mode: l.Mode}
+	fragment, baseName, err := l.destination(stamp)
+	if err != nil {
+		return placement, err
+	}
+	directory := OutputPath(l.Output, fragment)
+
+	// keep RAW+JPEG pairs and Live Photos together under one name
+	name := baseName
+	if partner, paired := l.pairs.Partner(stamp); paired {
+		placement.Partner = &partner
+		directory = partner.Directory
+		if partner.Stem != "" {
+			name = partner.Stem + filepath.Ext(baseName)
+		}
+	}
+	destPath := OutputPath(directory, name)
+
+	if !l.DryRun && !IsRemote(l.Output) {
+		err = EnsureDir(directory)
+		if err != nil {
+			return placement, fmt.Errorf("while creating directory %s: %w", directory, err)
+		}
+	}
+
+	// a dry run names the file as it was found rather than where it was
+	// staged
+	src := stamp.Local
+	if l.DryRun {
+		src = stamp.Path
+	}
+	keyAlgorithm := l.keyAlgorithm(stamp.Key)
+
+	// with Objects the content is stored once, and linked to by the layout
+	placeMode, placeSrc := l.Mode, src
+	if l.Objects != nil && !l.DryRun {
+		var stored bool
+		placeSrc, stored, err = l.Objects.Put(l.Mode, src, stamp.Key, filepath.Ext(stamp.Path), keyAlgorithm)
+		if err != nil {
+			return placement, fmt.Errorf("while storing %s: %w", stamp.Path, err)
+		}
+		placeMode = l.Objects.Links
+		// a stored copy nothing links to would never be found again
+		if stored {
+			defer func() {
+				if err != nil || placement.Existing {
+					os.Remove(placeSrc)
+				}
+			}()
+		}
+	}
+
+	// try alternative names until one is free, unless a taken one already
+	// holds the content
+	taken := destPath
+	err = l.transfer(placeMode, placeSrc, destPath)
+	for attempt := 1; os.IsExist(err); attempt += 1 {
+		if !IsRemote(l.Output) && SameContent(src, destPath, stamp.Key, keyAlgorithm, l.Algorithm) {
+			placement.Existing, err = true, nil
+			break
+		}
+		if l.Taken != nil && attempt == 1 {
+			if err = l.Taken(stamp, destPath); err != nil {
+				return placement, err
+			}
+		}
+		var ok bool
+		name, ok = CollisionName(l.Collision, baseName, stamp, attempt)
+		if !ok {
+			break
+		}
+		destPath = OutputPath(directory, name)
+		err = l.transfer(placeMode, placeSrc, destPath)
+	}
+	// out of names to try, or the transfer failed
+	if os.IsExist(err) {
+		err = collisionError(l.Collision, stamp)
+	}
+	if err != nil {
+		return placement, fmt.Errorf("while placing %s: %w", stamp.Path, err)
+	}
+	if placement.Existing {
+		l.emit("existing", stamp, destPath, "")
+	} else if destPath != taken {
+		placement.Taken = taken
+		l.emit("collision", stamp, destPath, taken)
+	}
+	// what this call placed goes again if the rest fails
+	placed := !placement.Existing && !l.DryRun && !IsRemote(l.Output)
+	defer func() {
+		if err != nil && placed {
+			os.Remove(destPath)
+		}
+	}()
+
+	// a move only lets go of the source once the copy is known good
+	if (l.Mode == TransferMove || l.Verify) && placed {
+		err = VerifyCopy(src, destPath, stamp.Key, keyAlgorithm, l.Algorithm)
+		if err != nil {
+			if l.Mode == TransferMove {
+				return placement, fmt.Errorf("while moving %s: %w", stamp.Path, err)
+			}
+			return placement, fmt.Errorf("while checking the copy of %s: %w", stamp.Path, err)
+		}
+		placement.Verified = true
+	}
+
+	if placed {
+		destPath, err = l.rewrite(&placement, destPath)
+		if err != nil {
+			return placement, err
+		}
+	}
+
+	stem := ""
+	if name != filepath.Base(stamp.Path) {
+		stem = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	l.pairs.Record(stamp, directory, stem)
+	if stamp.Sidecar != "" {
+		err = l.placeSidecar(&placement, stamp.Sidecar, XMPSidecarDest(stamp.Sidecar, stamp.Path, destPath))
+		if err != nil {
+			return placement, err
+		}
+	}
+	for _, companion := range stamp.Companions {
+		err = l.placeSidecar(&placement, companion, CompanionDest(companion, stamp.Path, destPath))
+		if err != nil {
+			return placement, err
+		}
+	}
+
+	placement.Path, placement.Planned = destPath, l.DryRun
+	placement.Destination, err = l.relative(destPath)
+	if err != nil {
+		return placement, fmt.Errorf("while recording destination of %s: %w", stamp.Path, err)
+	}
+	return placement, nil
+}
+
+// A path in the output relative to it, with slashes
+func (l *LayoutLinker) relative(dest string) (string, error) {
+	if IsRemote(l.Output) {
+		return strings.TrimPrefix(strings.TrimPrefix(dest, l.Output), "/"), nil
+	}
+	rel, err := filepath.Rel(l.Output, dest)
+	return filepath.ToSlash(rel), err
+}
+
+// Convert, redate and turn a placed file as asked, returning where it is
+// now. The copy is no longer the content it was keyed by, so what it holds
+// now is recorded for verify and undo.
+func (l *LayoutLinker) rewrite(placement *Placement, destPath string) (string, error) {
+	stamp := placement.Stamp
+	changed := false
+	// the placed HEIC gives way to a JPEG made from it, so that's what the
+	// content is recorded at. a HEIC that can't be converted is kept as it
+	// is
+	if l.ConvertHEIC && IsHEIC(destPath) {
+		converted, original, err := ConvertPlacedHEIC(l.Output, destPath, l.KeepHEIC)
+		if err != nil {
+			l.emit("not-converted", stamp, destPath, err.Error())
+		} else {
+			if original != "" {
+				placement.Original, err = l.relative(original)
+				if err != nil {
+					return destPath, fmt.Errorf("while recording the original of %s: %w", stamp.Path, err)
+				}
+			}
+			l.emit("converted", stamp, converted, original)
+			destPath, changed = converted, true
+		}
+	}
+	if l.WriteDates && !stamp.Time.IsZero() && hasExtension(destPath, JPEGExtensions) && ExifDateDiffers(destPath, stamp.Time) {
+		err := WriteExifDate(destPath, stamp.Time)
+		if err == NoExifDateTag {
+			l.emit("date-not-written", stamp, destPath, err.Error())
+		} else if err != nil {
+			return destPath, fmt.Errorf("while writing the date into %s: %w", destPath, err)
+		} else {
+			changed = true
+			l.emit("date-written", stamp, destPath, "")
+		}
+	}
+	// a photo that can't be turned is still placed, as it was
+	if l.AutoRotate && hasExtension(destPath, JPEGExtensions) {
+		rotated, err := RotateJPEG(destPath)
+		if err != nil {
+			l.emit("not-rotated", stamp, destPath, err.Error())
+		} else if rotated {
+			changed = true
+			l.emit("rotated", stamp, destPath, "")
+		}
+	}
+	if changed {
+		var err error
+		placement.Rewritten, err = HashFile(destPath, l.keyAlgorithm(stamp.Key))
+		if err != nil {
+			return destPath, fmt.Errorf("while hashing %s: %w", destPath, err)
+		}
+	}
+
+	if l.TouchDates && !stamp.Time.IsZero() {
+		err := os.Chtimes(destPath, stamp.Time, stamp.Time)
+		if err != nil {
+			return destPath, fmt.Errorf("while setting the dates of %s: %w", destPath, err)
+		}
+	}
+	return destPath, nil
+}
+
+// Place an XMP sidecar or a companion at dest, beside the file it goes
+// with
+func (l *LayoutLinker) placeSidecar(placement *Placement, sidecar, dest string) error {
+	err := l.transfer(l.Mode, sidecar, dest)
+	if os.IsExist(err) {
+		return nil // shared with the other half of a pair
+	}
+	if err != nil {
+		return fmt.Errorf("while placing %s: %w", sidecar, err)
+	}
+	l.Events.Emit(Event{Event: "sidecar", Source: sidecar, Destination: dest})
+
+	placed := PlacedSidecar{Source: sidecar, Path: dest}
+	placed.Destination, err = l.relative(dest)
+	if err != nil {
+		return fmt.Errorf("while recording destination of %s: %w", sidecar, err)
+	}
+	if !l.DryRun {
+		placed.Key, err = HashFile(sidecar, l.Algorithm)
+		if err != nil {
+			return fmt.Errorf("while hashing %s: %w", sidecar, err)
+		}
+	}
+	placement.Sidecars = append(placement.Sidecars, placed)
+	return nil
+}
+
+// Put what can be read of a file set aside in the output's quarantine
+// directory
+func (l *LayoutLinker) Quarantine(stamp FileStamp) string {
+	if l.DryRun || IsRemote(l.Output) {
+		return ""
+	}
+	return PlaceQuarantined(l.Mode, stamp.Local, stamp.Path, l.Output)
+}
+
+// The stages a file goes through in a Pipeline
+const (
+	StageScanned     = "scanned"
+	StageHashed      = "hashed"
+	StageQuarantined = "quarantined"
+	StageDuplicate   = "duplicate"
+	StageSkipped     = "skipped"
+	StageLinked      = "linked"
+	StageError       = "error"
+)
+
+// A file reaching a stage of a Pipeline
+type PipelineProgress struct {
+	Stage string
+	Stamp FileStamp
+	// Where the file was placed, relative to the output, once linked
+	Destination string
+	// Why the file failed, at StageError
+	Err error
+}
+
+// Report progress on a channel, for a UI that reads it elsewhere. Sends
+// block until they are received.
+func ProgressChannel(progress chan<- PipelineProgress) func(PipelineProgress) {
+	return func(p PipelineProgress) {
+		progress <- p
+	}
+}
+
+// Imports what Scanner finds: each file is keyed by Hasher, claimed from
+// Stater and placed by Linker, one at a time in the order found. Files
+// that can't be read or hashed are set aside, and the source of a file
+// moved is removed once its placement is recorded.
+type Pipeline struct {
+	Scanner Scanner
+	Hasher  Hasher
+	Stater  Stater
+	Linker  Linker
+	// How many files are hashed at once, one if unset
+	HashWorkers int
+	// Called on each file once it's hashed, from the hashing goroutines.
+	// Setting Quarantine sets the file aside.
+	Inspect func(stamp *FileStamp) error
+	// Each is given every file once all are hashed, and returns them in
+	// the order to place them, like ClusterEvents. Files are held back
+	// until the last has been scanned.
+	Arrange []func(stamps []FileStamp) ([]FileStamp, error)
+	// Called on each file just before it's placed. Setting DuplicateOf
+	// passes it over as a lesser copy.
+	Prepare func(stamp *FileStamp) error
+	// Places a file, applying an error policy. place's error is returned
+	// by default, stopping the pipeline.
+	Attempt func(stamp FileStamp, place func() error) error
+	// Called on each file once it has been placed, skipped or set aside
+	Done   func(stamp FileStamp) error
+	Events EventSink
+	// Called as each file reaches each stage, if set, from the goroutines
+	// running the pipeline, one at a time
+	Progress func(PipelineProgress)
+
+	mu sync.Mutex
+}
+
+func (p *Pipeline) report(stage string, stamp FileStamp, dest string, err error) {
+	if p.Progress != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.Progress(PipelineProgress{Stage: stage, Stamp: stamp, Destination: dest, Err: err})
+	}
+}
+
+func (p *Pipeline) release(stamp FileStamp) {
+	if releaser, ok := p.Scanner.(Releaser); ok {
+		releaser.Release(stamp)
+	}
+}
+
+// Run the import until every file is placed, one fails or ctx is done,
+// which Run returns the error of
+func (p *Pipeline) Run(ctx context.Context) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the first error winds the other stages down
+	var stopOnce sync.Once
+	var stopErr error
+	stop := func(err error) {
+		stopOnce.Do(func() {
+			stopErr = err
+			cancel()
+		})
+	}
+
+	scanned := make(chan FileStamp)
+	go func() {
+		defer close(scanned)
+		err := p.Scanner.Scan(ctx, func(stamp FileStamp) error {
+			p.report(StageScanned, stamp, "", nil)
+			select {
+			case scanned <- stamp:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			stop(err)
+		}
+	}()
+
+	placing := p.hash(ctx, scanned, stop)
+	for _, arrange := range p.Arrange {
+		arrange := arrange
+		placing = clusterAll(placing, func(stamps []FileStamp) []FileStamp {
+			if ctx.Err() != nil {
+				return stamps
+			}
+			arranged, err := arrange(stamps)
+			if err != nil {
+				stop(err)
+				return stamps
+			}
+			return arranged
+		})
+	}
+
+	for stamp := range placing {
+		if ctx.Err() != nil {
+			// left unhandled, so the next run comes back to it
+			p.release(stamp)
+			continue
+		}
+		err := p.place(stamp)
+		p.release(stamp)
+		if err != nil {
+			stop(err)
+		}
+	}
+	if stopErr != nil {
+		return stopErr
+	}
+	return parent.Err()
+}
+
+// Key the files scanned, setting aside those that can't be
+func (p *Pipeline) hash(ctx context.Context, scanned <-chan FileStamp, stop func(error)) <-chan FileStamp {
+	workers := p.HashWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	hashed := make(chan FileStamp)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for stamp := range scanned {
+				// pass on without hashing once stopping
+				if ctx.Err() == nil {
+					p.key(&stamp, stop)
+				}
+				hashed <- stamp
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(hashed)
+	}()
+	return hashed
+}
+
+func (p *Pipeline) key(stamp *FileStamp, stop func(error)) {
+	if stamp.Quarantine != "" {
+		return
+	}
+	key, err := p.Hasher.Key(*stamp)
+	if err != nil {
+		// set aside rather than stop the import
+		stamp.Quarantine = fmt.Sprintf("while hashing: %v", err)
+		return
+	}
+	stamp.Key = key
+	p.Events.Emit(StampEvent("hashed", *stamp))
+	p.report(StageHashed, *stamp, "", nil)
+	if p.Inspect != nil {
+		if err = p.Inspect(stamp); err != nil {
+			stop(err)
+		}
+	}
+}
+
+// Place, set aside or pass over one hashed file. The error stops the
+// pipeline.
+func (p *Pipeline) place(stamp FileStamp) error {
+	if p.Prepare != nil && stamp.Quarantine == "" && stamp.DuplicateOf == "" {
+		if err := p.Prepare(&stamp); err != nil {
+			return err
+		}
+	}
+	handle := func() error {
+		switch {
+		case stamp.Quarantine != "":
+			return p.setAside(stamp)
+		case stamp.DuplicateOf != "":
+			return p.passOver(stamp)
+		}
+		return p.link(stamp)
+	}
+	var err error
+	if p.Attempt != nil {
+		err = p.Attempt(stamp, handle)
+	} else {
+		err = handle()
+	}
+	if err == nil && p.Done != nil {
+		err = p.Done(stamp)
+	}
+	return err
+}
+
+func (p *Pipeline) skip(stamp FileStamp, event string) {
+	p.Events.Emit(StampEvent(event, stamp))
+	p.report(StageSkipped, stamp, "", nil)
+}
+
+// Set aside a file that couldn't be read
+func (p *Pipeline) setAside(stamp FileStamp) error {
+	if recorder, ok := p.Stater.(Recorder); ok {
+		fresh, err := recorder.SetAside(stamp)
+		if err != nil {
+			return &FatalError{"recording file", stamp.Path, err}
+		}
+		if !fresh {
+			p.skip(stamp, "skipped")
+			return nil
+		}
+	}
+	event := StampEvent("quarantined", stamp)
+	event.Message = stamp.Quarantine
+	if quarantiner, ok := p.Linker.(Quarantiner); ok {
+		event.Destination = quarantiner.Quarantine(stamp)
+	}
+	p.Events.Emit(event)
+	p.report(StageQuarantined, stamp, "", nil)
+	return nil
+}
+
+// Record a lesser copy of content in place of placing it
+func (p *Pipeline) passOver(stamp FileStamp) error {
+	if recorder, ok := p.Stater.(Recorder); ok {
+		recorded, err := recorder.PassOver(stamp)
+		if err != nil {
+			return &FatalError{"recording file", stamp.Path, err}
+		}
+		if !recorded {
+			p.skip(stamp, "skipped")
+			return nil
+		}
+	}
+	event := StampEvent("duplicate", stamp)
+	event.Partner = stamp.DuplicateOf
+	p.Events.Emit(event)
+	p.report(StageDuplicate, stamp, "", nil)
+	return nil
+}
+
+// Claim a file's content and place it. Errors are the file's own; the
+// database failing is a *FatalError.
+func (p *Pipeline) link(stamp FileStamp) error {
+	claimed, err := p.Stater.Claim(stamp)
+	if err != nil {
+		return &FatalError{"recording file", stamp.Path, err}
+	}
+	if !claimed {
+		rejected := false
+		if recorder, ok := p.Stater.(Recorder); ok {
+			rejected, err = recorder.Skipped(stamp)
+			if err != nil {
+				return &FatalError{"recording file", stamp.Path, err}
+			}
+		}
+		if rejected {
+			p.skip(stamp, "rejected")
+		} else {
+			p.skip(stamp, "skipped")
+		}
+		return nil
+	}
+
+	placement, err := p.Linker.Link(stamp)
+	if err != nil {
+		// let another attempt have the content
+		if rErr := p.Stater.Release(stamp); rErr != nil {
+			return &FatalError{"recording file", stamp.Path, rErr}
+		}
+		var declined *Declined
+		if errors.As(err, &declined) {
+			return p.decline(stamp, declined)
+		}
+		p.report(StageError, stamp, "", err)
+		return err
+	}
+	if err = p.Stater.Placed(placement); err != nil {
+		return &FatalError{"recording destination of", stamp.Path, err}
+	}
+	if placement.Planned {
+		p.report(StageLinked, placement.Stamp, placement.Destination, nil)
+		return nil
+	}
+
+	event := StampEvent("linked", placement.Stamp)
+	event.Destination = placement.Path
+	if placement.Partner != nil {
+		event.Partner = placement.Partner.Path
+	}
+	p.Events.Emit(event)
+
+	if placement.Mode == TransferMove {
+		err = os.Remove(stamp.Path)
+		if err != nil {
+			return fmt.Errorf("while removing moved file %s: %w", stamp.Path, err)
+		}
+		p.Events.Emit(Event{Event: "source-removed", Source: stamp.Path})
+	}
+	p.report(StageLinked, placement.Stamp, placement.Destination, nil)
+	return nil
+}
+
+// Leave a file a Linker turned down for a later run, or for good if it's
+// another copy of content placed before
+func (p *Pipeline) decline(stamp FileStamp, declined *Declined) error {
+	name := declined.Event
+	if name == "" {
+		name = "declined"
+	}
+	event := StampEvent(name, stamp)
+	event.Message = declined.Reason
+	p.Events.Emit(event)
+	p.report(StageSkipped, stamp, "", nil)
+
+	recorder, ok := p.Stater.(Recorder)
+	if declined.DuplicateOfKey == nil || !ok {
+		return nil
+	}
+	stamp.DuplicateOf, stamp.DuplicateOfKey = declined.DuplicateOf, declined.DuplicateOfKey
+	if _, err := recorder.PassOver(stamp); err != nil {
+		return &FatalError{"recording file", stamp.Path, err}
+	}
+	return nil
+}
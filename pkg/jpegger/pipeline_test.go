@@ -0,0 +1,205 @@
+package jpegger
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// Keys files by their content alone
+type contentHasher struct{}
+
+func (contentHasher) Key(stamp FileStamp) ([]byte, error) {
+	return HashFile(stamp.Local, DefaultHash)
+}
+
+// Tracks content in memory
+type memoryStater struct {
+	claimed map[string]bool
+	placed  map[string]string
+}
+
+func (s *memoryStater) Claim(stamp FileStamp) (bool, error) {
+	if s.claimed[string(stamp.Key)] {
+		return false, nil
+	}
+	s.claimed[string(stamp.Key)] = true
+	return true, nil
+}
+
+func (s *memoryStater) Placed(p Placement) error {
+	s.placed[p.Stamp.Path] = p.Destination
+	return nil
+}
+
+func (s *memoryStater) Release(stamp FileStamp) error {
+	delete(s.claimed, string(stamp.Key))
+	return nil
+}
+
+func TestPipelineFSSource(t *testing.T) {
+	modified := time.Date(2021, 6, 7, 8, 9, 10, 0, time.Local)
+	tree := fstest.MapFS{
+		"DCIM/IMG_1.jpg":  {Data: []byte("first"), ModTime: modified},
+		"DCIM/IMG_2.jpg":  {Data: []byte("second"), ModTime: modified},
+		"DCIM/copy.jpg":   {Data: []byte("first"), ModTime: modified},
+		"DCIM/broken.jpg": {Data: []byte("broken"), ModTime: modified},
+		"DCIM/notes.txt":  {Data: []byte("not a photo"), ModTime: modified},
+		"Trash/IMG_3.jpg": {Data: []byte("third"), ModTime: modified},
+		DefaultIgnoreFile: {Data: []byte("Trash/\n")},
+	}
+	// dates by content, as a camera would have written them
+	readExif := func(local string) (map[string]string, error) {
+		data, err := os.ReadFile(local)
+		if err != nil {
+			return nil, err
+		}
+		switch string(data) {
+		case "first":
+			return map[string]string{ExifKeys[0]: "2019:04:05 10:11:12"}, nil
+		case "broken":
+			return nil, errors.New("truncated")
+		}
+		return nil, NoExifData
+	}
+	layout, err := ParseLayout("%Y/%m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := NewFSSource(tree, "camera", t.TempDir())
+	source.IgnoreFile = DefaultIgnoreFile
+	defer source.Close()
+	output := t.TempDir()
+	stater := &memoryStater{claimed: map[string]bool{}, placed: map[string]string{}}
+	stages := map[string][]string{}
+	pipeline := &Pipeline{
+		Scanner: SourceScanner{Source: source, ReadExif: readExif},
+		Hasher:  contentHasher{},
+		Stater:  stater,
+		Linker:  &LayoutLinker{Output: output, Layout: layout, Mode: TransferCopy},
+		Progress: func(p PipelineProgress) {
+			stages[p.Stage] = append(stages[p.Stage], p.Stamp.Path)
+		},
+	}
+	if err = pipeline.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for stage, want := range map[string][]string{
+		StageScanned:     {"camera/DCIM/IMG_1.jpg", "camera/DCIM/IMG_2.jpg", "camera/DCIM/broken.jpg", "camera/DCIM/copy.jpg"},
+		StageQuarantined: {"camera/DCIM/broken.jpg"},
+		StageSkipped:     {"camera/DCIM/copy.jpg"},
+		StageLinked:      {"camera/DCIM/IMG_1.jpg", "camera/DCIM/IMG_2.jpg"},
+	} {
+		got := stages[stage]
+		sort.Strings(got)
+		if !equalStrings(got, want) {
+			t.Errorf("%s: got %v, want %v", stage, got, want)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"camera/DCIM/IMG_1.jpg": "2019/04/IMG_1.jpg",
+		"camera/DCIM/IMG_2.jpg": "2021/06/IMG_2.jpg",
+	} {
+		if got := stater.placed[name]; got != want {
+			t.Errorf("%s placed at %q, want %q", name, got, want)
+		}
+		data, err := os.ReadFile(filepath.Join(output, filepath.FromSlash(want)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if string(data) != string(tree[name[len("camera/"):]].Data) {
+			t.Errorf("%s: placed %q", name, data)
+		}
+	}
+
+	// what was fetched to hash and place is gone again
+	staged, err := os.ReadDir(source.staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(staged) != 0 {
+		t.Errorf("%d fetched files left behind", len(staged))
+	}
+}
+
+func TestPipelineMoveVerifiesCopy(t *testing.T) {
+	modified := time.Date(2021, 6, 7, 8, 9, 10, 0, time.Local)
+	noExif := func(local string) (map[string]string, error) {
+		return nil, NoExifData
+	}
+	layout, err := ParseLayout("%Y/%m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		corrupt bool
+		// whether the source is still there and the copy is
+		source, copied bool
+	}{
+		{"verified copy", false, false, true},
+		{"mismatched copy", true, true, false},
+	} {
+		input, output := t.TempDir(), t.TempDir()
+		src := filepath.Join(input, "IMG_1.jpg")
+		if err = os.WriteFile(src, []byte("first"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(src, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+
+		// a move copies before removing the source, and the copy can
+		// come out wrong on a failing disk
+		transfer := Transfer
+		if test.corrupt {
+			transfer = func(mode TransferMode, src, dest string) error {
+				return os.WriteFile(dest, []byte("fir$t"), 0644)
+			}
+		}
+		pipeline := &Pipeline{
+			Scanner: DirScanner{Inputs: []string{input}, ReadExif: noExif},
+			Hasher:  contentHasher{},
+			Stater:  &memoryStater{claimed: map[string]bool{}, placed: map[string]string{}},
+			Linker: &LayoutLinker{
+				Output:    output,
+				Layout:    layout,
+				Mode:      TransferMove,
+				Transfer:  transfer,
+				Algorithm: DefaultHash,
+			},
+		}
+		err = pipeline.Run(context.Background())
+		if test.corrupt != (err != nil) {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+
+		if _, err = os.Stat(src); test.source != (err == nil) {
+			t.Errorf("%s: source exists is %v, want %v", test.name, err == nil, test.source)
+		}
+		dest := filepath.Join(output, "2021", "06", "IMG_1.jpg")
+		if _, err = os.Stat(dest); test.copied != (err == nil) {
+			t.Errorf("%s: copy exists is %v, want %v", test.name, err == nil, test.copied)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package jpegger
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What a plan entry does to its file, besides the transfer modes
+const (
+	// The output already holds the content at the destination
+	PlanExisting = "existing"
+	// A lesser copy of a shot, recorded rather than imported
+	PlanDuplicate = "duplicate"
+	// Passed over, because it was imported before or is outside -since
+	// and -until
+	PlanSkip = "skip"
+	// Set aside as unreadable
+	PlanQuarantine = "quarantine"
+)
+
+var (
+	PlanPath = importFlags.String("plan", "", "with -dry-run, also write the plan to this file as JSON, or CSV if it ends in .csv, to review or to carry out with jpegger apply")
+
+	planColumns = []string{"action", "source", "destination", "of", "reason", "hash", "date", "date_source"}
+)
+
+// One step of a dry run's plan
+type PlanEntry struct {
+	// link, copy, move or reflink, or one of the Plan actions
+	Action      string `json:"action"`
+	Source      string `json:"source"`
+	Destination string `json:"destination,omitempty"`
+	// The destination of the file a sidecar or companion goes with, or the
+	// source of the copy a duplicate was passed over for
+	Of string `json:"of,omitempty"`
+	// The key of that copy, for a duplicate
+	OfHash     string     `json:"of_hash,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	Hash       string     `json:"hash,omitempty"`
+	Date       *time.Time `json:"date,omitempty"`
+	DateSource string     `json:"date_source,omitempty"`
+}
+
+// What a dry run would have done. Local paths are absolute, so the plan
+// can be applied from anywhere.
+type Plan struct {
+	Inputs []string `json:"inputs"`
+	Output string   `json:"output"`
+	// How the entries' content is keyed
+	Hash    string      `json:"hash"`
+	Entries []PlanEntry `json:"entries"`
+}
+
+// Start a plan entry about a file
+func StampPlanEntry(action string, stamp FileStamp) PlanEntry {
+	entry := PlanEntry{Action: action, Source: stamp.Path}
+	if stamp.Key != nil {
+		entry.Hash = hex.EncodeToString(stamp.Key)
+	}
+	if !stamp.Time.IsZero() {
+		date := stamp.Time
+		entry.Date = &date
+		entry.DateSource = stamp.Source.String()
+	}
+	return entry
+}
+
+func planPath(path string) string {
+	if path == "" || IsRemote(path) {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// Add a step to the plan
+func (d *DryRunPlan) Plan(entry PlanEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = append(d.entries, entry)
+}
+
+// Write the plan to path, as CSV if it ends in .csv and otherwise JSON
+func (d *DryRunPlan) WritePlan(path string, inputs []string, output, algorithm string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	plan := Plan{Output: planPath(output), Hash: algorithm, Entries: []PlanEntry{}}
+	for _, input := range inputs {
+		plan.Inputs = append(plan.Inputs, planPath(input))
+	}
+	for _, entry := range d.entries {
+		entry.Source = planPath(entry.Source)
+		entry.Destination = planPath(entry.Destination)
+		entry.Of = planPath(entry.Of)
+		plan.Entries = append(plan.Entries, entry)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = writePlanCSV(f, plan)
+	} else {
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(plan)
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+func writePlanCSV(f *os.File, plan Plan) error {
+	w := csv.NewWriter(f)
+	w.Write(planColumns)
+	for _, e := range plan.Entries {
+		date := ""
+		if e.Date != nil {
+			date = e.Date.Format(time.RFC3339)
+		}
+		w.Write([]string{e.Action, e.Source, e.Destination, e.Of, e.Reason, e.Hash, date, e.DateSource})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// Read a JSON plan written by a dry run
+func LoadPlan(path string) (Plan, error) {
+	var plan Plan
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return plan, fmt.Errorf("%s: only JSON plans can be applied, CSV is for reviewing", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return plan, err
+	}
+	if err = json.Unmarshal(data, &plan); err != nil {
+		return plan, fmt.Errorf("%s: %v", path, err)
+	}
+	if plan.Output == "" || plan.Hash == "" {
+		return plan, fmt.Errorf("%s: not a jpegger plan", path)
+	}
+	return plan, nil
+}
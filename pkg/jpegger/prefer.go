@@ -0,0 +1,107 @@
+package jpegger
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Which of several copies of one shot an import keeps
+type PreferPolicy int
+
+const (
+	// Keep every copy whose content differs
+	PreferAll = PreferPolicy(iota)
+	// Keep the largest file
+	PreferLarger
+	// Keep the RAW over a JPEG or HEIC, then the largest
+	PreferRaw
+	// Keep the file with the most EXIF tags, then the largest
+	PreferExif
+)
+
+var preferPolicyNames = map[string]PreferPolicy{
+	"":       PreferAll,
+	"larger": PreferLarger,
+	"raw":    PreferRaw,
+	"exif":   PreferExif,
+}
+
+const (
+	// The content of each lesser copy and the content kept in its place
+	Duplicates = "Duplicates"
+)
+
+func ParsePreferPolicy(name string) (PreferPolicy, error) {
+	policy, ok := preferPolicyNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown preference %q (expected larger, raw or exif)", name)
+	}
+	return policy, nil
+}
+
+// Is a a better copy of the shot than b?
+func (p PreferPolicy) Better(a, b FileStamp) bool {
+	switch p {
+	case PreferRaw:
+		if IsRaw(a.Path) != IsRaw(b.Path) {
+			return IsRaw(a.Path)
+		}
+	case PreferExif:
+		if a.Tags != b.Tags {
+			return a.Tags > b.Tags
+		}
+	}
+	return a.Size > b.Size
+}
+
+// Copies of one shot share a name, ignoring its extension and case, and the
+// time they were taken. Stills and videos are never copies of each other,
+// so Live Photos stay whole.
+func shotKey(stamp FileStamp) string {
+	kind := "still"
+	if IsQuickTime(stamp.Path) {
+		kind = "video"
+	}
+	return fmt.Sprintf("%s %s %d", kind, PairKey(filepath.Base(stamp.Path)), stamp.Time.UnixNano())
+}
+
+// Pick the best copy of each shot. The rest follow the files to import,
+// marked as duplicates of the best copy.
+func PreferBest(policy PreferPolicy, stamps []FileStamp) []FileStamp {
+	best := map[string]int{}
+	for i, stamp := range stamps {
+		if stamp.Quarantine != "" || stamp.Time.IsZero() {
+			continue
+		}
+		key := shotKey(stamp)
+		if j, ok := best[key]; !ok || policy.Better(stamp, stamps[j]) {
+			best[key] = i
+		}
+	}
+
+	var kept, duplicates []FileStamp
+	for i, stamp := range stamps {
+		j, ok := best[shotKey(stamp)]
+		if !ok || j == i || stamp.Quarantine != "" || stamp.Time.IsZero() || string(stamps[j].Key) == string(stamp.Key) {
+			// the same content is skipped as usual
+			kept = append(kept, stamp)
+			continue
+		}
+		stamp.DuplicateOf = stamps[j].Path
+		stamp.DuplicateOfKey = stamps[j].Key
+		duplicates = append(duplicates, stamp)
+	}
+	return append(kept, duplicates...)
+}
+
+// Remember that content was passed over for a better copy, so it isn't
+// imported later either. false if the content was already known.
+func RecordDuplicate(db Store, path string, key, preferred []byte) (bool, error) {
+	transitioned, err := CommitState(db, path, key, NoFile, DuplicateFile)
+	if err != nil || !transitioned {
+		return transitioned, err
+	}
+	return true, db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte(Duplicates)).Put(key, preferred)
+	})
+}
@@ -0,0 +1,207 @@
+package jpegger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// The first source path seen with each prefilter key
+	Prefilters = "Prefilters"
+	// The full hash of the content behind a prefilter key, once another
+	// file has collided with it
+	PrefilterHashes = "PrefilterHashes"
+
+	// The algorithm recorded for prefilter keys
+	PrefilterHash = "prefilter"
+
+	// How much of each end of a file the prefilter reads
+	prefilterSpan = 64 * 1024
+)
+
+// A cheap stand-in for the content hash from the size and the first and
+// last 64KB of a file. Files small enough to be read whole get a key as
+// good as a full hash.
+func QuickKey(path string) ([]byte, error) {
+	var key []byte
+	err := RetryIO(path, func() error {
+		var err error
+		key, err = quickKey(path)
+		return err
+	})
+	return key, err
+}
+
+func quickKey(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, info.Size())
+	if _, err = io.CopyN(h, f, prefilterSpan); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if info.Size() > prefilterSpan {
+		tail := info.Size() - prefilterSpan
+		if tail < prefilterSpan {
+			tail = prefilterSpan
+		}
+		if _, err = f.Seek(tail, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err = io.Copy(h, f); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// A copy of a value that outlives the transaction, nil if it or its bucket
+// is missing. A dry run may read a database from before the bucket.
+func lookup(tx Tx, bucket string, key []byte) []byte {
+	if b := tx.Bucket([]byte(bucket)); b != nil {
+		if v := b.Get(key); v != nil {
+			return append([]byte(nil), v...)
+		}
+	}
+	return nil
+}
+
+// Is every byte of a file that size covered by its prefilter key?
+func readWhole(size int64) bool {
+	return size <= 2*prefilterSpan
+}
+
+// Like FileKey, but content whose prefilter key is new is keyed by that
+// alone. The full hash is only worked out when a second file has the same
+// prefilter key: if the content matches the first file the prefilter key
+// is returned so the file is handled as a copy, otherwise the full hash
+// keys the file as different content. output is where the first file may
+// have been placed, should its source be gone.
+func PrefilterKey(db Store, path, local, algorithm, output string, seen SourceStat) ([]byte, error) {
+	var key []byte
+	err := db.View(func(tx Tx) error {
+		// a key cached by an older jpegger is checked once it is next
+		// worked out
+		key, _ = cachedSourceKey(tx, path, seen)
+		if key != nil {
+			if name := KeyAlgorithm(tx, key); name != algorithm && name != PrefilterHash {
+				key = nil
+			}
+		}
+		return nil
+	})
+	if err != nil || key != nil {
+		return key, err
+	}
+
+	quick, err := QuickKey(local)
+	if err != nil {
+		return nil, err
+	}
+
+	// a dry run must leave the database as it found it
+	update := db.Update
+	if db.IsReadOnly() {
+		update = db.View
+	}
+	save := func(key []byte, name string) error {
+		if db.IsReadOnly() {
+			return nil
+		}
+		return db.Update(func(tx Tx) error {
+			err := putSourceKey(tx, path, key, seen)
+			if err != nil {
+				return err
+			}
+			return RecordKeyAlgorithm(tx, key, name)
+		})
+	}
+
+	// claim the prefilter key unless another file has it
+	var first []byte
+	err = update(func(tx Tx) error {
+		first = lookup(tx, Prefilters, quick)
+		if len(first) > 0 || db.IsReadOnly() {
+			return nil
+		}
+		return tx.Bucket([]byte(Prefilters)).Put(quick, []byte(path))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(local)
+	if err != nil {
+		return nil, err
+	}
+	if len(first) == 0 || string(first) == path || readWhole(info.Size()) {
+		return quick, save(quick, PrefilterHash)
+	}
+
+	// a collision, so compare the content in full
+	full, err := HashFile(local, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	known, err := prefilteredContent(db, quick, string(first), algorithm, output)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(known, full) {
+		return quick, save(quick, PrefilterHash)
+	}
+	return full, save(full, algorithm)
+}
+
+// The full hash of the content behind a prefilter key, read from the first
+// file that had it or from where that was placed. nil if neither can be
+// read.
+func prefilteredContent(db Store, quick []byte, first, algorithm, output string) ([]byte, error) {
+	var known, dest []byte
+	err := db.View(func(tx Tx) error {
+		known = lookup(tx, PrefilterHashes, quick)
+		dest = lookup(tx, ContentDestination, quick)
+		return nil
+	})
+	if err != nil || known != nil {
+		return known, err
+	}
+
+	candidates := []string{first}
+	if dest != nil && !IsRemote(output) {
+		candidates = append(candidates, filepath.Join(output, filepath.FromSlash(string(dest))))
+	}
+	for _, candidate := range candidates {
+		if IsRemote(candidate) {
+			continue
+		}
+		// the file may have changed since
+		if key, err := QuickKey(candidate); err != nil || !bytes.Equal(key, quick) {
+			continue
+		}
+		known, err = HashFile(candidate, algorithm)
+		if err != nil {
+			continue
+		}
+		if db.IsReadOnly() {
+			return known, nil
+		}
+		return known, db.Update(func(tx Tx) error {
+			return tx.Bucket([]byte(PrefilterHashes)).Put(quick, known)
+		})
+	}
+	return nil, nil
+}
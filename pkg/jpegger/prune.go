@@ -0,0 +1,172 @@
+package jpegger
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// What a prune dropped from the database
+type PruneResult struct {
+	// Source paths checked, and those dropped as their files are gone
+	Checked, Pruned int
+	// Gone paths kept as the directory they were in is gone too, which
+	// may only mean a card or drive isn't mounted
+	Unmounted int
+	// Content no longer found anywhere that was put back to unseen
+	Forgotten int
+	// Unreadable and failed files dropped as they are gone
+	Problems int
+}
+
+// Is a source file gone? A path whose directory is gone as well only
+// counts with missingDirs.
+func sourceGone(path string, missingDirs bool) (gone, dirGone bool) {
+	if IsRemote(path) {
+		// checking means asking the store about every object
+		return false, false
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		return false, false
+	}
+	if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) && !missingDirs {
+		return false, true
+	}
+	return true, false
+}
+
+// Drop source paths whose files no longer exist, along with any failure
+// recorded for them. With forget, content that was never placed and has
+// no source left is put back to unseen, so only what the output holds is
+// remembered.
+func PruneSources(db Store, missingDirs, forget bool) (PruneResult, error) {
+	var result PruneResult
+	var paths, problems [][]byte
+	err := db.View(func(tx Tx) error {
+		collect := func(bucket string, into *[][]byte) {
+			if b := tx.Bucket([]byte(bucket)); b != nil {
+				b.ForEach(func(k, _ []byte) error {
+					*into = append(*into, append([]byte(nil), k...))
+					return nil
+				})
+			}
+		}
+		collect(SourcePath, &paths)
+		collect(Quarantined, &problems)
+		collect(FileErrors, &problems)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// look at the files before taking the database
+	var gonePaths, goneProblems [][]byte
+	for _, path := range paths {
+		gone, dirGone := sourceGone(string(path), missingDirs)
+		if gone {
+			gonePaths = append(gonePaths, path)
+		} else if dirGone {
+			result.Unmounted += 1
+		}
+	}
+	for _, path := range problems {
+		if gone, _ := sourceGone(string(path), missingDirs); gone {
+			goneProblems = append(goneProblems, path)
+		}
+	}
+	result.Checked = len(paths)
+
+	err = db.Update(func(tx Tx) error {
+		sources := tx.Bucket([]byte(SourcePath))
+		orphans := map[string]bool{}
+		for _, path := range gonePaths {
+			if key := sources.Get(path); key != nil {
+				orphans[string(key)] = true
+			}
+			if err := sources.Delete(path); err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte(SourceStats)).Delete(path); err != nil {
+				return err
+			}
+		}
+		result.Pruned = len(gonePaths)
+
+		for _, path := range goneProblems {
+			for _, bucket := range []string{Quarantined, FileErrors} {
+				if err := tx.Bucket([]byte(bucket)).Delete(path); err != nil {
+					return err
+				}
+			}
+		}
+		result.Problems = len(goneProblems)
+
+		if !forget || len(orphans) == 0 {
+			return nil
+		}
+		// content still found at another path keeps its state
+		sources.ForEach(func(_, key []byte) error {
+			delete(orphans, string(key))
+			return nil
+		})
+		hashes := tx.Bucket([]byte(ContentHash))
+		for key := range orphans {
+			k := []byte(key)
+			state := hashes.Get(k)
+			if state == nil || IsPlaced(state) {
+				continue
+			}
+			for _, bucket := range []string{ContentHash, Duplicates, KeyAlgorithms} {
+				if err := tx.Bucket([]byte(bucket)).Delete(k); err != nil {
+					return err
+				}
+			}
+			result.Forgotten += 1
+		}
+		return nil
+	})
+	return result, err
+}
+
+func dbPrune(args []string) error {
+	fs := flag.NewFlagSet("db prune", flag.ExitOnError)
+	missingDirs := fs.Bool("missing-dirs", false, "also prune files whose whole directory is gone. by default they are kept, as the card or drive they were on may just be unplugged")
+	forget := fs.Bool("content", false, "also forget content that was never placed, like duplicates and unreadable files, once no source of it is left")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return UsageError(dbFlags, "prune takes only -missing-dirs and -content")
+	}
+	if _, err := os.Stat(*Database); err != nil {
+		return err
+	}
+
+	lock, err := LockRun(*Database, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	db, err := OpenStore(*Database, StoreOptions{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = CreateBuckets(db); err != nil {
+		return err
+	}
+
+	result, err := PruneSources(db, *missingDirs, *forget)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("pruned %d of %d source paths and %d failed or unreadable files\n", result.Pruned, result.Checked, result.Problems)
+	if *forget {
+		fmt.Printf("forgot %d pieces of content with no source left\n", result.Forgotten)
+	}
+	if result.Unmounted > 0 {
+		fmt.Printf("kept %d paths in directories that are gone. use -missing-dirs if they won't be back\n", result.Unmounted)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package jpegger
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Files that couldn't be read and why
+	Quarantined = "Quarantined"
+	// Where copies of them are put, below the output directory
+	QuarantineDir = "quarantine"
+)
+
+// Remember that a file couldn't be read. A later import that can read it
+// takes it out again.
+func RecordQuarantine(db Store, path, reason string) error {
+	return db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte(Quarantined)).Put([]byte(path), []byte(reason))
+	})
+}
+
+func ReleaseQuarantine(db Store, path string) error {
+	// most files were never quarantined, so look before taking the lock
+	var found bool
+	err := db.View(func(tx Tx) error {
+		found = lookup(tx, Quarantined, []byte(path)) != nil
+		return nil
+	})
+	if err != nil || !found {
+		return err
+	}
+	return db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte(Quarantined)).Delete([]byte(path))
+	})
+}
+
+// Put what can be read of a quarantined file in the quarantine directory
+// of a local output, numbered if its name is taken. A move leaves the
+// source where it is. Files too damaged to copy have no place there, so
+// the path is empty.
+func PlaceQuarantined(mode TransferMode, src, name, output string) string {
+	if mode == TransferMove {
+		mode = TransferCopy
+	}
+	directory := filepath.Join(output, QuarantineDir)
+	if EnsureDir(directory) != nil {
+		return ""
+	}
+
+	base := filepath.Base(name)
+	dest := filepath.Join(directory, base)
+	err := Transfer(mode, src, dest)
+	for attempt := 1; os.IsExist(err); attempt += 1 {
+		numbered, _ := CollisionName(CollisionSequence, base, FileStamp{}, attempt)
+		dest = filepath.Join(directory, numbered)
+		err = Transfer(mode, src, dest)
+	}
+	if err != nil {
+		return ""
+	}
+	return dest
+}
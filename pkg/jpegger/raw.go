@@ -0,0 +1,144 @@
+package jpegger
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	RawExtensions  = []string{".cr2", ".nef", ".arw", ".dng", ".raf"}
+	JPEGExtensions = []string{".jpg", ".jpeg"}
+	TIFFExtensions = []string{".tif", ".tiff"}
+
+	// The halves of an Apple Live Photo
+	LiveStillExtensions = []string{".heic", ".jpg", ".jpeg"}
+	LiveVideoExtensions = []string{".mov"}
+)
+
+const (
+	// Which content hashes belong to one asset, both ways round
+	Pairs = "Pairs"
+
+	// A Live Photo's video date comes from its container, which may be in
+	// UTC where the still's EXIF is local time, so allow for time zones
+	LivePhotoWindow = 15 * time.Hour
+)
+
+func hasExtension(name string, extensions []string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Is the path a camera RAW file?
+func IsRaw(name string) bool {
+	return hasExtension(name, RawExtensions)
+}
+
+// Is the path a JPEG?
+func IsJPEG(name string) bool {
+	return hasExtension(name, JPEGExtensions)
+}
+
+// Is the path a TIFF image?
+func IsTIFF(name string) bool {
+	return hasExtension(name, TIFFExtensions)
+}
+
+// Could the path be the still of a Live Photo?
+func IsLiveStill(name string) bool {
+	return hasExtension(name, LiveStillExtensions)
+}
+
+// Could the path be the video of a Live Photo?
+func IsLiveVideo(name string) bool {
+	return hasExtension(name, LiveVideoExtensions)
+}
+
+// Could the file be half of a RAW+JPEG pair or a Live Photo?
+func isPairHalf(name string) bool {
+	return IsRaw(name) || IsJPEG(name) || IsLiveStill(name) || IsLiveVideo(name)
+}
+
+// Are two files with the same key the halves of a pair? RAW+JPEG pairs are
+// shot at exactly the same time.
+func Pairable(a string, aTime time.Time, b string, bTime time.Time) bool {
+	switch {
+	case IsRaw(a) && IsJPEG(b), IsJPEG(a) && IsRaw(b):
+		return aTime.Equal(bTime)
+	case IsLiveStill(a) && IsLiveVideo(b), IsLiveVideo(a) && IsLiveStill(b):
+		gap := aTime.Sub(bTime)
+		if gap < 0 {
+			gap = -gap
+		}
+		return gap <= LivePhotoWindow
+	}
+	return false
+}
+
+// Files that could be two halves of a pair share this key
+func PairKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+// Where one half of a pair ended up
+type PairPlacement struct {
+	Path      string
+	Time      time.Time
+	Key       []byte
+	Directory string
+	// The name it was given without its extension, if a collision meant
+	// it couldn't keep its own
+	Stem string
+}
+
+// Remembers where RAW, JPEG and Live Photo files were placed so that the
+// other half of a pair can be placed beside it under the same name.
+type PairTracker struct {
+	placed map[string]PairPlacement
+}
+
+func NewPairTracker() *PairTracker {
+	return &PairTracker{placed: map[string]PairPlacement{}}
+}
+
+// Find the already placed partner of a file, if it has one
+func (t *PairTracker) Partner(stamp FileStamp) (PairPlacement, bool) {
+	if !isPairHalf(stamp.Path) {
+		return PairPlacement{}, false
+	}
+
+	partner, ok := t.placed[PairKey(stamp.Path)]
+	if !ok || !Pairable(partner.Path, partner.Time, stamp.Path, stamp.Time) {
+		return PairPlacement{}, false
+	}
+
+	// a pair only has two halves
+	delete(t.placed, PairKey(stamp.Path))
+	return partner, true
+}
+
+// Remember where a file was placed in case its partner comes along later
+func (t *PairTracker) Record(stamp FileStamp, directory, stem string) {
+	if !isPairHalf(stamp.Path) {
+		return
+	}
+	t.placed[PairKey(stamp.Path)] = PairPlacement{stamp.Path, stamp.Time, stamp.Key, directory, stem}
+}
+
+// Remember that two pieces of content are one asset
+func RecordPair(db Store, a, b []byte) error {
+	return db.Update(func(tx Tx) error {
+		pairs := tx.Bucket([]byte(Pairs))
+		err := pairs.Put(a, b)
+		if err != nil {
+			return err
+		}
+		return pairs.Put(b, a)
+	})
+}
@@ -0,0 +1,36 @@
+//go:build darwin
+// +build darwin
+
+package jpegger
+
+import (
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Clone with clonefile, which APFS supports
+func cloneFile(src, dest string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	// clonefile makes the file itself, so only borrow a free name
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".jpegger-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	os.Remove(tmpName)
+	defer os.Remove(tmpName)
+
+	err = unix.Clonefile(src, tmpName, unix.CLONE_NOFOLLOW)
+	if err != nil {
+		return err
+	}
+
+	return placeTemp("reflink", src, tmpName, dest, info)
+}
@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package jpegger
+
+import (
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Clone with the FICLONE ioctl, which btrfs and XFS support
+func cloneFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".jpegger-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	err = unix.IoctlFileClone(int(tmp.Fd()), int(in.Fd()))
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return placeTemp("reflink", src, tmpName, dest, info)
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package jpegger
+
+import (
+	"errors"
+)
+
+func cloneFile(src, dest string) error {
+	return errors.New("cloning isn't supported on this platform")
+}
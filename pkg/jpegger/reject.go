@@ -0,0 +1,129 @@
+package jpegger
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	RejectCommand = &Command{
+		Name:    "reject",
+		Args:    "path|hash...",
+		Summary: "never import some content, wherever it turns up again",
+		Flags:   rejectFlags,
+		Run:     RunReject,
+	}
+
+	rejectFlags = NewFlagSet("reject", "path|hash...")
+
+	RejectUndo = rejectFlags.Bool("undo", false, "forget that the content was rejected, so the next import that finds it imports it")
+)
+
+// The content rejected, which outlives -delete-copy-state
+func rejectedKeys(tx Tx) [][]byte {
+	var keys [][]byte
+	if b := tx.Bucket([]byte(ContentHash)); b != nil {
+		b.ForEach(func(key, state []byte) error {
+			if bytes.Equal(state, RejectedFile) {
+				keys = append(keys, append([]byte(nil), key...))
+			}
+			return nil
+		})
+	}
+	return keys
+}
+
+// Was the content rejected?
+func Rejected(db Store, key []byte) (bool, error) {
+	rejected := false
+	err := db.View(func(tx Tx) error {
+		rejected = bytes.Equal(lookup(tx, ContentHash, key), RejectedFile)
+		return nil
+	})
+	return rejected, err
+}
+
+// The content to reject: what the database knows by that source path,
+// output path or hash prefix, and otherwise the content of the file there,
+// hashed as most content is. fresh is true for content the database didn't
+// know.
+func rejectKey(db Store, name string) (key []byte, algorithm string, fresh bool, err error) {
+	var unknown error
+	err = db.View(func(tx Tx) error {
+		key, unknown = resolveContent(tx, name)
+		algorithm = MainAlgorithm(ContentAlgorithms(tx))
+		return nil
+	})
+	if err != nil || unknown == nil {
+		return key, "", false, err
+	}
+	if info, sErr := os.Stat(name); sErr != nil || !info.Mode().IsRegular() {
+		return nil, "", false, unknown
+	}
+	key, err = HashFile(name, algorithm)
+	return key, algorithm, true, err
+}
+
+func RunReject(args []string) error {
+	if len(args) == 0 {
+		return UsageError(rejectFlags, "expected a path or hash to reject")
+	}
+
+	if _, err := os.Stat(*Database); err != nil {
+		return err
+	}
+	lock, err := LockRun(*Database, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	db, err := OpenStore(*Database, StoreOptions{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = CreateBuckets(db); err != nil {
+		return err
+	}
+
+	for _, name := range args {
+		key, algorithm, fresh, err := rejectKey(db, name)
+		if err != nil {
+			return err
+		}
+		err = db.Update(func(tx Tx) error {
+			b := tx.Bucket([]byte(ContentHash))
+			state := b.Get(key)
+			if *RejectUndo {
+				if !bytes.Equal(state, RejectedFile) {
+					fmt.Printf("%x  %s, not rejected\n", key, StateName(state))
+					return nil
+				}
+				fmt.Printf("%x  no longer rejected\n", key)
+				return b.Delete(key)
+			}
+
+			if IsPlaced(state) {
+				if dest := lookup(tx, ContentDestination, key); dest != nil {
+					fmt.Printf("%x  was placed at %s, which is left in the output\n", key, dest)
+				}
+			}
+			if fresh {
+				if err := RecordKeyAlgorithm(tx, key, algorithm); err != nil {
+					return err
+				}
+			}
+			if err := b.Put(key, RejectedFile); err != nil {
+				return err
+			}
+			fmt.Printf("%x  rejected\n", key)
+			return recordStateTime(tx, key, RejectedFile, time.Now())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
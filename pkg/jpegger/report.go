@@ -0,0 +1,156 @@
+package jpegger
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// The stages a file goes through in an import, in order
+	ReportStages = []string{"reading", "hashing", "placing"}
+
+	// Events for files passed over by -since, -until, -apple, ignore files
+	// or the symlink and filesystem rules
+	filteredEvents = map[string]bool{
+		"out-of-range":       true,
+		"apple-edit-skipped": true,
+		"symlink-skipped":    true,
+		"other-filesystem":   true,
+		"symlink-loop":       true,
+		"ignored":            true,
+	}
+
+	// The report of the import underway, which emitted events are counted
+	// in. nil when there isn't one.
+	reporting *RunReport
+)
+
+// Tallies what an import did, for the summary at the end of the run
+type RunReport struct {
+	mu       sync.Mutex
+	started  time.Time
+	scanned  int
+	filtered int
+	events   map[string]int
+	bytes    int64
+	stages   map[string]time.Duration
+	// the empty and too small files skipped
+	small []string
+}
+
+func NewRunReport() *RunReport {
+	return &RunReport{started: time.Now(), events: map[string]int{}, stages: map[string]time.Duration{}}
+}
+
+// Note a file found in an input, and whether it's one jpegger imports
+func (r *RunReport) Scan(valid bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scanned += 1
+	if !valid {
+		r.filtered += 1
+	}
+}
+
+// Count an event. Files a walk passes over never reach the import, so they
+// are counted as scanned here.
+func (r *RunReport) Note(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[e.Event] += 1
+	if e.Event == "empty" || e.Event == "too-small" {
+		r.small = append(r.small, e.Source)
+	}
+	if filteredEvents[e.Event] {
+		r.filtered += 1
+		if e.Event != "out-of-range" && e.Event != "apple-edit-skipped" {
+			r.scanned += 1
+		}
+	}
+}
+
+// The empty and too small files skipped so far
+func (r *RunReport) Small() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.small...)
+}
+
+// Note a file done with, of size bytes
+func (r *RunReport) Process(size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bytes += size
+}
+
+// How many files the run placed, passed over as duplicates or set aside
+func (r *RunReport) Handled() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events["linked"] + r.events["duplicate"] + r.events["quarantined"]
+}
+
+// Add the time since start to a stage. Stages run side by side and some
+// have several workers, so their times can add up to more than the run took.
+func (r *RunReport) Time(stage string, start time.Time) {
+	elapsed := time.Since(start)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stages[stage] += elapsed
+}
+
+func (r *RunReport) stageTimes() string {
+	var times []string
+	for _, stage := range ReportStages {
+		times = append(times, fmt.Sprintf("%s %s", stage, r.stages[stage].Round(time.Millisecond)))
+	}
+	return strings.Join(times, ", ")
+}
+
+// The summary as one line for the action log, given how many files failed
+func (r *RunReport) Line(failed int) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fmt.Sprintf("%d scanned, %d filtered, %d already known, %d linked, %d renamed, %d duplicates, %d quarantined, %d empty or too small, %d failed, %s in %s (%s)",
+		r.scanned, r.filtered, r.events["skipped"], r.events["linked"], r.events["collision"],
+		r.events["duplicate"], r.events["quarantined"], len(r.small), failed, HumanBytes(r.bytes),
+		time.Since(r.started).Round(time.Millisecond), r.stageTimes())
+}
+
+// Write the summary for people, given how many files failed
+func (r *RunReport) Write(out io.Writer, failed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rows := []struct {
+		label string
+		value interface{}
+	}{
+		{"scanned", r.scanned},
+		{"skipped by filter", r.filtered},
+		{"already known", r.events["skipped"]},
+		{"unchanged dirs", r.events["unchanged-dir"]},
+		{"moved sources", r.events["moved"]},
+		{"rejected", r.events["rejected"]},
+		{"still being written", r.events["unsettled"]},
+		{"newly linked", r.events["linked"]},
+		{"collisions renamed", r.events["collision"]},
+		{"duplicates passed over", r.events["duplicate"]},
+		{"quarantined", r.events["quarantined"]},
+		{"permission denied", r.events["permission-denied"]},
+		{"unreadable dirs", r.events["unreadable-dir"]},
+		{"empty or too small", len(r.small)},
+		{"errors", failed},
+		{"processed", HumanBytes(r.bytes)},
+		{"elapsed", time.Since(r.started).Round(time.Millisecond)},
+	}
+	fmt.Fprintln(out, "summary:")
+	for _, row := range rows {
+		fmt.Fprintf(out, "  %-24s %v\n", row.label, row.value)
+	}
+	for _, stage := range ReportStages {
+		fmt.Fprintf(out, "    %-22s %v\n", stage, r.stages[stage].Round(time.Millisecond))
+	}
+}
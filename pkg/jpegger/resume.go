@@ -0,0 +1,136 @@
+package jpegger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// Where an interrupted run over each input directory got to
+	Checkpoints = "Checkpoints"
+
+	// How many handled files between checkpoint saves
+	CheckpointInterval = 100
+)
+
+// Like WithFiles, but skip everything up to and including the file at
+// after, a path relative to the starting point. WithFiles visits names in
+// sorted order, depth first, so whole directories that sort before the
+// checkpoint are skipped without being read.
+func WithFilesAfter(path, after string, callback func(os.FileInfo, string) error) error {
+	walk, err := newTreeWalk(path)
+	if err != nil {
+		return err
+	}
+	return walk.walkAfter(path, after, callback)
+}
+
+func (w *treeWalk) walkAfter(path, after string, callback func(os.FileInfo, string) error) error {
+	var components []string
+	if after != "" {
+		components = strings.Split(after, "/")
+	}
+	return w.walk(path, components, 0, callback)
+}
+
+// Tracks which traversed files have been handled. Files are handled out of
+// order, so the checkpoint is the last file before which everything is
+// done. Sequence numbers start at 1; 0 marks files that aren't tracked.
+type Progress struct {
+	mu      sync.Mutex
+	root    string
+	next    uint64
+	low     uint64
+	pending map[uint64]string
+	done    map[uint64]bool
+
+	Checkpoint string
+	Handled    int
+}
+
+func NewProgress(root, checkpoint string) *Progress {
+	return &Progress{
+		root:       root,
+		next:       1,
+		low:        1,
+		pending:    map[uint64]string{},
+		done:       map[uint64]bool{},
+		Checkpoint: checkpoint,
+	}
+}
+
+// Note a file in traversal order, returning its sequence number
+func (p *Progress) Add(path string) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	seq := p.next
+	p.next += 1
+	p.pending[seq] = path
+	return seq
+}
+
+// Give a stamp its place in the traversal if it's part of it
+func (p *Progress) Track(stamp FileStamp, tracked bool) FileStamp {
+	if tracked {
+		stamp.Seq = p.Add(stamp.Path)
+	}
+	return stamp
+}
+
+// Note that a file has been handled
+func (p *Progress) Done(seq uint64) {
+	if seq == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done[seq] = true
+	p.Handled += 1
+	for p.done[p.low] {
+		rel, err := filepath.Rel(p.root, p.pending[p.low])
+		if err == nil {
+			p.Checkpoint = filepath.ToSlash(rel)
+		}
+		delete(p.done, p.low)
+		delete(p.pending, p.low)
+		p.low += 1
+	}
+}
+
+func checkpointKey(input string) []byte {
+	if IsRemote(input) {
+		return []byte(input)
+	}
+	if abs, err := filepath.Abs(input); err == nil {
+		input = abs
+	}
+	return []byte(input)
+}
+
+// Where the last interrupted run over an input directory got to
+func LoadCheckpoint(db Store, input string) (string, error) {
+	var checkpoint string
+	err := db.View(func(tx Tx) error {
+		if b := tx.Bucket([]byte(Checkpoints)); b != nil {
+			checkpoint = string(b.Get(checkpointKey(input)))
+		}
+		return nil
+	})
+	return checkpoint, err
+}
+
+// Remember where a run got to. An empty checkpoint means the run finished.
+func SaveCheckpoint(db Store, input, checkpoint string) error {
+	return db.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte(Checkpoints))
+		if checkpoint == "" {
+			return b.Delete(checkpointKey(input))
+		}
+		return b.Put(checkpointKey(input), []byte(checkpoint))
+	})
+}
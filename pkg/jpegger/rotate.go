@@ -0,0 +1,152 @@
+package jpegger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const orientationTag = 0x0112
+
+var (
+	AutoRotate = importFlags.Bool("auto-rotate", false, "turn placed JPEGs the way up their EXIF orientation says, losslessly with jpegtran, and reset the orientation, so viewers that ignore it show them upright. needs -mode=copy, move or reflink")
+	Jpegtran   = importFlags.String("jpegtran", "jpegtran", "the jpegtran command -auto-rotate turns JPEGs with")
+
+	// The jpegtran transform that undoes each EXIF orientation
+	orientationTransforms = map[uint16][]string{
+		2: {"-flip", "horizontal"},
+		3: {"-rotate", "180"},
+		4: {"-flip", "vertical"},
+		5: {"-transpose"},
+		6: {"-rotate", "90"},
+		7: {"-transverse"},
+		8: {"-rotate", "270"},
+	}
+)
+
+// Where the value of a JPEG's orientation is kept, the byte order it's in
+// and what it is. -1 and 1 if it has none.
+func readOrientation(f *os.File) (int64, binary.ByteOrder, uint16, error) {
+	start, _, err := locateJPEGExif(f)
+	if err != nil || start < 0 {
+		return -1, nil, 1, err
+	}
+	tiff := io.NewSectionReader(f, start, 1<<62)
+	header := make([]byte, 8)
+	if _, err := tiff.ReadAt(header, 0); err != nil {
+		return -1, nil, 1, nil
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return -1, nil, 1, nil
+	}
+
+	// the entries of IFD0 follow its count
+	ifd := int64(order.Uint32(header[4:]))
+	countBuf := make([]byte, 2)
+	if _, err := tiff.ReadAt(countBuf, ifd); err != nil {
+		return -1, nil, 1, nil
+	}
+	entry := make([]byte, 12)
+	for i := 0; i < int(order.Uint16(countBuf)) && i < maxIFDEntries; i++ {
+		at := ifd + 2 + 12*int64(i)
+		if _, err := tiff.ReadAt(entry, at); err != nil {
+			break
+		}
+		// a SHORT, held in the entry itself
+		if order.Uint16(entry) == orientationTag && order.Uint16(entry[2:]) == 3 {
+			return start + at + 8, order, order.Uint16(entry[8:]), nil
+		}
+	}
+	return -1, nil, 1, nil
+}
+
+// The EXIF orientation of a JPEG, 1 (the right way up) if it has none
+func JPEGOrientation(path string) (uint16, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 1, err
+	}
+	defer f.Close()
+	_, _, orientation, err := readOrientation(f)
+	return orientation, err
+}
+
+// Make sure jpegtran can be run before anything is placed
+func CheckJpegtran() error {
+	if _, err := exec.LookPath(*Jpegtran); err != nil {
+		return fmt.Errorf("-auto-rotate needs jpegtran: %v", err)
+	}
+	return nil
+}
+
+// Turn a JPEG the way up its orientation says with jpegtran, which moves
+// the compressed blocks about rather than decoding and encoding them
+// again, and set its orientation to 1. -perfect makes jpegtran refuse an
+// image whose size isn't a whole number of blocks rather than leave its
+// edges as they were. The file keeps its modification time and is left as
+// it was on any error. Returns whether it was turned.
+func RotateJPEG(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	orientation, err := JPEGOrientation(path)
+	if err != nil {
+		return false, err
+	}
+	transform, ok := orientationTransforms[orientation]
+	if !ok {
+		return false, nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".jpegger-")
+	if err != nil {
+		return false, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	args := append([]string{"-copy", "all", "-perfect"}, transform...)
+	cmd := exec.Command(*Jpegtran, append(args, "-outfile", tmp.Name(), path)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return false, fmt.Errorf("%s: %v: %s", *Jpegtran, err, strings.TrimSpace(stderr.String()))
+	}
+
+	f, err := os.OpenFile(tmp.Name(), os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	at, order, _, err := readOrientation(f)
+	if err == nil && at >= 0 {
+		upright := make([]byte, 2)
+		order.PutUint16(upright, 1)
+		_, err = f.WriteAt(upright, at)
+	}
+	if err == nil {
+		err = f.Chmod(info.Mode().Perm())
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return err == nil, err
+}
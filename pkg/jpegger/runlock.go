@@ -0,0 +1,80 @@
+package jpegger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+var Wait = new(bool)
+
+// Keeps a second import or undo off a database while one is running. The
+// lock file beside the database names the process holding it. The lock is
+// the operating system's, so it goes with the process however it ends.
+type RunLock struct {
+	file *os.File
+}
+
+// Another run holds the lock
+type RunActive struct {
+	PID int
+}
+
+func (e *RunActive) Error() string {
+	if e.PID == 0 {
+		return "another jpegger run is active"
+	}
+	return fmt.Sprintf("another jpegger run (pid %d) is active", e.PID)
+}
+
+// Take the lock for a database, waiting for the run holding it to finish
+// if wait is set and failing with *RunActive otherwise
+func LockRun(database string, wait bool) (*RunLock, error) {
+	f, err := os.OpenFile(database+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f, false)
+	if err == errLockHeld {
+		active := &RunActive{lockHolder(f)}
+		if !wait {
+			f.Close()
+			return nil, active
+		}
+		fmt.Fprintf(os.Stderr, "waiting: %v\n", active)
+		err = lockFile(f, true)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &RunLock{f}, nil
+}
+
+// The process named in a lock file, or 0 if it can't be read
+func lockHolder(f *os.File) int {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(string(bytes.TrimSpace(data)))
+	return pid
+}
+
+// Let the next run have the database. The file stays as removing it would
+// let two runs lock different files.
+func (l *RunLock) Release() error {
+	l.file.Truncate(0)
+	return l.file.Close()
+}
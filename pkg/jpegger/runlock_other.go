@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package jpegger
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+var errLockHeld = errors.New("the lock is held")
+
+func lockFile(f *os.File, wait bool) error {
+	how := unix.LOCK_EX
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EWOULDBLOCK {
+			return errLockHeld
+		}
+		return err
+	}
+}
@@ -0,0 +1,29 @@
+//go:build windows
+// +build windows
+
+package jpegger
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+var errLockHeld = errors.New("the lock is held")
+
+// Windows locks keep other processes from reading what they cover, so the
+// lock is on a byte well past the process number
+const lockOffset = 1 << 30
+
+func lockFile(f *os.File, wait bool) error {
+	var flags uint32 = windows.LOCKFILE_EXCLUSIVE_LOCK
+	if !wait {
+		flags |= windows.LOCKFILE_FAIL_IMMEDIATELY
+	}
+	overlapped := &windows.Overlapped{Offset: lockOffset}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, overlapped)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return errLockHeld
+	}
+	return err
+}
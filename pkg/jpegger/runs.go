@@ -0,0 +1,82 @@
+package jpegger
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What we remember about an import run
+type RunInfo struct {
+	ID      uint64    `json:"-"`
+	Started time.Time `json:"started"`
+	Input   string    `json:"input"`
+	Output  string    `json:"output"`
+	// How the run placed files, as -mode names it. Empty for runs from
+	// before it was recorded
+	Mode string `json:"mode,omitempty"`
+}
+
+// Runs are keyed by their number so they sort in the order they happened
+func RunKey(run uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, run)
+	return key
+}
+
+// Record the start of an import run placing files by mode and return its
+// number. A run over several inputs lists them all.
+func StartRun(db Store, inputs []string, output string, mode TransferMode) (uint64, error) {
+	// undo may be run from somewhere else
+	var absInputs []string
+	for _, input := range inputs {
+		if abs, err := filepath.Abs(input); err == nil && !IsRemote(input) {
+			input = abs
+		}
+		absInputs = append(absInputs, input)
+	}
+	input := strings.Join(absInputs, ", ")
+	if abs, err := filepath.Abs(output); err == nil && !IsRemote(output) {
+		output = abs
+	}
+
+	var run uint64
+	err := db.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte(Runs))
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		run = id
+
+		info, err := json.Marshal(RunInfo{Started: time.Now(), Input: input, Output: output, Mode: transferModeVerbs[mode]})
+		if err != nil {
+			return err
+		}
+		return b.Put(RunKey(run), info)
+	})
+	return run, err
+}
+
+// Every run we know about, oldest first
+func ListRuns(tx Tx) ([]RunInfo, error) {
+	var runs []RunInfo
+	b := tx.Bucket([]byte(Runs))
+	if b == nil {
+		return nil, nil
+	}
+
+	err := b.ForEach(func(k, v []byte) error {
+		var info RunInfo
+		err := json.Unmarshal(v, &info)
+		if err != nil {
+			return err
+		}
+		info.ID = binary.BigEndian.Uint64(k)
+		runs = append(runs, info)
+		return nil
+	})
+	return runs, err
+}
@@ -0,0 +1,467 @@
+package jpegger
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sha256 of an empty body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// A minimal client for S3 and S3-compatible stores such as Backblaze B2 and
+// MinIO. Requests use path-style addressing, which they all accept.
+type S3Client struct {
+	Endpoint  *url.URL
+	Region    string
+	AccessKey string
+	SecretKey string
+	Token     string
+	HTTP      *http.Client
+}
+
+// An object in a listing
+type S3Object struct {
+	Key          string
+	LastModified time.Time
+	ETag         string
+	Size         int64
+}
+
+// Is the path an s3://bucket/prefix URL?
+func IsS3(path string) bool {
+	return strings.HasPrefix(path, "s3://")
+}
+
+// A path under an output directory or bucket, from a path relative to it
+// with slashes
+func OutputPath(output, rel string) string {
+	if IsRemote(output) {
+		return output + "/" + rel
+	}
+	return filepath.Join(output, filepath.FromSlash(rel))
+}
+
+// Split an s3://bucket/prefix URL
+func ParseS3URL(path string) (bucket, prefix string, err error) {
+	if !IsS3(path) {
+		return "", "", fmt.Errorf("%s is not an s3:// URL", path)
+	}
+	rest := strings.TrimPrefix(path, "s3://")
+	bucket = rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		bucket, prefix = rest[:i], rest[i+1:]
+	}
+	if bucket == "" {
+		return "", "", fmt.Errorf("%s names no bucket", path)
+	}
+	return bucket, prefix, nil
+}
+
+// Create a client from the usual AWS environment variables. The endpoint
+// defaults to AWS; for other stores the region is taken from endpoints
+// like s3.us-west-002.backblazeb2.com unless AWS_REGION is set.
+func NewS3Client(endpoint string) (*S3Client, error) {
+	c := &S3Client{
+		Region:    os.Getenv("AWS_REGION"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Token:     os.Getenv("AWS_SESSION_TOKEN"),
+		HTTP:      http.DefaultClient,
+	}
+	if c.Region == "" {
+		c.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to use s3://")
+	}
+
+	if endpoint == "" {
+		if c.Region == "" {
+			c.Region = "us-east-1"
+		}
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", c.Region)
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %v", err)
+	}
+	c.Endpoint = u
+
+	if c.Region == "" {
+		parts := strings.Split(u.Hostname(), ".")
+		if len(parts) > 2 && parts[0] == "s3" {
+			c.Region = parts[1]
+		} else {
+			c.Region = "us-east-1"
+		}
+	}
+	return c, nil
+}
+
+// Escape a string the way SigV4 wants: everything but unreserved
+// characters, and slashes too unless it's a path
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Build a signed request for an object, or the bucket when key is empty
+func (c *S3Client) newRequest(method, bucket, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	escapedPath := strings.TrimRight(c.Endpoint.EscapedPath(), "/") + "/" + s3Escape(bucket, false)
+	if key != "" {
+		escapedPath += "/" + s3Escape(key, true)
+	}
+
+	var queryParts []string
+	for name, values := range query {
+		for _, value := range values {
+			queryParts = append(queryParts, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(queryParts)
+	canonicalQuery := strings.Join(queryParts, "&")
+
+	u, err := url.Parse(fmt.Sprintf("%s://%s%s", c.Endpoint.Scheme, c.Endpoint.Host, escapedPath))
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = canonicalQuery
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if c.Token != "" {
+		req.Header.Set("x-amz-security-token", c.Token)
+	}
+
+	var names []string
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "host" || strings.HasPrefix(lower, "x-amz-") || lower == "content-md5" || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method, escapedPath, canonicalQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", day, c.Region)
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", amzDate, scope, hex.EncodeToString(requestHash[:]))
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.SecretKey), day)
+	signingKey = hmacSHA256(signingKey, c.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signedHeaders, signature))
+	return req, nil
+}
+
+// Send a request, turning error responses into errors
+func (c *S3Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, s3Err.Code, s3Err.Message)
+	}
+	return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+}
+
+// Call a function for every object under a prefix in key order, starting
+// after the key startAfter
+func (c *S3Client) List(bucket, prefix, startAfter string, callback func(S3Object) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		} else if startAfter != "" {
+			query.Set("start-after", startAfter)
+		}
+
+		req, err := c.newRequest("GET", bucket, "", query, nil, emptyPayloadHash)
+		if err != nil {
+			return err
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return err
+		}
+
+		var result struct {
+			Contents              []S3Object
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("while listing s3://%s/%s: %v", bucket, prefix, err)
+		}
+
+		for _, object := range result.Contents {
+			err = callback(object)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Stream an object's content
+func (c *S3Client) Get(bucket, key string) (io.ReadCloser, error) {
+	req, err := c.newRequest("GET", bucket, key, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Objects larger than this are uploaded in parts of this size
+const S3PartSize = 16 << 20
+
+// Is there an object at the key?
+func (c *S3Client) Exists(bucket, key string) (bool, error) {
+	req, err := c.newRequest("HEAD", bucket, key, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	}
+	return false, fmt.Errorf("HEAD %s: %s", req.URL.Path, resp.Status)
+}
+
+func (c *S3Client) Delete(bucket, key string) error {
+	req, err := c.newRequest("DELETE", bucket, key, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Send part of a file. The request is signed with the sha256 of the part,
+// which the store checks before accepting it.
+func (c *S3Client) sendPart(method, bucket, key string, query url.Values, part *io.SectionReader) (*http.Response, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, ReadThrottle.Reader(io.NewSectionReader(part, 0, part.Size())))
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader = part
+	if part.Size() == 0 {
+		body = http.NoBody
+	}
+	req, err := c.newRequest(method, bucket, key, query, body, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = part.Size()
+	return c.do(req)
+}
+
+// Upload a local file, in parts if it's large. Nothing is visible at the
+// key until the whole file has arrived intact.
+func (c *S3Client) Upload(bucket, key, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() <= S3PartSize {
+		resp, err := c.sendPart("PUT", bucket, key, nil, io.NewSectionReader(f, 0, info.Size()))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	uploadID, err := c.createMultipartUpload(bucket, key)
+	if err != nil {
+		return err
+	}
+	err = c.uploadParts(bucket, key, uploadID, f, info.Size())
+	if err != nil {
+		// don't leave the parts behind to be billed for
+		c.abortMultipartUpload(bucket, key, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (c *S3Client) createMultipartUpload(bucket, key string) (string, error) {
+	req, err := c.newRequest("POST", bucket, key, url.Values{"uploads": {""}}, nil, emptyPayloadHash)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("while starting upload of %s: %v", key, err)
+	}
+	return result.UploadId, nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (c *S3Client) uploadParts(bucket, key, uploadID string, f *os.File, size int64) error {
+	var complete struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}
+
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+S3PartSize, number+1 {
+		length := size - offset
+		if length > S3PartSize {
+			length = S3PartSize
+		}
+		query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {uploadID}}
+		resp, err := c.sendPart("PUT", bucket, key, query, io.NewSectionReader(f, offset, length))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletedPart{number, resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := c.sendPart("POST", bucket, key, url.Values{"uploadId": {uploadID}}, io.NewSectionReader(bytes.NewReader(body), 0, int64(len(body))))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// completing can fail after the response has started
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return fmt.Errorf("while completing upload of %s: %v", key, err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("while completing upload of %s: %s: %s", key, result.Code, result.Message)
+	}
+	return nil
+}
+
+func (c *S3Client) abortMultipartUpload(bucket, key, uploadID string) {
+	req, err := c.newRequest("DELETE", bucket, key, url.Values{"uploadId": {uploadID}}, nil, emptyPayloadHash)
+	if err != nil {
+		return
+	}
+	if resp, err := c.do(req); err == nil {
+		resp.Body.Close()
+	}
+}
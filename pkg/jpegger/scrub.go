@@ -0,0 +1,189 @@
+package jpegger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// When each placed file was last found intact by a scrub, by path
+	// relative to the output and the root it was found under separated by
+	// a NUL, as in Mirrored
+	Scrubbed = "Scrubbed"
+)
+
+var (
+	ScrubFraction = importFlags.Float64("scrub", 0, "with -watch, re-hash this fraction of the output and mirrors each night, least recently checked first, and log files that no longer hold what was placed. e.g. 0.05 checks everything every 20 nights")
+	ScrubAt       = importFlags.String("scrub-at", "03:00", "the local time of day -scrub starts")
+)
+
+// What a scrub found
+type ScrubResult struct {
+	Checked    int
+	Drifted    int
+	Missing    int
+	Unreadable int
+}
+
+// A file a scrub can check, and what it should hold
+type scrubTarget struct {
+	root, relPath string
+	key           []byte
+	algorithm     string
+	last          time.Time
+}
+
+// The next time of day at after now, in now's location
+func nextScrub(now time.Time, at time.Time) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Every placed file under output and the mirrors that are there, with
+// when a scrub last found it intact. Sidecars are left out as they change
+// with every edit.
+func scrubTargets(db Store, output string, mirrors []string) ([]scrubTarget, error) {
+	roots := map[string]bool{}
+	for _, root := range mirrors {
+		if info, err := os.Stat(root); err == nil && info.IsDir() {
+			roots[root] = true
+		}
+	}
+
+	var targets []scrubTarget
+	err := db.View(func(tx Tx) error {
+		last := func(rel, root string) time.Time {
+			t, _ := time.Parse(time.RFC3339, string(lookup(tx, Scrubbed, mirrorEntry(rel, root))))
+			return t
+		}
+
+		b := tx.Bucket([]byte(DestinationPath))
+		if b == nil {
+			return nil
+		}
+		err := b.ForEach(func(rel, placed []byte) error {
+			if IsXMPSidecar(string(rel)) {
+				return nil
+			}
+			targets = append(targets, scrubTarget{
+				root:      output,
+				relPath:   string(rel),
+				key:       PlacedKey(tx, string(rel), placed),
+				algorithm: KeyAlgorithm(tx, placed),
+				last:      last(string(rel), output),
+			})
+			return nil
+		})
+		if err != nil || len(roots) == 0 {
+			return err
+		}
+
+		mirrored := tx.Bucket([]byte(Mirrored))
+		if mirrored == nil {
+			return nil
+		}
+		return mirrored.ForEach(func(entry, key []byte) error {
+			parts := strings.SplitN(string(entry), "\x00", 2)
+			if len(parts) != 2 || !roots[parts[1]] || IsXMPSidecar(parts[0]) {
+				return nil
+			}
+			placed := lookup(tx, DestinationPath, []byte(parts[0]))
+			if placed == nil {
+				return nil
+			}
+			targets = append(targets, scrubTarget{
+				root:      parts[1],
+				relPath:   parts[0],
+				key:       append([]byte(nil), key...),
+				algorithm: KeyAlgorithm(tx, placed),
+				last:      last(parts[0], parts[1]),
+			})
+			return nil
+		})
+	})
+	return targets, err
+}
+
+// Re-hash a fraction of the files placed under output and copied to the
+// mirrors, those least recently checked first, and report any that no
+// longer hold what was placed. Files found intact are remembered so the
+// next scrub moves on to others. Stops early when ctx is done.
+func Scrub(ctx context.Context, db Store, output string, mirrors []string, fraction float64) (ScrubResult, error) {
+	var result ScrubResult
+	output, err := filepath.Abs(output)
+	if err != nil {
+		return result, err
+	}
+	targets, err := scrubTargets(db, output, mirrors)
+	if err != nil {
+		return result, err
+	}
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].last.Before(targets[j].last) })
+	n := int(math.Ceil(fraction * float64(len(targets))))
+	if n > len(targets) {
+		n = len(targets)
+	}
+
+	for _, target := range targets[:n] {
+		if ctx.Err() != nil {
+			break
+		}
+		path := OutputPath(target.root, target.relPath)
+		found, err := HashFile(path, target.algorithm)
+		result.Checked += 1
+		switch {
+		case os.IsNotExist(err):
+			result.Missing += 1
+			Emit(Event{Event: "scrub-missing", Destination: path})
+			continue
+		case err != nil:
+			result.Unreadable += 1
+			Emit(Event{Event: "scrub-unreadable", Destination: path, Message: err.Error()})
+			continue
+		case !bytes.Equal(found, target.key):
+			result.Drifted += 1
+			Emit(Event{Event: "scrub-drift", Destination: path, Message: fmt.Sprintf("expected %x, found %x", target.key, found)})
+			continue
+		}
+
+		err = db.Update(func(tx Tx) error {
+			now := []byte(time.Now().Format(time.RFC3339))
+			return tx.Bucket([]byte(Scrubbed)).Put(mirrorEntry(target.relPath, target.root), now)
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// Scrub every night at the time of day at until ctx is done
+func ScheduleScrubs(ctx context.Context, db Store, output string, mirrors []string, fraction float64, at time.Time) {
+	for {
+		timer := time.NewTimer(time.Until(nextScrub(time.Now(), at)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		result, err := Scrub(ctx, db, output, mirrors, fraction)
+		if err != nil {
+			Emit(Event{Event: "scrub-failed", Destination: output, Message: err.Error()})
+			continue
+		}
+		Emit(Event{Event: "scrub-finished", Destination: output, Message: fmt.Sprintf("checked %d files: %d changed, %d missing, %d unreadable",
+			result.Checked, result.Drifted, result.Missing, result.Unreadable)})
+	}
+}
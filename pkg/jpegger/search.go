@@ -0,0 +1,272 @@
+package jpegger
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// What each piece of content was taken with and where, as JSON, for
+	// search
+	Shots = "Shots"
+)
+
+var (
+	SearchCommand = &Command{
+		Name:    "search",
+		Summary: "list the placed files matching a date range, camera, keywords, tags, a GPS box or a name",
+		Flags:   searchFlags,
+		Run:     RunSearch,
+	}
+
+	searchFlags = NewFlagSet("search", "")
+
+	searchQuery  = NewQueryFlags(searchFlags)
+	searchOutput = searchFlags.String("output", "", "print paths under this output directory rather than relative to it")
+)
+
+// The flags a command picks placed files by
+type QueryFlags struct {
+	fs       *flag.FlagSet
+	since    *string
+	until    *string
+	camera   *string
+	caption  *string
+	rating   *int
+	within   *string
+	name     *string
+	keywords StringList
+	tags     StringList
+}
+
+func NewQueryFlags(fs *flag.FlagSet) *QueryFlags {
+	q := &QueryFlags{
+		fs:      fs,
+		since:   fs.String("since", "", "only files taken on or after this day, month or year (e.g. 2015 or 2015-06-30)"),
+		until:   fs.String("until", "", "only files taken up to the end of this day, month or year"),
+		camera:  fs.String("camera", "", "only files from a camera whose name contains this, ignoring case"),
+		caption: fs.String("caption", "", "only files whose caption contains this, ignoring case"),
+		rating:  fs.Int("rating", 0, "only files rated at least this many stars"),
+		within:  fs.String("within", "", "only files taken inside this GPS box, given as two corners: lat,lon,lat,lon"),
+		name:    fs.String("name", "", "only files whose name contains this, ignoring case"),
+	}
+	fs.Var(&q.keywords, "keyword", "only files with this keyword, ignoring case. repeatable, and every one must match")
+	fs.Var(&q.tags, "tag", "only files given this tag with jpegger tag, ignoring case. repeatable, and every one must match")
+	return q
+}
+
+// The query the flags were given, or a usage error if they don't make
+// sense
+func (f *QueryFlags) Query() (SearchQuery, error) {
+	dates, err := ParseDateRange(*f.since, *f.until)
+	if err != nil {
+		return SearchQuery{}, UsageError(f.fs, "%v", err)
+	}
+	q := SearchQuery{
+		Dates:    dates,
+		Camera:   *f.camera,
+		Keywords: f.keywords,
+		Caption:  *f.caption,
+		Rating:   *f.rating,
+		Name:     *f.name,
+		Tags:     f.tags,
+	}
+	if *f.within != "" {
+		box, err := ParseGeoBox(*f.within)
+		if err != nil {
+			return SearchQuery{}, UsageError(f.fs, "-within: %v", err)
+		}
+		q.Within = &box
+	}
+	return q, nil
+}
+
+// What a piece of content was taken with and where
+type ShotInfo struct {
+	Camera string `json:"camera,omitempty"`
+	// Latitude and longitude, from its GPS tags
+	Position []float64 `json:"position,omitempty"`
+}
+
+func (c ShotInfo) IsEmpty() bool {
+	return c.Camera == "" && len(c.Position) == 0
+}
+
+// What a file was taken with and where
+func StampShotInfo(stamp FileStamp) ShotInfo {
+	return ShotInfo{Camera: CameraName(stamp.Make, stamp.Camera), Position: stamp.Position}
+}
+
+func RecordShotInfo(db Store, key []byte, c ShotInfo) error {
+	value, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte(Shots)).Put(key, value)
+	})
+}
+
+// What a piece of content was recorded as taken with and where, if
+// anything
+func ContentShotInfo(tx Tx, key []byte) (ShotInfo, bool) {
+	var c ShotInfo
+	value := lookup(tx, Shots, key)
+	if value == nil || json.Unmarshal(value, &c) != nil {
+		return c, false
+	}
+	return c, true
+}
+
+// A box on the map between two corners, which may be given either way
+// round
+type GeoBox struct {
+	South, West, North, East float64
+}
+
+func ParseGeoBox(value string) (GeoBox, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return GeoBox{}, fmt.Errorf("expected lat,lon,lat,lon, got %q", value)
+	}
+	var n [4]float64
+	for i, part := range parts {
+		var err error
+		if n[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64); err != nil {
+			return GeoBox{}, fmt.Errorf("expected lat,lon,lat,lon, got %q", value)
+		}
+	}
+	box := GeoBox{n[0], n[1], n[2], n[3]}
+	if box.South > box.North {
+		box.South, box.North = box.North, box.South
+	}
+	if box.West > box.East {
+		box.West, box.East = box.East, box.West
+	}
+	return box, nil
+}
+
+func (b GeoBox) Contains(position []float64) bool {
+	if len(position) != 2 {
+		return false
+	}
+	lat, lon := position[0], position[1]
+	return lat >= b.South && lat <= b.North && lon >= b.West && lon <= b.East
+}
+
+// What a search looks for. Empty fields match everything.
+type SearchQuery struct {
+	Dates    DateRange
+	Camera   string
+	Keywords []string
+	Caption  string
+	Rating   int
+	Within   *GeoBox
+	Name     string
+	Tags     []string
+}
+
+// Does the content placed at rel match? Content imported before its
+// camera and position were recorded matches no query asking for them.
+func (q SearchQuery) Matches(tx Tx, key []byte, rel string) bool {
+	if q.Name != "" && !strings.Contains(strings.ToLower(path.Base(rel)), strings.ToLower(q.Name)) {
+		return false
+	}
+	if len(q.Tags) > 0 {
+		tags := ContentTags(tx, key)
+		for _, tag := range q.Tags {
+			if !hasTag(tags, tag) {
+				return false
+			}
+		}
+	}
+	if !q.Dates.Since.IsZero() || !q.Dates.Until.IsZero() {
+		taken, ok := ContentDate(tx, key)
+		if !ok || !q.Dates.Contains(taken) {
+			return false
+		}
+	}
+	if q.Camera != "" || q.Within != nil {
+		c, _ := ContentShotInfo(tx, key)
+		if q.Camera != "" && !strings.Contains(strings.ToLower(c.Camera), strings.ToLower(q.Camera)) {
+			return false
+		}
+		if q.Within != nil && !q.Within.Contains(c.Position) {
+			return false
+		}
+	}
+	if len(q.Keywords) > 0 || q.Caption != "" || q.Rating > 0 {
+		d, _ := ContentDescription(tx, key)
+		if d.Rating < q.Rating {
+			return false
+		}
+		if q.Caption != "" && !strings.Contains(strings.ToLower(d.Caption), strings.ToLower(q.Caption)) {
+			return false
+		}
+		for _, keyword := range q.Keywords {
+			if !d.HasKeyword(keyword) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// The paths, relative to the output, of the placed files matching a query,
+// leaving out sidecars and companions
+func Search(tx Tx, q SearchQuery) []string {
+	var found []string
+	b := tx.Bucket([]byte(ContentDestination))
+	if b == nil {
+		return nil
+	}
+	b.ForEach(func(key, rel []byte) error {
+		if IsXMPSidecar(string(rel)) || lookup(tx, Companions, rel) != nil {
+			return nil
+		}
+		if q.Matches(tx, key, string(rel)) {
+			found = append(found, string(rel))
+		}
+		return nil
+	})
+	sort.Strings(found)
+	return found
+}
+
+func RunSearch(args []string) error {
+	if len(args) != 0 {
+		return UsageError(searchFlags, "unexpected arguments")
+	}
+	q, err := searchQuery.Query()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(*Database); err != nil {
+		return err
+	}
+	db, err := OpenReadOnlyDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var found []string
+	db.View(func(tx Tx) error {
+		found = Search(tx, q)
+		return nil
+	})
+	for _, rel := range found {
+		if *searchOutput != "" {
+			rel = OutputPath(*searchOutput, rel)
+		}
+		fmt.Println(rel)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package jpegger
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	ServeCommand = &Command{
+		Name:    "serve",
+		Summary: "show recent imports and what's pending or failed on a web page, with a JSON API",
+		Flags:   serveFlags,
+		Run:     RunServe,
+	}
+
+	serveFlags = NewFlagSet("serve", "")
+
+	ServeAddr = serveFlags.String("addr", "localhost:8080", "address to serve the page on. :8080 lets the rest of the network see it")
+
+	ImportServe = importFlags.String("serve", "", "also serve the page and JSON API of jpegger serve on this address (e.g. localhost:8080) for as long as the import runs, from the database it is importing into. with -watch, that's always")
+)
+
+const (
+	// How many runs the page lists
+	recentRuns = 10
+	// How many failed and unreadable files it lists
+	problemsListed = 50
+)
+
+// An import run and how many files it placed
+type RunSummary struct {
+	RunInfo
+	Files int
+}
+
+// How many files were placed by the runs of a month
+type MonthCount struct {
+	Month time.Time
+	Files int
+}
+
+// A file that couldn't be imported and why
+type Problem struct {
+	Path   string
+	Reason string
+}
+
+// Everything the page shows
+type Overview struct {
+	Runs   []RunSummary
+	Months []MonthCount
+	Copied int
+	// Content claimed by an import that hasn't finished placing it
+	Pending     int
+	Duplicates  int
+	Repeated    int
+	Failed      []Problem
+	FailedN     int
+	Unreadable  []Problem
+	UnreadableN int
+}
+
+// Gather the overview from the database. Runs and months are newest first.
+func LoadOverview(tx Tx) (*Overview, error) {
+	o := &Overview{}
+
+	runs, err := ListRuns(tx)
+	if err != nil {
+		return nil, err
+	}
+	months := map[time.Time]int{}
+	runFiles := tx.Bucket([]byte(RunFiles))
+	for i := len(runs) - 1; i >= 0; i-- {
+		files := 0
+		if runFiles != nil {
+			if b := runFiles.Bucket(RunKey(runs[i].ID)); b != nil {
+				files = b.KeyN()
+			}
+		}
+		started := runs[i].Started.Local()
+		months[time.Date(started.Year(), started.Month(), 1, 0, 0, 0, 0, time.Local)] += files
+		if len(o.Runs) < recentRuns {
+			o.Runs = append(o.Runs, RunSummary{RunInfo: runs[i], Files: files})
+		}
+	}
+	for month, files := range months {
+		o.Months = append(o.Months, MonthCount{Month: month, Files: files})
+	}
+	sort.Slice(o.Months, func(i, j int) bool {
+		return o.Months[i].Month.After(o.Months[j].Month)
+	})
+
+	if b := tx.Bucket([]byte(ContentHash)); b != nil {
+		b.ForEach(func(k, v []byte) error {
+			switch StateName(v) {
+			case "copied", "verified":
+				o.Copied += 1
+			case "discovered":
+				o.Pending += 1
+			case "duplicate":
+				o.Duplicates += 1
+			}
+			return nil
+		})
+	}
+	o.Repeated = len(FindDuplicates(tx))
+
+	o.Failed, o.FailedN = listProblems(tx, FileErrors)
+	o.Unreadable, o.UnreadableN = listProblems(tx, Quarantined)
+	return o, nil
+}
+
+// The first of the paths in a bucket of path to reason, and how many
+// there are
+func listProblems(tx Tx, bucket string) ([]Problem, int) {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil, 0
+	}
+	var problems []Problem
+	b.ForEach(func(k, v []byte) error {
+		if len(problems) < problemsListed {
+			problems = append(problems, Problem{Path: string(k), Reason: string(v)})
+		}
+		return nil
+	})
+	return problems, b.KeyN()
+}
+
+// The files a run placed, relative to its output
+func RunDestinations(tx Tx, run uint64) []string {
+	var paths []string
+	if runFiles := tx.Bucket([]byte(RunFiles)); runFiles != nil {
+		if b := runFiles.Bucket(RunKey(run)); b != nil {
+			b.ForEach(func(k, _ []byte) error {
+				paths = append(paths, string(k))
+				return nil
+			})
+		}
+	}
+	return paths
+}
+
+var servePage = template.Must(template.New("page").Funcs(template.FuncMap{
+	"date":  func(t time.Time) string { return t.Local().Format("Mon 2 Jan 2006 15:04") },
+	"month": func(t time.Time) string { return t.Format("January 2006") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>jpegger</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 1em auto; padding: 0 1em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: .2em .6em .2em 0; border-bottom: 1px solid #ddd; vertical-align: top; }
+td.n { text-align: right; }
+.bad { color: #a00; }
+small { color: #666; }
+</style>
+</head>
+<body>
+{{define "problems"}}<table>{{range .}}<tr><td>{{.Path}}</td><td><small>{{.Reason}}</small></td></tr>{{end}}</table>{{end}}
+{{if .Error}}
+<h1>jpegger</h1>
+<p class="bad">{{.Error}}</p>
+{{else if .Run}}
+<h1>Run {{.Run.ID}}</h1>
+<p>{{date .Run.Started}}, {{.Run.Input}} &rarr; {{.Run.Output}}</p>
+<p><a href="/">back</a></p>
+<table>{{range .Files}}<tr><td>{{.}}</td></tr>{{else}}<tr><td>no files were placed</td></tr>{{end}}</table>
+{{else}}{{with .Overview}}
+<h1>jpegger</h1>
+<p>{{.Copied}} photos and videos in the archive{{if .Pending}}, <span class="bad">{{.Pending}} still being imported</span>{{end}}.</p>
+
+<h2>Recent imports</h2>
+<table>
+<tr><th>When</th><th>From</th><th>Files</th></tr>
+{{range .Runs}}<tr><td><a href="/run?id={{.ID}}">{{date .Started}}</a></td><td>{{.Input}}</td><td class="n">{{.Files}}</td></tr>
+{{else}}<tr><td colspan="3">nothing has been imported yet</td></tr>{{end}}
+</table>
+
+<h2>Imported by month</h2>
+<table>
+{{range .Months}}<tr><td>{{month .Month}}</td><td class="n">{{.Files}}</td></tr>{{end}}
+</table>
+
+<h2>Duplicates</h2>
+<p>{{.Repeated}} photos or videos were found in more than one place and imported once.
+{{if .Duplicates}}{{.Duplicates}} lesser copies of a shot were passed over for a better one.{{end}}</p>
+
+{{if .FailedN}}<h2 class="bad">Failed ({{.FailedN}})</h2>
+{{template "problems" .Failed}}{{end}}
+{{if .UnreadableN}}<h2 class="bad">Unreadable ({{.UnreadableN}})</h2>
+{{template "problems" .Unreadable}}{{end}}
+{{end}}{{end}}
+</body>
+</html>
+`))
+
+type servePageData struct {
+	Status   int
+	Error    string
+	Overview *Overview
+	Run      *RunInfo
+	Files    []string
+}
+
+// Answers for the page and the JSON API from a database that stays open,
+// whether serve's own or the one an import is writing to
+type statusServer struct {
+	db Store
+}
+
+// The page and JSON API of jpegger serve, answered from db. An import can
+// go on writing to it, and each answer is a fresh look.
+func NewStatusHandler(db Store) http.Handler {
+	s := &statusServer{db: db}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveOverview)
+	mux.HandleFunc("/run", s.serveRun)
+	mux.HandleFunc("/files", s.serveFiles)
+	mux.HandleFunc("/hash/", s.serveHash)
+	mux.HandleFunc("/stats", s.serveStats)
+	return mux
+}
+
+// Serve the page and JSON API on addr until the import is over. A bad
+// address fails at once.
+func ServeImport(addr string, db Store) (stop func(), err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: NewStatusHandler(db)}
+	go server.Serve(listener)
+	Emit(Event{Event: "serving", Destination: "http://" + listener.Addr().String() + "/"})
+	return func() { server.Close() }, nil
+}
+
+// Render the page from a fresh look at the database
+func (s *statusServer) servePageFor(w http.ResponseWriter, view func(tx Tx, page *servePageData) error) {
+	var page servePageData
+	err := s.db.View(func(tx Tx) error {
+		return view(tx, &page)
+	})
+	if err != nil {
+		page = servePageData{Status: http.StatusInternalServerError, Error: err.Error()}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if page.Status != 0 {
+		w.WriteHeader(page.Status)
+	}
+	if err := servePage.Execute(w, page); err != nil {
+		log.Printf("while rendering the status page: %v", err)
+	}
+}
+
+func (s *statusServer) serveOverview(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	s.servePageFor(w, func(tx Tx, page *servePageData) error {
+		var err error
+		page.Overview, err = LoadOverview(tx)
+		return err
+	})
+}
+
+func (s *statusServer) serveRun(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "expected a run number", http.StatusBadRequest)
+		return
+	}
+	s.servePageFor(w, func(tx Tx, page *servePageData) error {
+		runs, err := ListRuns(tx)
+		if err != nil {
+			return err
+		}
+		for _, run := range runs {
+			if run.ID == id {
+				run := run
+				page.Run = &run
+			}
+		}
+		if page.Run == nil {
+			page.Status, page.Error = http.StatusNotFound, fmt.Sprintf("there is no run %d", id)
+			return nil
+		}
+		page.Files = RunDestinations(tx, id)
+		sort.Strings(page.Files)
+		return nil
+	})
+}
+
+func RunServe(args []string) error {
+	if len(args) != 0 {
+		return UsageError(serveFlags, "unexpected arguments")
+	}
+	if _, err := os.Stat(*Database); err != nil {
+		return err
+	}
+
+	// held open while serving, so an import waits for serve to stop. one
+	// that serves the page itself with -serve can run instead
+	db, err := OpenReadOnlyDB()
+	if err != nil {
+		return fmt.Errorf("%v. an import serves the page itself with -serve", err)
+	}
+	defer db.Close()
+
+	fmt.Fprintf(os.Stderr, "serving %s on http://%s/\n", *Database, *ServeAddr)
+	return http.ListenAndServe(*ServeAddr, NewStatusHandler(db))
+}
@@ -0,0 +1,69 @@
+package jpegger
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The page follows an import writing to the database it's served from
+func TestStatusHandlerDuringImport(t *testing.T) {
+	db, err := OpenBoltStore(filepath.Join(t.TempDir(), "state.db"), StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = CreateBuckets(db); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewStatusHandler(db))
+	defer server.Close()
+
+	get := func(path string) string {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s\n%s", path, resp.Status, body)
+		}
+		return string(body)
+	}
+
+	if page := get("/"); !strings.Contains(page, "nothing has been imported yet") {
+		t.Errorf("before the import:\n%s", page)
+	}
+
+	run, err := StartRun(db, []string{"input_dir"}, "output_dir", TransferCopy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("0123456789abcdef")
+	if err = RecordDestination(db, run, "2019/04/IMG_1.jpg", key, DefaultHash, time.Date(2019, 4, 5, 10, 11, 12, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	if page := get("/"); !strings.Contains(page, `href="/run?id=1"`) {
+		t.Errorf("the run isn't listed:\n%s", page)
+	}
+	if page := get("/run?id=1"); !strings.Contains(page, "2019/04/IMG_1.jpg") {
+		t.Errorf("the run's file isn't listed:\n%s", page)
+	}
+	var stats CatalogStats
+	if err = json.Unmarshal([]byte(get("/stats")), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Runs != 1 || stats.Destinations != 1 {
+		t.Errorf("stats %+v, want 1 run and 1 destination", stats)
+	}
+}
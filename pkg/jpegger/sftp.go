@@ -0,0 +1,316 @@
+package jpegger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var SSHCommand = importFlags.String("ssh", "ssh", "the ssh command sftp:// inputs are read with. keys, jump hosts and the like come from ~/.ssh/config")
+
+const (
+	// Lists every file under the current directory with its size and
+	// modification time, with GNU, busybox or toybox stat or BSD stat
+	sshListScript = `if stat -c %s . >/dev/null 2>&1; then find . -type f -exec stat -c '%s %Y %n' {} +; else find . -type f -exec stat -f '%z %m %N' {} +; fi`
+	// Prints the sha256 of the file named by $1
+	sshHashScript = `if command -v sha256sum >/dev/null 2>&1; then sha256sum -- "$1"; else shasum -a 256 -- "$1"; fi`
+)
+
+// Is the path an sftp://user@host/dir URL?
+func IsSFTP(path string) bool {
+	return strings.HasPrefix(path, "sftp://")
+}
+
+// Split an sftp://user@host:port/dir URL into the ssh destination, port
+// and directory. The directory is absolute, except that /~/ starts it in
+// the home directory, as does leaving it out.
+func ParseSFTPURL(name string) (target, port, dir string, err error) {
+	if !IsSFTP(name) {
+		return "", "", "", fmt.Errorf("%s is not an sftp:// URL", name)
+	}
+	rest := strings.TrimPrefix(name, "sftp://")
+	target, dir = rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		target, dir = rest[:i], rest[i+1:]
+	}
+	// a port, unless the colon is in an IPv6 address
+	if i := strings.LastIndex(target, ":"); i >= 0 && !strings.HasSuffix(target, "]") {
+		target, port = target[:i], target[i+1:]
+	}
+	target = strings.NewReplacer("[", "", "]", "").Replace(target)
+	if target == "" || strings.HasSuffix(target, "@") {
+		return "", "", "", fmt.Errorf("%s names no host", name)
+	}
+
+	// commands run in the home directory, so it needs no name of its own
+	switch {
+	case dir == "" || dir == "~":
+		dir = "."
+	case strings.HasPrefix(dir, "~/"):
+		dir = path.Clean(dir[2:])
+	default:
+		dir = path.Clean("/" + dir)
+	}
+	return target, port, dir, nil
+}
+
+// Quote a string for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// A file on the remote host, relative to the source's directory
+type sshFile struct {
+	RelPath string
+	Size    int64
+	ModTime time.Time
+}
+
+// Read the output of sshListScript
+func parseSSHList(r io.Reader) ([]sshFile, error) {
+	var files []sshFile
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], "./") {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, sshFile{strings.TrimPrefix(fields[2], "./"), size, time.Unix(secs, 0)})
+	}
+	return files, scanner.Err()
+}
+
+// The listing's view of a remote file
+type sshFileInfo struct {
+	file sshFile
+}
+
+func (i sshFileInfo) Name() string       { return path.Base(i.file.RelPath) }
+func (i sshFileInfo) Size() int64        { return i.file.Size }
+func (i sshFileInfo) Mode() os.FileMode  { return 0444 }
+func (i sshFileInfo) ModTime() time.Time { return i.file.ModTime }
+func (i sshFileInfo) IsDir() bool        { return false }
+func (i sshFileInfo) Sys() interface{}   { return nil }
+
+// The files under a directory on another machine, read over ssh. Only a
+// POSIX shell, find and stat are needed there. Like an S3 source, each file
+// is fetched once to a hidden file in the staging directory; where
+// sha256sum or shasum is there too, files are hashed where they are first
+// so that content already imported isn't fetched at all. One connection is
+// shared by every command where ssh can.
+type SFTPSource struct {
+	root    string
+	target  string
+	port    string
+	dir     string
+	staging string
+	control string
+
+	list    sync.Once
+	files   []sshFile
+	listErr error
+
+	mu      sync.Mutex
+	fetched map[string]bool
+}
+
+func NewSFTPSource(input, staging string) (*SFTPSource, error) {
+	target, port, dir, err := ParseSFTPURL(input)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath(*SSHCommand); err != nil {
+		return nil, fmt.Errorf("sftp:// inputs need ssh: %v", err)
+	}
+	s := &SFTPSource{
+		root:    strings.TrimSuffix(input, "/"),
+		target:  target,
+		port:    port,
+		dir:     dir,
+		staging: staging,
+		fetched: map[string]bool{},
+	}
+	// the Windows ssh can't share a connection
+	if runtime.GOOS != "windows" {
+		s.control, err = os.MkdirTemp("", "jpegger-ssh-")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// The ssh command running a shell script on the remote host, in the
+// source's directory
+func (s *SFTPSource) command(script string, args ...string) *exec.Cmd {
+	var sshArgs []string
+	if s.port != "" {
+		sshArgs = append(sshArgs, "-p", s.port)
+	}
+	if s.control != "" {
+		sshArgs = append(sshArgs, "-o", "ControlMaster=auto", "-o", "ControlPath="+path.Join(s.control, "%C"), "-o", "ControlPersist=60")
+	}
+	remote := "cd -- " + shellQuote(s.dir) + " && " + script
+	line := []string{"sh", "-c", shellQuote(remote), "sh"}
+	for _, arg := range args {
+		line = append(line, shellQuote(arg))
+	}
+	sshArgs = append(sshArgs, s.target, strings.Join(line, " "))
+	return exec.Command(*SSHCommand, sshArgs...)
+}
+
+// Run a script on the remote host, returning what it prints
+func (s *SFTPSource) run(script string, args ...string) ([]byte, error) {
+	cmd := s.command(script, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ssh %s: %v: %s", s.target, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// List the remote directory once, however many times it is walked
+func (s *SFTPSource) listing() ([]sshFile, error) {
+	s.list.Do(func() {
+		var out []byte
+		out, s.listErr = s.run(sshListScript)
+		if s.listErr != nil {
+			return
+		}
+		s.files, s.listErr = parseSSHList(bytes.NewReader(out))
+		sort.Slice(s.files, func(i, j int) bool { return s.files[i].RelPath < s.files[j].RelPath })
+	})
+	return s.files, s.listErr
+}
+
+func (s *SFTPSource) Walk(after string, callback func(os.FileInfo, string) error) error {
+	files, err := s.listing()
+	if err != nil {
+		return err
+	}
+	ignores := DefaultIgnorer()
+	for _, file := range files {
+		if after != "" && file.RelPath <= after {
+			continue
+		}
+		if ignores.Ignored(file.RelPath, false) {
+			continue
+		}
+		if err := callback(sshFileInfo{file}, s.root+"/"+file.RelPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The path of a file relative to the source's directory
+func (s *SFTPSource) relPath(name string) (string, error) {
+	if !strings.HasPrefix(name, s.root+"/") {
+		return "", fmt.Errorf("%s isn't under %s", name, s.root)
+	}
+	return strings.TrimPrefix(name, s.root+"/"), nil
+}
+
+// Hash a file where it is. Only sha256 can be counted on to be there.
+func (s *SFTPSource) RemoteHash(name, algorithm string) ([]byte, error) {
+	if algorithm != "sha256" {
+		return nil, fmt.Errorf("can't hash with %s over ssh", algorithm)
+	}
+	rel, err := s.relPath(name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.run(sshHashScript, rel)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no hash of %s", name)
+	}
+	key, err := hex.DecodeString(strings.TrimPrefix(fields[0], "\\"))
+	if err != nil || len(key) != sha256Size {
+		return nil, fmt.Errorf("unexpected hash of %s: %q", name, fields[0])
+	}
+	return key, nil
+}
+
+func (s *SFTPSource) Fetch(name string) (string, error) {
+	rel, err := s.relPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	// keep the extension, some EXIF readers go by it
+	f, err := os.CreateTemp(s.staging, ".jpegger-fetch-*"+path.Ext(rel))
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.fetched[f.Name()] = true
+	s.mu.Unlock()
+
+	cmd := s.command(`cat -- "$1"`, rel)
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = f, &stderr
+	err = cmd.Run()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.Release(f.Name())
+		return "", fmt.Errorf("while downloading %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return f.Name(), nil
+}
+
+func (s *SFTPSource) Release(local string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetched[local] {
+		os.Remove(local)
+		delete(s.fetched, local)
+	}
+}
+
+// Remove anything fetched but never placed, and close the shared
+// connection
+func (s *SFTPSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for local := range s.fetched {
+		os.Remove(local)
+	}
+	s.fetched = map[string]bool{}
+
+	if s.control != "" {
+		args := []string{"-O", "exit", "-o", "ControlPath=" + path.Join(s.control, "%C")}
+		if s.port != "" {
+			args = append(args, "-p", s.port)
+		}
+		exec.Command(*SSHCommand, append(args, s.target)...).Run()
+		os.RemoveAll(s.control)
+	}
+	return nil
+}
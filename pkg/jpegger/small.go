@@ -0,0 +1,52 @@
+package jpegger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+var MinSize = importFlags.Int64("min-size", 0, "also skip files smaller than this many bytes, like thumbnails left behind by a phone sync. they are listed at the end of the run. empty files are always skipped")
+
+// The key of empty content, which takes no reading to work out
+func EmptyKey(algorithm string) []byte {
+	return HashAlgorithms[algorithm]().Sum(nil)
+}
+
+// Record an empty file found at path, so later runs pass over it quietly.
+// false if it was found there before.
+func RecordEmpty(db Store, path, algorithm string, seen SourceStat) (bool, error) {
+	key := EmptyKey(algorithm)
+	fresh := false
+	err := db.Update(func(tx Tx) error {
+		if cached, _ := cachedSourceKey(tx, path, seen); bytes.Equal(cached, key) {
+			return nil
+		}
+		fresh = true
+		if err := putSourceKey(tx, path, key, seen); err != nil {
+			return err
+		}
+		if err := RecordKeyAlgorithm(tx, key, algorithm); err != nil {
+			return err
+		}
+		// an empty file an earlier version imported keeps its state
+		hashes := tx.Bucket([]byte(ContentHash))
+		if hashes.Get(key) != nil {
+			return nil
+		}
+		return hashes.Put(key, EmptyFile)
+	})
+	return fresh, err
+}
+
+// List the empty and too small files a run skipped
+func SummarizeSmall(out io.Writer, small []string) {
+	fmt.Fprintf(out, "%d empty or too small files were skipped:\n", len(small))
+	for i, path := range small {
+		if i == failuresListed {
+			fmt.Fprintf(out, "  ... and %d more\n", len(small)-i)
+			break
+		}
+		fmt.Fprintf(out, "  %s\n", path)
+	}
+}
@@ -0,0 +1,251 @@
+package jpegger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the files to import come from. Files are named by path for a
+// directory, by s3:// URL for a bucket, by mtp:// URL for a camera, by
+// sftp:// URL for another machine and by the archive's path and theirs in
+// it for a zip archive.
+type Source interface {
+	// Call a function for every file in a stable order, skipping
+	// everything up to and including after, a name relative to the root
+	Walk(after string, callback func(os.FileInfo, string) error) error
+
+	// Make a file's content available on the local filesystem
+	Fetch(name string) (string, error)
+
+	// Let go of a fetched copy once it has been placed
+	Release(local string)
+
+	Close() error
+}
+
+// A source that can hash its files where they are, so content imported
+// before is recognized without fetching it
+type RemoteHasher interface {
+	RemoteHash(name, algorithm string) ([]byte, error)
+}
+
+// Open the source for an input argument. Remote files are fetched into
+// staging, which should be on the output filesystem so they can be linked.
+func OpenSource(input, staging string) (Source, error) {
+	if IsMTP(input) {
+		return NewMTPSource(input, staging)
+	}
+	if IsSFTP(input) {
+		return NewSFTPSource(input, staging)
+	}
+	if IsWebDAV(input) {
+		return NewWebDAVSource(input, staging)
+	}
+	if IsZip(input) {
+		return OpenZipSource(input, staging)
+	}
+	if !IsS3(input) {
+		return DirSource{Root: input}, nil
+	}
+
+	bucket, prefix, err := ParseS3URL(input)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewS3Client(*S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Source{
+		client:  client,
+		bucket:  bucket,
+		prefix:  prefix,
+		staging: staging,
+		fetched: map[string]bool{},
+	}, nil
+}
+
+// How a walk of an input directory treats what it finds
+type WalkOptions struct {
+	// Import what symlinks point to, directories included, rather than
+	// skipping them
+	FollowSymlinks bool
+	// Stay out of directories on another filesystem than the input's
+	OneFileSystem bool
+	// The name of the files whose patterns leave things out of the input.
+	// Empty reads none, leaving out only DefaultIgnores.
+	IgnoreFile string
+}
+
+// Files in a local directory tree
+type DirSource struct {
+	Root string
+	WalkOptions
+	// Passes over directories unchanged since a run finished them, if set
+	Fingerprints *Fingerprinter
+	// How many directories deep files are looked for. 0 has no limit
+	MaxDepth int
+}
+
+func (s DirSource) Walk(after string, callback func(os.FileInfo, string) error) error {
+	walk, err := newInputWalk(s.Root, s.WalkOptions)
+	if err != nil {
+		return err
+	}
+	walk.fingerprints, walk.maxDepth = s.Fingerprints, s.MaxDepth
+	return walk.walkAfter(s.Root, after, callback)
+}
+
+func (s DirSource) Fetch(name string) (string, error) {
+	return name, nil
+}
+
+func (s DirSource) Release(local string) {}
+
+func (s DirSource) Close() error {
+	return nil
+}
+
+// Objects in an S3-compatible bucket. Each object is downloaded once, to a
+// hidden file in the staging directory, and read from there for EXIF
+// parsing, hashing and placing.
+type S3Source struct {
+	client  *S3Client
+	bucket  string
+	prefix  string
+	staging string
+
+	mu      sync.Mutex
+	fetched map[string]bool
+}
+
+// The listing's view of an object
+type s3FileInfo struct {
+	object S3Object
+}
+
+func (i s3FileInfo) Name() string       { return path.Base(i.object.Key) }
+func (i s3FileInfo) Size() int64        { return i.object.Size }
+func (i s3FileInfo) Mode() os.FileMode  { return 0444 }
+func (i s3FileInfo) ModTime() time.Time { return i.object.LastModified }
+func (i s3FileInfo) IsDir() bool        { return false }
+func (i s3FileInfo) Sys() interface{}   { return nil }
+
+// The prefix as a directory, so that names relative to it start cleanly
+func (s *S3Source) dir() string {
+	if s.prefix == "" || strings.HasSuffix(s.prefix, "/") {
+		return s.prefix
+	}
+	return s.prefix + "/"
+}
+
+func (s *S3Source) Walk(after string, callback func(os.FileInfo, string) error) error {
+	startAfter := ""
+	if after != "" {
+		startAfter = s.dir() + after
+	}
+	ignores := DefaultIgnorer()
+	return s.client.List(s.bucket, s.dir(), startAfter, func(object S3Object) error {
+		if strings.HasSuffix(object.Key, "/") {
+			return nil // folder placeholder
+		}
+		if ignores.Ignored(strings.TrimPrefix(object.Key, s.dir()), false) {
+			return nil
+		}
+		return callback(s3FileInfo{object}, fmt.Sprintf("s3://%s/%s", s.bucket, object.Key))
+	})
+}
+
+func (s *S3Source) Fetch(name string) (string, error) {
+	bucket, key, err := ParseS3URL(name)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := s.client.Get(bucket, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	// keep the extension, some EXIF readers go by it
+	f, err := os.CreateTemp(s.staging, ".jpegger-fetch-*"+path.Ext(key))
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.fetched[f.Name()] = true
+	s.mu.Unlock()
+
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.Release(f.Name())
+		return "", fmt.Errorf("while downloading %s: %v", name, err)
+	}
+	return f.Name(), nil
+}
+
+func (s *S3Source) Release(local string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetched[local] {
+		os.Remove(local)
+		delete(s.fetched, local)
+	}
+}
+
+// Remove anything fetched but never placed, e.g. after an interruption
+func (s *S3Source) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for local := range s.fetched {
+		os.Remove(local)
+	}
+	s.fetched = map[string]bool{}
+	return nil
+}
+
+// Has the file at this name already been copied, and not changed since as
+// seen? Lets remote sources skip downloading what an earlier run handled.
+func AlreadyCopied(db Store, name string, seen SourceStat) (bool, error) {
+	copied := false
+	err := db.View(func(tx Tx) error {
+		if key, _ := cachedSourceKey(tx, name, seen); key != nil {
+			copied = IsPlaced(lookup(tx, ContentHash, key))
+		}
+		return nil
+	})
+	return copied, err
+}
+
+// Hash a remote file where it is and remember its key by name, as FileKey
+// does for a file it reads. Has its content already been copied?
+func CopiedRemotely(db Store, hasher RemoteHasher, name, algorithm string, seen SourceStat) (bool, error) {
+	key, err := hasher.RemoteHash(name, algorithm)
+	if err != nil {
+		return false, err
+	}
+	copied := false
+	err = db.View(func(tx Tx) error {
+		copied = IsPlaced(lookup(tx, ContentHash, key))
+		return nil
+	})
+	if err != nil || db.IsReadOnly() {
+		return copied, err
+	}
+	err = db.Update(func(tx Tx) error {
+		if err := putSourceKey(tx, name, key, seen); err != nil {
+			return err
+		}
+		return RecordKeyAlgorithm(tx, key, algorithm)
+	})
+	return copied, err
+}
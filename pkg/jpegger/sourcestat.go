@@ -0,0 +1,68 @@
+package jpegger
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+const (
+	// The size and modification time each source path had when its key
+	// was worked out, as JSON, so a file overwritten since is hashed again
+	SourceStats = "SourceStats"
+)
+
+// The size and modification time of a source file
+type SourceStat struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+func FileStat(info os.FileInfo) SourceStat {
+	return SourceStat{Size: info.Size(), ModTime: info.ModTime()}
+}
+
+func StampStat(stamp FileStamp) SourceStat {
+	return SourceStat{Size: stamp.Size, ModTime: stamp.Modified}
+}
+
+func (s SourceStat) Same(other SourceStat) bool {
+	return s.Size == other.Size && s.ModTime.Equal(other.ModTime)
+}
+
+// The key cached for a source path, nil if there is none or the file has
+// changed size or modification time since. A key cached before those were
+// recorded is trusted; recorded is false for one.
+func cachedSourceKey(tx Tx, path string, seen SourceStat) (key []byte, recorded bool) {
+	key = lookup(tx, SourcePath, []byte(path))
+	if key == nil {
+		return nil, false
+	}
+	value := lookup(tx, SourceStats, []byte(path))
+	if value == nil {
+		return key, false
+	}
+	var stat SourceStat
+	if json.Unmarshal(value, &stat) != nil || !stat.Same(seen) {
+		return nil, true
+	}
+	return key, true
+}
+
+// Record the size and modification time a source path has
+func putSourceStat(tx Tx, path string, seen SourceStat) error {
+	value, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(SourceStats)).Put([]byte(path), value)
+}
+
+// Cache the key of a source path, along with its size and modification
+// time
+func putSourceKey(tx Tx, path string, key []byte, seen SourceStat) error {
+	if err := tx.Bucket([]byte(SourcePath)).Put([]byte(path), key); err != nil {
+		return err
+	}
+	return putSourceStat(tx, path, seen)
+}
@@ -0,0 +1,140 @@
+package jpegger
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// EXIF that is there but can't be read. The file is quarantined rather than
+// dated by the filesystem.
+type UnreadableError struct {
+	Reason string
+}
+
+func (e *UnreadableError) Error() string {
+	return e.Reason
+}
+
+// Where DateFile looks for dates and how it corrects them
+type DateOptions struct {
+	ReadExif ExifReader
+	// Take dates from Google Takeout sidecars
+	Takeout bool
+	// Take dates from iCloud Photo Details.csv files
+	Apple bool
+	Clock Clock
+}
+
+// Date a file from the best evidence it has: its container, its EXIF, an
+// XMP sidecar, a takeout sidecar, an iCloud Photo Details.csv, its name
+// and, failing those, when it was last modified. local is where the
+// content is read from. The EXIF tags are returned for what else they can
+// tell. Unreadable EXIF is an *UnreadableError, and the stamp is dated by
+// the filesystem.
+func DateFile(name, local string, file os.FileInfo, options DateOptions) (FileStamp, map[string]string, error) {
+	stamp, tags, err := dateFile(name, local, file, options)
+	stamp.Modified = file.ModTime()
+	return stamp, tags, err
+}
+
+func dateFile(name, local string, file os.FileInfo, options DateOptions) (FileStamp, map[string]string, error) {
+	date := file.ModTime()
+	/* doesn't produce expected results
+	stat, err := times.Stat(name)
+	if err == nil {
+		if stat.HasBirthTime() {
+			date = stat.BirthTime()
+		} else if stat.HasChangeTime() {
+			date = stat.ChangeTime()
+		}
+	}
+	*/
+	dateSource := DateSourceFilesystem
+
+	if IsQuickTime(name) {
+		containerDate, err := ReadContainerDate(local)
+		if err == nil {
+			stamp := FileStamp{Path: name, Time: options.Clock.Correct(containerDate, ""), Source: DateSourceContainer, Size: file.Size(), Local: local}
+			return stamp, nil, nil
+		}
+	}
+
+	var tags map[string]string
+	err := RetryIO(local, func() error {
+		var err error
+		tags, err = options.ReadExif(local)
+		return err
+	})
+	if err != nil {
+		if err != NoExifData {
+			stamp := FileStamp{Path: name, Time: date, Source: dateSource, Size: file.Size(), Local: local}
+			return stamp, nil, &UnreadableError{fmt.Sprintf("while reading EXIF: %v", err)}
+		}
+	} else {
+		// cameras without a clock set write 0000:00:00 00:00:00, which is
+		// no date at all rather than a damaged file
+		for _, key := range ExifKeys {
+			dateStr, ok := tags[key]
+			if ok {
+				maybeDate, err := time.Parse(DateFormat, dateStr)
+				if err != nil {
+					continue
+				}
+				date = ExifZone(maybeDate, tags, key)
+				dateSource = DateSourceExif
+				break
+			}
+		}
+
+	}
+
+	// edits made in Lightroom or darktable travel with the file
+	sidecar := FindXMPSidecar(name)
+	if sidecar != "" && dateSource != DateSourceExif {
+		xmpDate, err := ReadXMPDate(sidecar)
+		if err == nil {
+			date = xmpDate
+			dateSource = DateSourceXMP
+		} else if err != NoXMPDate {
+			return FileStamp{}, nil, err
+		}
+	}
+
+	// takeout strips EXIF but keeps the date beside the photo. a remote
+	// file's sidecar isn't fetched with it
+	if options.Takeout && dateSource != DateSourceExif && !IsRemote(name) {
+		takenDate, err := ReadTakeoutDate(name)
+		if err == nil {
+			date = takenDate
+			dateSource = DateSourceTakeout
+		} else if err != NoTakeoutDate {
+			return FileStamp{}, nil, err
+		}
+	}
+
+	// so do iCloud exports, for a whole directory at once
+	if options.Apple && dateSource != DateSourceExif {
+		takenDate, err := ReadAppleDate(name)
+		if err == nil {
+			date = takenDate
+			dateSource = DateSourceApple
+		} else if err != NoAppleDate {
+			return FileStamp{}, nil, err
+		}
+	}
+
+	// screenshots and messaging apps don't write EXIF but name files
+	// after when they were made
+	if dateSource == DateSourceFilesystem {
+		if namedDate, ok := FilenameDate(name); ok {
+			date = namedDate
+			dateSource = DateSourceFilename
+		}
+	}
+
+	stamp := FileStamp{Path: name, Time: options.Clock.Correct(date, tags["Model"]), Source: dateSource, Size: file.Size(), Local: local, Sidecar: sidecar, Companions: FindCompanions(name), Make: strings.TrimSpace(tags["Manufacturer"]), Camera: strings.TrimSpace(tags["Model"]), Tags: len(tags)}
+	stamp.Class = Classify(stamp, local, tags)
+	return stamp, tags, nil
+}
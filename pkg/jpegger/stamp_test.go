@@ -0,0 +1,53 @@
+package jpegger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDateFileExifDate(t *testing.T) {
+	modified := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	tests := []struct {
+		name   string
+		tags   map[string]string
+		want   time.Time
+		source DateSource
+	}{
+		{"IMG_1.jpg", map[string]string{ExifKeys[0]: "2019:04:05 10:11:12"},
+			time.Date(2019, 4, 5, 10, 11, 12, 0, time.UTC), DateSourceExif},
+		// a camera whose clock was never set
+		{"IMG_20190714_183022.jpg", map[string]string{ExifKeys[0]: "0000:00:00 00:00:00"},
+			time.Date(2019, 7, 14, 18, 30, 22, 0, time.UTC), DateSourceFilename},
+		{"IMG_1.jpg", map[string]string{ExifKeys[0]: "0000:00:00 00:00:00"},
+			modified, DateSourceFilesystem},
+		{"IMG_1.jpg", map[string]string{ExifKeys[0]: "    :  :     :  :  ", ExifKeys[1]: "2019:04:05 10:11:12"},
+			time.Date(2019, 4, 5, 10, 11, 12, 0, time.UTC), DateSourceExif},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		local := filepath.Join(dir, test.name)
+		if err := os.WriteFile(local, []byte("jpeg"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(local, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readExif := func(string) (map[string]string, error) {
+			return test.tags, nil
+		}
+		stamp, _, err := DateFile(local, local, info, DateOptions{ReadExif: readExif})
+		if err != nil {
+			t.Errorf("%s %v: %v", test.name, test.tags, err)
+			continue
+		}
+		if !stamp.Time.Equal(test.want) || stamp.Source != test.source {
+			t.Errorf("%s %v: dated %v by %v, want %v by %v", test.name, test.tags, stamp.Time, stamp.Source, test.want, test.source)
+		}
+	}
+}
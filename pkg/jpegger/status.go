@@ -0,0 +1,136 @@
+package jpegger
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+var (
+	StatusCommand = &Command{
+		Name:    "status",
+		Summary: "summarize what the database knows",
+		Flags:   statusFlags,
+		Run:     RunStatus,
+	}
+
+	statusFlags = NewFlagSet("status", "")
+)
+
+// Human names for the states in the ContentHash bucket
+var StateNames = []struct {
+	State []byte
+	Name  string
+}{
+	{DiscoveredFile, "discovered"},
+	{CopiedFile, "copied"},
+	{QuarantinedFile, "quarantined"},
+	{DuplicateFile, "duplicate"},
+	{EmptyFile, "empty"},
+	{VerifiedFile, "verified"},
+	{RejectedFile, "rejected"},
+}
+
+func StateName(state []byte) string {
+	if state == nil {
+		return "none"
+	}
+	for _, s := range StateNames {
+		if bytes.Equal(s.State, state) {
+			return s.Name
+		}
+	}
+	return fmt.Sprintf("unknown (%x)", state)
+}
+
+// Open the database without taking the write lock, failing rather than
+// blocking forever if an import holds it
+func OpenReadOnlyDB() (Store, error) {
+	return OpenStore(*Database, StoreOptions{ReadOnly: true, Timeout: time.Second})
+}
+
+func RunStatus(args []string) error {
+	if len(args) != 0 {
+		return UsageError(statusFlags, "unexpected arguments")
+	}
+
+	if _, err := os.Stat(*Database); err != nil {
+		return err
+	}
+	db, err := OpenReadOnlyDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	counts := map[string]int{}
+	sources, quarantined, failed := 0, 0, 0
+	var algorithms map[string]int
+	var latest map[string]time.Time
+	err = db.View(func(tx Tx) error {
+		if b := tx.Bucket([]byte(ContentHash)); b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				counts[StateName(v)] += 1
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if b := tx.Bucket([]byte(SourcePath)); b != nil {
+			sources = b.KeyN()
+		}
+		if b := tx.Bucket([]byte(Quarantined)); b != nil {
+			quarantined = b.KeyN()
+		}
+		if b := tx.Bucket([]byte(FileErrors)); b != nil {
+			failed = b.KeyN()
+		}
+		algorithms = ContentAlgorithms(tx)
+		latest = LatestStateTimes(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-20s %d\n", "source paths:", sources)
+	for _, s := range StateNames {
+		fmt.Printf("%-20s %d\n", s.Name+":", counts[s.Name])
+		delete(counts, s.Name)
+	}
+	for name, count := range counts {
+		fmt.Printf("%-20s %d\n", name+":", count)
+	}
+	for _, s := range StateNames {
+		if at, ok := latest[s.Name]; ok {
+			fmt.Printf("%-20s %s\n", "last "+s.Name+":", at.Format(time.RFC3339))
+		}
+	}
+	if quarantined > 0 {
+		fmt.Printf("%-20s %d\n", "unreadable paths:", quarantined)
+	}
+	if failed > 0 {
+		fmt.Printf("%-20s %d\n", "failed paths:", failed)
+	}
+
+	var names []string
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%-20s %d\n", "keyed by "+name+":", algorithms[name])
+	}
+	// prefilter keys go with whichever algorithm settles collisions
+	mixed := len(algorithms)
+	if algorithms[PrefilterHash] > 0 {
+		mixed -= 1
+	}
+	if mixed > 1 {
+		fmt.Println("content keyed by different algorithms can't be matched up, so some may have been imported twice")
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package jpegger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The state database. Everything jpegger remembers is kept in named buckets
+// of keys and values, as bolt stores it, and every backend offers that same
+// model.
+type Store interface {
+	View(fn func(Tx) error) error
+	Update(fn func(Tx) error) error
+	IsReadOnly() bool
+	Close() error
+}
+
+// The top level buckets, seen from inside a transaction
+type Tx interface {
+	Bucket(name []byte) Bucket
+	CreateBucket(name []byte) (Bucket, error)
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// A bucket of keys and values. Buckets can hold buckets of their own, as
+// RunFiles does; ForEach gives those a nil value.
+type Bucket interface {
+	Tx
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	ForEach(fn func(k, v []byte) error) error
+	Cursor() Cursor
+	KeyN() int
+	Sequence() uint64
+	SetSequence(n uint64) error
+	NextSequence() (uint64, error)
+}
+
+// Walks a bucket in key order
+type Cursor interface {
+	Seek(seek []byte) (key, value []byte)
+	Next() (key, value []byte)
+}
+
+type StoreOptions struct {
+	ReadOnly bool
+	// How long to wait for another run to let go of the database. Zero
+	// waits as long as it takes.
+	Timeout time.Duration
+}
+
+type StoreDriver func(path string, options StoreOptions) (Store, error)
+
+var (
+	ErrBucketNotFound = fmt.Errorf("bucket not found")
+	StoreLocked       = fmt.Errorf("locked by another jpegger run")
+
+	// Every storage backend compiled into this binary. The SQLite backend
+	// is only present in cgo builds.
+	StoreDrivers = map[string]StoreDriver{
+		"bolt": OpenBoltStore,
+	}
+)
+
+// Open the database at path with the backend chosen by -db-driver
+func OpenStore(path string, options StoreOptions) (Store, error) {
+	open, ok := StoreDrivers[*DBDriver]
+	if !ok {
+		var names []string
+		for n := range StoreDrivers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown database driver %q (available: %s)", *DBDriver, strings.Join(names, ", "))
+	}
+
+	db, err := open(path, options)
+	if err == StoreLocked {
+		return nil, fmt.Errorf("%s is %v", path, err)
+	}
+	return db, err
+}
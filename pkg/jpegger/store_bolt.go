@@ -0,0 +1,133 @@
+package jpegger
+
+import (
+	"github.com/coreos/bbolt"
+)
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+func OpenBoltStore(path string, options StoreOptions) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: options.ReadOnly, Timeout: options.Timeout})
+	if err == bolt.ErrTimeout {
+		return nil, StoreLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return boltStore{db}, nil
+}
+
+func (s boltStore) View(fn func(Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s boltStore) Update(fn func(Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s boltStore) IsReadOnly() bool {
+	return s.db.IsReadOnly()
+}
+
+func (s boltStore) Close() error {
+	return s.db.Close()
+}
+
+// Wrap a bolt bucket, keeping a missing one a nil interface
+func wrapBoltBucket(b *bolt.Bucket, err error) (Bucket, error) {
+	if b == nil {
+		return nil, err
+	}
+	return boltBucket{b}, err
+}
+
+func boltError(err error) error {
+	if err == bolt.ErrBucketNotFound {
+		return ErrBucketNotFound
+	}
+	return err
+}
+
+func (t boltTx) Bucket(name []byte) Bucket {
+	b, _ := wrapBoltBucket(t.tx.Bucket(name), nil)
+	return b
+}
+
+func (t boltTx) CreateBucket(name []byte) (Bucket, error) {
+	return wrapBoltBucket(t.tx.CreateBucket(name))
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return wrapBoltBucket(t.tx.CreateBucketIfNotExists(name))
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	return boltError(t.tx.DeleteBucket(name))
+}
+
+func (b boltBucket) Bucket(name []byte) Bucket {
+	nested, _ := wrapBoltBucket(b.b.Bucket(name), nil)
+	return nested
+}
+
+func (b boltBucket) CreateBucket(name []byte) (Bucket, error) {
+	return wrapBoltBucket(b.b.CreateBucket(name))
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return wrapBoltBucket(b.b.CreateBucketIfNotExists(name))
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	return boltError(b.b.DeleteBucket(name))
+}
+
+func (b boltBucket) Cursor() Cursor {
+	return b.b.Cursor()
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltBucket) Put(key, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b boltBucket) KeyN() int {
+	return b.b.Stats().KeyN
+}
+
+func (b boltBucket) Sequence() uint64 {
+	return b.b.Sequence()
+}
+
+func (b boltBucket) SetSequence(n uint64) error {
+	return b.b.SetSequence(n)
+}
+
+func (b boltBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
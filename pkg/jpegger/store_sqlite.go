@@ -0,0 +1,405 @@
+//go:build cgo
+// +build cgo
+
+package jpegger
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"net/url"
+	"sort"
+	"time"
+)
+
+func init() {
+	StoreDrivers["sqlite"] = OpenSQLiteStore
+}
+
+// Buckets are rows of their own so that they can nest, and every key and
+// value is a row of entries. The views name the common buckets for anyone
+// querying the database, e.g.
+//
+//	sqlite3 state.db "select path from sources join content using (hash) where state = 'discovered'"
+//
+// The default rollback journal is kept rather than WAL, as WAL needs shared
+// memory that network filesystems don't provide.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS buckets (
+	id INTEGER PRIMARY KEY,
+	parent INTEGER REFERENCES buckets (id),
+	name BLOB NOT NULL,
+	sequence INTEGER NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS buckets_name ON buckets (ifnull(parent, 0), name);
+CREATE TABLE IF NOT EXISTS entries (
+	bucket INTEGER NOT NULL REFERENCES buckets (id),
+	key BLOB NOT NULL,
+	value BLOB NOT NULL,
+	PRIMARY KEY (bucket, key)
+) WITHOUT ROWID;
+
+CREATE VIEW IF NOT EXISTS content AS
+	SELECT lower(hex(key)) AS hash,
+		CASE hex(value) WHEN '01' THEN 'discovered' WHEN '02' THEN 'copied' ELSE lower(hex(value)) END AS state
+	FROM entries JOIN buckets ON bucket = id
+	WHERE parent IS NULL AND name = CAST('ContentHash' AS BLOB);
+CREATE VIEW IF NOT EXISTS sources AS
+	SELECT CAST(key AS TEXT) AS path, lower(hex(value)) AS hash
+	FROM entries JOIN buckets ON bucket = id
+	WHERE parent IS NULL AND name = CAST('SourcePath' AS BLOB);
+CREATE VIEW IF NOT EXISTS destinations AS
+	SELECT CAST(key AS TEXT) AS path, lower(hex(value)) AS hash
+	FROM entries JOIN buckets ON bucket = id
+	WHERE parent IS NULL AND name = CAST('DestinationPath' AS BLOB);
+`
+
+type sqliteStore struct {
+	db       *sql.DB
+	readOnly bool
+}
+
+// A transaction remembers the first query that failed, since Get and
+// Bucket have no way to report it, and fails as a whole
+type sqliteTx struct {
+	tx  *sql.Tx
+	err error
+}
+
+type sqliteBucket struct {
+	tx *sqliteTx
+	id int64
+}
+
+type sqliteEntry struct {
+	key, value []byte
+}
+
+type sqliteCursor struct {
+	bucket  *sqliteBucket
+	entries []sqliteEntry
+}
+
+func OpenSQLiteStore(path string, options StoreOptions) (Store, error) {
+	query := url.Values{}
+	query.Set("_txlock", "immediate")
+	// bolt waits forever for a lock unless told otherwise. A day is as
+	// good as forever here.
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = 24 * time.Hour
+	}
+	query.Set("_busy_timeout", fmt.Sprint(timeout.Milliseconds()))
+	if options.ReadOnly {
+		query.Set("mode", "ro")
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+url.PathEscape(path)+"?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	// one connection keeps the hash workers from tripping over each other's
+	// locks
+	db.SetMaxOpenConns(1)
+
+	if !options.ReadOnly {
+		if _, err = db.Exec(sqliteSchema); err != nil {
+			db.Close()
+			return nil, sqliteError(err)
+		}
+	} else if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, sqliteError(err)
+	}
+	return &sqliteStore{db, options.ReadOnly}, nil
+}
+
+func sqliteError(err error) error {
+	if e, ok := err.(sqlite3.Error); ok && (e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked) {
+		return StoreLocked
+	}
+	return err
+}
+
+func (s *sqliteStore) run(readOnly bool, fn func(Tx) error) error {
+	sqlTx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: readOnly})
+	if err != nil {
+		return sqliteError(err)
+	}
+	tx := &sqliteTx{tx: sqlTx}
+
+	err = fn(tx)
+	if err == nil {
+		err = tx.err
+	}
+	if err != nil || readOnly {
+		sqlTx.Rollback()
+		return err
+	}
+	return sqliteError(sqlTx.Commit())
+}
+
+func (s *sqliteStore) View(fn func(Tx) error) error {
+	return s.run(true, fn)
+}
+
+func (s *sqliteStore) Update(fn func(Tx) error) error {
+	if s.readOnly {
+		return fmt.Errorf("database is read-only")
+	}
+	return s.run(false, fn)
+}
+
+func (s *sqliteStore) IsReadOnly() bool {
+	return s.readOnly
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func (t *sqliteTx) fail(err error) {
+	if t.err == nil {
+		t.err = sqliteError(err)
+	}
+}
+
+// The bucket called name inside parent, nil for the top level
+func (t *sqliteTx) bucket(parent interface{}, name []byte) Bucket {
+	var id int64
+	err := t.tx.QueryRow("SELECT id FROM buckets WHERE parent IS ? AND name = ?", parent, name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		t.fail(err)
+		return nil
+	}
+	return &sqliteBucket{t, id}
+}
+
+func (t *sqliteTx) createBucket(parent interface{}, name []byte, mayExist bool) (Bucket, error) {
+	if b := t.bucket(parent, name); b != nil {
+		if mayExist {
+			return b, nil
+		}
+		return nil, fmt.Errorf("bucket already exists")
+	}
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	result, err := t.tx.Exec("INSERT INTO buckets (parent, name) VALUES (?, ?)", parent, name)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteBucket{t, id}, nil
+}
+
+// Delete a bucket with everything in it, including nested buckets
+func (t *sqliteTx) deleteBucket(parent interface{}, name []byte) error {
+	b := t.bucket(parent, name)
+	if t.err != nil {
+		return t.err
+	}
+	if b == nil {
+		return ErrBucketNotFound
+	}
+
+	id := b.(*sqliteBucket).id
+	rows, err := t.tx.Query("SELECT name FROM buckets WHERE parent = ?", id)
+	if err != nil {
+		return sqliteError(err)
+	}
+	var nested [][]byte
+	for rows.Next() {
+		var n []byte
+		if err = rows.Scan(&n); err != nil {
+			rows.Close()
+			return err
+		}
+		nested = append(nested, n)
+	}
+	rows.Close()
+	for _, n := range nested {
+		if err = t.deleteBucket(id, n); err != nil {
+			return err
+		}
+	}
+
+	if _, err = t.tx.Exec("DELETE FROM entries WHERE bucket = ?", id); err != nil {
+		return sqliteError(err)
+	}
+	_, err = t.tx.Exec("DELETE FROM buckets WHERE id = ?", id)
+	return sqliteError(err)
+}
+
+func (t *sqliteTx) Bucket(name []byte) Bucket {
+	return t.bucket(nil, name)
+}
+
+func (t *sqliteTx) CreateBucket(name []byte) (Bucket, error) {
+	return t.createBucket(nil, name, false)
+}
+
+func (t *sqliteTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return t.createBucket(nil, name, true)
+}
+
+func (t *sqliteTx) DeleteBucket(name []byte) error {
+	return t.deleteBucket(nil, name)
+}
+
+func (b *sqliteBucket) Bucket(name []byte) Bucket {
+	return b.tx.bucket(b.id, name)
+}
+
+func (b *sqliteBucket) CreateBucket(name []byte) (Bucket, error) {
+	return b.tx.createBucket(b.id, name, false)
+}
+
+func (b *sqliteBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return b.tx.createBucket(b.id, name, true)
+}
+
+func (b *sqliteBucket) DeleteBucket(name []byte) error {
+	return b.tx.deleteBucket(b.id, name)
+}
+
+func (b *sqliteBucket) Get(key []byte) []byte {
+	var value []byte
+	err := b.tx.tx.QueryRow("SELECT value FROM entries WHERE bucket = ? AND key = ?", b.id, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		b.tx.fail(err)
+		return nil
+	}
+	// an empty value is still a value
+	if value == nil {
+		value = []byte{}
+	}
+	return value
+}
+
+func (b *sqliteBucket) Put(key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := b.tx.tx.Exec("INSERT OR REPLACE INTO entries (bucket, key, value) VALUES (?, ?, ?)", b.id, key, value)
+	return sqliteError(err)
+}
+
+func (b *sqliteBucket) Delete(key []byte) error {
+	_, err := b.tx.tx.Exec("DELETE FROM entries WHERE bucket = ? AND key = ?", b.id, key)
+	return sqliteError(err)
+}
+
+// Read every row a query returns as key and value pairs. They are read in
+// full before anyone sees them so callers are free to run other queries.
+func (b *sqliteBucket) entries(query string, args ...interface{}) ([]sqliteEntry, error) {
+	rows, err := b.tx.tx.Query(query, args...)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+
+	var entries []sqliteEntry
+	for rows.Next() {
+		var e sqliteEntry
+		if err = rows.Scan(&e.key, &e.value); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (b *sqliteBucket) ForEach(fn func(k, v []byte) error) error {
+	entries, err := b.entries("SELECT key, value FROM entries WHERE bucket = ?", b.id)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if entries[i].value == nil {
+			entries[i].value = []byte{}
+		}
+	}
+	nested, err := b.entries("SELECT name, NULL FROM buckets WHERE parent = ?", b.id)
+	if err != nil {
+		return err
+	}
+
+	entries = append(entries, nested...)
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	for _, e := range entries {
+		if err = fn(e.key, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *sqliteBucket) Cursor() Cursor {
+	return &sqliteCursor{bucket: b}
+}
+
+func (b *sqliteBucket) KeyN() int {
+	var n int
+	err := b.tx.tx.QueryRow("SELECT count(*) FROM entries WHERE bucket = ?", b.id).Scan(&n)
+	if err != nil {
+		b.tx.fail(err)
+	}
+	return n
+}
+
+func (b *sqliteBucket) Sequence() uint64 {
+	var n uint64
+	err := b.tx.tx.QueryRow("SELECT sequence FROM buckets WHERE id = ?", b.id).Scan(&n)
+	if err != nil {
+		b.tx.fail(err)
+	}
+	return n
+}
+
+func (b *sqliteBucket) SetSequence(n uint64) error {
+	_, err := b.tx.tx.Exec("UPDATE buckets SET sequence = ? WHERE id = ?", int64(n), b.id)
+	return sqliteError(err)
+}
+
+func (b *sqliteBucket) NextSequence() (uint64, error) {
+	_, err := b.tx.tx.Exec("UPDATE buckets SET sequence = sequence + 1 WHERE id = ?", b.id)
+	if err != nil {
+		return 0, sqliteError(err)
+	}
+	return b.Sequence(), b.tx.err
+}
+
+// Reads everything from the sought key on when it's positioned, which is
+// plenty for the prefix searches jpegger does with it
+func (c *sqliteCursor) Seek(seek []byte) ([]byte, []byte) {
+	entries, err := c.bucket.entries("SELECT key, value FROM entries WHERE bucket = ? AND key >= ? ORDER BY key", c.bucket.id, seek)
+	if err != nil {
+		c.bucket.tx.fail(err)
+	}
+	c.entries = entries
+	return c.Next()
+}
+
+func (c *sqliteCursor) Next() ([]byte, []byte) {
+	if len(c.entries) == 0 {
+		return nil, nil
+	}
+	e := c.entries[0]
+	c.entries = c.entries[1:]
+	return e.key, e.value
+}
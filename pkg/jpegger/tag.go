@@ -0,0 +1,206 @@
+package jpegger
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// The tags given to each piece of content with jpegger tag, as a JSON
+	// list
+	Tags = "Tags"
+)
+
+var (
+	TagCommand = &Command{
+		Name:    "tag",
+		Args:    "add path|hash tag... | remove path|hash tag... | list [path|hash]",
+		Summary: "tag content in the database, to find it again with search",
+		Flags:   tagFlags,
+		Run:     RunTag,
+	}
+
+	tagFlags = NewFlagSet("tag", "add path|hash tag... | remove path|hash tag... | list [path|hash]")
+)
+
+// The tags of a piece of content
+func ContentTags(tx Tx, key []byte) []string {
+	var tags []string
+	if value := lookup(tx, Tags, key); value != nil {
+		json.Unmarshal(value, &tags)
+	}
+	return tags
+}
+
+// Does the content have the tag, ignoring case?
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Every tag of either list, sorted, keeping the first spelling of each
+func unionTags(a, b []string) []string {
+	var tags []string
+	for _, tag := range append(append([]string(nil), a...), b...) {
+		if tag != "" && !hasTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func putTags(tx Tx, key []byte, tags []string) error {
+	b := tx.Bucket([]byte(Tags))
+	if len(tags) == 0 {
+		return b.Delete(key)
+	}
+	value, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+// Give content more tags
+func AddTags(tx Tx, key []byte, tags []string) error {
+	return putTags(tx, key, unionTags(ContentTags(tx, key), tags))
+}
+
+// Take tags off content, ignoring case
+func RemoveTags(tx Tx, key []byte, tags []string) error {
+	var kept []string
+	for _, tag := range ContentTags(tx, key) {
+		if !hasTag(tags, tag) {
+			kept = append(kept, tag)
+		}
+	}
+	return putTags(tx, key, kept)
+}
+
+// Merge two databases' tags of one piece of content
+func mergeTags(ours, theirs []byte) []byte {
+	var a, b []string
+	json.Unmarshal(ours, &a)
+	json.Unmarshal(theirs, &b)
+	merged, err := json.Marshal(unionTags(a, b))
+	if err != nil {
+		return ours
+	}
+	return merged
+}
+
+// The content at a source path, a path in the output relative to it, or
+// with a hash starting with a hex prefix
+func resolveContent(tx Tx, name string) ([]byte, error) {
+	if key := lookup(tx, SourcePath, []byte(name)); key != nil {
+		return key, nil
+	}
+	if key := lookup(tx, DestinationPath, []byte(strings.TrimPrefix(name, "./"))); key != nil {
+		return key, nil
+	}
+	if !hashPrefix.MatchString(strings.ToLower(name)) {
+		return nil, fmt.Errorf("no record of %s", name)
+	}
+	return findKey(tx, strings.ToLower(name))
+}
+
+// Print every tag and how much content has it
+func listAllTags(tx Tx) {
+	counts := map[string]int{}
+	b := tx.Bucket([]byte(Tags))
+	if b == nil {
+		return
+	}
+	b.ForEach(func(key, _ []byte) error {
+		for _, tag := range ContentTags(tx, key) {
+			counts[strings.ToLower(tag)] += 1
+		}
+		return nil
+	})
+	var names []string
+	for tag := range counts {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+	for _, tag := range names {
+		fmt.Printf("%6d  %s\n", counts[tag], tag)
+	}
+}
+
+func RunTag(args []string) error {
+	if len(args) == 0 {
+		return UsageError(tagFlags, "expected add, remove or list")
+	}
+	action, args := args[0], args[1:]
+	switch action {
+	case "add", "remove":
+		if len(args) < 2 {
+			return UsageError(tagFlags, "%s takes a path or hash and at least one tag", action)
+		}
+	case "list":
+		if len(args) > 1 {
+			return UsageError(tagFlags, "list takes at most a path or hash")
+		}
+	default:
+		return UsageError(tagFlags, "unknown action %q", action)
+	}
+
+	if _, err := os.Stat(*Database); err != nil {
+		return err
+	}
+	if action == "list" {
+		db, err := OpenReadOnlyDB()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.View(func(tx Tx) error {
+			if len(args) == 0 {
+				listAllTags(tx)
+				return nil
+			}
+			key, err := resolveContent(tx, args[0])
+			if err != nil {
+				return err
+			}
+			for _, tag := range ContentTags(tx, key) {
+				fmt.Println(tag)
+			}
+			return nil
+		})
+	}
+
+	lock, err := LockRun(*Database, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	db, err := OpenStore(*Database, StoreOptions{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = CreateBuckets(db); err != nil {
+		return err
+	}
+
+	return db.Update(func(tx Tx) error {
+		key, err := resolveContent(tx, args[0])
+		if err != nil {
+			return err
+		}
+		if action == "add" {
+			return AddTags(tx, key, args[1:])
+		}
+		return RemoveTags(tx, key, args[1:])
+	})
+}
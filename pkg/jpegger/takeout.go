@@ -0,0 +1,98 @@
+package jpegger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Takeout shortens sidecar names to this many characters before ".json"
+const takeoutNameLimit = 46
+
+var (
+	NoTakeoutDate = fmt.Errorf("no takeout date")
+
+	// a duplicate like IMG_1234(1).jpg, whose sidecar is IMG_1234.jpg(1).json
+	takeoutDuplicate = regexp.MustCompile(`^(.*)(\(\d+\))(\.[^.]*)$`)
+)
+
+// The parts of a Google Takeout .json sidecar we use
+type TakeoutSidecar struct {
+	Title          string `json:"title"`
+	Description    string `json:"description"`
+	PhotoTakenTime struct {
+		Timestamp string `json:"timestamp"`
+	} `json:"photoTakenTime"`
+	GeoData struct {
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+		Altitude  float64 `json:"altitude"`
+	} `json:"geoData"`
+}
+
+// Where the sidecar for a file may be, most likely first. Takeout has
+// named them differently over the years.
+func takeoutSidecarNames(name string) []string {
+	dir, base := filepath.Split(name)
+	ext := filepath.Ext(base)
+
+	names := []string{
+		base + ".json",
+		base + ".supplemental-metadata.json",
+		base[:len(base)-len(ext)] + ".json",
+	}
+	if m := takeoutDuplicate.FindStringSubmatch(base); m != nil {
+		names = append(names, m[1]+m[3]+m[2]+".json")
+	}
+	if len(base) > takeoutNameLimit {
+		names = append(names, base[:takeoutNameLimit]+".json")
+	}
+
+	for i := range names {
+		names[i] = dir + names[i]
+	}
+	return names
+}
+
+// Find and read the sidecar for a file
+func ReadTakeoutSidecar(name string) (*TakeoutSidecar, error) {
+	for _, sidecarName := range takeoutSidecarNames(name) {
+		data, err := ioutil.ReadFile(sidecarName)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var sidecar TakeoutSidecar
+		err = json.Unmarshal(data, &sidecar)
+		if err != nil {
+			return nil, fmt.Errorf("while reading %s: %v", sidecarName, err)
+		}
+		return &sidecar, nil
+	}
+	return nil, NoTakeoutDate
+}
+
+// When the photo was taken according to its sidecar
+func ReadTakeoutDate(name string) (time.Time, error) {
+	sidecar, err := ReadTakeoutSidecar(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if sidecar.PhotoTakenTime.Timestamp == "" {
+		return time.Time{}, NoTakeoutDate
+	}
+	seconds, err := strconv.ParseInt(sidecar.PhotoTakenTime.Timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid photoTakenTime for %s: %v", name, err)
+	}
+	return time.Unix(seconds, 0), nil
+}
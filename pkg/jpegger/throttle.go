@@ -0,0 +1,80 @@
+package jpegger
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Paces reads from the input and output so an import leaves some of a
+// shared disk for everyone else. Limits apply to every stage together.
+type Throttle struct {
+	mu          sync.Mutex
+	bytesPerSec float64
+	readsPerSec float64
+	next        time.Time
+}
+
+// Reads of files being hashed or copied. No limit until SetLimits is
+// called.
+var ReadThrottle = &Throttle{}
+
+// Limit reads to mbps megabytes and iops reads a second. Zero leaves
+// either unlimited.
+func (t *Throttle) SetLimits(mbps, iops float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bytesPerSec = mbps * 1000 * 1000
+	t.readsPerSec = iops
+}
+
+func (t *Throttle) limited() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bytesPerSec > 0 || t.readsPerSec > 0
+}
+
+// Wait for a read of n bytes to fit within the limits
+func (t *Throttle) Wait(n int) {
+	t.mu.Lock()
+	var cost time.Duration
+	if t.bytesPerSec > 0 {
+		cost = time.Duration(float64(n) / t.bytesPerSec * float64(time.Second))
+	}
+	if t.readsPerSec > 0 {
+		if c := time.Duration(float64(time.Second) / t.readsPerSec); c > cost {
+			cost = c
+		}
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(cost)
+	t.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// A reader paced by the throttle. Without limits the reader is returned as
+// it is, so copies keep their fast paths.
+func (t *Throttle) Reader(r io.Reader) io.Reader {
+	if !t.limited() {
+		return r
+	}
+	return throttledReader{r, t}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *Throttle
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.Wait(n)
+	return n, err
+}
@@ -0,0 +1,296 @@
+package jpegger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// How a file is placed into the output tree
+type TransferMode int
+
+const (
+	TransferLink = TransferMode(iota)
+	TransferCopy
+	// A copy whose source is deleted once it has been checked
+	TransferMove
+	// A copy-on-write clone, or a copy where the filesystem can't clone
+	TransferReflink
+	// A relative symlink, how -objects=symlink links to the store. Not a
+	// -mode
+	TransferSymlink
+)
+
+var transferModeNames = map[string]TransferMode{
+	"link":    TransferLink,
+	"copy":    TransferCopy,
+	"move":    TransferMove,
+	"reflink": TransferReflink,
+}
+
+func ParseTransferMode(name string) (TransferMode, error) {
+	mode, ok := transferModeNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown mode %q (expected link, copy, move or reflink)", name)
+	}
+	return mode, nil
+}
+
+// Place the file at src into dest. Like os.Link, the error satisfies
+// os.IsExist if something is already at dest. A move only copies; the
+// source is left for the caller to delete once the copy is checked.
+func Transfer(mode TransferMode, src, dest string) error {
+	return RetryIO(src, func() error {
+		switch mode {
+		case TransferCopy, TransferMove:
+			return CopyFile(src, dest)
+		case TransferReflink:
+			return ReflinkFile(src, dest)
+		case TransferSymlink:
+			return SymlinkFile(src, dest)
+		default:
+			return LinkFile(src, dest)
+		}
+	})
+}
+
+var linkFallback sync.Once
+
+// Can't the filesystem hard link these files?
+func LinkUnsupported(err error) bool {
+	for _, unsupported := range linkUnsupportedErrors {
+		if errors.Is(err, unsupported) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hard link src to dest. Where that isn't possible, like on a FAT or exFAT
+// card or across filesystems, the file is copied instead.
+func LinkFile(src, dest string) error {
+	// a hard link to a symlink would be another symlink
+	if resolved, err := filepath.EvalSymlinks(src); err == nil {
+		src = resolved
+	}
+	err := os.Link(src, dest)
+	if err == nil || os.IsExist(err) || !LinkUnsupported(err) {
+		return err
+	}
+	linkFallback.Do(func() {
+		log.Printf("can't hard link (%v), copying instead", err)
+	})
+	return CopyFile(src, dest)
+}
+
+// Stream src into a temporary file beside dest and then rename it into
+// place so that dest never holds a partial copy.
+func CopyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".jpegger-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	// harmless once the rename has happened
+	defer os.Remove(tmpName)
+
+	_, err = io.Copy(tmp, ReadThrottle.Reader(in))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return placeTemp("copy", src, tmpName, dest, info)
+}
+
+// Give a finished temporary file the mode and modification time of its
+// source and rename it to dest, unless something is already there.
+func placeTemp(op, src, tmpName, dest string, info os.FileInfo) error {
+	err := os.Chmod(tmpName, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(tmpName, info.ModTime(), info.ModTime())
+	if err != nil {
+		return err
+	}
+
+	// a link fails if dest exists, so two imports can't both claim a name.
+	// the temporary file is removed by the caller
+	err = os.Link(tmpName, dest)
+	if os.IsExist(err) {
+		return &os.LinkError{Op: op, Old: src, New: dest, Err: os.ErrExist}
+	}
+	if err == nil {
+		return nil
+	}
+
+	// without hard links, check first as rename would silently replace an
+	// existing file
+	if _, err = os.Lstat(dest); err == nil {
+		return &os.LinkError{Op: op, Old: src, New: dest, Err: os.ErrExist}
+	}
+
+	return os.Rename(tmpName, dest)
+}
+
+var reflinkFallback sync.Once
+
+// Clone src into dest so that they share blocks until one is changed.
+// Where the filesystem can't do that, like ext4 or across filesystems, the
+// file is copied instead.
+func ReflinkFile(src, dest string) error {
+	err := cloneFile(src, dest)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+	reflinkFallback.Do(func() {
+		log.Printf("can't clone %s (%v), copying instead", src, err)
+	})
+	return CopyFile(src, dest)
+}
+
+// Check the copy made for a move before the source goes. The copy is
+// hashed the way its key was made, except that prefilter keys only cover
+// the ends of a file, so then both are hashed in full with algorithm.
+func VerifyCopy(src, dest string, key []byte, keyAlgorithm, algorithm string) error {
+	expected := key
+	if keyAlgorithm == PrefilterHash {
+		var err error
+		expected, err = HashFile(src, algorithm)
+		if err != nil {
+			return err
+		}
+	} else {
+		algorithm = keyAlgorithm
+	}
+
+	found, err := HashFile(dest, algorithm)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(found, expected) {
+		return fmt.Errorf("the copy at %s doesn't match (expected %x, found %x)", dest, expected, found)
+	}
+	return nil
+}
+
+// Does dest already hold the content of src? A hard link to it does,
+// otherwise dest is checked like the copy made for a move.
+func SameContent(src, dest string, key []byte, keyAlgorithm, algorithm string) bool {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false
+	}
+	destInfo, err := os.Stat(dest)
+	if err != nil {
+		return false
+	}
+	if os.SameFile(srcInfo, destInfo) {
+		return true
+	}
+	if srcInfo.Size() != destInfo.Size() {
+		return false
+	}
+	return VerifyCopy(src, dest, key, keyAlgorithm, algorithm) == nil
+}
+
+// Somewhere other than a local directory files can be placed
+type RemoteDestination interface {
+	Transfer(mode TransferMode, src, dest string) error
+	// Delete a placed file if it still holds key, reporting whether it's
+	// gone
+	Remove(dest string, key []byte, algorithm string) (bool, error)
+}
+
+// The destination for a remote output, an S3 bucket or WebDAV server
+func OpenDestination(output string) (RemoteDestination, error) {
+	if IsWebDAV(output) {
+		client, _, err := ParseWebDAVURL(output)
+		if err != nil {
+			return nil, err
+		}
+		return WebDAVDestination{client}, nil
+	}
+	client, err := NewS3Client(*S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return S3Destination{client}, nil
+}
+
+// Places files in an S3-compatible bucket. Objects are always copies,
+// whatever the mode.
+type S3Destination struct {
+	Client *S3Client
+}
+
+func (d S3Destination) Transfer(mode TransferMode, src, dest string) error {
+	bucket, key, err := ParseS3URL(dest)
+	if err != nil {
+		return err
+	}
+
+	exists, err := d.Client.Exists(bucket, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return &os.LinkError{Op: "upload", Old: src, New: dest, Err: os.ErrExist}
+	}
+	return d.Client.Upload(bucket, key, src)
+}
+
+// Delete an uploaded object if it still holds what was placed there. Like
+// removePlaced, an object that's already gone counts as removed.
+func (d S3Destination) Remove(dest string, key []byte, algorithm string) (bool, error) {
+	if err := CheckHashAlgorithm(algorithm); err != nil {
+		return false, err
+	}
+	bucket, objectKey, err := ParseS3URL(dest)
+	if err != nil {
+		return false, err
+	}
+
+	exists, err := d.Client.Exists(bucket, objectKey)
+	if err != nil || !exists {
+		return !exists, err
+	}
+
+	body, err := d.Client.Get(bucket, objectKey)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	h := HashAlgorithms[algorithm]()
+	if _, err = io.Copy(h, body); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(h.Sum(nil), key) {
+		return false, nil
+	}
+	return true, d.Client.Delete(bucket, objectKey)
+}
@@ -0,0 +1,304 @@
+package jpegger
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	UndoCommand = &Command{
+		Name:    "undo",
+		Summary: "list import runs, or remove what one run placed with -run",
+		Flags:   undoFlags,
+		Run:     RunUndo,
+	}
+
+	undoFlags = NewFlagSet("undo", "")
+
+	UndoRun = undoFlags.Uint64("run", 0, "the import run to undo. without it the runs are listed")
+)
+
+func init() {
+	// undoing a run with an s3:// output talks to the same store
+	undoFlags.StringVar(S3Endpoint, "s3-endpoint", *S3Endpoint, "endpoint for runs with s3:// outputs on S3-compatible stores")
+	undoFlags.BoolVar(Wait, "wait", false, "wait for an import of the database to finish rather than stopping")
+}
+
+func printRuns(db Store) error {
+	return db.View(func(tx Tx) error {
+		runs, err := ListRuns(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, run := range runs {
+			count := 0
+			if files := tx.Bucket([]byte(RunFiles)).Bucket(RunKey(run.ID)); files != nil {
+				count = files.KeyN()
+			}
+			mode := run.Mode
+			if mode == "" {
+				mode = "-"
+			}
+			fmt.Printf("%6d  %s  %6d files  %-7s  %s -> %s\n",
+				run.ID, run.Started.Format("2006-01-02 15:04:05"), count, mode, run.Input, run.Output)
+		}
+		return nil
+	})
+}
+
+// Remove a file placed by a run if it still holds what was placed there
+func removePlaced(path string, key []byte, algorithm string) (bool, error) {
+	found, err := HashFile(path, algorithm)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(found, key) {
+		return false, nil
+	}
+	return true, os.Remove(path)
+}
+
+// Remove directories left empty, stopping at the output directory
+func removeEmptyParents(output, path string) {
+	for dir := filepath.Dir(path); dir != output && dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// Forget that content was copied so a later import places it again
+func revertPlacement(db Store, run uint64, relPath string, key []byte) error {
+	return db.Update(func(tx Tx) error {
+		destinations := tx.Bucket([]byte(DestinationPath))
+		if bytes.Equal(destinations.Get([]byte(relPath)), key) {
+			if err := destinations.Delete([]byte(relPath)); err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte(Rewritten)).Delete([]byte(relPath)); err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte(Companions)).Delete([]byte(relPath)); err != nil {
+				return err
+			}
+		}
+
+		contentDestinations := tx.Bucket([]byte(ContentDestination))
+		if bytes.Equal(contentDestinations.Get(key), []byte(relPath)) {
+			if err := contentDestinations.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		hashes := tx.Bucket([]byte(ContentHash))
+		if IsPlaced(hashes.Get(key)) {
+			if err := hashes.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket([]byte(RunFiles)).Bucket(RunKey(run)).Delete([]byte(relPath))
+	})
+}
+
+func RunUndo(args []string) error {
+	if len(args) != 0 {
+		return UsageError(undoFlags, "unexpected arguments")
+	}
+
+	lock, err := LockRun(*Database, *Wait)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	db, err := OpenStore(*Database, StoreOptions{})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = CreateBuckets(db)
+	if err != nil {
+		return err
+	}
+
+	if *UndoRun == 0 {
+		return printRuns(db)
+	}
+	run := *UndoRun
+
+	f, err := OpenLog()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	result, err := UndoImport(db, run)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("run %d: removed %d files, kept %d", run, result.Removed, result.Kept)
+	if len(result.Objects) > 0 {
+		fmt.Printf(", and %d stored objects nothing links to", len(result.Objects))
+	}
+	fmt.Println()
+	return nil
+}
+
+// What undoing a run did
+type UndoResult struct {
+	Removed, Kept int
+	// the stored objects removed once nothing linked to them
+	Objects []string
+}
+
+// Remove the files a run placed that still hold what it placed, and forget
+// them so a later import places their content again. The run itself is
+// forgotten once nothing of it is left.
+func UndoImport(db Store, run uint64) (UndoResult, error) {
+	var result UndoResult
+	var info *RunInfo
+	placed := map[string][]byte{}
+	// what each file should still hold, if it was rewritten after placing
+	holds := map[string][]byte{}
+	algorithms := map[string]string{}
+	// the file each sidecar or companion goes with
+	companionOf := map[string]string{}
+	err := db.View(func(tx Tx) error {
+		runs, err := ListRuns(tx)
+		if err != nil {
+			return err
+		}
+		for i := range runs {
+			if runs[i].ID == run {
+				info = &runs[i]
+			}
+		}
+
+		files := tx.Bucket([]byte(RunFiles)).Bucket(RunKey(run))
+		if files == nil {
+			return nil
+		}
+		return files.ForEach(func(rel, key []byte) error {
+			placed[string(rel)] = append([]byte(nil), key...)
+			holds[string(rel)] = PlacedKey(tx, string(rel), placed[string(rel)])
+			algorithms[string(rel)] = KeyAlgorithm(tx, key)
+			if of := lookup(tx, Companions, rel); of != nil {
+				companionOf[string(rel)] = string(of)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return result, err
+	}
+	if info == nil {
+		return result, fmt.Errorf("no run %d", run)
+	}
+	if info.Mode == transferModeVerbs[TransferMove] {
+		// the sources were deleted once their copies were checked
+		return result, fmt.Errorf("run %d moved its files into %s, so they are the only copies left. undo won't delete them", run, info.Output)
+	}
+
+	remove := removePlaced
+	if IsRemote(info.Output) {
+		dest, err := OpenDestination(info.Output)
+		if err != nil {
+			return result, err
+		}
+		remove = dest.Remove
+	}
+
+	// files first, so the companions of those kept can be kept with them
+	rels := make([]string, 0, len(placed))
+	for rel := range placed {
+		rels = append(rels, rel)
+	}
+	sort.SliceStable(rels, func(i, j int) bool {
+		_, a := companionOf[rels[i]]
+		_, b := companionOf[rels[j]]
+		return !a && b
+	})
+
+	kept := 0
+	keptFiles := map[string]bool{}
+	var removedKeys [][]byte
+	for _, rel := range rels {
+		key := placed[rel]
+		path := OutputPath(info.Output, rel)
+		if of, ok := companionOf[rel]; ok && keptFiles[of] {
+			kept += 1
+			fmt.Printf("kept %s: it goes with %s\n", path, OutputPath(info.Output, of))
+			Emit(Event{Event: "undo-companion-kept", Run: run, Destination: path, Partner: OutputPath(info.Output, of)})
+			continue
+		}
+		removed, err := remove(path, holds[rel], algorithms[rel])
+		if err != nil {
+			return result, fmt.Errorf("while removing %s: %v", path, err)
+		}
+		if !removed {
+			kept += 1
+			keptFiles[rel] = true
+			fmt.Printf("kept %s: it changed after run %d\n", path, run)
+			Emit(Event{Event: "undo-kept", Run: run, Destination: path})
+			continue
+		}
+		if !IsRemote(info.Output) {
+			if err = RemoveFromManifest(info.Output, rel); err != nil {
+				return result, fmt.Errorf("while updating the manifest beside %s: %v", path, err)
+			}
+			removeEmptyParents(info.Output, path)
+		}
+		unreachable, err := RemoveMirrored(db, rel, holds[rel], algorithms[rel])
+		if err != nil {
+			return result, err
+		}
+		for _, root := range unreachable {
+			fmt.Printf("kept %s in mirror %s: it isn't there\n", rel, root)
+			Emit(Event{Event: "undo-mirror-kept", Run: run, Destination: rel, Message: root})
+		}
+
+		err = revertPlacement(db, run, rel, key)
+		if err != nil {
+			return result, fmt.Errorf("while reverting %s: %v", rel, err)
+		}
+		removedKeys = append(removedKeys, key)
+		Emit(Event{Event: "undo-removed", Run: run, Destination: path})
+	}
+
+	// with -objects, the stored copies the removed files linked to
+	var objects []string
+	if !IsRemote(info.Output) {
+		objects, err = RemoveUnlinkedObjects(db, info.Output, removedKeys)
+		if err != nil {
+			return result, fmt.Errorf("while removing stored objects: %v", err)
+		}
+		for _, object := range objects {
+			Emit(Event{Event: "undo-object-removed", Run: run, Destination: object})
+		}
+	}
+
+	// only forget the run once nothing of it is left
+	if kept == 0 {
+		err = db.Update(func(tx Tx) error {
+			err := tx.Bucket([]byte(RunFiles)).DeleteBucket(RunKey(run))
+			if err != nil && err != ErrBucketNotFound {
+				return err
+			}
+			return tx.Bucket([]byte(Runs)).Delete(RunKey(run))
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.Removed, result.Kept, result.Objects = len(placed)-kept, kept, objects
+	return result, nil
+}
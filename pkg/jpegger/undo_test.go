@@ -0,0 +1,108 @@
+package jpegger
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Undoing a run removes what it placed and lets the content be imported
+// again
+func TestUndoImport(t *testing.T) {
+	modified := time.Date(2021, 6, 7, 8, 9, 10, 0, time.Local)
+	input, output := t.TempDir(), t.TempDir()
+	for name, data := range map[string]string{
+		"IMG_1.jpg": "first",
+		"IMG_2.jpg": "second",
+	} {
+		path := filepath.Join(input, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	noExif := func(local string) (map[string]string, error) {
+		return nil, NoExifData
+	}
+	layout, err := ParseLayout("%Y/%m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenBoltStore(filepath.Join(t.TempDir(), "state.db"), StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = CreateBuckets(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// import the input as a run, returning what it placed
+	importRun := func() (uint64, []string) {
+		run, err := StartRun(db, []string{input}, output, TransferCopy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var linked []string
+		pipeline := &Pipeline{
+			Scanner: DirScanner{Inputs: []string{input}, ReadExif: noExif},
+			Hasher:  StoreHasher{DB: db, Algorithm: DefaultHash},
+			Stater:  &StoreStater{DB: db, Run: run, Algorithm: DefaultHash},
+			Linker:  &LayoutLinker{Output: output, Layout: layout, Mode: TransferCopy, DB: db, Algorithm: DefaultHash},
+			Progress: func(p PipelineProgress) {
+				if p.Stage == StageLinked {
+					linked = append(linked, p.Destination)
+				}
+			},
+		}
+		if err = pipeline.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(linked)
+		return run, linked
+	}
+	want := []string{"2021/06/IMG_1.jpg", "2021/06/IMG_2.jpg"}
+
+	run, linked := importRun()
+	if !equalStrings(linked, want) {
+		t.Fatalf("placed %v, want %v", linked, want)
+	}
+
+	result, err := UndoImport(db, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 2 || result.Kept != 0 {
+		t.Errorf("removed %d and kept %d, want 2 and 0", result.Removed, result.Kept)
+	}
+	for _, rel := range want {
+		if _, err = os.Stat(filepath.Join(output, filepath.FromSlash(rel))); !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", rel, err)
+		}
+	}
+	err = db.View(func(tx Tx) error {
+		runs, err := ListRuns(tx)
+		if len(runs) != 0 {
+			t.Errorf("%d runs left, want none", len(runs))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, linked = importRun(); !equalStrings(linked, want) {
+		t.Errorf("placed %v again, want %v", linked, want)
+	}
+	for _, rel := range want {
+		if _, err = os.Stat(filepath.Join(output, filepath.FromSlash(rel))); err != nil {
+			t.Error(err)
+		}
+	}
+}
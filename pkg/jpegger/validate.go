@@ -0,0 +1,83 @@
+package jpegger
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+var (
+	Validate = importFlags.Bool("validate", false, "decode each new JPEG, PNG and GIF, and check that HEIC stills and videos are whole, quarantining files that are truncated or corrupt rather than placing them")
+
+	// Images the standard library can decode in full
+	decodedExtensions = []string{".jpg", ".jpeg", ".png", ".gif"}
+)
+
+// Check that a file can be read as what its name says it is: images are
+// decoded, and the boxes of HEIC stills and videos must each be whole with
+// the ones needed to show it there. Other kinds of file pass as they are.
+// name is the file's own path, local where its content is.
+func ValidateFile(name, local string) error {
+	if hasExtension(name, decodedExtensions) {
+		return decodeImage(local)
+	}
+	if IsHEIC(name) {
+		return probeBoxes(local, "ftyp", "meta", "mdat")
+	}
+	if IsQuickTime(name) {
+		return probeBoxes(local, "moov")
+	}
+	return nil
+}
+
+func decodeImage(path string) error {
+	err := RetryIO(path, func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, _, err = image.Decode(ReadThrottle.Reader(f))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("can't be decoded: %v", err)
+	}
+	return nil
+}
+
+// Check that the top level boxes of an ISO media file run exactly to its
+// end and that it has the ones needed. A truncated file ends partway
+// through its last box.
+func probeBoxes(path string, needed ...string) error {
+	return RetryIO(path, func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		atoms, err := readAtoms(io.NewSectionReader(f, 0, info.Size()))
+		if err != nil {
+			return fmt.Errorf("damaged: %v", err)
+		}
+		for _, typ := range needed {
+			a, ok := findAtom(atoms, typ)
+			if !ok {
+				return fmt.Errorf("damaged: it has no %s box", typ)
+			}
+			// the movie header is made of boxes in turn
+			if typ == "moov" {
+				if _, err = readAtoms(a.Body); err != nil {
+					return fmt.Errorf("damaged moov box: %v", err)
+				}
+			}
+		}
+		return nil
+	})
+}
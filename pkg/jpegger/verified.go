@@ -0,0 +1,108 @@
+package jpegger
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+const (
+	// When each piece of content last moved into each state, as JSON from
+	// the state's name to the time
+	StateTimes = "StateTimes"
+)
+
+var VerifyCopies = importFlags.Bool("verify-copies", false, "hash each placed file again and record its content as verified once it matches. moves always are")
+
+// Has the content been placed in the output, whether or not the copy has
+// been checked since?
+func IsPlaced(state []byte) bool {
+	return bytes.Equal(state, CopiedFile) || bytes.Equal(state, VerifiedFile)
+}
+
+// When a piece of content last moved into each state, by the state's name
+func ContentStateTimes(tx Tx, key []byte) map[string]time.Time {
+	times := map[string]time.Time{}
+	if value := lookup(tx, StateTimes, key); value != nil {
+		json.Unmarshal(value, &times)
+	}
+	return times
+}
+
+func recordStateTime(tx Tx, key, state []byte, at time.Time) error {
+	b := tx.Bucket([]byte(StateTimes))
+	if b == nil {
+		return nil // a database from before states were timed
+	}
+	times := ContentStateTimes(tx, key)
+	times[StateName(state)] = at
+	value, err := json.Marshal(times)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+// Record that the placed copy of some content was hashed and matched it.
+// Content verified before is stamped with the time again. false if the
+// content isn't placed.
+func MarkVerified(db Store, key []byte) (bool, error) {
+	marked := false
+	err := db.Update(func(tx Tx) error {
+		b := tx.Bucket([]byte(ContentHash))
+		if !IsPlaced(b.Get(key)) {
+			return nil
+		}
+		marked = true
+		if err := b.Put(key, VerifiedFile); err != nil {
+			return err
+		}
+		return recordStateTime(tx, key, VerifiedFile, time.Now())
+	})
+	return marked, err
+}
+
+// Record that the placed copy of some content no longer matches it, so it
+// is only known to have been copied
+func UnmarkVerified(db Store, key []byte) (bool, error) {
+	return CommitState(db, "", key, VerifiedFile, CopiedFile)
+}
+
+// The latest time any content moved into each state, by the state's name
+func LatestStateTimes(tx Tx) map[string]time.Time {
+	latest := map[string]time.Time{}
+	b := tx.Bucket([]byte(StateTimes))
+	if b == nil {
+		return latest
+	}
+	b.ForEach(func(key, _ []byte) error {
+		for name, at := range ContentStateTimes(tx, key) {
+			if at.After(latest[name]) {
+				latest[name] = at
+			}
+		}
+		return nil
+	})
+	return latest
+}
+
+// Merge two databases' state times of one piece of content, keeping the
+// later time of each state
+func mergeStateTimes(ours, theirs []byte) []byte {
+	var a, b map[string]time.Time
+	json.Unmarshal(ours, &a)
+	json.Unmarshal(theirs, &b)
+	if a == nil {
+		a = map[string]time.Time{}
+	}
+	for name, at := range b {
+		if at.After(a[name]) {
+			a[name] = at
+		}
+	}
+	merged, err := json.Marshal(a)
+	if err != nil {
+		return ours
+	}
+	return merged
+}
@@ -0,0 +1,284 @@
+package jpegger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	VerifyCommand = &Command{
+		Name:    "verify",
+		Args:    "output_dir",
+		Summary: "re-hash the output directory and report damaged, missing and untracked files",
+		Flags:   verifyFlags,
+		Run:     RunVerify,
+	}
+
+	verifyFlags = NewFlagSet("verify", "output_dir")
+
+	VerifyReportOnly = verifyFlags.Bool("report-only", false, "only report what was found, without recording content whose files all match as verified and content with a damaged or missing file as only copied")
+)
+
+// The hash of one file in the output tree
+type verifiedFile struct {
+	RelPath string
+	Key     []byte
+	Err     error
+}
+
+// Hash every file under root, HashWorkers at a time, each with the
+// algorithm algorithmOf gives for its path relative to root
+func hashTree(root string, algorithmOf func(string) string) ([]verifiedFile, error) {
+	var files []verifiedFile
+	err := hashTreeEach(root, nil, algorithmOf, func(file verifiedFile) error {
+		files = append(files, file)
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].RelPath < files[j].RelPath })
+	return files, err
+}
+
+// Like hashTree, but hand each file to found as it is hashed, in no
+// particular order, and only hash the paths want accepts if it is set.
+// An error from found stops the walk.
+func hashTreeEach(root string, want func(string) bool, algorithmOf func(string) string, found func(verifiedFile) error) error {
+	paths := make(chan string)
+	results := make(chan verifiedFile)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for w := 0; w < HashWorkers; w += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				rel, _ := filepath.Rel(root, path)
+				rel = filepath.ToSlash(rel)
+				key, err := HashFile(path, algorithmOf(rel))
+				results <- verifiedFile{rel, key, err}
+			}
+		}()
+	}
+
+	var walkErr error
+	go func() {
+		walkErr = WithOutputFiles(root, func(file os.FileInfo, path string) error {
+			// leftovers from an interrupted copy, files that couldn't
+			// be read which were never placed, the gallery, manifests
+			// and the object store, whose content is checked where it's
+			// linked to
+			rel, _ := filepath.Rel(root, path)
+			rel = filepath.ToSlash(rel)
+			if strings.HasPrefix(file.Name(), ".jpegger-") || file.Name() == ManifestName || strings.HasPrefix(rel, QuarantineDir+"/") || strings.HasPrefix(rel, GalleryDir+"/") || strings.HasPrefix(rel, ObjectsDir+"/") {
+				return nil
+			}
+			if want != nil && !want(rel) {
+				return nil
+			}
+			select {
+			case paths <- path:
+				return nil
+			case <-stop:
+				return errStopped
+			}
+		})
+		close(paths)
+		wg.Wait()
+		close(results)
+	}()
+
+	var foundErr error
+	for result := range results {
+		if foundErr != nil {
+			continue // let the workers finish
+		}
+		if foundErr = found(result); foundErr != nil {
+			close(stop)
+		}
+	}
+	if foundErr != nil {
+		return foundErr
+	}
+	return walkErr
+}
+
+var errStopped = errors.New("stopped")
+
+func RunVerify(args []string) error {
+	if len(args) == 0 && Configured.Output != "" {
+		args = []string{Configured.Output}
+	}
+	if len(args) != 1 {
+		return UsageError(verifyFlags, "expected the output directory")
+	}
+	output := args[0]
+	if IsRemote(output) {
+		return fmt.Errorf("%s: only local output directories can be verified", output)
+	}
+
+	var db Store
+	var err error
+	if !*VerifyReportOnly {
+		var lock *RunLock
+		if lock, err = LockRun(*Database, false); err != nil {
+			return err
+		}
+		defer lock.Release()
+		db, err = OpenStore(*Database, StoreOptions{Timeout: time.Second})
+	} else {
+		db, err = OpenReadOnlyDB()
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// files are hashed as they were when placed, and anything else as most
+	// content was
+	algorithms := map[string]string{}
+	usual := DefaultHash
+	err = db.View(func(tx Tx) error {
+		usual = MainAlgorithm(ContentAlgorithms(tx))
+		if b := tx.Bucket([]byte(DestinationPath)); b != nil {
+			return b.ForEach(func(rel, key []byte) error {
+				algorithms[string(rel)] = KeyAlgorithm(tx, key)
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	files, err := hashTree(output, func(rel string) string {
+		if algorithm, ok := algorithms[rel]; ok {
+			return algorithm
+		}
+		return usual
+	})
+	if err != nil {
+		return fmt.Errorf("while traversing %s: %v", output, err)
+	}
+
+	problems := 0
+	report := func(kind, format string, args ...interface{}) {
+		problems += 1
+		fmt.Printf("%-10s %s\n", kind, fmt.Sprintf(format, args...))
+	}
+	// the content found intact, and found damaged or missing
+	intact, damaged := map[string]bool{}, map[string]bool{}
+
+	err = db.View(func(tx Tx) error {
+		hashes := tx.Bucket([]byte(ContentHash))
+		destinations := tx.Bucket([]byte(DestinationPath))
+		if hashes == nil || destinations == nil {
+			return fmt.Errorf("%s has not been used for an import", *Database)
+		}
+
+		seenPaths := map[string]bool{}
+		seenKeys := map[string]bool{}
+		for _, file := range files {
+			seenPaths[file.RelPath] = true
+			key := destinations.Get([]byte(file.RelPath))
+			if file.Err != nil {
+				report("unreadable", "%s: %v", file.RelPath, file.Err)
+				if key != nil {
+					damaged[string(key)] = true
+				}
+				continue
+			}
+			seenKeys[string(file.Key)] = true
+
+			var expected []byte
+			if key != nil {
+				expected = PlacedKey(tx, file.RelPath, key)
+			}
+			switch {
+			case expected == nil && hashes.Get(file.Key) == nil:
+				report("untracked", "%s", file.RelPath)
+			case expected == nil:
+				report("untracked", "%s (a copy of known content %x)", file.RelPath, file.Key[:4])
+			// sidecars are meant to change as edits are made
+			case !bytes.Equal(expected, file.Key) && !IsXMPSidecar(file.RelPath):
+				report("mismatch", "%s (expected %x, found %x)", file.RelPath, expected, file.Key)
+				damaged[string(key)] = true
+			case !IsXMPSidecar(file.RelPath):
+				intact[string(key)] = true
+			}
+		}
+
+		err := destinations.ForEach(func(rel, key []byte) error {
+			if !seenPaths[string(rel)] {
+				report("missing", "%s", rel)
+				damaged[string(key)] = true
+			}
+			seenKeys[string(key)] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// copies made before destinations were recorded can only be
+		// checked by their content
+		return hashes.ForEach(func(key, state []byte) error {
+			if IsPlaced(state) && !seenKeys[string(key)] {
+				report("missing", "content %x is not in the output directory", key)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if !*VerifyReportOnly {
+		for key := range intact {
+			if damaged[key] {
+				continue
+			}
+			if _, err = MarkVerified(db, []byte(key)); err != nil {
+				return err
+			}
+		}
+		for key := range damaged {
+			if _, err = UnmarkVerified(db, []byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("verified %d files, %d problems\n", len(files), problems)
+	db.View(func(tx Tx) error {
+		placed, checked := 0, 0
+		if b := tx.Bucket([]byte(ContentHash)); b != nil {
+			b.ForEach(func(_, state []byte) error {
+				if IsPlaced(state) {
+					placed += 1
+				}
+				if bytes.Equal(state, VerifiedFile) {
+					checked += 1
+				}
+				return nil
+			})
+		}
+		fmt.Printf("%d of %d placed content recorded as verified", checked, placed)
+		if last, ok := LatestStateTimes(tx)[StateName(VerifiedFile)]; ok {
+			fmt.Printf(", last on %s", last.Format(time.RFC3339))
+		}
+		fmt.Println()
+		return nil
+	})
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package jpegger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const appleCreationDateKey = "com.apple.quicktime.creationdate"
+
+var (
+	// Containers built from QuickTime style atoms
+	QuickTimeExtensions = []string{".mov", ".mp4", ".m4v", ".3gp"}
+
+	NoContainerDate = fmt.Errorf("no container date")
+
+	// mvhd times count seconds from here
+	quickTimeEpoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// Is the path a QuickTime or MP4 video?
+func IsQuickTime(name string) bool {
+	return hasExtension(name, QuickTimeExtensions)
+}
+
+// One atom (box) within a QuickTime/MP4 file
+type atom struct {
+	Type string
+	Body *io.SectionReader
+}
+
+// List the atoms contained in a region of the file
+func readAtoms(r *io.SectionReader) ([]atom, error) {
+	var atoms []atom
+	var offset int64
+	header := make([]byte, 16)
+
+	for offset+8 <= r.Size() {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		typ := string(header[4:8])
+		headerLen := int64(8)
+
+		switch size {
+		case 0:
+			// extends to the end of the enclosing region
+			size = r.Size() - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			headerLen = 16
+		}
+		if size < headerLen || offset+size > r.Size() {
+			return nil, fmt.Errorf("atom %q at %d has bad size %d", typ, offset, size)
+		}
+
+		atoms = append(atoms, atom{typ, io.NewSectionReader(r, offset+headerLen, size-headerLen)})
+		offset += size
+	}
+
+	return atoms, nil
+}
+
+func findAtom(atoms []atom, typ string) (atom, bool) {
+	for _, a := range atoms {
+		if a.Type == typ {
+			return a, true
+		}
+	}
+	return atom{}, false
+}
+
+// Read the capture date of a QuickTime or MP4 video from its metadata. The
+// Apple CreationDate key is preferred because it carries the local time
+// zone; otherwise the mvhd creation time (UTC) is shown in local time.
+func ReadContainerDate(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	top, err := readAtoms(io.NewSectionReader(f, 0, info.Size()))
+	if err != nil {
+		return time.Time{}, NoContainerDate
+	}
+	moov, ok := findAtom(top, "moov")
+	if !ok {
+		return time.Time{}, NoContainerDate
+	}
+	children, err := readAtoms(moov.Body)
+	if err != nil {
+		return time.Time{}, NoContainerDate
+	}
+
+	if meta, ok := findAtom(children, "meta"); ok {
+		if date, err := readAppleCreationDate(meta.Body); err == nil {
+			return date, nil
+		}
+	}
+
+	if mvhd, ok := findAtom(children, "mvhd"); ok {
+		if date, err := readMovieHeaderDate(mvhd.Body); err == nil {
+			return date, nil
+		}
+	}
+
+	return time.Time{}, NoContainerDate
+}
+
+func readMovieHeaderDate(r *io.SectionReader) (time.Time, error) {
+	header := make([]byte, 12)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return time.Time{}, err
+	}
+
+	var seconds uint64
+	if header[0] == 1 {
+		seconds = binary.BigEndian.Uint64(header[4:])
+	} else {
+		seconds = uint64(binary.BigEndian.Uint32(header[4:]))
+	}
+	// plenty of devices never set it
+	if seconds == 0 {
+		return time.Time{}, NoContainerDate
+	}
+
+	return quickTimeEpoch.Add(time.Duration(seconds) * time.Second).Local(), nil
+}
+
+// Find com.apple.quicktime.creationdate in a meta atom's keys/ilst tables
+func readAppleCreationDate(r *io.SectionReader) (time.Time, error) {
+	// MP4 meta atoms carry version and flags before their children while
+	// QuickTime ones don't
+	peek := make([]byte, 8)
+	if _, err := r.ReadAt(peek, 0); err != nil {
+		return time.Time{}, err
+	}
+	if !bytes.Equal(peek[4:], []byte("hdlr")) {
+		r = io.NewSectionReader(r, 4, r.Size()-4)
+	}
+
+	atoms, err := readAtoms(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keys, ok := findAtom(atoms, "keys")
+	if !ok {
+		return time.Time{}, NoContainerDate
+	}
+	ilst, ok := findAtom(atoms, "ilst")
+	if !ok {
+		return time.Time{}, NoContainerDate
+	}
+
+	index, err := findMetadataKey(keys.Body, appleCreationDateKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	items, err := readAtoms(ilst.Body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, item := range items {
+		if binary.BigEndian.Uint32([]byte(item.Type)) != index {
+			continue
+		}
+		value, err := readMetadataValue(item.Body)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return parseAppleDate(value)
+	}
+
+	return time.Time{}, NoContainerDate
+}
+
+// Return the one-based index of a key in a keys atom
+func findMetadataKey(r *io.SectionReader, key string) (uint32, error) {
+	data := make([]byte, r.Size())
+	if _, err := r.ReadAt(data, 0); err != nil {
+		return 0, err
+	}
+	if len(data) < 8 {
+		return 0, NoContainerDate
+	}
+
+	count := binary.BigEndian.Uint32(data[4:])
+	offset := 8
+	for i := uint32(1); i <= count && offset+8 <= len(data); i++ {
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		if size < 8 || offset+size > len(data) {
+			break
+		}
+		if string(data[offset+8:offset+size]) == key {
+			return i, nil
+		}
+		offset += size
+	}
+	return 0, NoContainerDate
+}
+
+// Read the string held in the data atom of an ilst item
+func readMetadataValue(r *io.SectionReader) (string, error) {
+	atoms, err := readAtoms(r)
+	if err != nil {
+		return "", err
+	}
+	data, ok := findAtom(atoms, "data")
+	if !ok || data.Body.Size() < 8 {
+		return "", NoContainerDate
+	}
+
+	value := make([]byte, data.Body.Size()-8)
+	if _, err := data.Body.ReadAt(value, 8); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(value), "\x00"), nil
+}
+
+func parseAppleDate(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04:05-0700", time.RFC3339} {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized creation date %q", value)
+}
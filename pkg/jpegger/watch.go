@@ -0,0 +1,235 @@
+package jpegger
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const watchTick = time.Second
+
+var (
+	// How long a file must go without events or changing size before we
+	// import it
+	Settle = importFlags.Duration("settle", 2*time.Second, "while watching, how long a new file must go without changing size or being written to before it is imported")
+	// How long ago a file must have last been modified to be imported
+	MinAge = importFlags.Duration("min-age", 0, "pass over files modified less than this long ago (e.g. 30s), as they may still be being written. a watch imports them once they are old enough. 0 takes every file")
+)
+
+// A file waiting to settle, with when it was last written to or seen to
+// change size
+type pendingFile struct {
+	changed time.Time
+	size    int64
+}
+
+// Is a file too recently modified to be imported, by -min-age?
+func Unsettled(file os.FileInfo, now time.Time) bool {
+	return *MinAge > 0 && now.Sub(file.ModTime()) < *MinAge
+}
+
+// Watches a directory tree for new files. Directories created after the
+// watch starts are watched as well.
+type TreeWatcher struct {
+	watcher *fsnotify.Watcher
+	pending map[string]pendingFile
+	options WalkOptions
+	// the ignore files of each root
+	roots map[string]*Ignorer
+}
+
+// Start watching everything under the roots. Create the watcher before
+// the initial traversal so that nothing written in between is missed.
+func NewTreeWatcher(options WalkOptions, roots ...string) (*TreeWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TreeWatcher{watcher, map[string]pendingFile{}, options, map[string]*Ignorer{}}
+	for _, root := range roots {
+		// the initial traversal reports what it skips
+		walk, err := newInputWalk(root, options)
+		if err == nil {
+			walk.quiet = true
+			t.roots[filepath.Clean(root)] = walk.ignores
+			err = t.addTree(root, walk)
+		}
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Watch a directory and every directory beneath it
+func (t *TreeWatcher) addTree(root string, walk *treeWalk) error {
+	err := t.watcher.Add(root)
+	if err != nil {
+		return fmt.Errorf("while watching %s: %v", root, err)
+	}
+
+	files, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := filepath.Join(root, file.Name())
+		info, err := file.Info()
+		if err != nil {
+			continue // gone already
+		}
+		if walk.ignored(name, file.IsDir()) {
+			continue
+		}
+		info, ok := walk.entry(name, info)
+		if ok && info.IsDir() {
+			err = t.addTree(name, walk)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The root a name is under, and its ignore files
+func (t *TreeWatcher) rootOf(name string) (string, *Ignorer) {
+	best := ""
+	for root := range t.roots {
+		if strings.HasPrefix(name, root+string(filepath.Separator)) && len(root) > len(best) {
+			best = root
+		}
+	}
+	return best, t.roots[best]
+}
+
+func (t *TreeWatcher) handle(event fsnotify.Event) {
+	root, ignores := t.rootOf(event.Name)
+	name := t.options.IgnoreFile
+	if name != "" && filepath.Base(event.Name) == name && ignores != nil {
+		// read again for the files that appear from now on
+		if dir, err := filepath.Rel(root, filepath.Dir(event.Name)); err == nil {
+			if dir == "." {
+				dir = ""
+			}
+			ignores.forget(filepath.ToSlash(dir))
+		}
+		return
+	}
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		delete(t.pending, event.Name)
+		return
+	}
+	if event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+		return
+	}
+
+	info, err := os.Lstat(event.Name)
+	if err != nil {
+		return
+	}
+	// judged like the walk of the directory it appeared in would
+	walk, err := newInputWalk(filepath.Dir(event.Name), t.options)
+	if err != nil {
+		return
+	}
+	if ignores != nil {
+		walk.root, walk.ignores = root, ignores
+	}
+	if walk.ignored(event.Name, info.IsDir()) {
+		return
+	}
+	info, ok := walk.entry(event.Name, info)
+	if !ok {
+		return
+	}
+
+	if !info.IsDir() {
+		t.pending[event.Name] = pendingFile{time.Now(), info.Size()}
+		return
+	}
+
+	// a new directory may have been moved in with files already inside
+	walk.quiet = true
+	err = t.addTree(event.Name, walk)
+	if err != nil {
+		log.Printf("while watching new directory: %v", err)
+		return
+	}
+	inside, err := newTreeWalk(event.Name)
+	if err != nil {
+		return
+	}
+	inside.options, inside.root, inside.ignores = walk.options, walk.root, walk.ignores
+	inside.walk(event.Name, nil, 0, func(file os.FileInfo, name string) error {
+		t.pending[name] = pendingFile{time.Now(), file.Size()}
+		return nil
+	})
+}
+
+// Look at a file again once it has settled, like one found too recently
+// modified to import. Only from the goroutine that runs the watcher.
+func (t *TreeWatcher) Later(file os.FileInfo, name string) {
+	t.pending[name] = pendingFile{time.Now(), file.Size()}
+}
+
+// Call a function for every file that appears once it has stopped
+// changing, by -settle. Runs until the callback fails, the watcher is
+// closed or the context is done.
+func (t *TreeWatcher) Run(ctx context.Context, callback func(os.FileInfo, string) error) error {
+	ticker := time.NewTicker(watchTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case event, ok := <-t.watcher.Events:
+			if !ok {
+				return nil
+			}
+			t.handle(event)
+
+		case err, ok := <-t.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			// e.g. an event queue overflow. keep going with what we get
+			log.Printf("while watching files: %v", err)
+
+		case now := <-ticker.C:
+			for name, last := range t.pending {
+				if now.Sub(last.changed) < *Settle {
+					continue
+				}
+				info, err := os.Stat(name)
+				if err != nil || info.IsDir() {
+					delete(t.pending, name)
+					continue // gone already
+				}
+				// written to without an event, as over a network share
+				if info.Size() != last.size {
+					t.pending[name] = pendingFile{now, info.Size()}
+					continue
+				}
+				delete(t.pending, name)
+				err = callback(info, name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (t *TreeWatcher) Close() error {
+	return t.watcher.Close()
+}
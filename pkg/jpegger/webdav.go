@@ -0,0 +1,490 @@
+package jpegger
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The properties a listing asks for
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+// A minimal WebDAV client, enough to list, fetch, upload and delete files
+// on servers such as Nextcloud. The user comes from the URL and the
+// password from WEBDAV_PASSWORD.
+type WebDAVClient struct {
+	// The scheme and host requests go to
+	Base     *url.URL
+	User     string
+	Password string
+	HTTP     *http.Client
+}
+
+// A file or collection in a listing. Paths are unescaped.
+type DAVEntry struct {
+	Path         string
+	Size         int64
+	LastModified time.Time
+	IsDir        bool
+}
+
+// Is the path a dav:// or davs:// URL?
+func IsWebDAV(path string) bool {
+	return strings.HasPrefix(path, "dav://") || strings.HasPrefix(path, "davs://")
+}
+
+// Split a dav://user@host/path URL into a client for the server and the
+// path on it. davs:// is the same over https.
+func ParseWebDAVURL(name string) (*WebDAVClient, string, error) {
+	scheme, rest := "http", strings.TrimPrefix(name, "dav://")
+	if strings.HasPrefix(name, "davs://") {
+		scheme, rest = "https", strings.TrimPrefix(name, "davs://")
+	} else if !strings.HasPrefix(name, "dav://") {
+		return nil, "", fmt.Errorf("%s is not a dav:// or davs:// URL", name)
+	}
+	host, p := rest, "/"
+	if i := strings.Index(rest, "/"); i >= 0 {
+		host, p = rest[:i], path.Clean(rest[i:])
+	}
+	user := ""
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user, host = host[:i], host[i+1:]
+	}
+	if host == "" {
+		return nil, "", fmt.Errorf("%s names no server", name)
+	}
+
+	c := &WebDAVClient{
+		Base:     &url.URL{Scheme: scheme, Host: host},
+		User:     user,
+		Password: os.Getenv("WEBDAV_PASSWORD"),
+		HTTP:     http.DefaultClient,
+	}
+	if c.User != "" && c.Password == "" {
+		return nil, "", fmt.Errorf("WEBDAV_PASSWORD must be set to use %s as %s", host, user)
+	}
+	return c, p, nil
+}
+
+func (c *WebDAVClient) newRequest(method, p string, body io.Reader) (*http.Request, error) {
+	u := *c.Base
+	u.Path = p
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.User != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	return req, nil
+}
+
+// Send a request, turning error responses into errors
+func (c *WebDAVClient) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return nil, &DAVError{req.Method, req.URL.Path, resp.StatusCode, resp.Status}
+}
+
+// A request the server refused
+type DAVError struct {
+	Method, Path string
+	StatusCode   int
+	Status       string
+}
+
+func (e *DAVError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Status)
+}
+
+func davStatus(err error) int {
+	if e, ok := err.(*DAVError); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				Length   int64  `xml:"DAV: getcontentlength"`
+				Modified string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// What a collection holds, itself left out
+func (c *WebDAVClient) readDir(dir string) ([]DAVEntry, error) {
+	req, err := c.newRequest("PROPFIND", strings.TrimSuffix(dir, "/")+"/", strings.NewReader(davPropfind))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result davMultistatus
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("PROPFIND %s: %v", dir, err)
+	}
+	var entries []DAVEntry
+	for _, r := range result.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		entry := DAVEntry{Path: path.Clean(href.Path)}
+		if entry.Path == path.Clean(dir) {
+			continue
+		}
+		// properties the server lacks come back in a propstat of their own
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200") {
+				continue
+			}
+			entry.IsDir = entry.IsDir || ps.Prop.ResourceType.Collection != nil
+			if ps.Prop.Length > 0 {
+				entry.Size = ps.Prop.Length
+			}
+			if t, err := http.ParseTime(ps.Prop.Modified); err == nil {
+				entry.LastModified = t
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Every file under a collection, by path. Collections are read one level
+// at a time, as servers often refuse to list a whole tree at once.
+func (c *WebDAVClient) List(dir string) ([]DAVEntry, error) {
+	entries, err := c.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []DAVEntry
+	for _, entry := range entries {
+		if !entry.IsDir {
+			files = append(files, entry)
+			continue
+		}
+		below, err := c.List(entry.Path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, below...)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// Stream a file's content
+func (c *WebDAVClient) Get(p string) (io.ReadCloser, error) {
+	req, err := c.newRequest("GET", p, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Is there a file at the path?
+func (c *WebDAVClient) Exists(p string) (bool, error) {
+	req, err := c.newRequest("HEAD", p, nil)
+	if err != nil {
+		return false, err
+	}
+	_, err = c.do(req)
+	switch {
+	case err == nil:
+		return true, nil
+	case davStatus(err) == http.StatusNotFound:
+		return false, nil
+	}
+	return false, err
+}
+
+func (c *WebDAVClient) Delete(p string) error {
+	req, err := c.newRequest("DELETE", p, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Create a collection and any missing above it. One that's there already
+// is fine.
+func (c *WebDAVClient) MakeDirs(dir string) error {
+	if dir == "/" || dir == "." {
+		return nil
+	}
+	req, err := c.newRequest("MKCOL", dir, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	switch davStatus(err) {
+	case 0:
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return err
+	case http.StatusMethodNotAllowed:
+		return nil // exists
+	case http.StatusConflict:
+		// the parent is missing
+		if err = c.MakeDirs(path.Dir(dir)); err != nil {
+			return err
+		}
+		return c.MakeDirs(dir)
+	}
+	return err
+}
+
+// Upload a local file, creating the collections it goes in if need be
+func (c *WebDAVClient) Upload(p, src string) error {
+	put := func() error {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		req, err := c.newRequest("PUT", p, ReadThrottle.Reader(f))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = info.Size()
+		resp, err := c.do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	err := put()
+	if davStatus(err) == http.StatusConflict {
+		if err = c.MakeDirs(path.Dir(p)); err == nil {
+			err = put()
+		}
+	}
+	return err
+}
+
+// The path on the server of a file named by URL
+func davPath(name string) (string, error) {
+	_, p, err := ParseWebDAVURL(name)
+	return p, err
+}
+
+// The listing's view of a file on a WebDAV server
+type davFileInfo struct {
+	entry DAVEntry
+}
+
+func (i davFileInfo) Name() string       { return path.Base(i.entry.Path) }
+func (i davFileInfo) Size() int64        { return i.entry.Size }
+func (i davFileInfo) Mode() os.FileMode  { return 0444 }
+func (i davFileInfo) ModTime() time.Time { return i.entry.LastModified }
+func (i davFileInfo) IsDir() bool        { return false }
+func (i davFileInfo) Sys() interface{}   { return nil }
+
+// The files under a collection on a WebDAV server. Like an S3 source, each
+// file is downloaded once to a hidden file in the staging directory.
+type WebDAVSource struct {
+	client  *WebDAVClient
+	root    string
+	dir     string
+	staging string
+
+	list    sync.Once
+	files   []DAVEntry
+	listErr error
+
+	mu      sync.Mutex
+	fetched map[string]bool
+}
+
+func NewWebDAVSource(input, staging string) (*WebDAVSource, error) {
+	client, dir, err := ParseWebDAVURL(input)
+	if err != nil {
+		return nil, err
+	}
+	return &WebDAVSource{
+		client:  client,
+		root:    strings.TrimSuffix(input, "/"),
+		dir:     dir,
+		staging: staging,
+		fetched: map[string]bool{},
+	}, nil
+}
+
+// List the server once, however many times it is walked
+func (s *WebDAVSource) listing() ([]DAVEntry, error) {
+	s.list.Do(func() {
+		s.files, s.listErr = s.client.List(s.dir)
+	})
+	return s.files, s.listErr
+}
+
+func (s *WebDAVSource) Walk(after string, callback func(os.FileInfo, string) error) error {
+	files, err := s.listing()
+	if err != nil {
+		return err
+	}
+	ignores := DefaultIgnorer()
+	for _, file := range files {
+		rel := strings.TrimPrefix(strings.TrimPrefix(file.Path, s.dir), "/")
+		if after != "" && rel <= after {
+			continue
+		}
+		if ignores.Ignored(rel, false) {
+			continue
+		}
+		if err := callback(davFileInfo{file}, s.root+"/"+rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WebDAVSource) Fetch(name string) (string, error) {
+	p, err := davPath(name)
+	if err != nil {
+		return "", err
+	}
+	body, err := s.client.Get(p)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	// keep the extension, some EXIF readers go by it
+	f, err := os.CreateTemp(s.staging, ".jpegger-fetch-*"+path.Ext(p))
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.fetched[f.Name()] = true
+	s.mu.Unlock()
+
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.Release(f.Name())
+		return "", fmt.Errorf("while downloading %s: %v", name, err)
+	}
+	return f.Name(), nil
+}
+
+func (s *WebDAVSource) Release(local string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetched[local] {
+		os.Remove(local)
+		delete(s.fetched, local)
+	}
+}
+
+// Remove anything fetched but never placed, e.g. after an interruption
+func (s *WebDAVSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for local := range s.fetched {
+		os.Remove(local)
+	}
+	s.fetched = map[string]bool{}
+	return nil
+}
+
+// Places files on a WebDAV server. Files are always copies, whatever the
+// mode.
+type WebDAVDestination struct {
+	Client *WebDAVClient
+}
+
+func (d WebDAVDestination) Transfer(mode TransferMode, src, dest string) error {
+	p, err := davPath(dest)
+	if err != nil {
+		return err
+	}
+	exists, err := d.Client.Exists(p)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return &os.LinkError{Op: "upload", Old: src, New: dest, Err: os.ErrExist}
+	}
+	return d.Client.Upload(p, src)
+}
+
+// Delete an uploaded file if it still holds what was placed there. Like
+// removePlaced, a file that's already gone counts as removed.
+func (d WebDAVDestination) Remove(dest string, key []byte, algorithm string) (bool, error) {
+	if err := CheckHashAlgorithm(algorithm); err != nil {
+		return false, err
+	}
+	p, err := davPath(dest)
+	if err != nil {
+		return false, err
+	}
+
+	body, err := d.Client.Get(p)
+	if davStatus(err) == http.StatusNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	h := HashAlgorithms[algorithm]()
+	_, err = io.Copy(h, body)
+	body.Close()
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(h.Sum(nil), key) {
+		return false, nil
+	}
+	return true, d.Client.Delete(p)
+}
@@ -0,0 +1,97 @@
+package jpegger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	NoXMPDate = fmt.Errorf("no xmp date")
+
+	// in order of preference. either form of property may be used
+	xmpDateProperties = []*regexp.Regexp{
+		regexp.MustCompile(`xmp:CreateDate(?:="([^"]*)"|>([^<]*)<)`),
+		regexp.MustCompile(`photoshop:DateCreated(?:="([^"]*)"|>([^<]*)<)`),
+		regexp.MustCompile(`exif:DateTimeOriginal(?:="([^"]*)"|>([^<]*)<)`),
+	}
+
+	// XMP dates are ISO 8601 with optional precision
+	xmpDateFormats = []string{
+		"2006-01-02T15:04:05.999999999Z07:00",
+		"2006-01-02T15:04:05.999999999",
+		"2006-01-02T15:04Z07:00",
+		"2006-01-02T15:04",
+		"2006-01-02",
+	}
+)
+
+// Is the path an XMP sidecar?
+func IsXMPSidecar(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".xmp")
+}
+
+// Find the XMP sidecar beside a file. darktable names them IMG_1234.CR2.xmp
+// and Lightroom IMG_1234.xmp.
+func FindXMPSidecar(name string) string {
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, candidate := range []string{name + ".xmp", name + ".XMP", stem + ".xmp", stem + ".XMP"} {
+		info, err := os.Stat(candidate)
+		if err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// Where the sidecar of a file placed at dest goes, following the naming
+// style it was found with
+func XMPSidecarDest(sidecar, name, dest string) string {
+	if strings.EqualFold(strings.TrimSuffix(sidecar, filepath.Ext(sidecar)), name) {
+		return dest + filepath.Ext(sidecar)
+	}
+	return strings.TrimSuffix(dest, filepath.Ext(dest)) + filepath.Ext(sidecar)
+}
+
+// Read the creation date from a sidecar. Like EXIF dates, it's the time on
+// the camera's clock, so any offset is dropped.
+func ReadXMPDate(sidecar string) (time.Time, error) {
+	data, err := ioutil.ReadFile(sidecar)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	date, err := ParseXMPDate(data)
+	if err == NoXMPDate {
+		return time.Time{}, err
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%v in %s", err, sidecar)
+	}
+	return time.Date(date.Year(), date.Month(), date.Day(),
+		date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), time.UTC), nil
+}
+
+// Find the creation date in an XMP packet, in the time zone it gives if it
+// gives one
+func ParseXMPDate(data []byte) (time.Time, error) {
+	for _, property := range xmpDateProperties {
+		m := property.FindSubmatch(data)
+		if m == nil {
+			continue
+		}
+		value := strings.TrimSpace(string(m[1]) + string(m[2]))
+		for _, format := range xmpDateFormats {
+			date, err := time.Parse(format, value)
+			if err == nil {
+				return date, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid date %q", value)
+	}
+	return time.Time{}, NoXMPDate
+}